@@ -21,6 +21,10 @@ type SmtpConfig struct {
 	MaxIdleSeconds  int
 	MaxMessageBytes int
 	StoreMessages   bool
+	VerifyAuth      bool
+	MaxHoldSeconds  int
+	TLSCertFile     string
+	TLSKeyFile      string
 }
 
 type Pop3Config struct {
@@ -28,6 +32,9 @@ type Pop3Config struct {
 	Ip4port        int
 	Domain         string
 	MaxIdleSeconds int
+	TLSCertFile    string
+	TLSKeyFile     string
+	RequireTLS     bool
 }
 
 type WebConfig struct {
@@ -40,6 +47,7 @@ type WebConfig struct {
 }
 
 type DataStoreConfig struct {
+	Backend          string
 	Path             string
 	RetentionMinutes int
 	RetentionSleep   int
@@ -54,6 +62,78 @@ type DatabaseConfig struct {
 	DBHost   string
 }
 
+type DkimConfig struct {
+	Selector string
+	KeyBits  int
+	Headers  []string
+}
+
+type MilterConfig struct {
+	Sockets        []string
+	TimeoutSeconds int
+	DefaultAction  string
+}
+
+type SpamConfig struct {
+	Engine         string
+	Address        string
+	TimeoutSeconds int
+	RejectScore    float64
+	JunkScore      float64
+	JunkFolder     string
+}
+
+type ClamdConfig struct {
+	Socket            string
+	TimeoutSeconds    int
+	Action            string
+	QuarantineMailbox string
+	DefaultAction     string
+}
+
+type ManageSieveConfig struct {
+	Enabled        bool
+	Ip4address     net.IP
+	Ip4port        int
+	Domain         string
+	MaxIdleSeconds int
+	MaxScriptBytes int
+	MaxScripts     int
+	TLSCertFile    string
+	TLSKeyFile     string
+	RequireTLS     bool
+}
+
+type ImapConfig struct {
+	Enabled        bool
+	Ip4address     net.IP
+	Ip4port        int
+	Domain         string
+	MaxIdleSeconds int
+	TLSCertFile    string
+	TLSKeyFile     string
+	RequireTLS     bool
+}
+
+type OutboundConfig struct {
+	SmartHost      string
+	Username       string
+	Password       string
+	Helo           string
+	StartTLS       bool
+	TimeoutSeconds int
+	RetryMinutes   int
+	MaxAttempts    int
+}
+
+type ThrottleConfig struct {
+	MaxFailures     int
+	DelayMillis     int
+	MaxDelaySeconds int
+	WindowMinutes   int
+	LockoutMinutes  int
+}
+
 var (
 	// Build info, set by main
 	VERSION    = ""
@@ -63,11 +143,19 @@ var (
 	Config *config.Config
 
 	// Parsed specific configs
-	smtpConfig      *SmtpConfig
-	pop3Config      *Pop3Config
-	webConfig       *WebConfig
-	dataStoreConfig *DataStoreConfig
-	databaseConfig  *DatabaseConfig
+	smtpConfig        *SmtpConfig
+	pop3Config        *Pop3Config
+	webConfig         *WebConfig
+	dataStoreConfig   *DataStoreConfig
+	databaseConfig    *DatabaseConfig
+	dkimConfig        *DkimConfig
+	milterConfig      *MilterConfig
+	clamdConfig       *ClamdConfig
+	spamConfig        *SpamConfig
+	outboundConfig    *OutboundConfig
+	manageSieveConfig *ManageSieveConfig
+	imapConfig        *ImapConfig
+	throttleConfig    *ThrottleConfig
 )
 
 // GetSmtpConfig returns a copy of the SmtpConfig object
@@ -94,6 +182,46 @@ func GetDatabaseConfig() DatabaseConfig {
 	return *databaseConfig
 }
 
+// GetDkimConfig returns a copy of the DkimConfig object
+func GetDkimConfig() DkimConfig {
+	return *dkimConfig
+}
+
+// GetMilterConfig returns a copy of the MilterConfig object
+func GetMilterConfig() MilterConfig {
+	return *milterConfig
+}
+
+// GetClamdConfig returns a copy of the ClamdConfig object
+func GetClamdConfig() ClamdConfig {
+	return *clamdConfig
+}
+
+// GetSpamConfig returns a copy of the SpamConfig object
+func GetSpamConfig() SpamConfig {
+	return *spamConfig
+}
+
+// GetManageSieveConfig returns a copy of the ManageSieveConfig object
+func GetManageSieveConfig() ManageSieveConfig {
+	return *manageSieveConfig
+}
+
+// GetOutboundConfig returns a copy of the OutboundConfig object
+func GetOutboundConfig() OutboundConfig {
+	return *outboundConfig
+}
+
+// GetImapConfig returns a copy of the ImapConfig object
+func GetImapConfig() ImapConfig {
+	return *imapConfig
+}
+
+// GetThrottleConfig returns a copy of the ThrottleConfig object
+func GetThrottleConfig() ThrottleConfig {
+	return *throttleConfig
+}
+
 // LoadConfig loads the specified configuration file into inbucket.Config
 // and performs validations on it.
 func LoadConfig(filename string) error {
@@ -175,6 +303,38 @@ func LoadConfig(filename string) error {
 		return err
 	}
 
+	if err = parseDkimConfig(); err != nil {
+		return err
+	}
+
+	if err = parseMilterConfig(); err != nil {
+		return err
+	}
+
+	if err = parseClamdConfig(); err != nil {
+		return err
+	}
+
+	if err = parseSpamConfig(); err != nil {
+		return err
+	}
+
+	if err = parseOutboundConfig(); err != nil {
+		return err
+	}
+
+	if err = parseManageSieveConfig(); err != nil {
+		return err
+	}
+
+	if err = parseImapConfig(); err != nil {
+		return err
+	}
+
+	if err = parseThrottleConfig(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -263,6 +423,47 @@ func parseSmtpConfig() error {
 	}
 	smtpConfig.StoreMessages = flag
 
+	option = "verify.auth"
+	if Config.HasOption(section, option) {
+		flag, err = Config.Bool(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		smtpConfig.VerifyAuth = flag
+	}
+
+	option = "max.hold.seconds"
+	smtpConfig.MaxHoldSeconds = 7 * 24 * 60 * 60
+	if Config.HasOption(section, option) {
+		smtpConfig.MaxHoldSeconds, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if smtpConfig.MaxHoldSeconds < 0 {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option,
+				smtpConfig.MaxHoldSeconds)
+		}
+	}
+
+	option = "tls.cert.file"
+	if Config.HasOption(section, option) {
+		smtpConfig.TLSCertFile, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "tls.key.file"
+	if Config.HasOption(section, option) {
+		smtpConfig.TLSKeyFile, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+	if (smtpConfig.TLSCertFile == "") != (smtpConfig.TLSKeyFile == "") {
+		return fmt.Errorf("Both tls.cert.file and tls.key.file are required in [%v]", section)
+	}
+
 	return nil
 }
 
@@ -306,6 +507,36 @@ func parsePop3Config() error {
 		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
 	}
 
+	option = "tls.cert.file"
+	if Config.HasOption(section, option) {
+		pop3Config.TLSCertFile, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "tls.key.file"
+	if Config.HasOption(section, option) {
+		pop3Config.TLSKeyFile, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+	if (pop3Config.TLSCertFile == "") != (pop3Config.TLSKeyFile == "") {
+		return fmt.Errorf("Both tls.cert.file and tls.key.file are required in [%v]", section)
+	}
+
+	option = "require.tls"
+	if Config.HasOption(section, option) {
+		pop3Config.RequireTLS, err = Config.Bool(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if pop3Config.RequireTLS && pop3Config.TLSCertFile == "" {
+			return fmt.Errorf("[%v]%v needs tls.cert.file and tls.key.file", section, option)
+		}
+	}
+
 	return nil
 }
 
@@ -379,6 +610,22 @@ func parseDataStoreConfig() error {
 	}
 	dataStoreConfig.Path = str
 
+	option = "backend"
+	dataStoreConfig.Backend = "file"
+	if Config.HasOption(section, option) {
+		str, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		str = strings.ToLower(str)
+		switch str {
+		case "file", "maildir":
+		default:
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, str)
+		}
+		dataStoreConfig.Backend = str
+	}
+
 	option = "retention.minutes"
 	dataStoreConfig.RetentionMinutes, err = Config.Int(section, option)
 	if err != nil {
@@ -440,6 +687,608 @@ func parseDatabaseConfig() error {
 	return nil
 }
 
+// parseDkimConfig reads the optional [dkim] section, falling back to defaults
+func parseDkimConfig() error {
+	dkimConfig = &DkimConfig{
+		Selector: "inbucket",
+		KeyBits:  2048,
+		Headers: []string{"from", "to", "cc", "subject", "date", "message-id",
+			"reply-to", "in-reply-to", "references", "mime-version", "content-type",
+			"content-transfer-encoding"},
+	}
+	section := "dkim"
+
+	if !Config.HasSection(section) {
+		return nil
+	}
+
+	option := "selector"
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		dkimConfig.Selector = str
+	}
+
+	option = "key.bits"
+	if Config.HasOption(section, option) {
+		bits, err := Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if bits < 1024 {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, bits)
+		}
+		dkimConfig.KeyBits = bits
+	}
+
+	option = "headers"
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		headers := make([]string, 0)
+		for _, h := range strings.Split(str, ":") {
+			if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+				headers = append(headers, h)
+			}
+		}
+		dkimConfig.Headers = headers
+	}
+
+	return nil
+}
+
+// parseMilterConfig reads the optional [milter] section, no milters are
+// used when it is absent
+func parseMilterConfig() error {
+	milterConfig = &MilterConfig{TimeoutSeconds: 10, DefaultAction: "tempfail"}
+	section := "milter"
+
+	if !Config.HasSection(section) {
+		return nil
+	}
+
+	option := "sockets"
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		for _, s := range strings.Split(str, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			if !strings.HasPrefix(s, "inet:") && !strings.HasPrefix(s, "inet6:") &&
+				!strings.HasPrefix(s, "unix:") {
+				return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, s)
+			}
+			milterConfig.Sockets = append(milterConfig.Sockets, s)
+		}
+	}
+
+	option = "timeout.seconds"
+	if Config.HasOption(section, option) {
+		n, err := Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		milterConfig.TimeoutSeconds = n
+	}
+
+	option = "default.action"
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		str = strings.ToLower(str)
+		switch str {
+		case "accept", "reject", "tempfail":
+		default:
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, str)
+		}
+		milterConfig.DefaultAction = str
+	}
+
+	return nil
+}
+
+// parseClamdConfig reads the optional [clamd] section, messages are not
+// scanned when it is absent
+func parseClamdConfig() error {
+	clamdConfig = &ClamdConfig{TimeoutSeconds: 30, Action: "reject",
+		QuarantineMailbox: "quarantine", DefaultAction: "tempfail"}
+	section := "clamd"
+
+	if !Config.HasSection(section) {
+		return nil
+	}
+
+	option := "socket"
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if !strings.HasPrefix(str, "inet:") && !strings.HasPrefix(str, "inet6:") &&
+			!strings.HasPrefix(str, "unix:") {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, str)
+		}
+		clamdConfig.Socket = str
+	}
+
+	option = "timeout.seconds"
+	if Config.HasOption(section, option) {
+		n, err := Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		clamdConfig.TimeoutSeconds = n
+	}
+
+	option = "action"
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		str = strings.ToLower(str)
+		switch str {
+		case "reject", "quarantine", "tag":
+		default:
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, str)
+		}
+		clamdConfig.Action = str
+	}
+
+	option = "quarantine.mailbox"
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		clamdConfig.QuarantineMailbox = str
+	}
+
+	option = "default.action"
+	if Config.HasOption(section, option) {
+		str, err := Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		str = strings.ToLower(str)
+		switch str {
+		case "accept", "reject", "tempfail":
+		default:
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, str)
+		}
+		clamdConfig.DefaultAction = str
+	}
+
+	return nil
+}
+
+// parseSpamConfig reads the optional [spam] section, messages are not scored
+// when it is absent
+func parseSpamConfig() error {
+	spamConfig = &SpamConfig{TimeoutSeconds: 30, JunkFolder: "Junk"}
+	section := "spam"
+
+	if !Config.HasSection(section) {
+		return nil
+	}
+
+	option := "engine"
+	str, err := Config.String(section, option)
+	if err != nil {
+		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+	}
+	str = strings.ToLower(str)
+	switch str {
+	case "spamd", "rspamd":
+	default:
+		return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option, str)
+	}
+	spamConfig.Engine = str
+
+	option = "address"
+	str, err = Config.String(section, option)
+	if err != nil {
+		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+	}
+	spamConfig.Address = str
+
+	option = "timeout.seconds"
+	if Config.HasOption(section, option) {
+		spamConfig.TimeoutSeconds, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "reject.score"
+	if Config.HasOption(section, option) {
+		spamConfig.RejectScore, err = Config.Float(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "junk.score"
+	if Config.HasOption(section, option) {
+		spamConfig.JunkScore, err = Config.Float(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "junk.folder"
+	if Config.HasOption(section, option) {
+		spamConfig.JunkFolder, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if spamConfig.JunkFolder == "" {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option,
+				spamConfig.JunkFolder)
+		}
+	}
+
+	return nil
+}
+
+// parseOutboundConfig reads the optional [outbound] section, used for mail we
+// originate such as redirects and automatic replies
+func parseOutboundConfig() error {
+	outboundConfig = &OutboundConfig{Helo: smtpConfig.Domain, StartTLS: true,
+		TimeoutSeconds: 60, RetryMinutes: 15, MaxAttempts: 8}
+	section := "outbound"
+
+	if !Config.HasSection(section) {
+		return nil
+	}
+
+	var err error
+	option := "smarthost"
+	if Config.HasOption(section, option) {
+		outboundConfig.SmartHost, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if outboundConfig.SmartHost != "" {
+			if _, _, err = net.SplitHostPort(outboundConfig.SmartHost); err != nil {
+				return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option,
+					outboundConfig.SmartHost)
+			}
+		}
+	}
+
+	option = "username"
+	if Config.HasOption(section, option) {
+		outboundConfig.Username, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "password"
+	if Config.HasOption(section, option) {
+		outboundConfig.Password, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "helo"
+	if Config.HasOption(section, option) {
+		outboundConfig.Helo, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "starttls"
+	if Config.HasOption(section, option) {
+		outboundConfig.StartTLS, err = Config.Bool(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "timeout.seconds"
+	if Config.HasOption(section, option) {
+		outboundConfig.TimeoutSeconds, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "retry.minutes"
+	if Config.HasOption(section, option) {
+		outboundConfig.RetryMinutes, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "max.attempts"
+	if Config.HasOption(section, option) {
+		outboundConfig.MaxAttempts, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if outboundConfig.MaxAttempts < 1 {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option,
+				outboundConfig.MaxAttempts)
+		}
+	}
+
+	return nil
+}
+
+// parseManageSieveConfig reads the optional [managesieve] section, the
+// ManageSieve server only runs when it is present
+func parseManageSieveConfig() error {
+	manageSieveConfig = &ManageSieveConfig{Ip4port: 4190, Domain: smtpConfig.Domain,
+		MaxIdleSeconds: 300, MaxScriptBytes: 64 * 1024, MaxScripts: 16}
+	section := "managesieve"
+
+	if !Config.HasSection(section) {
+		return nil
+	}
+	manageSieveConfig.Enabled = true
+
+	// Parse IP4 address only, error on IP6.
+	option := "ip4.address"
+	str, err := Config.String(section, option)
+	if err != nil {
+		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+	}
+	addr := net.ParseIP(str)
+	if addr == nil {
+		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+	}
+	addr = addr.To4()
+	if addr == nil {
+		return fmt.Errorf("Failed to parse [%v]%v: '%v' not IPv4!", section, option, err)
+	}
+	manageSieveConfig.Ip4address = addr
+
+	option = "ip4.port"
+	if Config.HasOption(section, option) {
+		manageSieveConfig.Ip4port, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "domain"
+	if Config.HasOption(section, option) {
+		manageSieveConfig.Domain, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "max.idle.seconds"
+	if Config.HasOption(section, option) {
+		manageSieveConfig.MaxIdleSeconds, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "max.script.bytes"
+	if Config.HasOption(section, option) {
+		manageSieveConfig.MaxScriptBytes, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "max.scripts"
+	if Config.HasOption(section, option) {
+		manageSieveConfig.MaxScripts, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "tls.cert.file"
+	if Config.HasOption(section, option) {
+		manageSieveConfig.TLSCertFile, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "tls.key.file"
+	if Config.HasOption(section, option) {
+		manageSieveConfig.TLSKeyFile, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+	if (manageSieveConfig.TLSCertFile == "") != (manageSieveConfig.TLSKeyFile == "") {
+		return fmt.Errorf("Both tls.cert.file and tls.key.file are required in [%v]", section)
+	}
+
+	option = "require.tls"
+	if Config.HasOption(section, option) {
+		manageSieveConfig.RequireTLS, err = Config.Bool(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if manageSieveConfig.RequireTLS && manageSieveConfig.TLSCertFile == "" {
+			return fmt.Errorf("[%v]%v needs tls.cert.file and tls.key.file", section, option)
+		}
+	}
+
+	return nil
+}
+
+// parseImapConfig reads the optional [imap] section, the IMAP server only
+// runs when it is present
+func parseImapConfig() error {
+	imapConfig = &ImapConfig{Ip4port: 143, Domain: smtpConfig.Domain, MaxIdleSeconds: 1800}
+	section := "imap"
+
+	if !Config.HasSection(section) {
+		return nil
+	}
+	imapConfig.Enabled = true
+
+	// Parse IP4 address only, error on IP6.
+	option := "ip4.address"
+	str, err := Config.String(section, option)
+	if err != nil {
+		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+	}
+	addr := net.ParseIP(str)
+	if addr == nil {
+		return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+	}
+	addr = addr.To4()
+	if addr == nil {
+		return fmt.Errorf("Failed to parse [%v]%v: '%v' not IPv4!", section, option, err)
+	}
+	imapConfig.Ip4address = addr
+
+	option = "ip4.port"
+	if Config.HasOption(section, option) {
+		imapConfig.Ip4port, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "domain"
+	if Config.HasOption(section, option) {
+		imapConfig.Domain, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "max.idle.seconds"
+	if Config.HasOption(section, option) {
+		imapConfig.MaxIdleSeconds, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "tls.cert.file"
+	if Config.HasOption(section, option) {
+		imapConfig.TLSCertFile, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+
+	option = "tls.key.file"
+	if Config.HasOption(section, option) {
+		imapConfig.TLSKeyFile, err = Config.String(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+	}
+	if (imapConfig.TLSCertFile == "") != (imapConfig.TLSKeyFile == "") {
+		return fmt.Errorf("Both tls.cert.file and tls.key.file are required in [%v]", section)
+	}
+
+	option = "require.tls"
+	if Config.HasOption(section, option) {
+		imapConfig.RequireTLS, err = Config.Bool(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if imapConfig.RequireTLS && imapConfig.TLSCertFile == "" {
+			return fmt.Errorf("[%v]%v needs tls.cert.file and tls.key.file", section, option)
+		}
+	}
+
+	return nil
+}
+
+// parseThrottleConfig reads the optional [throttle] section, which limits
+// failed POP3 and SMTP logins per client address and per username
+func parseThrottleConfig() error {
+	throttleConfig = &ThrottleConfig{MaxFailures: 10, DelayMillis: 500, MaxDelaySeconds: 8,
+		WindowMinutes: 15, LockoutMinutes: 15}
+	section := "throttle"
+
+	if !Config.HasSection(section) {
+		return nil
+	}
+
+	var err error
+	option := "max.failures"
+	if Config.HasOption(section, option) {
+		throttleConfig.MaxFailures, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if throttleConfig.MaxFailures < 0 {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option,
+				throttleConfig.MaxFailures)
+		}
+	}
+
+	option = "delay.millis"
+	if Config.HasOption(section, option) {
+		throttleConfig.DelayMillis, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if throttleConfig.DelayMillis < 0 {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option,
+				throttleConfig.DelayMillis)
+		}
+	}
+
+	option = "max.delay.seconds"
+	if Config.HasOption(section, option) {
+		throttleConfig.MaxDelaySeconds, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if throttleConfig.MaxDelaySeconds < 0 {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option,
+				throttleConfig.MaxDelaySeconds)
+		}
+	}
+
+	option = "window.minutes"
+	if Config.HasOption(section, option) {
+		throttleConfig.WindowMinutes, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if throttleConfig.WindowMinutes < 0 {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option,
+				throttleConfig.WindowMinutes)
+		}
+	}
+
+	option = "lockout.minutes"
+	if Config.HasOption(section, option) {
+		throttleConfig.LockoutMinutes, err = Config.Int(section, option)
+		if err != nil {
+			return fmt.Errorf("Failed to parse [%v]%v: '%v'", section, option, err)
+		}
+		if throttleConfig.LockoutMinutes < 0 {
+			return fmt.Errorf("Invalid value provided for [%v]%v: '%v'", section, option,
+				throttleConfig.LockoutMinutes)
+		}
+	}
+
+	return nil
+}
+
 // requireSection checks that a [section] is defined in the configuration file,
 // appending a message if not.
 func requireSection(messages *list.List, section string) {
@@ -11,31 +11,235 @@ import (
 	"time"
 )
 
+// User is a mailbox owner.  ApopSecret is the shared secret for POP3 APOP,
+// which has to be kept in the clear, empty to disable APOP.
 type User struct {
-	Id       uint64    `xorm:"pk autoincr" json:"id"`
-	Username string    `xorm:"varchar(255) not null unique 'username'" json:"username"`
-	Password string    `xorm:"varchar(255) not null 'password'" json:"password"`
-	Domain   string    `xorm:"varchar(255) not null 'domain'" json:"domain"`
-	Created  time.Time `xorm:"created" json:"created"`
-	Updated  time.Time `xorm:"updated" json:"updated"`
+	Id         uint64    `xorm:"pk autoincr" json:"id"`
+	Username   string    `xorm:"varchar(255) not null unique 'username'" json:"username"`
+	Password   string    `xorm:"varchar(255) not null 'password'" json:"password"`
+	Domain     string    `xorm:"varchar(255) not null 'domain'" json:"domain"`
+	ApopSecret string    `xorm:"varchar(255) not null default '' 'apop_secret'" json:"-"`
+	Created    time.Time `xorm:"created" json:"created"`
+	Updated    time.Time `xorm:"updated" json:"updated"`
 }
 
+// Group is a distribution list of its members.  When IsList is set it is run
+// as a mailing list: members subscribe through the name-request address,
+// posts are tagged with List-* headers and bounces disable members.  ReplyTo
+// is empty to leave Reply-To alone, "list" to point it at the list, or an
+// address to point it at.  Policy is one of the GROUP_POLICY values, empty
+// meaning anyone may post.
 type Group struct {
 	Id      uint64    `xorm:"pk autoincr" json:"id"`
 	Name    string    `xorm:"varchar(255) not null unique 'name'" json:"name"`
 	Domain  string    `xorm:"varchar(255) not null 'domain'" json:"domain"`
+	IsList  bool      `xorm:"not null default 0 'is_list'" json:"isList"`
+	ReplyTo string    `xorm:"varchar(255) not null default '' 'reply_to'" json:"replyTo"`
+	Policy  string    `xorm:"varchar(16) not null default '' 'policy'" json:"policy"`
 	Created time.Time `xorm:"created" json:"created"`
 	Updated time.Time `xorm:"updated" json:"updated"`
 }
 
+// Who may send to a group
+const (
+	GROUP_POLICY_ANYONE    = "anyone"
+	GROUP_POLICY_MEMBERS   = "members"   // Members of the group, nested ones included
+	GROUP_POLICY_SENDERS   = "senders"   // Addresses listed as GroupSenders
+	GROUP_POLICY_MODERATED = "moderated" // Anyone, once a moderator approves
+)
+
+// GroupSender is an address allowed to post to a group with the senders
+// policy
+type GroupSender struct {
+	Id      uint64    `xorm:"pk autoincr" json:"id"`
+	GroupId uint64    `xorm:"BigInt not null unique(group_sender) 'group_id'" json:"groupId"`
+	Address string    `xorm:"varchar(255) not null unique(group_sender) 'address'" json:"address"`
+	Created time.Time `xorm:"created" json:"created"`
+}
+
+// States of a held message
+const (
+	HELD_WAITING  = "held"
+	HELD_APPROVED = "approved"
+	HELD_REJECTED = "rejected"
+)
+
+// GroupHeld is a message to a moderated group waiting for a moderator.
+// Approved and rejected messages stay until SMTP has delivered the message
+// or told the sender.
+type GroupHeld struct {
+	Id        uint64    `xorm:"pk autoincr" json:"id"`
+	GroupId   uint64    `xorm:"BigInt not null index 'group_id'" json:"groupId"`
+	Sender    string    `xorm:"varchar(255) not null 'sender'" json:"sender"`
+	Recipient string    `xorm:"varchar(255) not null 'recipient'" json:"recipient"`
+	Subject   string    `xorm:"varchar(255) not null default '' 'subject'" json:"subject"`
+	Data      []byte    `xorm:"mediumblob not null 'data'" json:"-"`
+	State     string    `xorm:"varchar(16) not null index 'state'" json:"state"`
+	Reason    string    `xorm:"text 'reason'" json:"reason"`
+	Created   time.Time `xorm:"created" json:"created"`
+	Updated   time.Time `xorm:"updated" json:"updated"`
+}
+
+// GroupMember puts one of a user, all the members of another group
+// (MemberGroupId) or an outside email address (Address) into a group.  Digest
+// members of a list receive posts in batches, disabled ones not at all.
 type GroupMember struct {
+	Id            uint64    `xorm:"pk autoincr" json:"id"`
+	UserId        uint64    `xorm:"BigInt not null" json:"userId"`
+	GroupId       uint64    `xorm:"BigInt not null" json:"groupId"`
+	MemberGroupId uint64    `xorm:"BigInt not null default 0" json:"memberGroupId"`
+	Address       string    `xorm:"varchar(255) not null default '' 'address'" json:"address"`
+	Digest        bool      `xorm:"not null default 0 'digest'" json:"digest"`
+	Disabled      bool      `xorm:"not null default 0 'disabled'" json:"disabled"`
+	Bounces       int       `xorm:"not null default 0 'bounces'" json:"bounces"`
+	Created       time.Time `xorm:"created" json:"created"`
+	Updated       time.Time `xorm:"updated" json:"updated"`
+}
+
+type DkimKey struct {
+	Id         uint64    `xorm:"pk autoincr" json:"id"`
+	Domain     string    `xorm:"varchar(255) not null unique 'domain'" json:"domain"`
+	Selector   string    `xorm:"varchar(63) not null 'selector'" json:"selector"`
+	PrivateKey string    `xorm:"text not null 'private_key'" json:"-"`
+	Created    time.Time `xorm:"created" json:"created"`
+	Updated    time.Time `xorm:"updated" json:"updated"`
+}
+
+// SieveScript is a user's mail filter, at most one script per user is active
+type SieveScript struct {
+	Id      uint64    `xorm:"pk autoincr" json:"id"`
+	UserId  uint64    `xorm:"BigInt not null unique(user_script)" json:"userId"`
+	Name    string    `xorm:"varchar(255) not null unique(user_script) 'name'" json:"name"`
+	Script  string    `xorm:"text not null 'script'" json:"script"`
+	Active  bool      `xorm:"not null 'active'" json:"active"`
+	Created time.Time `xorm:"created" json:"created"`
+	Updated time.Time `xorm:"updated" json:"updated"`
+}
+
+// VacationResponse records when an automatic reply was last sent to a sender,
+// so each sender hears from us at most once per period
+type VacationResponse struct {
+	Id        uint64    `xorm:"pk autoincr" json:"id"`
+	Recipient string    `xorm:"varchar(255) not null unique(vacation) 'recipient'" json:"recipient"`
+	Handle    string    `xorm:"varchar(64) not null unique(vacation) 'handle'" json:"handle"`
+	Sender    string    `xorm:"varchar(255) not null unique(vacation) 'sender'" json:"sender"`
+	Sent      time.Time `xorm:"not null 'sent'" json:"sent"`
+}
+
+// Vacation holds a user's out of office settings, replies are sent while
+// Active and within the optional StartTime and EndTime
+type Vacation struct {
+	Id           uint64    `xorm:"pk autoincr" json:"id"`
+	UserId       uint64    `xorm:"not null unique 'user_id'" json:"userId"`
+	Active       bool      `xorm:"not null 'active'" json:"active"`
+	Subject      string    `xorm:"varchar(255) 'subject'" json:"subject"`
+	Body         string    `xorm:"text 'body'" json:"body"`
+	StartTime    time.Time `xorm:"'start_time'" json:"startTime"`
+	EndTime      time.Time `xorm:"'end_time'" json:"endTime"`
+	IntervalDays int       `xorm:"not null 'interval_days'" json:"intervalDays"`
+	Created      time.Time `xorm:"created" json:"created"`
+	Updated      time.Time `xorm:"updated" json:"updated"`
+}
+
+// InEffect reports whether replies should be sent at time t
+func (v *Vacation) InEffect(t time.Time) bool {
+	if !v.Active {
+		return false
+	}
+	if !v.StartTime.IsZero() && t.Before(v.StartTime) {
+		return false
+	}
+	if !v.EndTime.IsZero() && !t.Before(v.EndTime) {
+		return false
+	}
+	return true
+}
+
+// Forward redirects a user's mail to Address, a copy is still delivered to
+// their own mailbox when KeepCopy is set
+type Forward struct {
+	Id       uint64    `xorm:"pk autoincr" json:"id"`
+	UserId   uint64    `xorm:"not null unique 'user_id'" json:"userId"`
+	Address  string    `xorm:"varchar(255) not null 'address'" json:"address"`
+	KeepCopy bool      `xorm:"not null 'keep_copy'" json:"keepCopy"`
+	Created  time.Time `xorm:"created" json:"created"`
+	Updated  time.Time `xorm:"updated" json:"updated"`
+}
+
+// Alias delivers mail for addresses matching Pattern to Target, a comma
+// separated list of addresses.  See smtpd.AliasTargets for the pattern
+// syntax.
+type Alias struct {
 	Id      uint64    `xorm:"pk autoincr" json:"id"`
-	UserId  uint64    `xorm:"BigInt not null" json:"userId"`
-	GroupId uint64    `xorm:"BigInt not null" json:"groupId"`
+	Pattern string    `xorm:"varchar(255) not null unique 'pattern'" json:"pattern"`
+	Target  string    `xorm:"text not null 'target'" json:"target"`
 	Created time.Time `xorm:"created" json:"created"`
 	Updated time.Time `xorm:"updated" json:"updated"`
 }
 
+// ListConfirm is a mailing list request waiting for the address to confirm
+// it by replying with Token
+type ListConfirm struct {
+	Id      uint64    `xorm:"pk autoincr" json:"id"`
+	GroupId uint64    `xorm:"BigInt not null 'group_id'" json:"groupId"`
+	Address string    `xorm:"varchar(255) not null 'address'" json:"address"`
+	Action  string    `xorm:"varchar(32) not null 'action'" json:"action"`
+	Token   string    `xorm:"varchar(64) not null unique 'token'" json:"-"`
+	Created time.Time `xorm:"created" json:"created"`
+}
+
+// ListDigest is a post queued for a list's digest members
+type ListDigest struct {
+	Id      uint64    `xorm:"pk autoincr" json:"id"`
+	GroupId uint64    `xorm:"BigInt not null index 'group_id'" json:"groupId"`
+	Data    []byte    `xorm:"mediumblob not null 'data'" json:"-"`
+	Created time.Time `xorm:"created" json:"created"`
+}
+
+// SharedMailbox is a team mailbox such as support that users reach through
+// their MailboxAcl rather than by owning it.  Name is the mailbox name, the
+// local part mail for it is addressed to.
+type SharedMailbox struct {
+	Id      uint64    `xorm:"pk autoincr" json:"id"`
+	Name    string    `xorm:"varchar(255) not null unique 'name'" json:"name"`
+	Created time.Time `xorm:"created" json:"created"`
+	Updated time.Time `xorm:"updated" json:"updated"`
+}
+
+// MailboxAcl grants a user rights on a shared mailbox: reading its messages,
+// deleting them and sending mail as its address
+type MailboxAcl struct {
+	Id        uint64    `xorm:"pk autoincr" json:"id"`
+	MailboxId uint64    `xorm:"BigInt not null unique(mailbox_acl) 'mailbox_id'" json:"mailboxId"`
+	UserId    uint64    `xorm:"BigInt not null unique(mailbox_acl) 'user_id'" json:"userId"`
+	Read      bool      `xorm:"not null 'can_read'" json:"read"`
+	Delete    bool      `xorm:"not null 'can_delete'" json:"delete"`
+	SendAs    bool      `xorm:"not null 'can_send_as'" json:"sendAs"`
+	Created   time.Time `xorm:"created" json:"created"`
+	Updated   time.Time `xorm:"updated" json:"updated"`
+}
+
+// FutureRelease is a message a client asked SMTP to hold until ReleaseAt
+// (RFC 4865).  A local copy is stored in Mailbox, or its Folder if set, when
+// released, a remote one (Remote set) is relayed to Recipient.  Messages
+// submitted over JMAP record the submitting user in UserId, and are
+// delivered as mail sent with SMTP AUTH would be.  Attempts counts the
+// failed releases so far.
+type FutureRelease struct {
+	Id        uint64    `xorm:"pk autoincr" json:"id"`
+	Sender    string    `xorm:"varchar(255) not null 'sender'" json:"sender"`
+	Recipient string    `xorm:"varchar(255) not null 'recipient'" json:"recipient"`
+	Mailbox   string    `xorm:"varchar(255) not null default '' 'mailbox'" json:"mailbox"`
+	Folder    string    `xorm:"varchar(255) not null default '' 'folder'" json:"folder"`
+	Remote    bool      `xorm:"not null 'remote'" json:"remote"`
+	UserId    uint64    `xorm:"not null default 0 'user_id'" json:"userId"`
+	Subject   string    `xorm:"varchar(255) not null default '' 'subject'" json:"subject"`
+	Data      []byte    `xorm:"mediumblob not null 'data'" json:"-"`
+	ReleaseAt time.Time `xorm:"not null index 'release_at'" json:"releaseAt"`
+	Attempts  int       `xorm:"not null default 0 'attempts'" json:"attempts"`
+	Created   time.Time `xorm:"created" json:"created"`
+}
+
 type Database struct {
 	engine *xorm.Engine
 }
@@ -56,6 +260,19 @@ func New() *Database {
 		new(User),
 		new(Group),
 		new(GroupMember),
+		new(DkimKey),
+		new(SieveScript),
+		new(VacationResponse),
+		new(Vacation),
+		new(Forward),
+		new(Alias),
+		new(ListConfirm),
+		new(ListDigest),
+		new(GroupSender),
+		new(GroupHeld),
+		new(SharedMailbox),
+		new(MailboxAcl),
+		new(FutureRelease),
 	)
 
 	if err != nil {
@@ -89,6 +306,12 @@ func (db *Database) UserUpdate(user *User) error {
 	return err
 }
 
+// UserSetApopSecret replaces the user's APOP secret
+func (db *Database) UserSetApopSecret(id uint64, secret string) error {
+	_, err := db.engine.Id(id).Cols("apop_secret").Update(&User{ApopSecret: secret})
+	return err
+}
+
 func (db *Database) UserGet(id uint64) (*User, error) {
 	user := new(User)
 	has, err := db.engine.Id(id).Get(user)
@@ -107,6 +330,23 @@ func (db *Database) UserGetByName(name string) (*User, error) {
 	return user, nil
 }
 
+// UserGetByAddress finds the user owning the mailbox addr (username@domain)
+func (db *Database) UserGetByAddress(addr string) (*User, error) {
+	sub := strings.SplitN(strings.ToLower(addr), "@", 2)
+	user := new(User)
+	var has bool
+	var err error
+	if len(sub) == 2 {
+		has, err = db.engine.Where("username=? and domain=?", sub[0], sub[1]).Get(user)
+	} else {
+		has, err = db.engine.Where("username=?", sub[0]).Get(user)
+	}
+	if !has || err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
 func (db *Database) UserList(pageno int, count int, ids []uint64, column string, order string, match string) (int64, []*User, error) {
 
 	if len(column) < 1 {
@@ -159,13 +399,10 @@ func (db *Database) UserList(pageno int, count int, ids []uint64, column string,
 func (db *Database) Auth(id uint64, pass string) (bool, error) {
 	user := new(User)
 
-	log.LogInfo("Auth - id: %v, pass: <%v>", id, pass)
-
 	has, err := db.engine.Where("id=?", id).Get(user)
 	if err != nil {
 		return false, err
 	}
-	log.LogInfo("has: %v, user pass: %v", has, user.Password)
 	if has {
 
 		substrs := strings.Split(user.Password, "$")
@@ -180,8 +417,6 @@ func (db *Database) Auth(id uint64, pass string) (bool, error) {
 			return false, nil
 		}
 
-		log.LogInfo("salt : %v, cryptPass: %v", salt, string(cryptPass))
-
 		if string(cryptPass) != user.Password {
 			return false, nil
 		} else {
@@ -205,7 +440,7 @@ func (db *Database) GroupDel(id uint64) error {
 
 func (db *Database) GroupUpdate(group *Group) error {
 
-	_, err := db.engine.Id(group.Id).Update(group)
+	_, err := db.engine.Id(group.Id).Cols("name", "domain", "is_list", "reply_to", "policy").Update(group)
 	return err
 }
 
@@ -218,6 +453,15 @@ func (db *Database) GroupGet(id uint64) (*Group, error) {
 	return group, nil
 }
 
+func (db *Database) GroupGetByName(name string) (*Group, error) {
+	group := new(Group)
+	has, err := db.engine.Where("name=?", name).Get(group)
+	if !has || err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
 func (db *Database) GroupList(pageno int, count int) (int64, []*Group, error) {
 	groups := make([]*Group, 0)
 
@@ -232,7 +476,7 @@ func (db *Database) GroupList(pageno int, count int) (int64, []*Group, error) {
 }
 
 func (db *Database) GroupMemberAdd(groupMember *GroupMember) error {
-
+	groupMember.Address = strings.ToLower(groupMember.Address)
 	_, err := db.engine.Insert(groupMember)
 	return err
 }
@@ -243,6 +487,70 @@ func (db *Database) GroupMemberDel(id uint64) error {
 	return err
 }
 
+// GroupMemberUpdate saves the list delivery settings of a member
+func (db *Database) GroupMemberUpdate(groupMember *GroupMember) error {
+	_, err := db.engine.Id(groupMember.Id).Cols("digest", "disabled", "bounces").Update(groupMember)
+	return err
+}
+
+// GroupMemberAll returns the direct members of the group
+func (db *Database) GroupMemberAll(groupId uint64) ([]*GroupMember, error) {
+	groupMembers := make([]*GroupMember, 0)
+	err := db.engine.Where("group_id=?", groupId).Asc("id").Find(&groupMembers)
+	return groupMembers, err
+}
+
+// GroupMemberAddress returns the address mail for the member goes to, empty
+// for nested groups and deleted users
+func (db *Database) GroupMemberAddress(groupMember *GroupMember) (string, error) {
+	if groupMember.Address != "" || groupMember.UserId == 0 {
+		return groupMember.Address, nil
+	}
+	user, err := db.UserGet(groupMember.UserId)
+	if err != nil || user == nil {
+		return "", err
+	}
+	return user.Username + "@" + user.Domain, nil
+}
+
+// GroupMemberFind finds the direct member of the group with the address,
+// whether added by address or as a user
+func (db *Database) GroupMemberFind(groupId uint64, addr string) (*GroupMember, error) {
+	groupMember, err := db.GroupMemberGetByAddress(groupId, addr)
+	if groupMember != nil || err != nil {
+		return groupMember, err
+	}
+	user, err := db.UserGetByAddress(addr)
+	if user == nil || err != nil {
+		return nil, err
+	}
+	groupMember = new(GroupMember)
+	has, err := db.engine.Where("group_id=? and user_id=?", groupId, user.Id).Get(groupMember)
+	if !has || err != nil {
+		return nil, err
+	}
+	return groupMember, nil
+}
+
+// GroupMemberGetByAddress finds the member of the group with the address,
+// nil if there is none
+func (db *Database) GroupMemberGetByAddress(groupId uint64, addr string) (*GroupMember, error) {
+	groupMember := new(GroupMember)
+	has, err := db.engine.Where("group_id=? and address=?", groupId,
+		strings.ToLower(addr)).Get(groupMember)
+	if !has || err != nil {
+		return nil, err
+	}
+	return groupMember, nil
+}
+
+func (db *Database) GroupMemberDelByAddress(groupId uint64, addr string) error {
+	groupMember := new(GroupMember)
+	_, err := db.engine.Where("group_id=? and address=?", groupId,
+		strings.ToLower(addr)).Delete(groupMember)
+	return err
+}
+
 func (db *Database) GroupMemberGet(id uint64) (*GroupMember, error) {
 	groupMember := new(GroupMember)
 	has, err := db.engine.Id(id).Get(groupMember)
@@ -275,23 +583,659 @@ func (db *Database) GroupMemberList(groupId uint64, pageno int, count int) (int6
 	return total, groupMembers, nil
 }
 
+// IsGroup expands the group named by the local part of name into its
+// members' addresses, following nested groups.  An empty result means name
+// is not a group.
 func (db *Database) IsGroup(name string) ([]string, error) {
+	sub := strings.Split(name, "@")
 
-	log.LogInfo("Auth - name: %v", name)
+	group := new(Group)
+	has, err := db.engine.Where("name=?", sub[0]).Get(group)
+	if !has || err != nil {
+		return nil, err
+	}
+	return db.GroupExpand(group.Id)
+}
 
-	sub := strings.Split(name, "@")
+// GroupExpand returns the addresses of every user and outside address in
+// the group, including those in groups nested within it.  Each address is
+// listed once and each nested group is expanded only once, so cycles
+// terminate.
+func (db *Database) GroupExpand(groupId uint64) ([]string, error) {
+	return expandGroup(groupId, db.groupMembers, db.UserGet)
+}
+
+// GroupNested returns the ids of all groups nested within the group, at any
+// depth
+func (db *Database) GroupNested(groupId uint64) (map[uint64]bool, error) {
+	return nestedGroups(groupId, func(id uint64) ([]*GroupMember, error) {
+		members := make([]*GroupMember, 0)
+		err := db.engine.Where("group_id=? and member_group_id<>0", id).Find(&members)
+		return members, err
+	})
+}
 
+// groupMembers returns the direct members of a group in the order they
+// were added
+func (db *Database) groupMembers(groupId uint64) ([]*GroupMember, error) {
+	members := make([]*GroupMember, 0)
+	err := db.engine.Where("group_id=?", groupId).Asc("id").Find(&members)
+	return members, err
+}
+
+// expandGroup does the work of GroupExpand, walking the nested groups breadth
+// first with members and looking up member users with userGet
+func expandGroup(groupId uint64, members func(groupId uint64) ([]*GroupMember, error),
+	userGet func(id uint64) (*User, error)) ([]string, error) {
 	var names []string
+	seenNames := make(map[string]bool)
+	seenGroups := map[uint64]bool{groupId: true}
+
+	queue := []uint64{groupId}
+	for len(queue) > 0 {
+		list, err := members(queue[0])
+		if err != nil {
+			return nil, err
+		}
+		queue = queue[1:]
+
+		for _, m := range list {
+			if m.MemberGroupId != 0 {
+				if !seenGroups[m.MemberGroupId] {
+					seenGroups[m.MemberGroupId] = true
+					queue = append(queue, m.MemberGroupId)
+				}
+				continue
+			}
+			if m.Disabled {
+				continue
+			}
+			name := m.Address
+			if name == "" {
+				user, err := userGet(m.UserId)
+				if err != nil {
+					return nil, err
+				}
+				if user == nil {
+					continue
+				}
+				name = user.Username + "@" + user.Domain
+			}
+			if key := strings.ToLower(name); !seenNames[key] {
+				seenNames[key] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
 
-	users := make([]User, 0)
-	err := db.engine.Sql("select username, a.domain from user as a, email.group as b, group_member as c where a.id=c.user_id and b.id=c.group_id and b.name=?", sub[0]).Find(&users)
+// nestedGroups does the work of GroupNested, nestedMembers returns the
+// members of a group that are groups themselves
+func nestedGroups(groupId uint64,
+	nestedMembers func(groupId uint64) ([]*GroupMember, error)) (map[uint64]bool, error) {
+	nested := make(map[uint64]bool)
+	queue := []uint64{groupId}
+	for len(queue) > 0 {
+		members, err := nestedMembers(queue[0])
+		if err != nil {
+			return nil, err
+		}
+		queue = queue[1:]
+		for _, m := range members {
+			if !nested[m.MemberGroupId] {
+				nested[m.MemberGroupId] = true
+				queue = append(queue, m.MemberGroupId)
+			}
+		}
+	}
+	return nested, nil
+}
+
+func (db *Database) AliasAdd(alias *Alias) error {
+	alias.Pattern = strings.ToLower(alias.Pattern)
+	_, err := db.engine.Insert(alias)
+	return err
+}
+
+func (db *Database) AliasDel(id uint64) error {
+	alias := new(Alias)
+	_, err := db.engine.Id(id).Delete(alias)
+	return err
+}
 
+func (db *Database) AliasUpdate(alias *Alias) error {
+	alias.Pattern = strings.ToLower(alias.Pattern)
+	_, err := db.engine.Id(alias.Id).Cols("pattern", "target").Update(alias)
+	return err
+}
+
+func (db *Database) AliasGet(id uint64) (*Alias, error) {
+	alias := new(Alias)
+	has, err := db.engine.Id(id).Get(alias)
+	if !has || err != nil {
+		return nil, err
+	}
+	return alias, nil
+}
+
+func (db *Database) AliasGetByPattern(pattern string) (*Alias, error) {
+	alias := new(Alias)
+	has, err := db.engine.Where("pattern=?", strings.ToLower(pattern)).Get(alias)
+	if !has || err != nil {
+		return nil, err
+	}
+	return alias, nil
+}
+
+func (db *Database) AliasList(pageno int, count int) (int64, []*Alias, error) {
+	aliases := make([]*Alias, 0)
+
+	alias := new(Alias)
+	total, err := db.engine.Count(alias)
 	if err != nil {
-		return names, err
+		return 0, nil, err
 	}
+	err = db.engine.Asc("pattern").Limit(count, pageno*count).Find(&aliases)
 
-	for _, v := range users {
-		names = append(names, v.Username+"@"+v.Domain)
+	return total, aliases, err
+}
+
+// AliasFind returns the aliases whose pattern is exactly one of patterns
+func (db *Database) AliasFind(patterns ...string) ([]*Alias, error) {
+	aliases := make([]*Alias, 0)
+	if len(patterns) == 0 {
+		return aliases, nil
 	}
-	return names, nil
+	args := make([]interface{}, len(patterns))
+	for i, p := range patterns {
+		args[i] = strings.ToLower(p)
+	}
+	err := db.engine.In("pattern", args...).Find(&aliases)
+	return aliases, err
+}
+
+// AliasWildcards returns the aliases whose pattern has a wildcard
+func (db *Database) AliasWildcards() ([]*Alias, error) {
+	aliases := make([]*Alias, 0)
+	err := db.engine.Where("pattern like ?", "%*%").Find(&aliases)
+	return aliases, err
+}
+
+func (db *Database) ListConfirmAdd(confirm *ListConfirm) error {
+	confirm.Address = strings.ToLower(confirm.Address)
+	_, err := db.engine.Insert(confirm)
+	return err
+}
+
+// ListConfirmTake returns the request waiting on token and removes it, nil if
+// there is none
+func (db *Database) ListConfirmTake(token string) (*ListConfirm, error) {
+	confirm := new(ListConfirm)
+	has, err := db.engine.Where("token=?", token).Get(confirm)
+	if !has || err != nil {
+		return nil, err
+	}
+	_, err = db.engine.Id(confirm.Id).Delete(new(ListConfirm))
+	return confirm, err
+}
+
+func (db *Database) ListDigestAdd(groupId uint64, data []byte) error {
+	_, err := db.engine.Insert(&ListDigest{GroupId: groupId, Data: data})
+	return err
+}
+
+// ListDigestAll returns every queued digest post, oldest first
+func (db *Database) ListDigestAll() ([]*ListDigest, error) {
+	digests := make([]*ListDigest, 0)
+	err := db.engine.Asc("id").Find(&digests)
+	return digests, err
+}
+
+func (db *Database) ListDigestDel(id uint64) error {
+	_, err := db.engine.Id(id).Delete(new(ListDigest))
+	return err
+}
+
+func (db *Database) GroupSenderAdd(sender *GroupSender) error {
+	sender.Address = strings.ToLower(sender.Address)
+	_, err := db.engine.Insert(sender)
+	return err
+}
+
+func (db *Database) GroupSenderDel(groupId uint64, addr string) error {
+	_, err := db.engine.Where("group_id=? and address=?", groupId,
+		strings.ToLower(addr)).Delete(new(GroupSender))
+	return err
+}
+
+func (db *Database) GroupSenderList(groupId uint64) ([]*GroupSender, error) {
+	senders := make([]*GroupSender, 0)
+	err := db.engine.Where("group_id=?", groupId).Asc("address").Find(&senders)
+	return senders, err
+}
+
+// GroupSenderHas reports whether addr is a listed sender of the group
+func (db *Database) GroupSenderHas(groupId uint64, addr string) (bool, error) {
+	return db.engine.Where("group_id=? and address=?", groupId,
+		strings.ToLower(addr)).Get(new(GroupSender))
+}
+
+func (db *Database) GroupHeldAdd(held *GroupHeld) error {
+	held.State = HELD_WAITING
+	_, err := db.engine.Insert(held)
+	return err
+}
+
+func (db *Database) GroupHeldGet(id uint64) (*GroupHeld, error) {
+	held := new(GroupHeld)
+	has, err := db.engine.Id(id).Get(held)
+	if !has || err != nil {
+		return nil, err
+	}
+	return held, nil
+}
+
+// GroupHeldList pages through the messages of the group still waiting for a
+// moderator, oldest first
+func (db *Database) GroupHeldList(groupId uint64, pageno int, count int) (int64, []*GroupHeld, error) {
+	helds := make([]*GroupHeld, 0)
+
+	total, err := db.engine.Where("group_id=? and state=?", groupId, HELD_WAITING).
+		Count(new(GroupHeld))
+	if err != nil {
+		return 0, nil, err
+	}
+	err = db.engine.Where("group_id=? and state=?", groupId, HELD_WAITING).Omit("data").
+		Asc("id").Limit(count, pageno*count).Find(&helds)
+
+	return total, helds, err
+}
+
+// GroupHeldDecide records the moderator's decision on a waiting message,
+// returning false when it was no longer waiting
+func (db *Database) GroupHeldDecide(id uint64, state string, reason string) (bool, error) {
+	held := &GroupHeld{State: state, Reason: reason}
+	n, err := db.engine.Where("id=? and state=?", id, HELD_WAITING).Cols("state", "reason").
+		Update(held)
+	return n > 0, err
+}
+
+// GroupHeldDecided returns the messages a moderator has approved or rejected
+func (db *Database) GroupHeldDecided() ([]*GroupHeld, error) {
+	helds := make([]*GroupHeld, 0)
+	err := db.engine.Where("state<>?", HELD_WAITING).Asc("id").Find(&helds)
+	return helds, err
+}
+
+func (db *Database) GroupHeldDel(id uint64) error {
+	_, err := db.engine.Id(id).Delete(new(GroupHeld))
+	return err
+}
+
+func (db *Database) SharedMailboxAdd(mailbox *SharedMailbox) error {
+	mailbox.Name = strings.ToLower(mailbox.Name)
+	_, err := db.engine.Insert(mailbox)
+	return err
+}
+
+// SharedMailboxDel removes the shared mailbox and the rights granted on it,
+// the messages in it are left alone
+func (db *Database) SharedMailboxDel(id uint64) error {
+	if _, err := db.engine.Where("mailbox_id=?", id).Delete(new(MailboxAcl)); err != nil {
+		return err
+	}
+	_, err := db.engine.Id(id).Delete(new(SharedMailbox))
+	return err
+}
+
+func (db *Database) SharedMailboxGet(id uint64) (*SharedMailbox, error) {
+	mailbox := new(SharedMailbox)
+	has, err := db.engine.Id(id).Get(mailbox)
+	if !has || err != nil {
+		return nil, err
+	}
+	return mailbox, nil
+}
+
+func (db *Database) SharedMailboxGetByName(name string) (*SharedMailbox, error) {
+	mailbox := new(SharedMailbox)
+	has, err := db.engine.Where("name=?", strings.ToLower(name)).Get(mailbox)
+	if !has || err != nil {
+		return nil, err
+	}
+	return mailbox, nil
+}
+
+func (db *Database) SharedMailboxList(pageno int, count int) (int64, []*SharedMailbox, error) {
+	mailboxes := make([]*SharedMailbox, 0)
+
+	total, err := db.engine.Count(new(SharedMailbox))
+	if err != nil {
+		return 0, nil, err
+	}
+	err = db.engine.Asc("name").Limit(count, pageno*count).Find(&mailboxes)
+
+	return total, mailboxes, err
+}
+
+func (db *Database) MailboxAclGet(mailboxId uint64, userId uint64) (*MailboxAcl, error) {
+	acl := new(MailboxAcl)
+	has, err := db.engine.Where("mailbox_id=? and user_id=?", mailboxId, userId).Get(acl)
+	if !has || err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// MailboxAclSave stores the rights of acl's user on its mailbox, replacing
+// any they had before
+func (db *Database) MailboxAclSave(acl *MailboxAcl) error {
+	old, err := db.MailboxAclGet(acl.MailboxId, acl.UserId)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		_, err = db.engine.Insert(acl)
+		return err
+	}
+	acl.Id = old.Id
+	_, err = db.engine.Id(acl.Id).Cols("can_read", "can_delete", "can_send_as").Update(acl)
+	return err
+}
+
+func (db *Database) MailboxAclDel(mailboxId uint64, userId uint64) error {
+	_, err := db.engine.Where("mailbox_id=? and user_id=?", mailboxId,
+		userId).Delete(new(MailboxAcl))
+	return err
+}
+
+func (db *Database) MailboxAclList(mailboxId uint64) ([]*MailboxAcl, error) {
+	acls := make([]*MailboxAcl, 0)
+	err := db.engine.Where("mailbox_id=?", mailboxId).Asc("user_id").Find(&acls)
+	return acls, err
+}
+
+// MailboxAclListByUser returns the rights userId has been granted on shared
+// mailboxes
+func (db *Database) MailboxAclListByUser(userId uint64) ([]*MailboxAcl, error) {
+	acls := make([]*MailboxAcl, 0)
+	err := db.engine.Where("user_id=?", userId).Asc("mailbox_id").Find(&acls)
+	return acls, err
+}
+
+// MailboxRights returns what user may do with the mailbox called name.  A
+// user has every right on the mailbox named after them, shared mailboxes
+// grant what their ACL says, and other mailboxes give no rights: nil.
+func (db *Database) MailboxRights(name string, user *User) (*MailboxAcl, error) {
+	if strings.EqualFold(name, user.Username) {
+		return &MailboxAcl{UserId: user.Id, Read: true, Delete: true, SendAs: true}, nil
+	}
+	mailbox, err := db.SharedMailboxGetByName(name)
+	if mailbox == nil || err != nil {
+		return nil, err
+	}
+	return db.MailboxAclGet(mailbox.Id, user.Id)
+}
+
+func (db *Database) DkimKeyGet(domain string) (*DkimKey, error) {
+	key := new(DkimKey)
+	has, err := db.engine.Where("domain=?", strings.ToLower(domain)).Get(key)
+	if !has || err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DkimKeySave stores key as the signing key for its domain, replacing any
+// previous key
+func (db *Database) DkimKeySave(key *DkimKey) error {
+	key.Domain = strings.ToLower(key.Domain)
+	old, err := db.DkimKeyGet(key.Domain)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		_, err = db.engine.Insert(key)
+		return err
+	}
+	key.Id = old.Id
+	_, err = db.engine.Id(key.Id).Cols("selector", "private_key").Update(key)
+	return err
+}
+
+func (db *Database) DkimKeyDel(domain string) error {
+	key := new(DkimKey)
+	_, err := db.engine.Where("domain=?", strings.ToLower(domain)).Delete(key)
+	return err
+}
+
+func (db *Database) DkimKeyList(pageno int, count int) (int64, []*DkimKey, error) {
+	keys := make([]*DkimKey, 0)
+
+	key := new(DkimKey)
+	total, err := db.engine.Count(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = db.engine.Limit(count, pageno*count).Find(&keys)
+
+	return total, keys, err
+}
+
+func (db *Database) SieveScriptGet(userId uint64, name string) (*SieveScript, error) {
+	script := new(SieveScript)
+	has, err := db.engine.Where("user_id=? and name=?", userId, name).Get(script)
+	if !has || err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+// SieveScriptSave stores script under its name for the user, replacing any
+// previous script of that name.  The active flag is left alone, use
+// SieveScriptSetActive to change it.
+func (db *Database) SieveScriptSave(script *SieveScript) error {
+	old, err := db.SieveScriptGet(script.UserId, script.Name)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		script.Active = false
+		_, err = db.engine.Insert(script)
+		return err
+	}
+	script.Id = old.Id
+	script.Active = old.Active
+	_, err = db.engine.Id(script.Id).Cols("script").Update(script)
+	return err
+}
+
+func (db *Database) SieveScriptDel(userId uint64, name string) error {
+	script := new(SieveScript)
+	_, err := db.engine.Where("user_id=? and name=?", userId, name).Delete(script)
+	return err
+}
+
+// SieveScriptRename changes the name of a script, keeping its active flag
+func (db *Database) SieveScriptRename(userId uint64, name string, newName string) error {
+	script := &SieveScript{Name: newName}
+	_, err := db.engine.Where("user_id=? and name=?", userId, name).Cols("name").Update(script)
+	return err
+}
+
+func (db *Database) SieveScriptList(userId uint64) ([]*SieveScript, error) {
+	scripts := make([]*SieveScript, 0)
+	err := db.engine.Where("user_id=?", userId).Asc("name").Find(&scripts)
+	return scripts, err
+}
+
+// SieveScriptActive returns the user's active script, nil if there is none
+func (db *Database) SieveScriptActive(userId uint64) (*SieveScript, error) {
+	script := new(SieveScript)
+	has, err := db.engine.Where("user_id=? and active=?", userId, true).Get(script)
+	if !has || err != nil {
+		return nil, err
+	}
+	return script, nil
+}
+
+// SieveScriptSetActive makes the named script the user's active one, an
+// empty name deactivates all of the user's scripts
+func (db *Database) SieveScriptSetActive(userId uint64, name string) error {
+	off := &SieveScript{Active: false}
+	_, err := db.engine.Where("user_id=?", userId).Cols("active").Update(off)
+	if err != nil || name == "" {
+		return err
+	}
+	on := &SieveScript{Active: true}
+	_, err = db.engine.Where("user_id=? and name=?", userId, name).Cols("active").Update(on)
+	return err
+}
+
+func (db *Database) VacationGet(userId uint64) (*Vacation, error) {
+	vacation := new(Vacation)
+	has, err := db.engine.Where("user_id=?", userId).Get(vacation)
+	if !has || err != nil {
+		return nil, err
+	}
+	return vacation, nil
+}
+
+// VacationSave stores the user's vacation settings, replacing any existing
+func (db *Database) VacationSave(vacation *Vacation) error {
+	old, err := db.VacationGet(vacation.UserId)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		_, err = db.engine.Insert(vacation)
+		return err
+	}
+	vacation.Id = old.Id
+	vacation.Created = old.Created
+	_, err = db.engine.Id(vacation.Id).Cols("active", "subject", "body", "start_time",
+		"end_time", "interval_days").Update(vacation)
+	return err
+}
+
+func (db *Database) ForwardGet(userId uint64) (*Forward, error) {
+	forward := new(Forward)
+	has, err := db.engine.Where("user_id=?", userId).Get(forward)
+	if !has || err != nil {
+		return nil, err
+	}
+	return forward, nil
+}
+
+// ForwardSave stores the user's forwarding rule, replacing any existing one
+func (db *Database) ForwardSave(forward *Forward) error {
+	old, err := db.ForwardGet(forward.UserId)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		_, err = db.engine.Insert(forward)
+		return err
+	}
+	forward.Id = old.Id
+	forward.Created = old.Created
+	_, err = db.engine.Id(forward.Id).Cols("address", "keep_copy").Update(forward)
+	return err
+}
+
+func (db *Database) ForwardDel(userId uint64) error {
+	forward := new(Forward)
+	_, err := db.engine.Where("user_id=?", userId).Delete(forward)
+	return err
+}
+
+func (db *Database) VacationResponseGet(recipient string, handle string,
+	sender string) (*VacationResponse, error) {
+	resp := new(VacationResponse)
+	has, err := db.engine.Where("recipient=? and handle=? and sender=?",
+		strings.ToLower(recipient), handle, strings.ToLower(sender)).Get(resp)
+	if !has || err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// VacationResponseSave records that a response was sent to sender now
+func (db *Database) VacationResponseSave(recipient string, handle string, sender string) error {
+	old, err := db.VacationResponseGet(recipient, handle, sender)
+	if err != nil {
+		return err
+	}
+	resp := &VacationResponse{
+		Recipient: strings.ToLower(recipient),
+		Handle:    handle,
+		Sender:    strings.ToLower(sender),
+		Sent:      time.Now(),
+	}
+	if old == nil {
+		_, err = db.engine.Insert(resp)
+		return err
+	}
+	_, err = db.engine.Id(old.Id).Cols("sent").Update(resp)
+	return err
+}
+
+func (db *Database) FutureReleaseAdd(release *FutureRelease) error {
+	_, err := db.engine.Insert(release)
+	return err
+}
+
+// FutureReleaseAddAll inserts the held copies of one message in a single
+// transaction, so either all of them are held or none are
+func (db *Database) FutureReleaseAddAll(releases []*FutureRelease) error {
+	session := db.engine.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	for _, release := range releases {
+		if _, err := session.Insert(release); err != nil {
+			session.Rollback()
+			return err
+		}
+	}
+	return session.Commit()
+}
+
+func (db *Database) FutureReleaseGet(id uint64) (*FutureRelease, error) {
+	release := new(FutureRelease)
+	has, err := db.engine.Id(id).Get(release)
+	if !has || err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// FutureReleaseList pages through the held messages, soonest due first
+func (db *Database) FutureReleaseList(pageno int, count int) (int64, []*FutureRelease, error) {
+	releases := make([]*FutureRelease, 0)
+
+	total, err := db.engine.Count(new(FutureRelease))
+	if err != nil {
+		return 0, nil, err
+	}
+	err = db.engine.Omit("data").Asc("release_at", "id").Limit(count, pageno*count).
+		Find(&releases)
+
+	return total, releases, err
+}
+
+// FutureReleaseDue returns the held messages due for release at now
+func (db *Database) FutureReleaseDue(now time.Time) ([]*FutureRelease, error) {
+	releases := make([]*FutureRelease, 0)
+	err := db.engine.Where("release_at<=?", now).Asc("release_at", "id").Find(&releases)
+	return releases, err
+}
+
+// FutureReleaseDel removes a held message, returning false if it was already
+// gone: released or cancelled by someone else
+func (db *Database) FutureReleaseDel(id uint64) (bool, error) {
+	n, err := db.engine.Id(id).Delete(new(FutureRelease))
+	return n > 0, err
 }
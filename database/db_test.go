@@ -0,0 +1,99 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testGroups stands in for the group_member and user tables
+type testGroups struct {
+	members map[uint64][]*GroupMember
+	users   map[uint64]*User
+	queried []uint64
+}
+
+func (g *testGroups) groupMembers(groupId uint64) ([]*GroupMember, error) {
+	g.queried = append(g.queried, groupId)
+	return g.members[groupId], nil
+}
+
+func (g *testGroups) nestedMembers(groupId uint64) ([]*GroupMember, error) {
+	var nested []*GroupMember
+	for _, m := range g.members[groupId] {
+		if m.MemberGroupId != 0 {
+			nested = append(nested, m)
+		}
+	}
+	return nested, nil
+}
+
+func (g *testGroups) userGet(id uint64) (*User, error) {
+	return g.users[id], nil
+}
+
+func newTestGroups() *testGroups {
+	return &testGroups{
+		members: map[uint64][]*GroupMember{
+			// staff contains sales and support, support contains staff again
+			1: {{UserId: 1}, {MemberGroupId: 2}, {MemberGroupId: 3}},
+			2: {{UserId: 2}, {UserId: 3, Disabled: true}, {MemberGroupId: 4}},
+			3: {{UserId: 4}, {UserId: 9}, {MemberGroupId: 1}, {MemberGroupId: 2}},
+			4: {{UserId: 2}, {UserId: 5}},
+		},
+		users: map[uint64]*User{
+			1: {Id: 1, Username: "alice", Domain: "example.com"},
+			2: {Id: 2, Username: "bob", Domain: "example.com"},
+			3: {Id: 3, Username: "carol", Domain: "example.com"},
+			4: {Id: 4, Username: "dave", Domain: "example.com"},
+			5: {Id: 5, Username: "BOB", Domain: "EXAMPLE.com"},
+		},
+	}
+}
+
+func TestExpandGroup(t *testing.T) {
+	g := newTestGroups()
+	names, err := expandGroup(1, g.groupMembers, g.userGet)
+	assert.Nil(t, err)
+	// Breadth first, each address once, disabled and deleted members skipped
+	assert.Equal(t, []string{"alice@example.com", "bob@example.com", "dave@example.com"}, names)
+	// The cycle back to staff is not followed
+	assert.Equal(t, []uint64{1, 2, 3, 4}, g.queried)
+
+	names, err = expandGroup(4, g.groupMembers, g.userGet)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bob@example.com"}, names)
+
+	failed := errors.New("database down")
+	_, err = expandGroup(1, g.groupMembers, func(id uint64) (*User, error) {
+		return nil, failed
+	})
+	assert.Equal(t, failed, err)
+}
+
+func TestExpandGroupOutsideMembers(t *testing.T) {
+	g := newTestGroups()
+	g.members[4] = append(g.members[4], &GroupMember{Address: "erin@example.org"},
+		&GroupMember{Address: "frank@example.org", Disabled: true})
+	g.members[3] = append(g.members[3], &GroupMember{Address: "Erin@Example.org"},
+		&GroupMember{Address: "grace@example.net"})
+
+	names, err := expandGroup(1, g.groupMembers, g.userGet)
+	assert.Nil(t, err)
+	// Outside addresses are taken as they are, without a user lookup
+	assert.Equal(t, []string{"alice@example.com", "bob@example.com", "dave@example.com",
+		"Erin@Example.org", "grace@example.net"}, names)
+}
+
+func TestNestedGroups(t *testing.T) {
+	g := newTestGroups()
+	nested, err := nestedGroups(2, g.nestedMembers)
+	assert.Nil(t, err)
+	assert.Equal(t, map[uint64]bool{4: true}, nested)
+
+	// Through the cycle staff ends up nested within itself
+	nested, err = nestedGroups(1, g.nestedMembers)
+	assert.Nil(t, err)
+	assert.Equal(t, map[uint64]bool{1: true, 2: true, 3: true, 4: true}, nested)
+}
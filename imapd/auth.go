@@ -0,0 +1,107 @@
+package imapd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/smtpd"
+)
+
+// loginHandler runs the LOGIN command.  As with POP3, logging in as
+// mailbox*user opens a shared mailbox as INBOX with the user's credentials.
+func (ses *Session) loginHandler(tag string, args []arg) {
+	if ses.loginDisabled() {
+		ses.logWarn("Refusing LOGIN before STARTTLS")
+		ses.no(tag, "[PRIVACYREQUIRED] Must issue STARTTLS first")
+		return
+	}
+	if len(args) != 2 {
+		ses.bad(tag, "LOGIN requires a user name and password")
+		return
+	}
+	name, ok := args[0].astring()
+	pass, ok2 := args[1].astring()
+	if !ok || !ok2 {
+		ses.bad(tag, "LOGIN requires a user name and password")
+		return
+	}
+	ses.logIn(tag, strings.Split(name, "@")[0], smtpd.PasswordCheck(ses.server.db, pass))
+}
+
+// authenticateHandler runs the AUTHENTICATE command with the PLAIN and LOGIN
+// mechanisms, taking an initial response per RFC 4959
+func (ses *Session) authenticateHandler(tag string, args []arg) {
+	if ses.loginDisabled() {
+		ses.logWarn("Refusing AUTHENTICATE before STARTTLS")
+		ses.no(tag, "[PRIVACYREQUIRED] Must issue STARTTLS first")
+		return
+	}
+	if len(args) == 0 || len(args) > 2 || args[0].isList {
+		ses.bad(tag, "AUTHENTICATE requires a mechanism and optional initial response")
+		return
+	}
+
+	var initial string
+	if len(args) == 2 {
+		initial = args[1].value
+	}
+	authz, name, pass, err := smtpd.SaslAuthenticate(args[0].value, initial, ses.challenge)
+	if err != nil {
+		if err == smtpd.ErrSaslMechanism {
+			ses.no(tag, err.Error())
+		} else if ses.sendError == nil {
+			ses.bad(tag, err.Error())
+		}
+		return
+	}
+	ses.logIn(tag, smtpd.SaslLogin(authz, name), smtpd.PasswordCheck(ses.server.db, pass))
+}
+
+// logIn opens name as INBOX once check accepts the credentials given for its
+// user.  name is a user, or mailbox*user to open a shared mailbox with the
+// user's credentials.
+func (ses *Session) logIn(tag string, name string, check func(user *db.User) (bool, error)) {
+	mailbox, login := smtpd.SplitLogin(name)
+
+	user, err := smtpd.LogIn(ses.server.db, ses.server.throttle, "IMAP", ses.remoteHost, login, check)
+	if err == smtpd.ErrThrottled {
+		ses.logWarn("Refusing login for %v - %v", login, err)
+		ses.no(tag, fmt.Sprintf("[UNAVAILABLE] %v", err))
+		return
+	}
+	if err != nil {
+		ses.logError("Failed to auth for %v - %v", login, err)
+		ses.no(tag, "[AUTHENTICATIONFAILED] Authentication failed")
+		return
+	}
+
+	rights, err := ses.server.db.MailboxRights(mailbox, user)
+	if err != nil || rights == nil || !rights.Read {
+		ses.logWarn("User %v may not read mailbox %v - %v", login, mailbox, err)
+		ses.no(tag, fmt.Sprintf("[AUTHORIZATIONFAILED] Permission denied for mailbox %v", mailbox))
+		return
+	}
+
+	ses.user = user
+	ses.inbox = mailbox
+	ses.canDelete = rights.Delete
+	ses.logInfo("Logged in as %v to mailbox %v", login, mailbox)
+	ses.enterState(AUTHENTICATED)
+	ses.ok(tag, fmt.Sprintf("[CAPABILITY %v] Logged in", ses.capabilities()))
+}
+
+// challenge sends a SASL challenge and reads the client's response
+func (ses *Session) challenge(text string) (string, error) {
+	ses.send("+ " + base64.StdEncoding.EncodeToString([]byte(text)))
+	line, err := ses.readLine()
+	if err != nil {
+		ses.sendError = err
+		return "", err
+	}
+	if line == "*" {
+		return "", smtpd.ErrSaslCancelled
+	}
+	return line, nil
+}
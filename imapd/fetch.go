@@ -0,0 +1,333 @@
+package imapd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/egggo/inbucket/smtpd"
+)
+
+// INTERNALDATE format, RFC 3501 date-time
+const DATE_TIME_FORMAT = "02-Jan-2006 15:04:05 -0700"
+
+// A fetchAtt is one data item a FETCH asks for
+type fetchAtt struct {
+	name    string   // UID, FLAGS, BODY etc, BODY.PEEK[] is BODY with peek set
+	peek    bool     // BODY.PEEK or RFC822.HEADER, which leave \Seen alone
+	bracket bool     // BODY[...] rather than BODY, the structure
+	section string   // Section text as echoed in the reply
+	path    []int    // Part numbers of the section
+	part    string   // HEADER, HEADER.FIELDS, HEADER.FIELDS.NOT, TEXT, MIME or empty
+	fields  []string // Header fields named by HEADER.FIELDS
+	partial bool     // Whether <offset.count> was given
+	offset  int
+	count   int
+}
+
+// macros expand to the attributes they stand for
+var macros = map[string][]string{
+	"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+	"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+	"FULL": {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"},
+}
+
+// parseFetchAtts parses the attributes of a FETCH, a macro, one attribute or
+// a list of attributes
+func parseFetchAtts(args []arg) ([]fetchAtt, error) {
+	if len(args) != 1 {
+		return nil, syntaxError("FETCH requires a sequence set and attributes")
+	}
+	var names []string
+	if args[0].isList {
+		for _, a := range args[0].list {
+			if a.isList || a.quoted {
+				return nil, syntaxError("Bad fetch attribute")
+			}
+			names = append(names, a.value)
+		}
+	} else if m, ok := macros[strings.ToUpper(args[0].value)]; ok && !args[0].quoted {
+		names = m
+	} else if !args[0].quoted {
+		names = []string{args[0].value}
+	}
+	if len(names) == 0 {
+		return nil, syntaxError("FETCH requires attributes")
+	}
+
+	atts := make([]fetchAtt, 0, len(names))
+	for _, name := range names {
+		att, err := parseFetchAtt(name)
+		if err != nil {
+			return nil, err
+		}
+		atts = append(atts, att)
+	}
+	return atts, nil
+}
+
+func parseFetchAtt(s string) (fetchAtt, error) {
+	bad := syntaxError(fmt.Sprintf("Bad fetch attribute %v", s))
+	i := strings.IndexByte(s, '[')
+	if i < 0 {
+		name := strings.ToUpper(s)
+		switch name {
+		case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY",
+			"BODYSTRUCTURE", "RFC822", "RFC822.TEXT":
+			return fetchAtt{name: name}, nil
+		case "RFC822.HEADER":
+			return fetchAtt{name: name, peek: true, part: "HEADER"}, nil
+		}
+		return fetchAtt{}, bad
+	}
+
+	att := fetchAtt{name: "BODY", bracket: true}
+	switch strings.ToUpper(s[:i]) {
+	case "BODY":
+	case "BODY.PEEK":
+		att.peek = true
+	default:
+		return att, bad
+	}
+	end := strings.LastIndex(s, "]")
+	if end < i {
+		return att, bad
+	}
+	if err := att.parseSection(s[i+1 : end]); err != nil {
+		return att, err
+	}
+
+	if rest := s[end+1:]; rest != "" {
+		// <offset.count>
+		if !strings.HasPrefix(rest, "<") || !strings.HasSuffix(rest, ">") {
+			return att, bad
+		}
+		nums := strings.Split(rest[1:len(rest)-1], ".")
+		if len(nums) != 2 {
+			return att, bad
+		}
+		offset, err := strconv.ParseUint(nums[0], 10, 31)
+		count, err2 := strconv.ParseUint(nums[1], 10, 31)
+		if err != nil || err2 != nil || count == 0 {
+			return att, bad
+		}
+		att.partial, att.offset, att.count = true, int(offset), int(count)
+	}
+	return att, nil
+}
+
+// parseSection parses section text such as 1.2.HEADER.FIELDS (FROM TO)
+func (att *fetchAtt) parseSection(s string) error {
+	bad := syntaxError(fmt.Sprintf("Bad section %v", s))
+	spec := s
+	if i := strings.IndexByte(s, '('); i >= 0 {
+		if !strings.HasSuffix(s, ")") {
+			return bad
+		}
+		spec = strings.TrimSpace(s[:i])
+		for _, f := range strings.Fields(s[i+1 : len(s)-1]) {
+			att.fields = append(att.fields, strings.Trim(f, "\""))
+		}
+		if len(att.fields) == 0 {
+			return bad
+		}
+	}
+
+	var names []string
+	if spec != "" {
+		for _, item := range strings.Split(spec, ".") {
+			if n, err := strconv.Atoi(item); err == nil && len(names) == 0 {
+				if n < 1 {
+					return bad
+				}
+				att.path = append(att.path, n)
+				continue
+			}
+			names = append(names, strings.ToUpper(item))
+		}
+	}
+	att.part = strings.Join(names, ".")
+
+	switch att.part {
+	case "", "HEADER", "TEXT":
+		if att.fields != nil {
+			return bad
+		}
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		if att.fields == nil {
+			return bad
+		}
+	case "MIME":
+		if len(att.path) == 0 || att.fields != nil {
+			return bad
+		}
+	default:
+		return bad
+	}
+
+	att.section = strings.ToUpper(spec)
+	if att.fields != nil {
+		att.section += " (" + strings.ToUpper(strings.Join(att.fields, " ")) + ")"
+	}
+	return nil
+}
+
+// needsBody reports whether att needs the message contents rather than just
+// what the index holds
+func (att fetchAtt) needsBody() bool {
+	switch att.name {
+	case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE":
+		return false
+	}
+	return true
+}
+
+// setsSeen reports whether fetching att sets the \Seen flag
+func (att fetchAtt) setsSeen() bool {
+	return !att.peek && (att.bracket || att.name == "RFC822" || att.name == "RFC822.TEXT")
+}
+
+func (ses *Session) fetchHandler(tag string, args []arg, uid bool) {
+	if len(args) < 2 {
+		ses.bad(tag, "FETCH requires a sequence set and attributes")
+		return
+	}
+	set, err := ses.parseSet(args[0], uid)
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	atts, err := parseFetchAtts(args[1:])
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	if uid {
+		// UID FETCH always tells the client the UID
+		atts = append([]fetchAtt{{name: "UID"}}, atts...)
+	}
+
+	for i, msg := range ses.messages {
+		if !ses.inSet(set, i, uid) {
+			continue
+		}
+		items, err := ses.fetchMessage(msg, atts)
+		if err != nil {
+			ses.logError("Failed to fetch %v - %v", msg, err)
+			ses.no(tag, "[SERVERBUG] Failed to read message")
+			return
+		}
+		ses.send(fmt.Sprintf("* %v FETCH (%v)", i+1, strings.Join(items, " ")))
+	}
+	ses.update(uid)
+	ses.ok(tag, "FETCH completed")
+}
+
+// fetchMessage formats the attributes atts of msg
+func (ses *Session) fetchMessage(msg smtpd.Message, atts []fetchAtt) ([]string, error) {
+	var root *mimePart
+	var raw string
+	seen := false
+	for _, att := range atts {
+		if att.needsBody() && root == nil {
+			r, err := msg.ReadRaw()
+			if err != nil {
+				return nil, err
+			}
+			raw = *r
+			root = parseMessage([]byte(raw))
+		}
+		if !ses.readOnly && att.setsSeen() && !seen && !smtpd.HasFlag(msg, `\Seen`) {
+			if err := smtpd.AddFlags(msg, `\Seen`); err != nil && err != smtpd.ErrNotExist {
+				return nil, err
+			}
+			seen = true
+		}
+	}
+
+	var items []string
+	sentUid, sentFlags := false, false
+	for _, att := range atts {
+		switch {
+		case att.name == "UID":
+			if !sentUid {
+				items = append(items, fmt.Sprintf("UID %v", msg.Uid()))
+			}
+			sentUid = true
+		case att.name == "FLAGS":
+			if !sentFlags {
+				items = append(items, "FLAGS "+ses.flagList(msg))
+			}
+			sentFlags = true
+		case att.name == "INTERNALDATE":
+			items = append(items, "INTERNALDATE "+quote(msg.Date().Format(DATE_TIME_FORMAT)))
+		case att.name == "RFC822.SIZE":
+			items = append(items, fmt.Sprintf("RFC822.SIZE %v", msg.Size()))
+		case att.name == "ENVELOPE":
+			items = append(items, "ENVELOPE "+root.envelope())
+		case att.name == "BODYSTRUCTURE":
+			items = append(items, "BODYSTRUCTURE "+root.bodyStructure(true))
+		case att.name == "RFC822":
+			items = append(items, "RFC822 "+literal(raw))
+		case att.name == "RFC822.HEADER":
+			items = append(items, "RFC822.HEADER "+literal(string(root.rawHeader)))
+		case att.name == "RFC822.TEXT":
+			items = append(items, "RFC822.TEXT "+literal(string(root.body)))
+		case att.bracket:
+			data := att.sectionData(root, raw)
+			name := "BODY[" + att.section + "]"
+			if att.partial {
+				name += fmt.Sprintf("<%v>", att.offset)
+				if att.offset >= len(data) {
+					data = ""
+				} else {
+					data = data[att.offset:]
+				}
+				if len(data) > att.count {
+					data = data[:att.count]
+				}
+			}
+			items = append(items, name+" "+literal(data))
+		default:
+			items = append(items, "BODY "+root.bodyStructure(false))
+		}
+	}
+	if seen && !sentFlags {
+		// The client should hear of the \Seen flag we set
+		items = append(items, "FLAGS "+ses.flagList(msg))
+	}
+	return items, nil
+}
+
+// sectionData returns the contents of the section att asks for, empty when
+// the message has no such part
+func (att fetchAtt) sectionData(root *mimePart, raw string) string {
+	if len(att.path) == 0 && att.part == "" {
+		return raw
+	}
+	p := root.section(att.path)
+	if p == nil {
+		return ""
+	}
+	if att.part == "" || att.part == "MIME" {
+		if att.part == "MIME" {
+			return string(p.rawHeader)
+		}
+		return string(p.body)
+	}
+	if len(att.path) > 0 {
+		// HEADER and TEXT of a part refer to the message it encapsulates
+		if p = p.message; p == nil {
+			return ""
+		}
+	}
+	switch att.part {
+	case "HEADER":
+		return string(p.rawHeader)
+	case "TEXT":
+		return string(p.body)
+	case "HEADER.FIELDS":
+		return string(p.headerFields(att.fields, false))
+	}
+	return string(p.headerFields(att.fields, true))
+}
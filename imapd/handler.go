@@ -0,0 +1,476 @@
+package imapd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+	"github.com/egggo/inbucket/smtpd"
+)
+
+type State int
+
+const (
+	NOT_AUTHENTICATED State = iota // The client must log in or start TLS
+	AUTHENTICATED                  // Logged in, no mailbox selected
+	SELECTED                       // A mailbox is selected
+	LOGOUT
+)
+
+func (s State) String() string {
+	switch s {
+	case NOT_AUTHENTICATED:
+		return "NOT_AUTHENTICATED"
+	case AUTHENTICATED:
+		return "AUTHENTICATED"
+	case SELECTED:
+		return "SELECTED"
+	case LOGOUT:
+		return "LOGOUT"
+	}
+	return "Unknown"
+}
+
+var commands = map[string]bool{
+	"CAPABILITY":   true,
+	"NOOP":         true,
+	"LOGOUT":       true,
+	"STARTTLS":     true,
+	"AUTHENTICATE": true,
+	"LOGIN":        true,
+	"SELECT":       true,
+	"EXAMINE":      true,
+	"CREATE":       true,
+	"DELETE":       true,
+	"RENAME":       true,
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"LIST":         true,
+	"LSUB":         true,
+	"STATUS":       true,
+	"APPEND":       true,
+	"CHECK":        true,
+	"CLOSE":        true,
+	"EXPUNGE":      true,
+	"SEARCH":       true,
+	"FETCH":        true,
+	"STORE":        true,
+	"COPY":         true,
+	"MOVE":         true,
+	"UID":          true,
+}
+
+// Limits on the literals of a command before the client has logged in, when
+// they can only hold a user name and password
+const (
+	MAX_AUTH_LITERALS      = 2
+	MAX_AUTH_LITERAL_BYTES = 4096
+)
+
+type Session struct {
+	server      *Server         // Reference to the server we belong to
+	id          int             // Session ID number
+	conn        net.Conn        // Our network connection
+	remoteHost  string          // IP address of client
+	sendError   error           // Used to bail out of read loop on send error
+	state       State           // Current session state
+	reader      *bufio.Reader   // Buffered reader for our net conn
+	tls         bool            // Whether STARTTLS has completed
+	user        *db.User        // Authenticated user
+	inbox       string          // Mailbox opened as INBOX, the user's or a shared one
+	canDelete   bool            // Whether the user may delete from inbox
+	mailbox     string          // INBOX or the folder selected
+	readOnly    bool            // Selected with EXAMINE or without delete rights
+	messages    []smtpd.Message // Messages of the selected mailbox by sequence number
+	uidValidity uint32          // UID validity of the selected mailbox
+	recent      map[uint32]bool // UIDs of messages arrived during the session
+}
+
+func NewSession(server *Server, id int, conn net.Conn) *Session {
+	reader := bufio.NewReader(conn)
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return &Session{server: server, id: id, conn: conn, state: NOT_AUTHENTICATED,
+		reader: reader, remoteHost: host}
+}
+
+func (ses *Session) String() string {
+	return fmt.Sprintf("Session{id: %v, state: %v}", ses.id, ses.state)
+}
+
+/* Session flow:
+ *  1. Send initial greeting
+ *  2. Receive tagged cmd
+ *  3. If good cmd, respond, optionally change state
+ *  4. If bad cmd, respond error
+ *  5. Goto 2
+ */
+func (s *Server) startSession(id int, conn net.Conn) {
+	log.LogInfo("IMAP connection from %v, starting session <%v>", conn.RemoteAddr(), id)
+	ses := NewSession(s, id, conn)
+	defer func() {
+		// ses.conn rather than conn, STARTTLS may have replaced it
+		ses.conn.Close()
+		s.waitgroup.Done()
+	}()
+
+	ses.send(fmt.Sprintf("* OK [CAPABILITY %v] Inbucket IMAP4rev1 server ready on %v",
+		ses.capabilities(), s.domain))
+
+	// This is our command reading loop
+	for ses.state != LOGOUT && ses.sendError == nil {
+		args, err := ses.readCommand()
+		if err == nil {
+			if len(args) == 0 {
+				ses.send("* BAD Speak up")
+				continue
+			}
+			if args[0].isList || args[0].quoted || args[0].value == "*" ||
+				args[0].value == "+" {
+				ses.send("* BAD Syntax error, bad tag")
+				continue
+			}
+			tag := args[0].value
+			if len(args) < 2 || args[1].isList || args[1].quoted {
+				ses.bad(tag, "Syntax error, missing command")
+				continue
+			}
+			cmd := strings.ToUpper(args[1].value)
+			args = args[2:]
+			if !commands[cmd] {
+				ses.bad(tag, fmt.Sprintf("Syntax error, %v command unrecognized", cmd))
+				ses.logWarn("Unrecognized command: %v", cmd)
+				continue
+			}
+
+			// Commands we handle in any state
+			switch cmd {
+			case "CAPABILITY":
+				ses.send("* CAPABILITY " + ses.capabilities())
+				ses.ok(tag, "CAPABILITY completed")
+				continue
+			case "NOOP":
+				if ses.state == SELECTED {
+					ses.update(true)
+				}
+				ses.ok(tag, "NOOP completed")
+				continue
+			case "LOGOUT":
+				ses.send("* BYE Goodnight and good luck")
+				ses.ok(tag, "LOGOUT completed")
+				ses.enterState(LOGOUT)
+				continue
+			}
+
+			// Send command to handler for current state
+			switch ses.state {
+			case NOT_AUTHENTICATED:
+				ses.notAuthenticatedHandler(tag, cmd, args)
+				continue
+			case AUTHENTICATED:
+				ses.authenticatedHandler(tag, cmd, args)
+				continue
+			case SELECTED:
+				ses.selectedHandler(tag, cmd, args)
+				continue
+			}
+			ses.logError("Session entered unexpected state %v", ses.state)
+			break
+		} else {
+			if serr, ok := err.(syntaxError); ok {
+				tag := "*"
+				if len(args) > 0 && !args[0].isList && !args[0].quoted {
+					tag = args[0].value
+				}
+				if serr == errTooBig {
+					ses.no(tag, "Literal too big")
+				} else {
+					ses.bad(tag, fmt.Sprintf("Syntax error, %v", serr))
+				}
+				continue
+			}
+			// readCommand() returned an error
+			if err == io.EOF {
+				switch ses.state {
+				case NOT_AUTHENTICATED:
+					// EOF is common here
+					ses.logInfo("Client closed connection (state %v)", ses.state)
+				default:
+					ses.logWarn("Got EOF while in state %v", ses.state)
+				}
+				break
+			}
+			// not an EOF
+			ses.logWarn("Connection error: %v", err)
+			if netErr, ok := err.(net.Error); ok {
+				if netErr.Timeout() {
+					ses.send("* BYE Autologout; idle for too long")
+					break
+				}
+			}
+			ses.send("* BYE Connection error, sorry")
+			break
+		}
+	}
+	if ses.sendError != nil {
+		ses.logWarn("Network send error: %v", ses.sendError)
+	}
+	ses.logInfo("Closing connection")
+}
+
+// NOT_AUTHENTICATED state
+func (ses *Session) notAuthenticatedHandler(tag string, cmd string, args []arg) {
+	switch cmd {
+	case "STARTTLS":
+		if ses.server.tlsConfig == nil || ses.tls {
+			ses.bad(tag, "STARTTLS not available")
+			return
+		}
+		ses.ok(tag, "Begin TLS negotiation now")
+		conn := tls.Server(ses.conn, ses.server.tlsConfig)
+		if err := conn.SetDeadline(ses.nextDeadline()); err != nil {
+			ses.sendError = err
+			return
+		}
+		if err := conn.Handshake(); err != nil {
+			ses.logWarn("TLS handshake failed: %v", err)
+			ses.enterState(LOGOUT)
+			return
+		}
+		ses.conn = conn
+		ses.reader = bufio.NewReader(conn)
+		ses.tls = true
+	case "LOGIN":
+		ses.loginHandler(tag, args)
+	case "AUTHENTICATE":
+		ses.authenticateHandler(tag, args)
+	default:
+		ses.ooSeq(tag, cmd)
+	}
+}
+
+// AUTHENTICATED state, these commands are also valid with a mailbox selected
+func (ses *Session) authenticatedHandler(tag string, cmd string, args []arg) {
+	switch cmd {
+	case "SELECT", "EXAMINE":
+		ses.selectHandler(tag, cmd, args)
+	case "CREATE":
+		ses.createHandler(tag, args)
+	case "DELETE":
+		ses.deleteHandler(tag, args)
+	case "RENAME":
+		ses.renameHandler(tag, args)
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		// Every mailbox is taken as subscribed
+		if len(args) != 1 {
+			ses.bad(tag, fmt.Sprintf("%v requires a mailbox name", cmd))
+			return
+		}
+		name, err := mailboxName(args[0])
+		if err != nil {
+			ses.bad(tag, err.Error())
+			return
+		}
+		if _, err = ses.openMailbox(name); err != nil {
+			ses.folderError(tag, cmd, name, err)
+			return
+		}
+		ses.ok(tag, cmd+" completed")
+	case "LIST", "LSUB":
+		ses.listHandler(tag, cmd, args)
+	case "STATUS":
+		ses.statusHandler(tag, args)
+	case "APPEND":
+		ses.appendHandler(tag, args)
+	default:
+		ses.ooSeq(tag, cmd)
+	}
+}
+
+// SELECTED state
+func (ses *Session) selectedHandler(tag string, cmd string, args []arg) {
+	uid := false
+	if cmd == "UID" {
+		if len(args) == 0 || args[0].isList || args[0].quoted {
+			ses.bad(tag, "UID requires a command")
+			return
+		}
+		cmd = strings.ToUpper(args[0].value)
+		args = args[1:]
+		switch cmd {
+		case "FETCH", "SEARCH", "STORE", "COPY", "MOVE":
+			uid = true
+		default:
+			ses.bad(tag, fmt.Sprintf("UID %v is not supported", cmd))
+			return
+		}
+	}
+
+	switch cmd {
+	case "CHECK":
+		ses.update(true)
+		ses.ok(tag, "CHECK completed")
+	case "CLOSE":
+		if !ses.readOnly {
+			// CLOSE expunges without telling the client
+			if err := ses.expunge(); err != nil {
+				ses.logWarn("Failed to expunge %v on close - %v", ses.mailbox, err)
+			}
+		}
+		ses.unselect()
+		ses.ok(tag, "CLOSE completed")
+	case "EXPUNGE":
+		if ses.readOnly {
+			ses.no(tag, "[READ-ONLY] Mailbox is read only")
+			return
+		}
+		if err := ses.expunge(); err != nil {
+			if err == smtpd.ErrMailboxLocked {
+				ses.no(tag, "[INUSE] Mailbox is in use by another session")
+				return
+			}
+			ses.logError("Failed to expunge %v - %v", ses.mailbox, err)
+			ses.no(tag, "[SERVERBUG] Failed to expunge")
+			return
+		}
+		ses.update(true)
+		ses.ok(tag, "EXPUNGE completed")
+	case "SEARCH":
+		ses.searchHandler(tag, args, uid)
+	case "FETCH":
+		ses.fetchHandler(tag, args, uid)
+	case "STORE":
+		ses.storeHandler(tag, args, uid)
+	case "COPY":
+		ses.copyHandler(tag, args, uid)
+	case "MOVE":
+		ses.moveHandler(tag, args, uid)
+	default:
+		ses.authenticatedHandler(tag, cmd, args)
+	}
+}
+
+// capabilities lists what we support, which depends on the session's state
+func (ses *Session) capabilities() string {
+	caps := []string{"IMAP4rev1", "SASL-IR", "MOVE"}
+	if ses.state == NOT_AUTHENTICATED {
+		if ses.server.tlsConfig != nil && !ses.tls {
+			caps = append(caps, "STARTTLS")
+		}
+		if ses.loginDisabled() {
+			caps = append(caps, "LOGINDISABLED")
+		} else {
+			caps = append(caps, "AUTH=PLAIN", "AUTH=LOGIN")
+		}
+	} else {
+		// Literals are limited until login, so only then may clients send
+		// them without waiting
+		caps = append(caps, "LITERAL+")
+	}
+	return strings.Join(caps, " ")
+}
+
+// loginDisabled reports whether the client must issue STARTTLS before
+// sending credentials
+func (ses *Session) loginDisabled() bool {
+	return ses.server.requireTLS && !ses.tls
+}
+
+func (ses *Session) enterState(state State) {
+	ses.state = state
+	ses.logTrace("Entering state %v", state)
+}
+
+// Calculate the next read or write deadline based on maxIdleSeconds
+func (ses *Session) nextDeadline() time.Time {
+	return time.Now().Add(time.Duration(ses.server.maxIdleSeconds) * time.Second)
+}
+
+// Send requested message, store errors in Session.sendError
+func (ses *Session) send(msg string) {
+	if err := ses.conn.SetWriteDeadline(ses.nextDeadline()); err != nil {
+		ses.sendError = err
+		return
+	}
+	if _, err := fmt.Fprint(ses.conn, msg+"\r\n"); err != nil {
+		ses.sendError = err
+		ses.logWarn("Failed to send: '%v'", msg)
+		return
+	}
+	if len(msg) > 200 {
+		// Keep message contents out of the log
+		msg = msg[:200] + "..."
+	}
+	ses.logTrace(">> %v >>", msg)
+}
+
+func (ses *Session) ok(tag string, msg string) {
+	ses.send(tag + " OK " + msg)
+}
+
+func (ses *Session) no(tag string, msg string) {
+	ses.send(tag + " NO " + msg)
+}
+
+func (ses *Session) bad(tag string, msg string) {
+	ses.send(tag + " BAD " + msg)
+}
+
+// Reads a command and its arguments
+func (ses *Session) readCommand() ([]arg, error) {
+	if err := ses.conn.SetReadDeadline(ses.nextDeadline()); err != nil {
+		return nil, err
+	}
+	maxLiteral, maxLiterals := ses.server.maxMessageBytes, 0
+	if ses.state == NOT_AUTHENTICATED {
+		maxLiteral, maxLiterals = MAX_AUTH_LITERAL_BYTES, MAX_AUTH_LITERALS
+	}
+	args, err := readCommand(ses.reader, maxLiteral, maxLiterals, func() {
+		ses.send("+ Ready for literal data")
+	})
+	if err == nil && len(args) > 1 {
+		// Arguments may hold credentials or whole messages, keep them out
+		// of the log
+		ses.logTrace("<< %v %v (%v arguments) <<", args[0].value, args[1].value, len(args)-2)
+	}
+	return args, err
+}
+
+// readLine reads a line that is not a command, such as a SASL response
+func (ses *Session) readLine() (string, error) {
+	if err := ses.conn.SetReadDeadline(ses.nextDeadline()); err != nil {
+		return "", err
+	}
+	line, err := ses.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (ses *Session) ooSeq(tag string, cmd string) {
+	ses.bad(tag, fmt.Sprintf("Command %v is not valid in state %v", cmd, ses.state))
+	ses.logWarn("Wasn't expecting %v here", cmd)
+}
+
+// Session specific logging methods
+func (ses *Session) logTrace(msg string, args ...interface{}) {
+	log.LogTrace("IMAP[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
+
+func (ses *Session) logInfo(msg string, args ...interface{}) {
+	log.LogInfo("IMAP[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
+
+func (ses *Session) logWarn(msg string, args ...interface{}) {
+	log.LogWarn("IMAP[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
+
+func (ses *Session) logError(msg string, args ...interface{}) {
+	log.LogError("IMAP[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
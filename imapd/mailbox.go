@@ -0,0 +1,776 @@
+package imapd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/egggo/inbucket/smtpd"
+)
+
+// mailboxName reads a mailbox name argument, INBOX in any case is given as
+// INBOX and the folders of the user's mailbox by their names
+func mailboxName(a arg) (string, error) {
+	s, ok := a.astring()
+	if !ok {
+		return "", syntaxError("Expected a mailbox name")
+	}
+	name, err := decodeMailbox(s)
+	if err != nil {
+		return "", err
+	}
+	if smtpd.IsInbox(name) {
+		return smtpd.INBOX, nil
+	}
+	return name, nil
+}
+
+// openMailbox opens the user's mailbox as INBOX, or one of its folders
+func (ses *Session) openMailbox(name string) (smtpd.Mailbox, error) {
+	inbox, err := ses.server.dataStore.MailboxFor(ses.inbox)
+	if err != nil {
+		return nil, err
+	}
+	return inbox.Folder(name)
+}
+
+// folderError answers a command that failed on a mailbox
+func (ses *Session) folderError(tag string, cmd string, name string, err error) {
+	switch err {
+	case smtpd.ErrFolderNotExist:
+		ses.no(tag, "[NONEXISTENT] No such mailbox")
+	case smtpd.ErrFolderExists:
+		ses.no(tag, "[ALREADYEXISTS] Mailbox already exists")
+	case smtpd.ErrBadFolderName:
+		ses.no(tag, "[CANNOT] Invalid mailbox name")
+	default:
+		ses.logError("%v failed for %v - %v", cmd, name, err)
+		ses.no(tag, fmt.Sprintf("[SERVERBUG] %v failed", cmd))
+	}
+}
+
+func (ses *Session) selectHandler(tag string, cmd string, args []arg) {
+	// A failed SELECT leaves no mailbox selected
+	ses.unselect()
+	if len(args) != 1 || args[0].isList {
+		ses.bad(tag, fmt.Sprintf("%v requires a mailbox name", cmd))
+		return
+	}
+	name, err := mailboxName(args[0])
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	mb, err := ses.openMailbox(name)
+	if err != nil {
+		ses.folderError(tag, cmd, name, err)
+		return
+	}
+	messages, err := mb.GetMessages()
+	var validity, next uint32
+	if err == nil {
+		validity, err = mb.UidValidity()
+	}
+	if err == nil {
+		next, err = mb.UidNext()
+	}
+	if err != nil {
+		ses.logError("Failed to load messages for %v - %v", name, err)
+		ses.no(tag, "[SERVERBUG] Failed to open mailbox")
+		return
+	}
+
+	ses.mailbox = name
+	ses.readOnly = cmd == "EXAMINE" || !ses.canDelete
+	ses.messages = messages
+	ses.uidValidity = validity
+	ses.recent = make(map[uint32]bool)
+	ses.enterState(SELECTED)
+
+	ses.send(fmt.Sprintf("* FLAGS (%v)", strings.Join(mailboxFlags(messages), " ")))
+	ses.send(fmt.Sprintf("* OK [PERMANENTFLAGS (%v \\*)] Flags are kept",
+		strings.Join(smtpd.SystemFlags, " ")))
+	ses.send(fmt.Sprintf("* %v EXISTS", len(messages)))
+	ses.send("* 0 RECENT")
+	for i, msg := range messages {
+		if !smtpd.HasFlag(msg, `\Seen`) {
+			ses.send(fmt.Sprintf("* OK [UNSEEN %v] First unseen message", i+1))
+			break
+		}
+	}
+	ses.send(fmt.Sprintf("* OK [UIDVALIDITY %v] UIDs valid", validity))
+	ses.send(fmt.Sprintf("* OK [UIDNEXT %v] Predicted next UID", next))
+	if ses.readOnly {
+		ses.ok(tag, fmt.Sprintf("[READ-ONLY] %v completed", cmd))
+	} else {
+		ses.ok(tag, fmt.Sprintf("[READ-WRITE] %v completed", cmd))
+	}
+}
+
+// unselect returns to the AUTHENTICATED state
+func (ses *Session) unselect() {
+	ses.mailbox = ""
+	ses.messages = nil
+	ses.recent = nil
+	if ses.state == SELECTED {
+		ses.enterState(AUTHENTICATED)
+	}
+}
+
+// update tells the client about messages delivered to, or removed from, the
+// selected mailbox by others.  RFC 3501 forbids EXPUNGE responses during
+// FETCH, STORE and SEARCH, so removals are only reported when expunge is true.
+func (ses *Session) update(expunge bool) {
+	mb, err := ses.openMailbox(ses.mailbox)
+	if err != nil {
+		ses.logError("Failed to open mailbox for %v - %v", ses.mailbox, err)
+		return
+	}
+	fresh, err := mb.GetMessages()
+	var validity uint32
+	if err == nil {
+		validity, err = mb.UidValidity()
+	}
+	if err != nil {
+		ses.logError("Failed to load messages for %v - %v", ses.mailbox, err)
+		return
+	}
+
+	if validity != ses.uidValidity {
+		// The mailbox was emptied and created anew, none of our UIDs stand
+		if !expunge {
+			return
+		}
+		for i := len(ses.messages); i > 0; i-- {
+			ses.send(fmt.Sprintf("* %v EXPUNGE", i))
+		}
+		ses.messages = nil
+		ses.uidValidity = validity
+		ses.send(fmt.Sprintf("* OK [UIDVALIDITY %v] UIDs valid", validity))
+	}
+
+	byUid := make(map[uint32]smtpd.Message)
+	for _, msg := range fresh {
+		byUid[msg.Uid()] = msg
+	}
+	var lastUid uint32
+	kept := ses.messages[:0]
+	for _, msg := range ses.messages {
+		uid := msg.Uid()
+		lastUid = uid
+		if f, ok := byUid[uid]; ok {
+			// The newer copy reads from an up to date index, with any flags
+			// changed by others
+			if !sameFlags(msg.Flags(), f.Flags()) {
+				ses.send(fmt.Sprintf("* %v FETCH (FLAGS %v)", len(kept)+1, ses.flagList(f)))
+			}
+			kept = append(kept, f)
+		} else if expunge {
+			ses.send(fmt.Sprintf("* %v EXPUNGE", len(kept)+1))
+			delete(ses.recent, uid)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	exists := len(kept)
+	for _, msg := range fresh {
+		if msg.Uid() > lastUid {
+			kept = append(kept, msg)
+			ses.recent[msg.Uid()] = true
+		}
+	}
+	changed := len(kept) != exists || len(kept) != len(ses.messages)
+	ses.messages = kept
+	if changed {
+		ses.send(fmt.Sprintf("* %v EXISTS", len(ses.messages)))
+		ses.send(fmt.Sprintf("* %v RECENT", len(ses.recent)))
+	}
+}
+
+// expunge deletes the messages flagged \Deleted, update then reports them
+func (ses *Session) expunge() error {
+	mb, err := ses.openMailbox(ses.mailbox)
+	if err != nil {
+		return err
+	}
+	if err = mb.Lock(fmt.Sprintf("IMAP session %v", ses.id)); err != nil {
+		return err
+	}
+	defer mb.Unlock()
+
+	// Delete through a fresh index, so we don't drop messages delivered since
+	// our last look
+	messages, err := mb.GetMessages()
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if smtpd.HasFlag(msg, `\Deleted`) {
+			ses.logTrace("Deleting %v", msg)
+			if err = msg.Delete(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ses *Session) listHandler(tag string, cmd string, args []arg) {
+	if len(args) != 2 {
+		ses.bad(tag, fmt.Sprintf("%v requires a reference and mailbox name", cmd))
+		return
+	}
+	ref, ok := args[0].astring()
+	pattern, ok2 := args[1].astring()
+	if !ok || !ok2 {
+		ses.bad(tag, fmt.Sprintf("%v requires a reference and mailbox name", cmd))
+		return
+	}
+	if pattern == "" && cmd == "LIST" {
+		// The client wants our hierarchy delimiter
+		ses.send(`* LIST (\Noselect) "/" ""`)
+		ses.ok(tag, cmd+" completed")
+		return
+	}
+	pattern, err := decodeMailbox(ref + pattern)
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	inbox, err := ses.server.dataStore.MailboxFor(ses.inbox)
+	var folders []string
+	if err == nil {
+		folders, err = inbox.Folders()
+	}
+	if err != nil {
+		ses.logError("Failed to list folders of %v - %v", ses.inbox, err)
+		ses.no(tag, fmt.Sprintf("[SERVERBUG] %v failed", cmd))
+		return
+	}
+
+	if match(strings.ToUpper(pattern), smtpd.INBOX) {
+		ses.send(fmt.Sprintf(`* %v () "/" INBOX`, cmd))
+	}
+	selectable := hierarchy(folders)
+	names := make([]string, 0, len(selectable))
+	for name := range selectable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !match(pattern, name) {
+			continue
+		}
+		attrs := ""
+		if !selectable[name] {
+			attrs = `\Noselect`
+		}
+		ses.send(fmt.Sprintf(`* %v (%v) "/" %v`, cmd, attrs, quote(encodeMailbox(name))))
+	}
+	ses.ok(tag, cmd+" completed")
+}
+
+// hierarchy maps the folders and the levels above them to whether they may be
+// selected, the levels left behind when a folder with folders beneath it is
+// deleted may not
+func hierarchy(folders []string) map[string]bool {
+	selectable := make(map[string]bool)
+	for _, folder := range folders {
+		selectable[folder] = true
+		for i := strings.LastIndex(folder, "/"); i > 0; i = strings.LastIndex(folder[:i], "/") {
+			if _, ok := selectable[folder[:i]]; !ok {
+				selectable[folder[:i]] = false
+			}
+		}
+	}
+	return selectable
+}
+
+func (ses *Session) createHandler(tag string, args []arg) {
+	if len(args) != 1 || args[0].isList {
+		ses.bad(tag, "CREATE requires a mailbox name")
+		return
+	}
+	name, err := mailboxName(args[0])
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	// A trailing delimiter only says the client means to create folders
+	// beneath it
+	name = strings.TrimSuffix(name, "/")
+	inbox, err := ses.server.dataStore.MailboxFor(ses.inbox)
+	if err == nil {
+		_, err = inbox.CreateFolder(name)
+	}
+	if err != nil {
+		ses.folderError(tag, "CREATE", name, err)
+		return
+	}
+	ses.ok(tag, "CREATE completed")
+}
+
+func (ses *Session) deleteHandler(tag string, args []arg) {
+	if len(args) != 1 || args[0].isList {
+		ses.bad(tag, "DELETE requires a mailbox name")
+		return
+	}
+	if !ses.canDelete {
+		ses.no(tag, "[NOPERM] Permission denied")
+		return
+	}
+	name, err := mailboxName(args[0])
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	if name == smtpd.INBOX {
+		ses.no(tag, "[CANNOT] INBOX cannot be deleted")
+		return
+	}
+	inbox, err := ses.server.dataStore.MailboxFor(ses.inbox)
+	if err == nil {
+		err = inbox.DeleteFolder(name)
+	}
+	if err != nil {
+		ses.folderError(tag, "DELETE", name, err)
+		return
+	}
+	ses.ok(tag, "DELETE completed")
+}
+
+// renameHandler renames a folder, renaming INBOX moves its messages to a new
+// folder and leaves it empty as RFC 3501 asks
+func (ses *Session) renameHandler(tag string, args []arg) {
+	if len(args) != 2 || args[0].isList || args[1].isList {
+		ses.bad(tag, "RENAME requires two mailbox names")
+		return
+	}
+	if !ses.canDelete {
+		ses.no(tag, "[NOPERM] Permission denied")
+		return
+	}
+	name, err := mailboxName(args[0])
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	newName, err := mailboxName(args[1])
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	if newName == smtpd.INBOX {
+		ses.no(tag, "[ALREADYEXISTS] Mailbox already exists")
+		return
+	}
+	inbox, err := ses.server.dataStore.MailboxFor(ses.inbox)
+	if err != nil {
+		ses.folderError(tag, "RENAME", name, err)
+		return
+	}
+	if name != smtpd.INBOX {
+		if err = inbox.RenameFolder(name, newName); err != nil {
+			ses.folderError(tag, "RENAME", name, err)
+			return
+		}
+		ses.ok(tag, "RENAME completed")
+		return
+	}
+
+	folder, err := inbox.CreateFolder(newName)
+	var messages []smtpd.Message
+	if err == nil {
+		messages, err = inbox.GetMessages()
+	}
+	for _, msg := range messages {
+		if err != nil {
+			break
+		}
+		_, err = inbox.MoveMessage(msg.Id(), folder)
+	}
+	if err != nil {
+		ses.folderError(tag, "RENAME", name, err)
+		return
+	}
+	if ses.state == SELECTED {
+		ses.update(true)
+	}
+	ses.ok(tag, "RENAME completed")
+}
+
+func (ses *Session) statusHandler(tag string, args []arg) {
+	if len(args) != 2 || args[0].isList || !args[1].isList {
+		ses.bad(tag, "STATUS requires a mailbox name and list of items")
+		return
+	}
+	name, err := mailboxName(args[0])
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	mb, err := ses.openMailbox(name)
+	if err != nil {
+		ses.folderError(tag, "STATUS", name, err)
+		return
+	}
+	messages, err := mb.GetMessages()
+	if err != nil {
+		ses.logError("Failed to load messages for %v - %v", name, err)
+		ses.no(tag, "[SERVERBUG] Failed to open mailbox")
+		return
+	}
+
+	var items []string
+	for _, item := range args[1].list {
+		var value uint32
+		switch strings.ToUpper(item.value) {
+		case "MESSAGES":
+			value = uint32(len(messages))
+		case "RECENT":
+			if name == ses.mailbox {
+				value = uint32(len(ses.recent))
+			}
+		case "UIDNEXT":
+			value, err = mb.UidNext()
+		case "UIDVALIDITY":
+			value, err = mb.UidValidity()
+		case "UNSEEN":
+			for _, msg := range messages {
+				if !smtpd.HasFlag(msg, `\Seen`) {
+					value++
+				}
+			}
+		default:
+			ses.bad(tag, fmt.Sprintf("Unknown status item %v", item.value))
+			return
+		}
+		if err != nil {
+			ses.logError("Failed to read UIDs of %v - %v", name, err)
+			ses.no(tag, "[SERVERBUG] Failed to read mailbox status")
+			return
+		}
+		items = append(items, fmt.Sprintf("%v %v", strings.ToUpper(item.value), value))
+	}
+	ses.send(fmt.Sprintf("* STATUS %v (%v)", quote(encodeMailbox(name)),
+		strings.Join(items, " ")))
+	ses.ok(tag, "STATUS completed")
+}
+
+// appendHandler stores a message the client uploads, the file store dates it
+// when stored rather than with any date-time the client gives
+func (ses *Session) appendHandler(tag string, args []arg) {
+	if len(args) < 2 || len(args) > 4 || args[0].isList || args[len(args)-1].isList {
+		ses.bad(tag, "APPEND requires a mailbox name and message")
+		return
+	}
+	var flags []string
+	if args[1].isList {
+		var err error
+		if flags, err = parseFlags(args[1].list); err != nil {
+			ses.bad(tag, err.Error())
+			return
+		}
+	}
+	name, err := mailboxName(args[0])
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	mb, err := ses.openMailbox(name)
+	if err != nil {
+		if err == smtpd.ErrFolderNotExist {
+			ses.no(tag, "[TRYCREATE] No such mailbox")
+		} else {
+			ses.folderError(tag, "APPEND", name, err)
+		}
+		return
+	}
+
+	if err = storeMessage(mb, []byte(args[len(args)-1].value), flags); err != nil {
+		ses.logError("Failed to append to %v - %v", name, err)
+		ses.no(tag, "[SERVERBUG] Failed to store message")
+		return
+	}
+	if ses.state == SELECTED {
+		ses.update(true)
+	}
+	ses.ok(tag, "APPEND completed")
+}
+
+func (ses *Session) copyHandler(tag string, args []arg, uid bool) {
+	if len(args) != 2 || args[1].isList {
+		ses.bad(tag, "COPY requires a sequence set and mailbox name")
+		return
+	}
+	set, err := ses.parseSet(args[0], uid)
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	name, err := mailboxName(args[1])
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	mb, err := ses.openMailbox(name)
+	if err != nil {
+		if err == smtpd.ErrFolderNotExist {
+			ses.no(tag, "[TRYCREATE] No such mailbox")
+		} else {
+			ses.folderError(tag, "COPY", name, err)
+		}
+		return
+	}
+
+	for i, msg := range ses.messages {
+		if !ses.inSet(set, i, uid) {
+			continue
+		}
+		raw, err := msg.ReadRaw()
+		if err == nil {
+			err = storeMessage(mb, []byte(*raw), msg.Flags())
+		}
+		if err != nil {
+			ses.logError("Failed to copy %v to %v - %v", msg, name, err)
+			ses.no(tag, "[SERVERBUG] Failed to copy messages")
+			return
+		}
+	}
+	ses.update(true)
+	ses.ok(tag, "COPY completed")
+}
+
+// moveHandler moves messages to another mailbox (RFC 6851), they are gone
+// from the selected one as if expunged
+func (ses *Session) moveHandler(tag string, args []arg, uid bool) {
+	if len(args) != 2 || args[1].isList {
+		ses.bad(tag, "MOVE requires a sequence set and mailbox name")
+		return
+	}
+	if ses.readOnly {
+		ses.no(tag, "[READ-ONLY] Mailbox is read only")
+		return
+	}
+	set, err := ses.parseSet(args[0], uid)
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	name, err := mailboxName(args[1])
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	if name == ses.mailbox {
+		ses.no(tag, "[CANNOT] Messages are already in that mailbox")
+		return
+	}
+	dest, err := ses.openMailbox(name)
+	if err != nil {
+		if err == smtpd.ErrFolderNotExist {
+			ses.no(tag, "[TRYCREATE] No such mailbox")
+		} else {
+			ses.folderError(tag, "MOVE", name, err)
+		}
+		return
+	}
+	mb, err := ses.openMailbox(ses.mailbox)
+	if err == nil {
+		err = mb.Lock(fmt.Sprintf("IMAP session %v", ses.id))
+	}
+	if err != nil {
+		if err == smtpd.ErrMailboxLocked {
+			ses.no(tag, "[INUSE] Mailbox is in use by another session")
+		} else {
+			ses.folderError(tag, "MOVE", ses.mailbox, err)
+		}
+		return
+	}
+	defer mb.Unlock()
+
+	// Stop at the first failure, the messages moved before it are still
+	// reported
+	var failed error
+	kept := make([]smtpd.Message, 0, len(ses.messages))
+	for i, msg := range ses.messages {
+		if failed == nil && ses.inSet(set, i, uid) {
+			_, err := mb.MoveMessage(msg.Id(), dest)
+			if err == nil || err == smtpd.ErrNotExist {
+				ses.send(fmt.Sprintf("* %v EXPUNGE", len(kept)+1))
+				delete(ses.recent, msg.Uid())
+				continue
+			}
+			failed = err
+		}
+		kept = append(kept, msg)
+	}
+	ses.messages = kept
+	if failed != nil {
+		ses.logError("Failed to move messages to %v - %v", name, failed)
+		ses.no(tag, "[SERVERBUG] Failed to move messages")
+		return
+	}
+	ses.update(true)
+	ses.ok(tag, "MOVE completed")
+}
+
+// storeMessage adds raw to mb with flags set
+func storeMessage(mb smtpd.Mailbox, raw []byte, flags []string) error {
+	msg, err := mb.NewMessage()
+	if err != nil {
+		return err
+	}
+	if err = msg.SetFlags(flags); err != nil {
+		return err
+	}
+	if err = msg.Append(raw); err != nil {
+		return err
+	}
+	return msg.Close()
+}
+
+func (ses *Session) storeHandler(tag string, args []arg, uid bool) {
+	if len(args) < 3 || args[1].isList {
+		ses.bad(tag, "STORE requires a sequence set, item and flags")
+		return
+	}
+	if ses.readOnly {
+		ses.no(tag, "[READ-ONLY] Mailbox is read only")
+		return
+	}
+	set, err := ses.parseSet(args[0], uid)
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+	item := strings.ToUpper(args[1].value)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS" {
+		ses.bad(tag, fmt.Sprintf("Unknown store item %v", args[1].value))
+		return
+	}
+	list := args[2:]
+	if len(list) == 1 && list[0].isList {
+		list = list[0].list
+	}
+	flags, err := parseFlags(list)
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+
+	for i, msg := range ses.messages {
+		if !ses.inSet(set, i, uid) {
+			continue
+		}
+		switch item {
+		case "FLAGS":
+			err = msg.SetFlags(flags)
+		case "+FLAGS":
+			err = smtpd.AddFlags(msg, flags...)
+		case "-FLAGS":
+			err = smtpd.RemoveFlags(msg, flags...)
+		}
+		if err == smtpd.ErrNotExist {
+			// Expunged by another session, RFC 3501 lets us carry on
+			continue
+		}
+		if err != nil {
+			ses.logError("Failed to store flags of %v - %v", msg, err)
+			ses.no(tag, "[SERVERBUG] Failed to store flags")
+			return
+		}
+		if !silent {
+			response := "FLAGS " + ses.flagList(msg)
+			if uid {
+				response = fmt.Sprintf("UID %v %v", msg.Uid(), response)
+			}
+			ses.send(fmt.Sprintf("* %v FETCH (%v)", i+1, response))
+		}
+	}
+	ses.update(uid)
+	ses.ok(tag, "STORE completed")
+}
+
+// parseFlags checks a list of flags, putting system flags in their usual case
+func parseFlags(list []arg) ([]string, error) {
+	flags := make([]string, 0, len(list))
+	for _, a := range list {
+		if a.isList || a.quoted || a.value == "" {
+			return nil, syntaxError("Flags must be atoms")
+		}
+		flags = append(flags, a.value)
+	}
+	flags, err := smtpd.CanonicalFlags(flags)
+	if err != nil {
+		return nil, syntaxError("Flags must be system flags or keywords, \\Recent may not be set")
+	}
+	return flags, nil
+}
+
+// mailboxFlags lists the system flags and the keywords in use in messages
+func mailboxFlags(messages []smtpd.Message) []string {
+	flags := append([]string{}, smtpd.SystemFlags...)
+	for _, msg := range messages {
+		for _, flag := range msg.Flags() {
+			if !strings.HasPrefix(flag, `\`) && !containsFold(flags, flag) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	return flags
+}
+
+// sameFlags reports whether a and b hold the same flags in any order
+func sameFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, flag := range a {
+		if !containsFold(b, flag) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// flagList formats the flags of a message as a parenthesized list
+func (ses *Session) flagList(msg smtpd.Message) string {
+	flags := append([]string{}, msg.Flags()...)
+	if ses.recent[msg.Uid()] {
+		flags = append(flags, `\Recent`)
+	}
+	sort.Strings(flags)
+	return "(" + strings.Join(flags, " ") + ")"
+}
+
+// parseSet parses a sequence set of sequence numbers, or UIDs if uid is set
+func (ses *Session) parseSet(a arg, uid bool) (seqSet, error) {
+	if a.isList || a.quoted {
+		return nil, syntaxError("Bad sequence set")
+	}
+	max := uint32(len(ses.messages))
+	if uid && max > 0 {
+		max = ses.messages[max-1].Uid()
+	}
+	return parseSeqSet(a.value, max)
+}
+
+// inSet reports whether the message at index i of the mailbox is in set
+func (ses *Session) inSet(set seqSet, i int, uid bool) bool {
+	if uid {
+		return set.contains(ses.messages[i].Uid())
+	}
+	return set.contains(uint32(i + 1))
+}
@@ -0,0 +1,328 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A mimePart is a message or one of its MIME parts, keeping the raw bytes
+// IMAP clients fetch along with what BODYSTRUCTURE describes
+type mimePart struct {
+	rawHeader []byte // Header including the blank line that ends it
+	body      []byte
+	header    textproto.MIMEHeader
+	mediaType string // Lower case type/subtype
+	params    map[string]string
+	parts     []*mimePart // Parts of a multipart
+	message   *mimePart   // The message inside a message/rfc822 part
+}
+
+// parseMessage splits a raw message into its MIME parts
+func parseMessage(raw []byte) *mimePart {
+	return parsePart(raw, "text/plain")
+}
+
+// parsePart parses an entity whose content type defaults to defaultType
+func parsePart(raw []byte, defaultType string) *mimePart {
+	p := new(mimePart)
+	p.rawHeader, p.body = splitHeader(raw)
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(p.rawHeader)))
+	p.header, _ = r.ReadMIMEHeader()
+	if p.header == nil {
+		p.header = make(textproto.MIMEHeader)
+	}
+
+	p.mediaType = defaultType
+	p.params = make(map[string]string)
+	if ct := p.header.Get("Content-Type"); ct != "" {
+		if mediaType, params, err := mime.ParseMediaType(ct); err == nil {
+			p.mediaType, p.params = mediaType, params
+		}
+	}
+	if strings.HasPrefix(p.mediaType, "text/") && p.params["charset"] == "" {
+		p.params["charset"] = "us-ascii"
+	}
+
+	switch {
+	case strings.HasPrefix(p.mediaType, "multipart/"):
+		childType := "text/plain"
+		if p.mediaType == "multipart/digest" {
+			childType = "message/rfc822"
+		}
+		if boundary := p.params["boundary"]; boundary != "" {
+			for _, raw := range splitMultipart(p.body, boundary) {
+				p.parts = append(p.parts, parsePart(raw, childType))
+			}
+		}
+		if len(p.parts) == 0 {
+			// Unusable, treat it as opaque data
+			p.mediaType = "application/octet-stream"
+		}
+	case p.mediaType == "message/rfc822":
+		p.message = parseMessage(p.body)
+	}
+	return p
+}
+
+// splitHeader splits an entity at the blank line ending its header
+func splitHeader(raw []byte) ([]byte, []byte) {
+	if bytes.HasPrefix(raw, []byte("\r\n")) {
+		return raw[:2], raw[2:]
+	}
+	if bytes.HasPrefix(raw, []byte("\n")) {
+		return raw[:1], raw[1:]
+	}
+	crlf := bytes.Index(raw, []byte("\r\n\r\n"))
+	lf := bytes.Index(raw, []byte("\n\n"))
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return raw[:crlf+4], raw[crlf+4:]
+	case lf >= 0:
+		return raw[:lf+2], raw[lf+2:]
+	}
+	return raw, nil
+}
+
+// splitMultipart returns the raw parts of a multipart body, the line break
+// before each delimiter belongs to the delimiter
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delim := []byte("--" + boundary)
+	var parts [][]byte
+	start := -1
+	for pos := 0; pos < len(body); {
+		end := bytes.IndexByte(body[pos:], '\n')
+		next := len(body)
+		if end >= 0 {
+			next = pos + end + 1
+		}
+		line := bytes.TrimRight(body[pos:next], " \t\r\n")
+		if bytes.HasPrefix(line, delim) {
+			rest := line[len(delim):]
+			closing := bytes.Equal(rest, []byte("--"))
+			if len(rest) == 0 || closing {
+				if start >= 0 {
+					partEnd := pos
+					if partEnd > start && body[partEnd-1] == '\n' {
+						partEnd--
+						if partEnd > start && body[partEnd-1] == '\r' {
+							partEnd--
+						}
+					}
+					parts = append(parts, body[start:partEnd])
+				}
+				if closing {
+					return parts
+				}
+				start = next
+			}
+		}
+		pos = next
+	}
+	return parts
+}
+
+// section finds the part numbered path, as in BODY[1.2]
+func (p *mimePart) section(path []int) *mimePart {
+	for i, n := range path {
+		if i > 0 && p.message != nil {
+			// Numbers after a message/rfc822 part count the parts inside it
+			p = p.message
+		}
+		if len(p.parts) > 0 {
+			if n < 1 || n > len(p.parts) {
+				return nil
+			}
+			p = p.parts[n-1]
+		} else if n != 1 {
+			return nil
+		}
+	}
+	return p
+}
+
+// headerFields returns the raw header lines of p named in fields, or those
+// not named when not is true, ending with a blank line
+func (p *mimePart) headerFields(fields []string, not bool) []byte {
+	want := make(map[string]bool)
+	for _, f := range fields {
+		want[strings.ToLower(f)] = true
+	}
+
+	var out bytes.Buffer
+	keep := false
+	for _, line := range bytes.SplitAfter(p.rawHeader, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			break
+		}
+		if trimmed[0] != ' ' && trimmed[0] != '\t' {
+			// A new field, rather than a continuation of the last
+			name := trimmed
+			if i := bytes.IndexByte(trimmed, ':'); i >= 0 {
+				name = trimmed[:i]
+			}
+			keep = want[strings.ToLower(strings.TrimSpace(string(name)))] != not
+		}
+		if keep {
+			out.Write(line)
+		}
+	}
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+// bodyStructure formats p for the BODY or, with extensions, BODYSTRUCTURE
+// fetch attribute
+func (p *mimePart) bodyStructure(extensions bool) string {
+	mediaType, subType := splitMediaType(p.mediaType)
+	var s []string
+	if len(p.parts) > 0 {
+		var children string
+		for _, part := range p.parts {
+			children += part.bodyStructure(extensions)
+		}
+		s = append(s, children, quote(subType))
+		if extensions {
+			s = append(s, p.paramList(), p.disposition(), p.language(), p.location())
+		}
+		return "(" + strings.Join(s, " ") + ")"
+	}
+
+	s = append(s, quote(mediaType), quote(subType), p.paramList(),
+		nstring(p.header.Get("Content-Id")), nstring(p.header.Get("Content-Description")),
+		quote(p.encoding()), strconv.Itoa(len(p.body)))
+	switch {
+	case p.message != nil:
+		s = append(s, p.message.envelope(), p.message.bodyStructure(extensions),
+			strconv.Itoa(countLines(p.body)))
+	case mediaType == "TEXT":
+		s = append(s, strconv.Itoa(countLines(p.body)))
+	}
+	if extensions {
+		s = append(s, nstring(p.header.Get("Content-Md5")), p.disposition(), p.language(),
+			p.location())
+	}
+	return "(" + strings.Join(s, " ") + ")"
+}
+
+func (p *mimePart) encoding() string {
+	if enc := p.header.Get("Content-Transfer-Encoding"); enc != "" {
+		return strings.ToUpper(strings.TrimSpace(enc))
+	}
+	return "7BIT"
+}
+
+func (p *mimePart) paramList() string {
+	return formatParams(p.params)
+}
+
+func (p *mimePart) disposition() string {
+	value := p.header.Get("Content-Disposition")
+	if value == "" {
+		return "NIL"
+	}
+	disposition, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "NIL"
+	}
+	return "(" + quote(strings.ToUpper(disposition)) + " " + formatParams(params) + ")"
+}
+
+func (p *mimePart) language() string {
+	value := p.header.Get("Content-Language")
+	if value == "" {
+		return "NIL"
+	}
+	var langs []string
+	for _, lang := range strings.Split(value, ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			langs = append(langs, quote(lang))
+		}
+	}
+	if len(langs) == 0 {
+		return "NIL"
+	}
+	return "(" + strings.Join(langs, " ") + ")"
+}
+
+func (p *mimePart) location() string {
+	return nstring(p.header.Get("Content-Location"))
+}
+
+// envelope formats the header of message p for the ENVELOPE fetch attribute
+func (p *mimePart) envelope() string {
+	from := p.addressList("From")
+	sender := p.addressList("Sender")
+	if sender == "NIL" {
+		sender = from
+	}
+	replyTo := p.addressList("Reply-To")
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	return fmt.Sprintf("(%v %v %v %v %v %v %v %v %v %v)", nstring(p.header.Get("Date")),
+		nstring(p.header.Get("Subject")), from, sender, replyTo, p.addressList("To"),
+		p.addressList("Cc"), p.addressList("Bcc"), nstring(p.header.Get("In-Reply-To")),
+		nstring(p.header.Get("Message-Id")))
+}
+
+func (p *mimePart) addressList(field string) string {
+	value := p.header.Get(field)
+	if value == "" {
+		return "NIL"
+	}
+	addrs, err := mail.ParseAddressList(value)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+	var s string
+	for _, addr := range addrs {
+		local, host := addr.Address, ""
+		if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+			local, host = addr.Address[:i], addr.Address[i+1:]
+		}
+		s += fmt.Sprintf("(%v NIL %v %v)", nstring(addr.Name), nstring(local), nstring(host))
+	}
+	return "(" + s + ")"
+}
+
+// formatParams formats MIME parameters as an IMAP list, sorted so the output
+// is stable
+func formatParams(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var s []string
+	for _, k := range keys {
+		s = append(s, quote(strings.ToUpper(k)), quote(params[k]))
+	}
+	return "(" + strings.Join(s, " ") + ")"
+}
+
+func splitMediaType(mediaType string) (string, string) {
+	mediaType = strings.ToUpper(mediaType)
+	if i := strings.IndexByte(mediaType, '/'); i >= 0 {
+		return mediaType[:i], mediaType[i+1:]
+	}
+	return mediaType, ""
+}
+
+func countLines(b []byte) int {
+	n := bytes.Count(b, []byte("\n"))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,106 @@
+package imapd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// crlf replaces line feeds with CRLF, as messages arrive over SMTP
+func crlf(s string) string {
+	return strings.Replace(s, "\n", "\r\n", -1)
+}
+
+var testMessage = crlf(`From: Alice <alice@example.com>
+To: bob@example.com, "Carol C" <carol@example.com>
+Subject: Hello
+Date: Mon, 18 Oct 2026 10:00:00 +0000
+Message-Id: <1@example.com>
+Content-Type: multipart/mixed; boundary="b1"
+
+Preamble
+--b1
+Content-Type: text/plain
+
+Hi Bob
+--b1
+Content-Type: message/rfc822
+Content-Disposition: attachment; filename="fwd.eml"
+
+From: dave@example.com
+Subject: Inner
+
+Inner body
+--b1--
+`)
+
+func TestParseMessage(t *testing.T) {
+	root := parseMessage([]byte(testMessage))
+	assert.Equal(t, "multipart/mixed", root.mediaType)
+	assert.Equal(t, 2, len(root.parts))
+
+	text := root.section([]int{1})
+	assert.Equal(t, "text/plain", text.mediaType)
+	assert.Equal(t, "Hi Bob", string(text.body))
+	assert.Equal(t, "us-ascii", text.params["charset"])
+
+	inner := root.section([]int{2})
+	assert.Equal(t, "message/rfc822", inner.mediaType)
+	assert.NotNil(t, inner.message)
+	assert.Equal(t, "Inner", inner.message.header.Get("Subject"))
+
+	// Numbers past a message/rfc822 part count the parts inside it, the line
+	// break before a delimiter belongs to the delimiter
+	assert.Equal(t, "Inner body", string(root.section([]int{2, 1}).body))
+	assert.Nil(t, root.section([]int{3}))
+	assert.Nil(t, root.section([]int{1, 2}))
+}
+
+func TestHeaderFields(t *testing.T) {
+	root := parseMessage([]byte(testMessage))
+	assert.Equal(t, "To: bob@example.com, \"Carol C\" <carol@example.com>\r\nSubject: Hello\r\n\r\n",
+		string(root.headerFields([]string{"subject", "TO"}, false)))
+
+	fields := string(root.headerFields([]string{"Content-Type", "Date", "Message-Id", "To"}, true))
+	assert.Equal(t, "From: Alice <alice@example.com>\r\nSubject: Hello\r\n\r\n", fields)
+}
+
+func TestBodyStructure(t *testing.T) {
+	root := parseMessage([]byte(testMessage))
+	assert.Equal(t, `(("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 6 1)`+
+		`("MESSAGE" "RFC822" NIL NIL NIL "7BIT" 52 `+
+		`(NIL "Inner" ((NIL NIL "dave" "example.com")) ((NIL NIL "dave" "example.com")) `+
+		`((NIL NIL "dave" "example.com")) NIL NIL NIL NIL NIL) `+
+		`("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 10 1) 4) "MIXED")`,
+		root.bodyStructure(false))
+
+	ext := root.bodyStructure(true)
+	assert.Contains(t, ext, `("ATTACHMENT" ("FILENAME" "fwd.eml"))`)
+	assert.True(t, strings.HasSuffix(ext, `"MIXED" ("BOUNDARY" "b1") NIL NIL NIL)`), ext)
+}
+
+func TestEnvelope(t *testing.T) {
+	root := parseMessage([]byte(testMessage))
+	from := `(("Alice" NIL "alice" "example.com"))`
+	assert.Equal(t, `("Mon, 18 Oct 2026 10:00:00 +0000" "Hello" `+from+` `+from+` `+from+` `+
+		`((NIL NIL "bob" "example.com")("Carol C" NIL "carol" "example.com")) `+
+		`NIL NIL NIL "<1@example.com>")`, root.envelope())
+}
+
+func TestSectionData(t *testing.T) {
+	root := parseMessage([]byte(testMessage))
+	data := func(s string) string {
+		att, err := parseFetchAtt(s)
+		assert.Nil(t, err)
+		return att.sectionData(root, testMessage)
+	}
+	assert.Equal(t, testMessage, data("BODY[]"))
+	assert.Equal(t, "Hi Bob", data("BODY[1]"))
+	assert.Equal(t, "Content-Type: text/plain\r\n\r\n", data("BODY[1.MIME]"))
+	assert.Equal(t, "From: dave@example.com\r\nSubject: Inner\r\n\r\n", data("BODY[2.HEADER]"))
+	assert.Equal(t, "Inner body", data("BODY[2.TEXT]"))
+	assert.Equal(t, "Subject: Inner\r\n\r\n", data("BODY[2.HEADER.FIELDS (SUBJECT)]"))
+	assert.Equal(t, "", data("BODY[1.HEADER]"))
+	assert.Equal(t, "", data("BODY[4]"))
+}
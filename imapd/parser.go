@@ -0,0 +1,314 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// syntaxError is returned by readCommand when the client sent something we
+// could not parse, the session carries on with the next line
+type syntaxError string
+
+func (e syntaxError) Error() string {
+	return string(e)
+}
+
+// errTooBig is returned by readCommand when a literal exceeded the maximum
+// size, its contents are discarded
+var errTooBig = syntaxError("Literal too big")
+
+// errTooManyLiterals is returned by readCommand when a command has more
+// literals than allowed, the session ends as the rest cannot be skipped
+var errTooManyLiterals = errors.New("Too many literals")
+
+// An arg is one argument of a command: an atom, a string (quoted or literal)
+// or a parenthesized list of args
+type arg struct {
+	value  string
+	quoted bool
+	list   []arg
+	isList bool
+}
+
+func (a arg) String() string {
+	if a.isList {
+		s := make([]string, len(a.list))
+		for i, item := range a.list {
+			s[i] = item.String()
+		}
+		return "(" + strings.Join(s, " ") + ")"
+	}
+	if a.quoted {
+		return quote(a.value)
+	}
+	return a.value
+}
+
+// isAtom reports whether a is the atom name, compared case-insensitively
+func (a arg) isAtom(name string) bool {
+	return !a.isList && !a.quoted && strings.EqualFold(a.value, name)
+}
+
+// astring returns the value of an atom or string, false for a list
+func (a arg) astring() (string, bool) {
+	if a.isList {
+		return "", false
+	}
+	return a.value, true
+}
+
+// readCommand reads a command from r and splits it into args; the first is
+// the tag and the second the command name.  Before reading a synchronizing
+// literal it calls ready, so the client knows to send it.  maxLiterals limits
+// how many literals the command may have, 0 means no limit.  On a syntax
+// error the args read so far are returned, that the tag may be used in the
+// reply.
+func readCommand(r *bufio.Reader, maxLiteral int, maxLiterals int,
+	ready func()) ([]arg, error) {
+	stack := [][]arg{make([]arg, 0, 4)}
+	for literals := 1; ; literals++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		size, sync, err := scanLine(line, &stack)
+		if err != nil {
+			return stack[0], err
+		}
+		if size < 0 {
+			if len(stack) != 1 {
+				return stack[0], syntaxError("Unbalanced parentheses")
+			}
+			return stack[0], nil
+		}
+
+		if maxLiterals > 0 && literals > maxLiterals {
+			return nil, errTooManyLiterals
+		}
+		if size > maxLiteral {
+			if sync {
+				// The client waits for our go-ahead, so sends nothing more
+				return stack[0], errTooBig
+			}
+			// Skip the literal and the remainder of the command
+			if _, err = io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+				return nil, err
+			}
+			if _, err = r.ReadString('\n'); err != nil {
+				return nil, err
+			}
+			return stack[0], errTooBig
+		}
+		if sync {
+			ready()
+		}
+		buf := make([]byte, size)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		top := len(stack) - 1
+		stack[top] = append(stack[top], arg{value: string(buf), quoted: true})
+	}
+}
+
+// scanLine appends the args in line to the innermost open list on stack.  If
+// the line ends with a literal its size is returned along with whether it is
+// synchronizing, otherwise size is -1.
+func scanLine(line string, stack *[][]arg) (int, bool, error) {
+	push := func(a arg) {
+		top := len(*stack) - 1
+		(*stack)[top] = append((*stack)[top], a)
+	}
+
+	i := 0
+	for {
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		if i >= len(line) {
+			return -1, false, nil
+		}
+
+		switch line[i] {
+		case '(':
+			*stack = append(*stack, make([]arg, 0, 4))
+			i++
+		case ')':
+			if len(*stack) < 2 {
+				return 0, false, syntaxError("Unbalanced parentheses")
+			}
+			list := (*stack)[len(*stack)-1]
+			*stack = (*stack)[:len(*stack)-1]
+			push(arg{list: list, isList: true})
+			i++
+		case '"':
+			var buf bytes.Buffer
+			i++
+			for {
+				if i >= len(line) {
+					return 0, false, syntaxError("Unterminated quoted string")
+				}
+				c := line[i]
+				i++
+				if c == '"' {
+					break
+				}
+				if c == '\\' {
+					if i >= len(line) || (line[i] != '"' && line[i] != '\\') {
+						return 0, false, syntaxError("Bad escape in quoted string")
+					}
+					c = line[i]
+					i++
+				}
+				buf.WriteByte(c)
+			}
+			push(arg{value: buf.String(), quoted: true})
+		case '{':
+			end := strings.IndexByte(line[i:], '}')
+			if end < 0 || i+end != len(line)-1 {
+				return 0, false, syntaxError("Literal must end the line")
+			}
+			digits := line[i+1 : i+end]
+			sync := !strings.HasSuffix(digits, "+")
+			size, err := strconv.ParseUint(strings.TrimSuffix(digits, "+"), 10, 31)
+			if err != nil {
+				return 0, false, syntaxError("Bad literal size")
+			}
+			return int(size), sync, nil
+		default:
+			// Fetch attributes such as BODY[HEADER.FIELDS (FROM)]<0.100> hold
+			// spaces and parentheses between their brackets
+			start := i
+			depth := 0
+			for i < len(line) {
+				c := line[i]
+				if depth == 0 && (c == ' ' || c == '(' || c == ')') {
+					break
+				}
+				if c == '[' {
+					depth++
+				} else if c == ']' && depth > 0 {
+					depth--
+				}
+				i++
+			}
+			push(arg{value: line[start:i]})
+		}
+	}
+}
+
+// quote formats s as a quoted string, falling back to a literal when it
+// holds characters a quoted string may not
+func quote(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || c == 0 || c >= 0x80 {
+			return literal(s)
+		}
+	}
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + s + "\""
+}
+
+// nstring formats s as a quoted string, or NIL when it is empty
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return quote(s)
+}
+
+// literal formats s as a literal string
+func literal(s string) string {
+	return fmt.Sprintf("{%v}\r\n%v", len(s), s)
+}
+
+// seqRange is an inclusive range from a sequence set, low <= high
+type seqRange struct {
+	low, high uint32
+}
+
+// seqSet is a parsed sequence set such as 1:4,7,9:*
+type seqSet []seqRange
+
+// parseSeqSet parses a sequence set, * standing for max: the highest sequence
+// number or UID in the mailbox
+func parseSeqSet(s string, max uint32) (seqSet, error) {
+	if s == "" {
+		return nil, syntaxError("Empty sequence set")
+	}
+	number := func(n string) (uint32, error) {
+		if n == "*" {
+			return max, nil
+		}
+		v, err := strconv.ParseUint(n, 10, 32)
+		if err != nil || v == 0 {
+			return 0, syntaxError(fmt.Sprintf("Bad sequence number %q", n))
+		}
+		return uint32(v), nil
+	}
+
+	var set seqSet
+	for _, item := range strings.Split(s, ",") {
+		bounds := strings.Split(item, ":")
+		if len(bounds) > 2 {
+			return nil, syntaxError(fmt.Sprintf("Bad sequence range %q", item))
+		}
+		low, err := number(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = number(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		if low > high {
+			low, high = high, low
+		}
+		set = append(set, seqRange{low, high})
+	}
+	return set, nil
+}
+
+func (set seqSet) contains(n uint32) bool {
+	for _, r := range set {
+		if n >= r.low && n <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether name matches an IMAP LIST pattern, where * matches
+// anything and % anything but the hierarchy delimiter
+func match(pattern string, name string) bool {
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '*', '%':
+		for i := 0; i <= len(name); i++ {
+			if match(pattern[1:], name[i:]) {
+				return true
+			}
+			if i < len(name) && pattern[0] == '%' && name[i] == '/' {
+				return false
+			}
+		}
+		return false
+	}
+	if name == "" || pattern[0] != name[0] {
+		return false
+	}
+	return match(pattern[1:], name[1:])
+}
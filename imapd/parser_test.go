@@ -0,0 +1,174 @@
+package imapd
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func read(t *testing.T, input string) ([]arg, error) {
+	return readCommand(bufio.NewReader(strings.NewReader(input)), 16, 0, func() {})
+}
+
+// strs flattens args to their String forms for easy comparison
+func strs(args []arg) []string {
+	s := make([]string, len(args))
+	for i, a := range args {
+		s[i] = a.String()
+	}
+	return s
+}
+
+func TestReadCommand(t *testing.T) {
+	args, err := read(t, "a1 CAPABILITY\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a1", "CAPABILITY"}, strs(args))
+
+	args, err = read(t, "a2 LOGIN bob \"se \\\"cr\\\\ et\"\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "se \"cr\\ et", args[3].value)
+	assert.True(t, args[3].quoted)
+
+	args, err = read(t, "a3 FETCH 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.100>)\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(args))
+	assert.True(t, args[3].isList)
+	assert.Equal(t, []string{"FLAGS", "BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.100>"},
+		strs(args[3].list))
+
+	// Literals, synchronizing or not, may appear mid command
+	ready := 0
+	r := bufio.NewReader(strings.NewReader("a4 LOGIN {3}\r\nbob {6+}\r\nsecret\r\n"))
+	args, err = readCommand(r, 16, 0, func() { ready++ })
+	assert.Nil(t, err)
+	assert.Equal(t, 1, ready)
+	assert.Equal(t, "bob", args[2].value)
+	assert.Equal(t, "secret", args[3].value)
+
+	args, err = read(t, "a5 SEARCH (OR SEEN (FROM \"x\" NOT DELETED))\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, "(OR SEEN (FROM \"x\" NOT DELETED))", args[2].String())
+
+	args, err = read(t, "\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(args))
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	args, err := read(t, "a1 LOGIN \"open\r\n")
+	assert.IsType(t, syntaxError(""), err)
+	assert.Equal(t, "a1", args[0].value)
+
+	_, err = read(t, "a2 FETCH 1 (FLAGS\r\n")
+	assert.IsType(t, syntaxError(""), err)
+
+	_, err = read(t, "a3 FETCH 1 FLAGS)\r\n")
+	assert.IsType(t, syntaxError(""), err)
+
+	_, err = read(t, "a4 APPEND INBOX {3} x\r\n")
+	assert.IsType(t, syntaxError(""), err)
+
+	// Oversized non-synchronizing literals are skipped so the next command
+	// can be read
+	r := bufio.NewReader(strings.NewReader(
+		"a5 APPEND INBOX {20+}\r\n01234567890123456789\r\na6 NOOP\r\n"))
+	_, err = readCommand(r, 16, 0, func() {})
+	assert.Equal(t, errTooBig, err)
+	args, err = readCommand(r, 16, 0, func() {})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a6", "NOOP"}, strs(args))
+
+	// Nothing follows a refused synchronizing literal
+	ready := false
+	_, err = readCommand(bufio.NewReader(strings.NewReader("a7 APPEND INBOX {20}\r\n")), 16, 0,
+		func() { ready = true })
+	assert.Equal(t, errTooBig, err)
+	assert.False(t, ready)
+
+	// Before login a command may only carry a few literals
+	input := "a8 LOGIN {3+}\r\nbob {6+}\r\nsecret {1+}\r\nx\r\n"
+	_, err = readCommand(bufio.NewReader(strings.NewReader(input)), 16, 2, func() {})
+	assert.Equal(t, errTooManyLiterals, err)
+	args, err = readCommand(bufio.NewReader(strings.NewReader(input)), 16, 3, func() {})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a8", "LOGIN", "\"bob\"", "\"secret\"", "\"x\""}, strs(args))
+}
+
+func TestQuote(t *testing.T) {
+	assert.Equal(t, "\"INBOX\"", quote("INBOX"))
+	assert.Equal(t, "\"a \\\"b\\\" \\\\c\"", quote("a \"b\" \\c"))
+	assert.Equal(t, "{6}\r\nline\r\n", quote("line\r\n"))
+	assert.Equal(t, "NIL", nstring(""))
+}
+
+func TestParseSeqSet(t *testing.T) {
+	set, err := parseSeqSet("1:3,7,9:*", 12)
+	assert.Nil(t, err)
+	assert.Equal(t, seqSet{{1, 3}, {7, 7}, {9, 12}}, set)
+	assert.True(t, set.contains(2))
+	assert.False(t, set.contains(8))
+	assert.True(t, set.contains(12))
+
+	// Ranges may be given backwards
+	set, err = parseSeqSet("*:4", 6)
+	assert.Nil(t, err)
+	assert.Equal(t, seqSet{{4, 6}}, set)
+
+	for _, s := range []string{"", "0", "1:2:3", "a", "1,,2", "-1"} {
+		_, err = parseSeqSet(s, 10)
+		assert.IsType(t, syntaxError(""), err, "Expected %q to fail", s)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	assert.True(t, match("INBOX", "INBOX"))
+	assert.True(t, match("*", "INBOX"))
+	assert.True(t, match("%", "INBOX"))
+	assert.True(t, match("IN*", "INBOX"))
+	assert.True(t, match("*/*", "a/b/c"))
+	assert.False(t, match("%", "a/b"))
+	assert.False(t, match("INBOX/%", "INBOX"))
+	assert.False(t, match("", "INBOX"))
+}
+
+func TestParseFetchAtts(t *testing.T) {
+	atts, err := parseFetchAtts([]arg{{value: "fast"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(atts))
+	assert.Equal(t, "RFC822.SIZE", atts[2].name)
+
+	atts, err = parseFetchAtts([]arg{{isList: true, list: []arg{
+		{value: "uid"},
+		{value: "body.peek[1.2.header.fields (From \"To\")]<10.20>"},
+		{value: "BODY[]"},
+		{value: "BODY"},
+	}}})
+	assert.Nil(t, err)
+	assert.Equal(t, "UID", atts[0].name)
+
+	att := atts[1]
+	assert.True(t, att.peek)
+	assert.True(t, att.bracket)
+	assert.Equal(t, []int{1, 2}, att.path)
+	assert.Equal(t, "HEADER.FIELDS", att.part)
+	assert.Equal(t, []string{"From", "To"}, att.fields)
+	assert.Equal(t, "1.2.HEADER.FIELDS (FROM TO)", att.section)
+	assert.True(t, att.partial)
+	assert.Equal(t, 10, att.offset)
+	assert.Equal(t, 20, att.count)
+	assert.False(t, att.setsSeen())
+
+	assert.True(t, atts[2].bracket)
+	assert.Equal(t, "", atts[2].section)
+	assert.True(t, atts[2].setsSeen())
+	assert.False(t, atts[3].bracket)
+	assert.False(t, atts[3].setsSeen())
+
+	for _, s := range []string{"BODY[", "BODY[FOO]", "BODY[MIME]", "BODY[HEADER.FIELDS]",
+		"BODY[TEXT (FROM)]", "BODY[]<1>", "BODY[]<1.0>", "BOGUS", "BODY.FOO[]"} {
+		_, err = parseFetchAtts([]arg{{value: s}})
+		assert.IsType(t, syntaxError(""), err, "Expected %q to fail", s)
+	}
+}
@@ -0,0 +1,344 @@
+package imapd
+
+import (
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/egggo/inbucket/smtpd"
+)
+
+// SEARCH date format, RFC 3501 date
+const DATE_FORMAT = "2-Jan-2006"
+
+// A searchKey reports whether the message in c matches
+type searchKey func(c *searchContext) bool
+
+// searchContext is the message a search is testing, its contents are only
+// read if a key needs them
+type searchContext struct {
+	ses  *Session
+	msg  smtpd.Message
+	seq  uint32
+	raw  string
+	root *mimePart
+	err  error
+}
+
+// message parses the contents of the message, a failure to read them is kept
+// in c.err and the message treated as empty
+func (c *searchContext) message() *mimePart {
+	if c.root == nil {
+		raw, err := c.msg.ReadRaw()
+		if err != nil {
+			c.err = err
+			raw = new(string)
+		}
+		c.raw = *raw
+		c.root = parseMessage([]byte(c.raw))
+	}
+	return c.root
+}
+
+func (c *searchContext) hasFlag(flag string) bool {
+	return smtpd.HasFlag(c.msg, flag)
+}
+
+// searchParser turns the arguments of SEARCH into a searchKey
+type searchParser struct {
+	ses  *Session
+	args []arg
+	pos  int
+}
+
+func (ses *Session) searchHandler(tag string, args []arg, uid bool) {
+	if len(args) >= 2 && args[0].isAtom("CHARSET") {
+		charset, _ := args[1].astring()
+		switch strings.ToUpper(charset) {
+		case "US-ASCII", "UTF-8":
+		default:
+			ses.no(tag, "[BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+			return
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		ses.bad(tag, "SEARCH requires search keys")
+		return
+	}
+	p := &searchParser{ses: ses, args: args}
+	key, err := p.all()
+	if err != nil {
+		ses.bad(tag, err.Error())
+		return
+	}
+
+	var found []string
+	for i, msg := range ses.messages {
+		c := &searchContext{ses: ses, msg: msg, seq: uint32(i + 1)}
+		matched := key(c)
+		if c.err != nil {
+			ses.logError("Failed to search %v - %v", msg, c.err)
+			ses.no(tag, "[SERVERBUG] Failed to read message")
+			return
+		}
+		if !matched {
+			continue
+		}
+		if uid {
+			found = append(found, strconv.FormatUint(uint64(msg.Uid()), 10))
+		} else {
+			found = append(found, strconv.Itoa(i+1))
+		}
+	}
+	ses.send(strings.TrimSpace("* SEARCH " + strings.Join(found, " ")))
+	ses.update(uid)
+	ses.ok(tag, "SEARCH completed")
+}
+
+// all parses the remaining keys, all of which must match
+func (p *searchParser) all() (searchKey, error) {
+	var keys []searchKey
+	for p.pos < len(p.args) {
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, syntaxError("Empty search key list")
+	}
+	return func(c *searchContext) bool {
+		for _, key := range keys {
+			if !key(c) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func (p *searchParser) next() (arg, error) {
+	if p.pos >= len(p.args) {
+		return arg{}, syntaxError("Missing search argument")
+	}
+	a := p.args[p.pos]
+	p.pos++
+	return a, nil
+}
+
+// str reads a string argument
+func (p *searchParser) str() (string, error) {
+	a, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	s, ok := a.astring()
+	if !ok {
+		return "", syntaxError("Expected a string")
+	}
+	return s, nil
+}
+
+// date reads a date argument
+func (p *searchParser) date() (time.Time, error) {
+	s, err := p.str()
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(DATE_FORMAT, s)
+	if err != nil {
+		return time.Time{}, syntaxError(fmt.Sprintf("Bad date %q", s))
+	}
+	return t, nil
+}
+
+// number reads a number argument
+func (p *searchParser) number() (int64, error) {
+	s, err := p.str()
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, syntaxError(fmt.Sprintf("Bad number %q", s))
+	}
+	return int64(n), nil
+}
+
+// key parses one search key
+func (p *searchParser) key() (searchKey, error) {
+	a, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if a.isList {
+		sub := &searchParser{ses: p.ses, args: a.list}
+		return sub.all()
+	}
+	if a.quoted {
+		return nil, syntaxError(fmt.Sprintf("Unexpected string %q", a.value))
+	}
+	if a.value != "" && (a.value[0] == '*' || (a.value[0] >= '0' && a.value[0] <= '9')) {
+		set, err := p.ses.parseSet(a, false)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *searchContext) bool { return set.contains(c.seq) }, nil
+	}
+
+	name := strings.ToUpper(a.value)
+	switch name {
+	case "ALL":
+		return func(c *searchContext) bool { return true }, nil
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "SEEN":
+		flag := `\` + name[:1] + strings.ToLower(name[1:])
+		return func(c *searchContext) bool { return c.hasFlag(flag) }, nil
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		flag := `\` + name[2:3] + strings.ToLower(name[3:])
+		return func(c *searchContext) bool { return !c.hasFlag(flag) }, nil
+	case "KEYWORD", "UNKEYWORD":
+		flag, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		want := name == "KEYWORD"
+		return func(c *searchContext) bool { return c.hasFlag(flag) == want }, nil
+	case "RECENT":
+		return func(c *searchContext) bool { return c.ses.recent[c.msg.Uid()] }, nil
+	case "OLD":
+		return func(c *searchContext) bool { return !c.ses.recent[c.msg.Uid()] }, nil
+	case "NEW":
+		return func(c *searchContext) bool {
+			return c.ses.recent[c.msg.Uid()] && !c.hasFlag(`\Seen`)
+		}, nil
+	case "BCC", "CC", "FROM", "SUBJECT", "TO":
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return headerKey(name, s), nil
+	case "HEADER":
+		field, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return headerKey(field, s), nil
+	case "BODY":
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *searchContext) bool { return contains(string(c.message().body), s) }, nil
+	case "TEXT":
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *searchContext) bool {
+			c.message()
+			return contains(c.raw, s)
+		}, nil
+	case "BEFORE", "ON", "SINCE":
+		d, err := p.date()
+		if err != nil {
+			return nil, err
+		}
+		return dateKey(name, d, func(c *searchContext) (time.Time, bool) {
+			return c.msg.Date(), true
+		}), nil
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		d, err := p.date()
+		if err != nil {
+			return nil, err
+		}
+		return dateKey(name[4:], d, func(c *searchContext) (time.Time, bool) {
+			t, err := mail.ParseDate(c.message().header.Get("Date"))
+			return t, err == nil
+		}), nil
+	case "LARGER":
+		n, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *searchContext) bool { return c.msg.Size() > n }, nil
+	case "SMALLER":
+		n, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *searchContext) bool { return c.msg.Size() < n }, nil
+	case "UID":
+		b, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		set, err := p.ses.parseSet(b, true)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *searchContext) bool { return set.contains(c.msg.Uid()) }, nil
+	case "NOT":
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *searchContext) bool { return !key(c) }, nil
+	case "OR":
+		key1, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		key2, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *searchContext) bool { return key1(c) || key2(c) }, nil
+	}
+	return nil, syntaxError(fmt.Sprintf("Unknown search key %v", a.value))
+}
+
+// headerKey matches messages with a header field containing s, any message
+// with the field if s is empty
+func headerKey(field string, s string) searchKey {
+	return func(c *searchContext) bool {
+		for _, value := range c.message().header[textproto.CanonicalMIMEHeaderKey(field)] {
+			if contains(value, s) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// dateKey compares the date of a message with d, disregarding the time and
+// time zone as RFC 3501 asks
+func dateKey(op string, d time.Time, date func(c *searchContext) (time.Time, bool)) searchKey {
+	return func(c *searchContext) bool {
+		t, ok := date(c)
+		if !ok {
+			return false
+		}
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		switch op {
+		case "BEFORE":
+			return t.Before(d)
+		case "ON":
+			return t.Equal(d)
+		}
+		return !t.Before(d)
+	}
+}
+
+// contains is a case-insensitive strings.Contains
+func contains(s string, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
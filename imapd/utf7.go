@@ -0,0 +1,84 @@
+package imapd
+
+import (
+	"encoding/base64"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Modified BASE64 of mailbox names, RFC 3501 section 5.1.3
+var utf7Encoding = base64.NewEncoding(
+	"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+// encodeMailbox converts a mailbox name to the modified UTF-7 clients expect
+func encodeMailbox(name string) string {
+	var buf strings.Builder
+	var run []rune
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		units := utf16.Encode(run)
+		b := make([]byte, 2*len(units))
+		for i, u := range units {
+			b[2*i], b[2*i+1] = byte(u>>8), byte(u)
+		}
+		buf.WriteString("&" + utf7Encoding.EncodeToString(b) + "-")
+		run = run[:0]
+	}
+	for _, r := range name {
+		if r >= 0x20 && r <= 0x7e {
+			flush()
+			if r == '&' {
+				buf.WriteString("&-")
+			} else {
+				buf.WriteRune(r)
+			}
+		} else {
+			run = append(run, r)
+		}
+	}
+	flush()
+	return buf.String()
+}
+
+// decodeMailbox converts a mailbox name from modified UTF-7
+func decodeMailbox(s string) (string, error) {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 0x80 {
+			// Some clients send UTF-8 regardless, take it as it is
+			if !utf8.ValidString(s) {
+				return "", syntaxError("Mailbox name is not valid modified UTF-7")
+			}
+			buf.WriteByte(c)
+			continue
+		}
+		if c != '&' {
+			buf.WriteByte(c)
+			continue
+		}
+		end := strings.IndexByte(s[i:], '-')
+		if end < 0 {
+			return "", syntaxError("Mailbox name is not valid modified UTF-7")
+		}
+		if end == 1 {
+			buf.WriteByte('&')
+			i++
+			continue
+		}
+		b, err := utf7Encoding.DecodeString(s[i+1 : i+end])
+		if err != nil || len(b)%2 != 0 {
+			return "", syntaxError("Mailbox name is not valid modified UTF-7")
+		}
+		units := make([]uint16, len(b)/2)
+		for j := range units {
+			units[j] = uint16(b[2*j])<<8 | uint16(b[2*j+1])
+		}
+		buf.WriteString(string(utf16.Decode(units)))
+		i += end
+	}
+	return buf.String(), nil
+}
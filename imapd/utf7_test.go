@@ -0,0 +1,40 @@
+package imapd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeMailbox(t *testing.T) {
+	assert.Equal(t, "Lists/Go", encodeMailbox("Lists/Go"))
+	assert.Equal(t, "Tom &- Jerry", encodeMailbox("Tom & Jerry"))
+	assert.Equal(t, "Entw&APw-rfe", encodeMailbox("Entwürfe"))
+	assert.Equal(t, "&ZeVnLIqe-", encodeMailbox("日本語"))
+	assert.Equal(t, "~peter/mail/&U,BTFw-/&ZeVnLIqe-", encodeMailbox("~peter/mail/台北/日本語"))
+}
+
+func TestDecodeMailbox(t *testing.T) {
+	for _, name := range []string{"INBOX", "Tom & Jerry", "Entwürfe", "~peter/mail/台北/日本語",
+		"😀 emoji"} {
+		decoded, err := decodeMailbox(encodeMailbox(name))
+		assert.Nil(t, err)
+		assert.Equal(t, name, decoded)
+	}
+
+	// Clients that send UTF-8 anyway are understood
+	decoded, err := decodeMailbox("Entwürfe")
+	assert.Nil(t, err)
+	assert.Equal(t, "Entwürfe", decoded)
+
+	for _, s := range []string{"&", "&APw", "&A-", "&AP*-", "\xff"} {
+		_, err = decodeMailbox(s)
+		assert.IsType(t, syntaxError(""), err, "Expected %q to fail", s)
+	}
+}
+
+func TestHierarchy(t *testing.T) {
+	assert.Equal(t, map[string]bool{"Archive": false, "Archive/Lists": false,
+		"Archive/Lists/Go": true, "Junk": true, "Lists": true, "Lists/Go": true},
+		hierarchy([]string{"Archive/Lists/Go", "Junk", "Lists", "Lists/Go"}))
+}
@@ -15,8 +15,10 @@ import (
 
 	"github.com/egggo/inbucket/config"
 	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/imapd"
 	"github.com/egggo/inbucket/log"
 	"github.com/egggo/inbucket/pop3d"
+	"github.com/egggo/inbucket/sieved"
 	"github.com/egggo/inbucket/smtpd"
 	"github.com/egggo/inbucket/web"
 )
@@ -38,8 +40,10 @@ var (
 	logf *os.File
 
 	// Server instances
-	smtpServer *smtpd.Server
-	pop3Server *pop3d.Server
+	smtpServer  *smtpd.Server
+	pop3Server  *pop3d.Server
+	sieveServer *sieved.Server
+	imapServer  *imapd.Server
 )
 
 func main() {
@@ -111,7 +115,7 @@ func main() {
 	db := db.New()
 	defer db.Close()
 	// Grab our datastore
-	ds := smtpd.DefaultFileDataStore()
+	ds := smtpd.DefaultDataStore()
 
 	// Start HTTP server
 	web.Initialize(config.GetWebConfig(), ds, db)
@@ -121,6 +125,18 @@ func main() {
 	pop3Server = pop3d.New(db)
 	go pop3Server.Start()
 
+	// Start ManageSieve server if configured
+	if config.GetManageSieveConfig().Enabled {
+		sieveServer = sieved.New(db)
+		go sieveServer.Start()
+	}
+
+	// Start IMAP server if configured
+	if config.GetImapConfig().Enabled {
+		imapServer = imapd.New(db)
+		go imapServer.Start()
+	}
+
 	// Startup SMTP server, block until it exits
 	smtpServer = smtpd.NewSmtpServer(config.GetSmtpConfig(), ds, db)
 	smtpServer.Start()
@@ -128,6 +144,12 @@ func main() {
 	// Wait for active connections to finish
 	smtpServer.Drain()
 	pop3Server.Drain()
+	if sieveServer != nil {
+		sieveServer.Drain()
+	}
+	if imapServer != nil {
+		imapServer.Drain()
+	}
 }
 
 // openLogFile creates or appends to the logfile passed on commandline
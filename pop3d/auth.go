@@ -0,0 +1,61 @@
+package pop3d
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/egggo/inbucket/smtpd"
+)
+
+// authHandler runs the AUTH command (RFC 5034) with the PLAIN and LOGIN
+// mechanisms, checking passwords as USER/PASS does
+func (ses *Session) authHandler(args []string) {
+	if len(args) == 0 {
+		// RFC 1734 clients ask for the mechanisms this way
+		ses.send("+OK Supported mechanisms follow")
+		ses.send("PLAIN")
+		ses.send("LOGIN")
+		ses.send(".")
+		return
+	}
+	if ses.server.requireTLS && !ses.tls {
+		ses.logWarn("Refusing AUTH before STLS")
+		ses.send("-ERR Must issue STLS first")
+		return
+	}
+	if len(args) > 2 {
+		ses.send("-ERR AUTH requires a mechanism and optional initial response")
+		return
+	}
+
+	var initial string
+	if len(args) == 2 {
+		initial = args[1]
+	}
+	authz, name, pass, err := smtpd.SaslAuthenticate(args[0], initial, ses.challenge)
+	if err != nil {
+		if err == smtpd.ErrSaslMechanism {
+			ses.send("-ERR Unrecognized authentication type")
+		} else if ses.sendError == nil {
+			ses.send(fmt.Sprintf("-ERR %v", err))
+		}
+		return
+	}
+	ses.logIn(smtpd.SaslLogin(authz, name), smtpd.PasswordCheck(ses.server.db, pass))
+}
+
+// challenge sends a SASL challenge and reads the client's response
+func (ses *Session) challenge(text string) (string, error) {
+	ses.send("+ " + base64.StdEncoding.EncodeToString([]byte(text)))
+	line, err := ses.readLine()
+	if err != nil {
+		ses.sendError = err
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "*" {
+		return "", smtpd.ErrSaslCancelled
+	}
+	return line, nil
+}
@@ -3,6 +3,10 @@ package pop3d
 import (
 	"bufio"
 	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
@@ -11,6 +15,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/egggo/inbucket/database"
 	"github.com/egggo/inbucket/log"
 	"github.com/egggo/inbucket/smtpd"
 )
@@ -49,6 +54,8 @@ var commands = map[string]bool{
 	"PASS": true,
 	"APOP": true,
 	"CAPA": true,
+	"STLS": true,
+	"AUTH": true,
 }
 
 type Session struct {
@@ -59,10 +66,14 @@ type Session struct {
 	sendError  error           // Used to bail out of read loop on send error
 	state      State           // Current session state
 	reader     *bufio.Reader   // Buffered reader for our net conn
+	tls        bool            // Whether STLS has completed
+	banner     string          // Timestamp from our greeting, for APOP
 	user       string          // Mailbox name
+	readOnly   bool            // Logged in to a shared mailbox without delete rights
 	mailbox    smtpd.Mailbox   // Mailbox instance
 	messages   []smtpd.Message // Slice of messages in mailbox
 	retain     []bool          // Messages to retain upon UPDATE (true=retain)
+	retrieved  []bool          // Messages sent with RETR, flagged \Seen upon UPDATE
 	msgCount   int             // Number of undeleted messages
 }
 
@@ -87,15 +98,18 @@ func (ses *Session) String() string {
 func (s *Server) startSession(id int, conn net.Conn) {
 	log.LogInfo("POP3 connection from %v, starting session <%v>", conn.RemoteAddr(), id)
 	//expConnectsCurrent.Add(1)
+	ses := NewSession(s, id, conn)
 	defer func() {
-		conn.Close()
+		// ses.conn rather than conn, STLS may have replaced it
+		ses.conn.Close()
+		if ses.mailbox != nil {
+			ses.mailbox.Unlock()
+		}
 		s.waitgroup.Done()
 		//expConnectsCurrent.Add(-1)
 	}()
 
-	ses := NewSession(s, id, conn)
-	ses.send(fmt.Sprintf("+OK Inbucket POP3 server ready <%v.%v@%v>", os.Getpid(),
-		time.Now().Unix(), s.domain))
+	ses.greet()
 
 	// This is our command reading loop
 	for ses.state != QUIT && ses.sendError == nil {
@@ -119,8 +133,15 @@ func (s *Server) startSession(id int, conn net.Conn) {
 					// List our capabilities per RFC2449
 					ses.send("+OK Capability list follows")
 					ses.send("TOP")
-					ses.send("USER")
+					if ses.state == AUTHORIZATION && ses.server.tlsConfig != nil && !ses.tls {
+						ses.send("STLS")
+					}
+					if ses.tls || !ses.server.requireTLS {
+						ses.send("USER")
+						ses.send("SASL PLAIN LOGIN")
+					}
 					ses.send("UIDL")
+					ses.send("RESP-CODES")
 					ses.send("IMPLEMENTATION Inbucket")
 					ses.send(".")
 					continue
@@ -176,7 +197,33 @@ func (ses *Session) authorizationHandler(cmd string, args []string) {
 	case "QUIT":
 		ses.send("+OK Goodnight and good luck")
 		ses.enterState(QUIT)
+	case "STLS":
+		if ses.server.tlsConfig == nil || ses.tls {
+			ses.send("-ERR STLS not available")
+			return
+		}
+		ses.send("+OK Begin TLS negotiation")
+		conn := tls.Server(ses.conn, ses.server.tlsConfig)
+		if err := conn.SetDeadline(ses.nextDeadline()); err != nil {
+			ses.sendError = err
+			return
+		}
+		if err := conn.Handshake(); err != nil {
+			ses.logWarn("TLS handshake failed: %v", err)
+			ses.enterState(QUIT)
+			return
+		}
+		// Plain text buffered before the handshake is discarded
+		ses.conn = conn
+		ses.reader = bufio.NewReader(conn)
+		ses.tls = true
+		ses.user = ""
 	case "USER":
+		if ses.server.requireTLS && !ses.tls {
+			ses.logWarn("Refusing USER before STLS")
+			ses.send("-ERR Must issue STLS first")
+			return
+		}
 		if len(args) > 0 {
 			sub := strings.Split(args[0], "@")
 
@@ -186,39 +233,16 @@ func (ses *Session) authorizationHandler(cmd string, args []string) {
 			ses.send("-ERR Missing username argument")
 		}
 	case "PASS":
+		if ses.server.requireTLS && !ses.tls {
+			ses.logWarn("Refusing PASS before STLS")
+			ses.send("-ERR Must issue STLS first")
+			return
+		}
 		if ses.user == "" {
 			ses.ooSeq(cmd)
 		} else {
-			var err error
-
-			user, err := ses.server.db.UserGetByName(ses.user)
-
-			if err != nil || user == nil {
-				ses.logError("Failed to auth for %v - %v", ses.user, err)
-				ses.send(fmt.Sprintf("-ERR Failed to auth for %v", ses.user))
-				ses.enterState(QUIT)
-				return
-			}
-
-			ok, err := ses.server.db.Auth(user.Id, args[0])
-
-			if err != nil || !ok {
-				ses.logError("Failed to auth for %v - %v", ses.user, err)
-				ses.send(fmt.Sprintf("-ERR Failed to auth for %v", ses.user))
-				ses.enterState(QUIT)
-				return
-			}
-
-			ses.mailbox, err = ses.server.dataStore.MailboxFor(ses.user)
-			if err != nil {
-				ses.logError("Failed to open mailbox for %v - %v", ses.user, err)
-				ses.send(fmt.Sprintf("-ERR Failed to open mailbox for %v", ses.user))
-				ses.enterState(QUIT)
-				return
-			}
-			ses.loadMailbox()
-			ses.send(fmt.Sprintf("+OK Found %v messages for %v", ses.msgCount, ses.user))
-			ses.enterState(TRANSACTION)
+			pass := strings.Join(args, " ")
+			ses.logIn(ses.user, smtpd.PasswordCheck(ses.server.db, pass))
 		}
 	case "APOP":
 		if len(args) != 2 {
@@ -226,23 +250,80 @@ func (ses *Session) authorizationHandler(cmd string, args []string) {
 			ses.send("-ERR APOP requires two arguments")
 			return
 		}
-		ses.user = args[0]
-		var err error
-		ses.mailbox, err = ses.server.dataStore.MailboxFor(ses.user)
-		if err != nil {
-			ses.logError("Failed to open mailbox for %v", ses.user)
-			ses.send(fmt.Sprintf("-ERR Failed to open mailbox for %v", ses.user))
-			ses.enterState(QUIT)
-			return
-		}
-		ses.loadMailbox()
-		ses.send(fmt.Sprintf("+OK Found %v messages for %v", ses.msgCount, ses.user))
-		ses.enterState(TRANSACTION)
+		ses.logIn(strings.Split(args[0], "@")[0], apopCheck(ses.banner, args[1]))
+	case "AUTH":
+		ses.authHandler(args)
 	default:
 		ses.ooSeq(cmd)
 	}
 }
 
+// apopCheck returns a check for logIn accepting users whose APOP digest of
+// the timestamp in our banner is digest.  RFC 1939 APOP needs the secret in
+// the clear, so it has its own.
+func apopCheck(banner string, digest string) func(user *db.User) (bool, error) {
+	digest = strings.ToLower(digest)
+	return func(user *db.User) (bool, error) {
+		if user.ApopSecret == "" {
+			return false, fmt.Errorf("no APOP secret set")
+		}
+		sum := md5.Sum([]byte(banner + user.ApopSecret))
+		expected := hex.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(digest)) == 1, nil
+	}
+}
+
+// logIn opens the mailbox for name once check accepts the credentials
+// given for its user.  name is a user, or mailbox*user to open a shared
+// mailbox with the user's credentials.
+func (ses *Session) logIn(name string, check func(user *db.User) (bool, error)) {
+	mailbox, login := smtpd.SplitLogin(name)
+
+	user, err := smtpd.LogIn(ses.server.db, ses.server.throttle, "POP3", ses.remoteHost, login, check)
+	if err == smtpd.ErrThrottled {
+		ses.logWarn("Refusing login for %v - %v", login, err)
+		ses.send(fmt.Sprintf("-ERR %v", err))
+		ses.enterState(QUIT)
+		return
+	}
+	if err != nil {
+		ses.logError("Failed to auth for %v - %v", login, err)
+		ses.send(fmt.Sprintf("-ERR Failed to auth for %v", login))
+		ses.enterState(QUIT)
+		return
+	}
+
+	rights, err := ses.server.db.MailboxRights(mailbox, user)
+	if err != nil || rights == nil || !rights.Read {
+		ses.logWarn("User %v may not read mailbox %v - %v", login, mailbox, err)
+		ses.send(fmt.Sprintf("-ERR Permission denied for mailbox %v", mailbox))
+		ses.enterState(QUIT)
+		return
+	}
+	ses.user = mailbox
+	ses.readOnly = !rights.Delete
+
+	mb, err := ses.server.dataStore.MailboxFor(ses.user)
+	if err != nil {
+		ses.logError("Failed to open mailbox for %v - %v", ses.user, err)
+		ses.send(fmt.Sprintf("-ERR Failed to open mailbox for %v", ses.user))
+		ses.enterState(QUIT)
+		return
+	}
+	// RFC 1939 wants an exclusive-access lock on the maildrop, held until the
+	// session ends
+	if err = mb.Lock(fmt.Sprintf("POP3 session %v", ses.id)); err != nil {
+		ses.logWarn("Mailbox %v is locked - %v", ses.user, err)
+		ses.send(fmt.Sprintf("-ERR [IN-USE] Mailbox %v is locked by another session", ses.user))
+		ses.enterState(QUIT)
+		return
+	}
+	ses.mailbox = mb
+	ses.loadMailbox()
+	ses.send(fmt.Sprintf("+OK Found %v messages for %v", ses.msgCount, ses.user))
+	ses.enterState(TRANSACTION)
+}
+
 // TRANSACTION state
 func (ses *Session) transactionHandler(cmd string, args []string) {
 	switch cmd {
@@ -359,6 +440,11 @@ func (ses *Session) transactionHandler(cmd string, args []string) {
 			ses.send("-ERR DELE argument must not exceed the number of messages")
 			return
 		}
+		if ses.readOnly {
+			ses.logWarn("Client tried to DELE without delete rights on %v", ses.user)
+			ses.send("-ERR Permission denied, mailbox is read only")
+			return
+		}
 		if ses.retain[msgNum-1] {
 			ses.retain[msgNum-1] = false
 			ses.msgCount -= 1
@@ -391,6 +477,7 @@ func (ses *Session) transactionHandler(cmd string, args []string) {
 		}
 		ses.send(fmt.Sprintf("+OK %v bytes follows", ses.messages[msgNum-1].Size()))
 		ses.sendMessage(ses.messages[msgNum-1])
+		ses.retrieved[msgNum-1] = true
 	case "TOP":
 		if len(args) != 2 {
 			ses.logWarn("TOP command had invalid number of arguments")
@@ -522,6 +609,7 @@ func (ses *Session) loadMailbox() {
 		ses.logError("Failed to load messages for %v", ses.user)
 	}
 
+	ses.retrieved = make([]bool, len(ses.messages))
 	ses.retainAll()
 }
 
@@ -537,13 +625,18 @@ func (ses *Session) retainAll() {
 // This would be considered the "UPDATE" state in the RFC, but it does not fit
 // with our state-machine design here, since no commands are accepted - it just
 // indicates that the session was closed cleanly and that deletes should be
-// processed.
+// processed.  Retrieved messages that are kept are flagged \Seen, unless the
+// session could not change the mailbox.
 func (ses *Session) processDeletes() {
 	ses.logInfo("Processing deletes")
 	for i, msg := range ses.messages {
 		if !ses.retain[i] {
 			ses.logTrace("Deleting %v", msg)
 			msg.Delete()
+		} else if ses.retrieved[i] && !ses.readOnly {
+			if err := smtpd.AddFlags(msg, `\Seen`); err != nil {
+				ses.logWarn("Failed to flag %v seen: %v", msg, err)
+			}
 		}
 	}
 }
@@ -558,6 +651,13 @@ func (ses *Session) nextDeadline() time.Time {
 	return time.Now().Add(time.Duration(ses.server.maxIdleSeconds) * time.Second)
 }
 
+// greet sends the greeting with the timestamp APOP digests are made from
+func (ses *Session) greet() {
+	ses.banner = fmt.Sprintf("<%v.%v.%v@%v>", os.Getpid(), ses.id, time.Now().Unix(),
+		ses.server.domain)
+	ses.send(fmt.Sprintf("+OK Inbucket POP3 server ready %v", ses.banner))
+}
+
 // Send requested message, store errors in Session.sendError
 func (ses *Session) send(msg string) {
 	if err := ses.conn.SetWriteDeadline(ses.nextDeadline()); err != nil {
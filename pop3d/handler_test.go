@@ -0,0 +1,61 @@
+package pop3d
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApopCheck(t *testing.T) {
+	// The example from RFC 1939
+	banner := "<1896.697170952@dbc.mtview.ca.us>"
+	user := &db.User{Username: "mrose", ApopSecret: "tanstaaf"}
+
+	ok, err := apopCheck(banner, "c4c9334bac560ecc979e58001b3e22fb")(user)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = apopCheck(banner, "C4C9334BAC560ECC979E58001B3E22FB")(user)
+	assert.Nil(t, err)
+	assert.True(t, ok, "hex digits in either case")
+
+	ok, err = apopCheck(banner, "c4c9334bac560ecc979e58001b3e22fc")(user)
+	assert.Nil(t, err)
+	assert.False(t, ok, "wrong digest")
+	ok, _ = apopCheck("<1897.697170952@dbc.mtview.ca.us>", "c4c9334bac560ecc979e58001b3e22fb")(user)
+	assert.False(t, ok, "digest of another banner")
+
+	// Without a secret nothing matches, not even the digest of the bare banner
+	sum := md5.Sum([]byte(banner))
+	ok, err = apopCheck(banner, hex.EncodeToString(sum[:]))(&db.User{Username: "mrose"})
+	assert.NotNil(t, err)
+	assert.False(t, ok, "empty secret")
+}
+
+// Test that the timestamp in the greeting is the one APOP digests are checked against
+func TestApopBanner(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	ses := NewSession(&Server{domain: "inbucket.local", maxIdleSeconds: 5}, 7, serverConn)
+	go ses.greet()
+
+	greeting, err := bufio.NewReader(clientConn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := regexp.MustCompile(`^\+OK .* (<\d+\.7\.\d+@inbucket\.local>)\r\n$`).FindStringSubmatch(greeting)
+	if m == nil {
+		t.Fatalf("Unexpected greeting %q", greeting)
+	}
+	assert.Equal(t, ses.banner, m[1])
+
+	sum := md5.Sum([]byte(m[1] + "tanstaaf"))
+	ok, err := apopCheck(ses.banner, hex.EncodeToString(sum[:]))(&db.User{ApopSecret: "tanstaaf"})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
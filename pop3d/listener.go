@@ -1,6 +1,7 @@
 package pop3d
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sync"
@@ -23,22 +24,37 @@ type Server struct {
 	shutdown       bool
 	waitgroup      *sync.WaitGroup
 	db             *db.Database
+	tlsConfig      *tls.Config
+	requireTLS     bool
+	throttle       *smtpd.AuthThrottle
 }
 
 // Init a new Server object
 func New(db *db.Database) *Server {
 	// TODO is two filestores better/worse than sharing w/ smtpd?
-	ds := smtpd.DefaultFileDataStore()
+	ds := smtpd.DefaultDataStore()
 	cfg := config.GetPop3Config()
 
 	return &Server{domain: cfg.Domain, dataStore: ds, maxIdleSeconds: cfg.MaxIdleSeconds,
-		waitgroup: new(sync.WaitGroup),
-		db:        db}
+		requireTLS: cfg.RequireTLS,
+		throttle:   smtpd.DefaultAuthThrottle(),
+		waitgroup:  new(sync.WaitGroup),
+		db:         db}
 }
 
 // Main listener loop
 func (s *Server) Start() {
 	cfg := config.GetPop3Config()
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			log.LogError("POP3 failed to load TLS certificate: %v", err)
+			// TODO More graceful early-shutdown procedure
+			panic(err)
+		}
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
 	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%v:%v",
 		cfg.Ip4address, cfg.Ip4port))
 	if err != nil {
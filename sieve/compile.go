@@ -0,0 +1,354 @@
+package sieve
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Extensions we understand, scripts must require them before use
+var Extensions = []string{
+	"comparator-i;ascii-casemap", "comparator-i;octet", "copy", "envelope",
+	"fileinto", "imap4flags", "reject", "vacation", "variables",
+}
+
+type kind int
+
+const (
+	kindNone kind = iota
+	kindNumber
+	kindString
+	kindStringList
+)
+
+type tagSpec struct {
+	value kind
+	ext   string
+}
+
+// spec describes the arguments a command or test takes
+type spec struct {
+	ext    string
+	tags   map[string]tagSpec
+	params []kind
+	// Leading optional parameters, for imap4flags' variable name
+	optional int
+	// tests is 0 for none, 1 for a single test and 2 for a test list
+	tests int
+	block bool
+}
+
+var comparisonTags = map[string]tagSpec{
+	"comparator": {value: kindString},
+	"is":         {}, "contains": {}, "matches": {},
+}
+
+var addressTags = map[string]tagSpec{
+	"comparator": {value: kindString},
+	"is":         {}, "contains": {}, "matches": {},
+	"all": {}, "localpart": {}, "domain": {},
+}
+
+var commandSpecs = map[string]*spec{
+	"require": {params: []kind{kindStringList}},
+	"if":      {tests: 1, block: true},
+	"elsif":   {tests: 1, block: true},
+	"else":    {block: true},
+	"stop":    {},
+	"keep": {tags: map[string]tagSpec{
+		"flags": {value: kindStringList, ext: "imap4flags"}}},
+	"discard": {},
+	"redirect": {tags: map[string]tagSpec{"copy": {ext: "copy"}},
+		params: []kind{kindString}},
+	"fileinto": {ext: "fileinto", params: []kind{kindString},
+		tags: map[string]tagSpec{
+			"copy":  {ext: "copy"},
+			"flags": {value: kindStringList, ext: "imap4flags"}}},
+	"reject": {ext: "reject", params: []kind{kindString}},
+	"vacation": {ext: "vacation", params: []kind{kindString},
+		tags: map[string]tagSpec{
+			"days":      {value: kindNumber},
+			"subject":   {value: kindString},
+			"from":      {value: kindString},
+			"addresses": {value: kindStringList},
+			"mime":      {},
+			"handle":    {value: kindString}}},
+	"set": {ext: "variables", params: []kind{kindString, kindString},
+		tags: map[string]tagSpec{
+			"lower": {}, "upper": {}, "lowerfirst": {}, "upperfirst": {},
+			"quotewildcard": {}, "length": {}}},
+	"setflag":    {ext: "imap4flags", params: []kind{kindString, kindStringList}, optional: 1},
+	"addflag":    {ext: "imap4flags", params: []kind{kindString, kindStringList}, optional: 1},
+	"removeflag": {ext: "imap4flags", params: []kind{kindString, kindStringList}, optional: 1},
+}
+
+var testSpecs = map[string]*spec{
+	"address":  {tags: addressTags, params: []kind{kindStringList, kindStringList}},
+	"envelope": {ext: "envelope", tags: addressTags, params: []kind{kindStringList, kindStringList}},
+	"header":   {tags: comparisonTags, params: []kind{kindStringList, kindStringList}},
+	"exists":   {params: []kind{kindStringList}},
+	"size": {tags: map[string]tagSpec{"over": {}, "under": {}},
+		params: []kind{kindNumber}},
+	"true":   {},
+	"false":  {},
+	"not":    {tests: 1},
+	"allof":  {tests: 2},
+	"anyof":  {tests: 2},
+	"string": {ext: "variables", tags: comparisonTags, params: []kind{kindStringList, kindStringList}},
+	"hasflag": {ext: "imap4flags", tags: comparisonTags,
+		params: []kind{kindStringList, kindStringList}, optional: 1},
+}
+
+// Tags that may only appear once per command, whichever member is chosen
+var exclusiveTags = [][]string{
+	{"is", "contains", "matches"},
+	{"all", "localpart", "domain"},
+	{"over", "under"},
+	{"lower", "upper"},
+	{"lowerfirst", "upperfirst"},
+}
+
+// Script is a compiled Sieve script, ready to be run against messages
+type Script struct {
+	commands []*Command
+	requires map[string]bool
+}
+
+// Requires reports whether the script declared the named extension
+func (s *Script) Requires(ext string) bool {
+	return s.requires[ext]
+}
+
+// Compile parses and checks src, errors carry the line of the problem
+func Compile(src string) (*Script, error) {
+	cmds, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	c := &checker{requires: make(map[string]bool)}
+	if err = c.commands(cmds, true); err != nil {
+		return nil, err
+	}
+	return &Script{commands: cmds, requires: c.requires}, nil
+}
+
+type checker struct {
+	requires map[string]bool
+}
+
+func (c *checker) commands(cmds []*Command, top bool) error {
+	prev := ""
+	leading := top
+	for _, cmd := range cmds {
+		sp := commandSpecs[cmd.Name]
+		if sp == nil {
+			return errorf(cmd.Line, "unknown command %v", cmd.Name)
+		}
+		if sp.ext != "" && !c.requires[sp.ext] {
+			return errorf(cmd.Line, "%v requires the %q extension", cmd.Name, sp.ext)
+		}
+		switch cmd.Name {
+		case "require":
+			if !leading {
+				return errorf(cmd.Line, "require must come before other commands")
+			}
+		case "elsif", "else":
+			if prev != "if" && prev != "elsif" {
+				return errorf(cmd.Line, "%v without if", cmd.Name)
+			}
+		}
+		if cmd.Name != "require" {
+			leading = false
+		}
+
+		tags, params, err := c.arguments(cmd.Name, sp, cmd.Args, cmd.Line)
+		if err != nil {
+			return err
+		}
+		cmd.tags, cmd.params = tags, params
+
+		switch {
+		case sp.tests == 0 && len(cmd.Tests) > 0:
+			return errorf(cmd.Line, "%v does not take a test", cmd.Name)
+		case sp.tests == 1 && (len(cmd.Tests) != 1 || cmd.TestList):
+			return errorf(cmd.Line, "%v needs a single test", cmd.Name)
+		}
+		for _, t := range cmd.Tests {
+			if err = c.test(t); err != nil {
+				return err
+			}
+		}
+		if sp.block != cmd.HasBlock {
+			if sp.block {
+				return errorf(cmd.Line, "%v needs a block", cmd.Name)
+			}
+			return errorf(cmd.Line, "%v does not take a block", cmd.Name)
+		}
+		if err = c.commands(cmd.Block, false); err != nil {
+			return err
+		}
+
+		if cmd.Name == "require" {
+			for _, ext := range params[0].Strings {
+				if !supported(ext) {
+					return errorf(cmd.Line, "unsupported extension %q", ext)
+				}
+				c.requires[ext] = true
+			}
+		}
+		prev = cmd.Name
+	}
+	return nil
+}
+
+// ValidName checks a script name is one we are willing to store, RFC 5804
+// forbids control characters
+func ValidName(name string) bool {
+	if name == "" || len(name) > 255 {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar ||
+			r == '\u2028' || r == '\u2029' {
+			return false
+		}
+	}
+	return true
+}
+
+func supported(ext string) bool {
+	for _, e := range Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *checker) test(t *Test) error {
+	sp := testSpecs[t.Name]
+	if sp == nil {
+		return errorf(t.Line, "unknown test %v", t.Name)
+	}
+	if sp.ext != "" && !c.requires[sp.ext] {
+		return errorf(t.Line, "%v requires the %q extension", t.Name, sp.ext)
+	}
+	tags, params, err := c.arguments(t.Name, sp, t.Args, t.Line)
+	if err != nil {
+		return err
+	}
+	t.tags, t.params = tags, params
+	switch {
+	case sp.tests == 0 && len(t.Tests) > 0:
+		return errorf(t.Line, "%v does not take a test", t.Name)
+	case sp.tests == 1 && len(t.Tests) != 1:
+		return errorf(t.Line, "%v needs a single test", t.Name)
+	case sp.tests == 2 && len(t.Tests) == 0:
+		return errorf(t.Line, "%v needs a test list", t.Name)
+	}
+	if t.Name == "size" && len(tags) != 1 {
+		return errorf(t.Line, "size needs :over or :under")
+	}
+	for _, sub := range t.Tests {
+		if err = c.test(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// arguments splits args into tagged and positional arguments, checking them
+// against sp
+func (c *checker) arguments(name string, sp *spec, args []*Argument,
+	line int) (map[string]*Argument, []*Argument, error) {
+	tags := make(map[string]*Argument)
+	params := make([]*Argument, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg.Type != argTag {
+			params = append(params, arg)
+			continue
+		}
+		if len(params) > 0 {
+			return nil, nil, errorf(arg.Line, "tag :%v must come before positional arguments", arg.Tag)
+		}
+		ts, ok := sp.tags[arg.Tag]
+		if !ok {
+			return nil, nil, errorf(arg.Line, "%v does not take :%v", name, arg.Tag)
+		}
+		if ts.ext != "" && !c.requires[ts.ext] {
+			return nil, nil, errorf(arg.Line, ":%v requires the %q extension", arg.Tag, ts.ext)
+		}
+		if _, dup := tags[arg.Tag]; dup {
+			return nil, nil, errorf(arg.Line, ":%v given twice", arg.Tag)
+		}
+		var value *Argument
+		if ts.value != kindNone {
+			i++
+			if i >= len(args) || !matchesKind(args[i], ts.value) {
+				return nil, nil, errorf(arg.Line, ":%v needs a %v", arg.Tag, kindName(ts.value))
+			}
+			value = args[i]
+		}
+		tags[arg.Tag] = value
+	}
+	for _, group := range exclusiveTags {
+		n := 0
+		for _, tag := range group {
+			if _, ok := tags[tag]; ok {
+				n++
+			}
+		}
+		if n > 1 {
+			return nil, nil, errorf(line, "%v takes only one of :%v", name, strings.Join(group, ", :"))
+		}
+	}
+	if cmp, ok := tags["comparator"]; ok {
+		switch cmp.Strings[0] {
+		case "i;ascii-casemap", "i;octet":
+		default:
+			return nil, nil, errorf(cmp.Line, "unsupported comparator %q", cmp.Strings[0])
+		}
+	}
+
+	// Leading optional parameters are dropped from the front of the spec
+	kinds := sp.params
+	if extra := len(kinds) - len(params); extra > 0 && extra <= sp.optional {
+		kinds = kinds[extra:]
+	}
+	if len(params) != len(kinds) {
+		return nil, nil, errorf(line, "%v takes %v arguments but %v were given", name, len(kinds), len(params))
+	}
+	for i, k := range kinds {
+		if !matchesKind(params[i], k) {
+			return nil, nil, errorf(params[i].Line, "%v argument %v must be a %v", name, i+1, kindName(k))
+		}
+	}
+	if len(params) < len(sp.params) {
+		// Pad so the executor can address parameters by position
+		pad := make([]*Argument, len(sp.params)-len(params))
+		params = append(pad, params...)
+	}
+	return tags, params, nil
+}
+
+func matchesKind(arg *Argument, k kind) bool {
+	switch k {
+	case kindNumber:
+		return arg.Type == argNumber
+	case kindString:
+		return arg.Type == argStrings && !arg.IsList
+	case kindStringList:
+		return arg.Type == argStrings
+	}
+	return false
+}
+
+func kindName(k kind) string {
+	switch k {
+	case kindNumber:
+		return "number"
+	case kindString:
+		return "string"
+	}
+	return "string list"
+}
@@ -0,0 +1,550 @@
+package sieve
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Most redirects a single script run may perform
+const MAX_REDIRECTS = 10
+
+// Action types returned by Execute
+const (
+	ACTION_KEEP     = "keep"
+	ACTION_FILEINTO = "fileinto"
+	ACTION_REDIRECT = "redirect"
+	ACTION_REJECT   = "reject"
+	ACTION_VACATION = "vacation"
+)
+
+// Message is what a script is run against: the message header, its size and
+// the SMTP envelope
+type Message struct {
+	Header mail.Header
+	Size   int
+	From   string
+	To     string
+}
+
+// Vacation holds the arguments of a vacation action, the caller decides
+// whether a response is due (RFC 5230 4.2)
+type Vacation struct {
+	Days      int
+	Subject   string
+	From      string
+	Addresses []string
+	Mime      bool
+	Handle    string
+	Reason    string
+}
+
+// Action is something the script asked to be done with the message
+type Action struct {
+	Type     string
+	Mailbox  string
+	Address  string
+	Reason   string
+	Flags    []string
+	Vacation *Vacation
+}
+
+type execution struct {
+	script   *Script
+	msg      *Message
+	vars     map[string]string
+	matches  []string
+	flags    []string
+	actions  []*Action
+	keep     bool
+	stopped  bool
+	redirect int
+}
+
+var wordDecoder = new(mime.WordDecoder)
+
+// Execute runs the script against msg.  The implicit keep is included in the
+// returned actions unless the script cancelled it.  On a runtime error the
+// caller should fall back to keeping the message (RFC 5228 2.10.6).
+func (s *Script) Execute(msg *Message) ([]*Action, error) {
+	e := &execution{
+		script:  s,
+		msg:     msg,
+		vars:    make(map[string]string),
+		keep:    true,
+		actions: make([]*Action, 0),
+	}
+	if err := e.run(s.commands); err != nil {
+		return nil, err
+	}
+	if e.keep {
+		e.actions = append(e.actions, &Action{Type: ACTION_KEEP, Flags: e.flags})
+	}
+	return e.actions, nil
+}
+
+func (e *execution) run(cmds []*Command) error {
+	// Whether the preceding if/elsif chain has already taken a branch
+	taken := false
+	for _, cmd := range cmds {
+		if e.stopped {
+			return nil
+		}
+		switch cmd.Name {
+		case "if", "elsif", "else":
+			if cmd.Name == "if" {
+				taken = false
+			}
+			if taken {
+				continue
+			}
+			if cmd.Name != "else" {
+				ok, err := e.test(cmd.Tests[0])
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+			}
+			taken = true
+			if err := e.run(cmd.Block); err != nil {
+				return err
+			}
+		default:
+			if err := e.command(cmd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *execution) command(cmd *Command) error {
+	switch cmd.Name {
+	case "require":
+	case "stop":
+		e.stopped = true
+	case "keep":
+		e.keep = false
+		e.add(&Action{Type: ACTION_KEEP, Flags: e.actionFlags(cmd)})
+	case "discard":
+		e.keep = false
+	case "fileinto":
+		if _, ok := cmd.tags["copy"]; !ok {
+			e.keep = false
+		}
+		e.add(&Action{Type: ACTION_FILEINTO, Mailbox: e.expand(cmd.params[0].Strings[0]),
+			Flags: e.actionFlags(cmd)})
+	case "redirect":
+		if e.redirect++; e.redirect > MAX_REDIRECTS {
+			return errorf(cmd.Line, "too many redirects")
+		}
+		if _, ok := cmd.tags["copy"]; !ok {
+			e.keep = false
+		}
+		addr := e.expand(cmd.params[0].Strings[0])
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return errorf(cmd.Line, "bad redirect address %q", addr)
+		}
+		e.add(&Action{Type: ACTION_REDIRECT, Address: addr})
+	case "reject":
+		e.keep = false
+		e.add(&Action{Type: ACTION_REJECT, Reason: e.expand(cmd.params[0].Strings[0])})
+	case "vacation":
+		e.add(&Action{Type: ACTION_VACATION, Vacation: e.vacation(cmd)})
+	case "set":
+		e.set(cmd)
+	case "setflag", "addflag", "removeflag":
+		e.setFlags(cmd)
+	}
+	return e.compatible(cmd.Line)
+}
+
+// add records an action, dropping exact duplicates
+func (e *execution) add(action *Action) {
+	for _, a := range e.actions {
+		if a.Type == action.Type && a.Mailbox == action.Mailbox && a.Address == action.Address &&
+			action.Type != ACTION_VACATION {
+			a.Flags = action.Flags
+			return
+		}
+	}
+	e.actions = append(e.actions, action)
+}
+
+// compatible enforces RFC 5429 2.1, reject cannot be combined with delivery
+// or vacation
+func (e *execution) compatible(line int) error {
+	rejected, other := false, ""
+	for _, a := range e.actions {
+		switch a.Type {
+		case ACTION_REJECT:
+			rejected = true
+		default:
+			other = a.Type
+		}
+	}
+	if rejected && other != "" {
+		return errorf(line, "reject cannot be used with %v", other)
+	}
+	return nil
+}
+
+func (e *execution) vacation(cmd *Command) *Vacation {
+	v := &Vacation{Days: 7, Reason: e.expand(cmd.params[0].Strings[0])}
+	if arg := cmd.tags["days"]; arg != nil {
+		v.Days = arg.Number
+		if v.Days < 1 {
+			v.Days = 1
+		}
+	}
+	if arg := cmd.tags["subject"]; arg != nil {
+		v.Subject = e.expand(arg.Strings[0])
+	}
+	if arg := cmd.tags["from"]; arg != nil {
+		v.From = e.expand(arg.Strings[0])
+	}
+	if arg := cmd.tags["addresses"]; arg != nil {
+		v.Addresses = e.expandList(arg.Strings)
+	}
+	_, v.Mime = cmd.tags["mime"]
+	if arg := cmd.tags["handle"]; arg != nil {
+		v.Handle = e.expand(arg.Strings[0])
+	} else {
+		// RFC 5230 4.2, responses with different arguments are different
+		v.Handle = fmt.Sprintf("%v\x00%v\x00%v\x00%v", v.Reason, v.Subject, v.From, v.Mime)
+	}
+	return v
+}
+
+func (e *execution) test(t *Test) (bool, error) {
+	switch t.Name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "not":
+		ok, err := e.test(t.Tests[0])
+		return !ok, err
+	case "allof", "anyof":
+		want := t.Name == "anyof"
+		for _, sub := range t.Tests {
+			ok, err := e.test(sub)
+			if err != nil {
+				return false, err
+			}
+			if ok == want {
+				return want, nil
+			}
+		}
+		return !want, nil
+	case "exists":
+		for _, name := range e.expandList(t.params[0].Strings) {
+			if len(e.msg.Header[textprotoKey(name)]) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "size":
+		if _, over := t.tags["over"]; over {
+			return e.msg.Size > t.params[0].Number, nil
+		}
+		return e.msg.Size < t.params[0].Number, nil
+	case "header":
+		values := make([]string, 0)
+		for _, name := range e.expandList(t.params[0].Strings) {
+			values = append(values, e.headerValues(name)...)
+		}
+		return e.match(t, values, t.params[1].Strings), nil
+	case "address":
+		values := make([]string, 0)
+		for _, name := range e.expandList(t.params[0].Strings) {
+			for _, v := range e.headerValues(name) {
+				for _, addr := range parseAddresses(v) {
+					values = append(values, addressPart(t, addr))
+				}
+			}
+		}
+		return e.match(t, values, t.params[1].Strings), nil
+	case "envelope":
+		values := make([]string, 0)
+		for _, part := range e.expandList(t.params[0].Strings) {
+			switch strings.ToLower(part) {
+			case "from":
+				values = append(values, addressPart(t, e.msg.From))
+			case "to":
+				values = append(values, addressPart(t, e.msg.To))
+			}
+		}
+		return e.match(t, values, t.params[1].Strings), nil
+	case "string":
+		return e.match(t, e.expandList(t.params[0].Strings), t.params[1].Strings), nil
+	case "hasflag":
+		flags := e.flags
+		if t.params[0] != nil {
+			flags = make([]string, 0)
+			for _, name := range e.expandList(t.params[0].Strings) {
+				flags = addFlags(flags, strings.Fields(e.vars[strings.ToLower(name)]))
+			}
+		}
+		return e.match(t, flags, t.params[1].Strings), nil
+	}
+	return false, errorf(t.Line, "unknown test %v", t.Name)
+}
+
+func textprotoKey(name string) string {
+	return textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+}
+
+// headerValues returns the unfolded and decoded values of the named header
+func (e *execution) headerValues(name string) []string {
+	raw := e.msg.Header[textprotoKey(name)]
+	values := make([]string, 0, len(raw))
+	for _, v := range raw {
+		v = strings.Replace(strings.Replace(v, "\r\n", "", -1), "\n", "", -1)
+		if dec, err := wordDecoder.DecodeHeader(v); err == nil {
+			v = dec
+		}
+		values = append(values, strings.TrimSpace(v))
+	}
+	return values
+}
+
+// parseAddresses pulls the addresses out of a header value, falling back to
+// the raw value when it does not parse
+func parseAddresses(value string) []string {
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return []string{value}
+	}
+	addrs := make([]string, 0, len(list))
+	for _, a := range list {
+		addrs = append(addrs, a.Address)
+	}
+	return addrs
+}
+
+func addressPart(t *Test, addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if _, ok := t.tags["localpart"]; ok {
+		if at < 0 {
+			return addr
+		}
+		return addr[:at]
+	}
+	if _, ok := t.tags["domain"]; ok {
+		if at < 0 {
+			return ""
+		}
+		return addr[at+1:]
+	}
+	return addr
+}
+
+// match compares values against keys using the test's comparator and match
+// type, :matches records the wildcard captures for ${1} and friends
+func (e *execution) match(t *Test, values []string, keys []string) bool {
+	fold := true
+	if cmp := t.tags["comparator"]; cmp != nil && cmp.Strings[0] == "i;octet" {
+		fold = false
+	}
+	keys = e.expandList(keys)
+	for _, v := range values {
+		for _, k := range keys {
+			cv, ck := v, k
+			if fold {
+				cv, ck = strings.ToLower(v), strings.ToLower(k)
+			}
+			if _, ok := t.tags["contains"]; ok {
+				if strings.Contains(cv, ck) {
+					return true
+				}
+				continue
+			}
+			if _, ok := t.tags["matches"]; ok {
+				if caps, ok := globMatch(ck, cv, v); ok {
+					if e.script.requires["variables"] {
+						e.matches = append([]string{v}, caps...)
+					}
+					return true
+				}
+				continue
+			}
+			if cv == ck {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globMatch matches value against pattern, where * matches any run of
+// characters and ? matches one.  Captures are taken from orig, which is value
+// before case folding.
+func globMatch(pattern string, value string, orig string) ([]string, bool) {
+	var re strings.Builder
+	re.WriteString("(?s)^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			re.WriteString("(.*?)")
+		case '?':
+			re.WriteString("(.)")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+	exp, err := regexp.Compile(re.String())
+	if err != nil {
+		return nil, false
+	}
+	idx := exp.FindStringSubmatchIndex(value)
+	if idx == nil {
+		return nil, false
+	}
+	caps := make([]string, 0, len(idx)/2-1)
+	for i := 2; i < len(idx); i += 2 {
+		if len(orig) == len(value) {
+			caps = append(caps, orig[idx[i]:idx[i+1]])
+		} else {
+			caps = append(caps, value[idx[i]:idx[i+1]])
+		}
+	}
+	return caps, true
+}
+
+var variableRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_.]*|[0-9]+)\}`)
+
+// expand substitutes ${name} references when the variables extension is in
+// use, unknown namespaces are left untouched
+func (e *execution) expand(s string) string {
+	if !e.script.requires["variables"] || !strings.Contains(s, "${") {
+		return s
+	}
+	return variableRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := strings.ToLower(ref[2 : len(ref)-1])
+		if n, err := strconv.Atoi(name); err == nil {
+			if n < len(e.matches) {
+				return e.matches[n]
+			}
+			return ""
+		}
+		if strings.Contains(name, ".") {
+			return ref
+		}
+		return e.vars[name]
+	})
+}
+
+func (e *execution) expandList(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = e.expand(s)
+	}
+	return out
+}
+
+// set implements the variables extension set command, modifiers apply in
+// order of precedence (RFC 5229 4.1)
+func (e *execution) set(cmd *Command) {
+	value := e.expand(cmd.params[1].Strings[0])
+	if _, ok := cmd.tags["lower"]; ok {
+		value = strings.ToLower(value)
+	}
+	if _, ok := cmd.tags["upper"]; ok {
+		value = strings.ToUpper(value)
+	}
+	if _, ok := cmd.tags["lowerfirst"]; ok && value != "" {
+		value = strings.ToLower(value[:1]) + value[1:]
+	}
+	if _, ok := cmd.tags["upperfirst"]; ok && value != "" {
+		value = strings.ToUpper(value[:1]) + value[1:]
+	}
+	if _, ok := cmd.tags["quotewildcard"]; ok {
+		r := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
+		value = r.Replace(value)
+	}
+	if _, ok := cmd.tags["length"]; ok {
+		value = strconv.Itoa(len([]rune(value)))
+	}
+	e.vars[strings.ToLower(cmd.params[0].Strings[0])] = value
+}
+
+// setFlags implements setflag, addflag and removeflag from imap4flags,
+// acting on a named variable or the internal flags variable
+func (e *execution) setFlags(cmd *Command) {
+	current := e.flags
+	name := ""
+	if cmd.params[0] != nil {
+		name = strings.ToLower(cmd.params[0].Strings[0])
+		current = strings.Fields(e.vars[name])
+	}
+	given := make([]string, 0)
+	for _, s := range e.expandList(cmd.params[1].Strings) {
+		given = append(given, strings.Fields(s)...)
+	}
+	switch cmd.Name {
+	case "setflag":
+		current = addFlags(nil, given)
+	case "addflag":
+		current = addFlags(current, given)
+	case "removeflag":
+		kept := make([]string, 0, len(current))
+		for _, f := range current {
+			if !hasFlag(given, f) {
+				kept = append(kept, f)
+			}
+		}
+		current = kept
+	}
+	if name != "" {
+		e.vars[name] = strings.Join(current, " ")
+	} else {
+		e.flags = current
+	}
+}
+
+// actionFlags returns the flags for keep or fileinto, from :flags if given
+// otherwise the internal flags variable
+func (e *execution) actionFlags(cmd *Command) []string {
+	if arg := cmd.tags["flags"]; arg != nil {
+		flags := make([]string, 0)
+		for _, s := range e.expandList(arg.Strings) {
+			flags = addFlags(flags, strings.Fields(s))
+		}
+		return flags
+	}
+	return e.flags
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// addFlags adds flags not already present, flags compare case insensitively
+func addFlags(flags []string, add []string) []string {
+	out := append(make([]string, 0, len(flags)+len(add)), flags...)
+	for _, f := range add {
+		if !hasFlag(out, f) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
@@ -0,0 +1,456 @@
+/*
+	The sieve package implements the Sieve mail filtering language (RFC 5228)
+	along with the extensions Inbucket supports for per-user delivery rules
+*/
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Error describes a problem with a script, Line is 1 based
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+func errorf(line int, format string, args ...interface{}) *Error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokIdentifier
+	tokTag
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	typ  tokenType
+	text string
+	num  int
+	line int
+}
+
+func (t *token) String() string {
+	switch t.typ {
+	case tokEOF:
+		return "end of script"
+	case tokString:
+		return "string"
+	case tokNumber:
+		return "number " + strconv.Itoa(t.num)
+	case tokTag:
+		return ":" + t.text
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lexer splits a script into tokens, skipping whitespace and comments
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func (l *lexer) next() (*token, error) {
+	// Skip white space and comments
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return nil, errorf(l.line, "unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			goto token
+		}
+	}
+	return &token{typ: tokEOF, line: l.line}, nil
+
+token:
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case isAlpha(c):
+		for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		word := l.src[start:l.pos]
+		if strings.EqualFold(word, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			return l.multiline()
+		}
+		return &token{typ: tokIdentifier, text: strings.ToLower(word), line: l.line}, nil
+	case c == ':':
+		l.pos++
+		for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		if l.pos == start+1 || !isAlpha(l.src[start+1]) {
+			return nil, errorf(l.line, "bad tag")
+		}
+		return &token{typ: tokTag, text: strings.ToLower(l.src[start+1 : l.pos]), line: l.line}, nil
+	case isDigit(c):
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		n, err := strconv.Atoi(l.src[start:l.pos])
+		if err != nil {
+			return nil, errorf(l.line, "bad number %q", l.src[start:l.pos])
+		}
+		if l.pos < len(l.src) {
+			switch l.src[l.pos] {
+			case 'k', 'K':
+				n <<= 10
+				l.pos++
+			case 'm', 'M':
+				n <<= 20
+				l.pos++
+			case 'g', 'G':
+				n <<= 30
+				l.pos++
+			}
+		}
+		return &token{typ: tokNumber, num: n, line: l.line}, nil
+	case c == '"':
+		return l.quoted()
+	case strings.IndexByte(";,()[]{}", c) >= 0:
+		l.pos++
+		return &token{typ: tokPunct, text: string(c), line: l.line}, nil
+	}
+	return nil, errorf(l.line, "unexpected character %q", c)
+}
+
+// quoted reads a quoted string, a backslash escapes the next character
+func (l *lexer) quoted() (*token, error) {
+	line := l.line
+	l.pos++
+	var buf strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case '"':
+			return &token{typ: tokString, text: buf.String(), line: line}, nil
+		case '\\':
+			if l.pos < len(l.src) {
+				c = l.src[l.pos]
+				l.pos++
+			}
+		case '\n':
+			l.line++
+		}
+		buf.WriteByte(c)
+	}
+	return nil, errorf(line, "unterminated string")
+}
+
+// multiline reads a text: string, ended by a line containing a single dot
+func (l *lexer) multiline() (*token, error) {
+	line := l.line
+	// Rest of the text: line may only hold white space or a comment
+	eol := strings.IndexByte(l.src[l.pos:], '\n')
+	if eol < 0 {
+		return nil, errorf(line, "unterminated multi-line string")
+	}
+	rest := strings.TrimSpace(l.src[l.pos : l.pos+eol])
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, errorf(line, "unexpected text after text:")
+	}
+	l.pos += eol + 1
+	l.line++
+
+	var buf strings.Builder
+	for {
+		eol = strings.IndexByte(l.src[l.pos:], '\n')
+		if eol < 0 {
+			return nil, errorf(line, "unterminated multi-line string")
+		}
+		text := strings.TrimSuffix(l.src[l.pos:l.pos+eol], "\r")
+		l.pos += eol + 1
+		l.line++
+		if text == "." {
+			return &token{typ: tokString, text: buf.String(), line: line}, nil
+		}
+		// Dot stuffing
+		if strings.HasPrefix(text, "..") {
+			text = text[1:]
+		}
+		buf.WriteString(text)
+		buf.WriteString("\r\n")
+	}
+}
+
+type argType int
+
+const (
+	argTag argType = iota
+	argNumber
+	argStrings
+)
+
+// Argument is a tag, number, string or string list.  A single string is held
+// as a list of one, IsList records which form was written.
+type Argument struct {
+	Type    argType
+	Tag     string
+	Number  int
+	Strings []string
+	IsList  bool
+	Line    int
+}
+
+// Test is a test command, used as the condition of if and elsif
+type Test struct {
+	Name  string
+	Args  []*Argument
+	Tests []*Test
+	Line  int
+
+	tags   map[string]*Argument
+	params []*Argument
+}
+
+// Command is a control or action command with an optional block
+type Command struct {
+	Name     string
+	Args     []*Argument
+	Tests    []*Test
+	TestList bool
+	Block    []*Command
+	HasBlock bool
+	Line     int
+
+	tags   map[string]*Argument
+	params []*Argument
+}
+
+type parser struct {
+	lex *lexer
+	tok *token
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) isPunct(s string) bool {
+	return p.tok.typ == tokPunct && p.tok.text == s
+}
+
+func (p *parser) expectPunct(s string) error {
+	if !p.isPunct(s) {
+		return errorf(p.tok.line, "expected %q but found %v", s, p.tok)
+	}
+	return p.advance()
+}
+
+// parse reads the whole script into a list of commands
+func parse(src string) ([]*Command, error) {
+	p := &parser{lex: &lexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.typ != tokEOF {
+		return nil, errorf(p.tok.line, "unexpected %v", p.tok)
+	}
+	return cmds, nil
+}
+
+func (p *parser) commands() ([]*Command, error) {
+	cmds := make([]*Command, 0)
+	for p.tok.typ == tokIdentifier {
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (p *parser) command() (*Command, error) {
+	cmd := &Command{Name: p.tok.text, Line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	args, err := p.arguments()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Args = args
+
+	// Optional test or test list
+	switch {
+	case p.isPunct("("):
+		cmd.TestList = true
+		if cmd.Tests, err = p.testList(); err != nil {
+			return nil, err
+		}
+	case p.tok.typ == tokIdentifier:
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		cmd.Tests = []*Test{test}
+	}
+
+	switch {
+	case p.isPunct(";"):
+		return cmd, p.advance()
+	case p.isPunct("{"):
+		if err = p.advance(); err != nil {
+			return nil, err
+		}
+		if cmd.Block, err = p.commands(); err != nil {
+			return nil, err
+		}
+		cmd.HasBlock = true
+		return cmd, p.expectPunct("}")
+	}
+	return nil, errorf(p.tok.line, "expected \";\" or block after %v but found %v", cmd.Name, p.tok)
+}
+
+func (p *parser) arguments() ([]*Argument, error) {
+	args := make([]*Argument, 0)
+	for {
+		arg := &Argument{Line: p.tok.line}
+		switch {
+		case p.tok.typ == tokTag:
+			arg.Type = argTag
+			arg.Tag = p.tok.text
+		case p.tok.typ == tokNumber:
+			arg.Type = argNumber
+			arg.Number = p.tok.num
+		case p.tok.typ == tokString:
+			arg.Type = argStrings
+			arg.Strings = []string{p.tok.text}
+		case p.isPunct("["):
+			arg.Type = argStrings
+			arg.IsList = true
+			list, err := p.stringList()
+			if err != nil {
+				return nil, err
+			}
+			arg.Strings = list
+			args = append(args, arg)
+			continue
+		default:
+			return args, nil
+		}
+		args = append(args, arg)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) stringList() ([]string, error) {
+	list := make([]string, 0)
+	for {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.typ != tokString {
+			return nil, errorf(p.tok.line, "expected string in list but found %v", p.tok)
+		}
+		list = append(list, p.tok.text)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.isPunct("]") {
+			return list, p.advance()
+		}
+		if !p.isPunct(",") {
+			return nil, errorf(p.tok.line, "expected \",\" or \"]\" but found %v", p.tok)
+		}
+	}
+}
+
+func (p *parser) test() (*Test, error) {
+	if p.tok.typ != tokIdentifier {
+		return nil, errorf(p.tok.line, "expected test but found %v", p.tok)
+	}
+	test := &Test{Name: p.tok.text, Line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	args, err := p.arguments()
+	if err != nil {
+		return nil, err
+	}
+	test.Args = args
+	switch {
+	case p.isPunct("("):
+		if test.Tests, err = p.testList(); err != nil {
+			return nil, err
+		}
+	case p.tok.typ == tokIdentifier:
+		sub, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		test.Tests = []*Test{sub}
+	}
+	return test, nil
+}
+
+func (p *parser) testList() ([]*Test, error) {
+	tests := make([]*Test, 0)
+	for {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+		if p.isPunct(")") {
+			return tests, p.advance()
+		}
+		if !p.isPunct(",") {
+			return nil, errorf(p.tok.line, "expected \",\" or \")\" but found %v", p.tok)
+		}
+	}
+}
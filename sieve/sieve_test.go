@@ -0,0 +1,202 @@
+package sieve
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testHeader = "From: \"Bob Smith\" <bob@example.com>\r\n" +
+	"To: alice@inbucket.org, carol@Example.org\r\n" +
+	"Subject: =?UTF-8?Q?Weekly_report_for_March?=\r\n" +
+	"X-Spam-Flag: YES\r\n" +
+	"List-Id: <dev.lists.example.com>\r\n" +
+	"\r\n"
+
+func testMessage(t *testing.T) *Message {
+	m, err := mail.ReadMessage(strings.NewReader(testHeader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Message{Header: m.Header, Size: 2048, From: "bob@example.com",
+		To: "alice@inbucket.org"}
+}
+
+func run(t *testing.T, src string) []*Action {
+	script, err := Compile(src)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	actions, err := script.Execute(testMessage(t))
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	return actions
+}
+
+func TestImplicitKeep(t *testing.T) {
+	actions := run(t, "# nothing to do\r\n")
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, ACTION_KEEP, actions[0].Type)
+
+	actions = run(t, "discard;")
+	assert.Equal(t, 0, len(actions))
+}
+
+func TestFileinto(t *testing.T) {
+	actions := run(t, `require "fileinto";
+if header :contains "subject" "weekly report" {
+	fileinto "Reports";
+}`)
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, ACTION_FILEINTO, actions[0].Type)
+	assert.Equal(t, "Reports", actions[0].Mailbox)
+
+	// :copy keeps the implicit keep
+	actions = run(t, `require ["fileinto", "copy"];
+fileinto :copy "Reports";`)
+	assert.Equal(t, 2, len(actions))
+	assert.Equal(t, ACTION_KEEP, actions[1].Type)
+}
+
+func TestIfElsif(t *testing.T) {
+	src := `require "fileinto";
+if address :domain :is "from" "example.net" {
+	fileinto "net";
+} elsif address :localpart "from" "bob" {
+	fileinto "bob";
+} else {
+	fileinto "other";
+}`
+	actions := run(t, src)
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, "bob", actions[0].Mailbox)
+}
+
+func TestTests(t *testing.T) {
+	var cases = []struct {
+		test string
+		want bool
+	}{
+		{`true`, true},
+		{`false`, false},
+		{`not true`, false},
+		{`exists ["From", "List-Id"]`, true},
+		{`exists ["From", "X-Missing"]`, false},
+		{`size :over 1K`, true},
+		{`size :under 1K`, false},
+		{`header :is "x-spam-flag" "yes"`, true},
+		{`header :comparator "i;octet" :is "x-spam-flag" "yes"`, false},
+		{`header :matches "subject" "weekly*march"`, true},
+		{`header :matches "list-id" "<*.lists.example.com>"`, true},
+		{`address :all :is "to" "carol@example.org"`, true},
+		{`address :domain :is ["to", "cc"] "inbucket.org"`, true},
+		{`envelope :localpart :is "to" "alice"`, true},
+		{`envelope :domain :is "from" "example.org"`, false},
+		{`allof (true, header :contains "from" "bob")`, true},
+		{`allof (true, false)`, false},
+		{`anyof (false, exists "subject")`, true},
+		{`anyof (false, false)`, false},
+	}
+	for _, c := range cases {
+		src := "require \"envelope\";\r\nif " + c.test + " { discard; }"
+		actions := run(t, src)
+		assert.Equal(t, c.want, len(actions) == 0, c.test)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	actions := run(t, `require ["fileinto", "variables"];
+if header :matches "list-id" "<*.lists.*>" {
+	set :lower :upperfirst "list" "${1}";
+	fileinto "Lists/${list}";
+}`)
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, "Lists/Dev", actions[0].Mailbox)
+
+	actions = run(t, `require ["variables", "reject"];
+set "limit" "2";
+set :length "len" "abcd";
+if string :is "${len}" "4" { reject "too long: ${len} > ${limit}"; }`)
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, ACTION_REJECT, actions[0].Type)
+	assert.Equal(t, "too long: 4 > 2", actions[0].Reason)
+}
+
+func TestVacation(t *testing.T) {
+	actions := run(t, `require "vacation";
+vacation :days 3 :subject "Away" :addresses ["alice@inbucket.org"] text:
+I am away until Monday.
+..and will reply then.
+.
+;`)
+	assert.Equal(t, 2, len(actions))
+	v := actions[0].Vacation
+	if assert.NotNil(t, v) {
+		assert.Equal(t, 3, v.Days)
+		assert.Equal(t, "Away", v.Subject)
+		assert.Equal(t, "I am away until Monday.\r\n.and will reply then.\r\n", v.Reason)
+		assert.NotEqual(t, "", v.Handle)
+	}
+	assert.Equal(t, ACTION_KEEP, actions[1].Type)
+}
+
+func TestFlags(t *testing.T) {
+	actions := run(t, `require ["imap4flags", "fileinto"];
+addflag "\\Seen";
+addflag ["$Junk", "\\seen"];
+fileinto :flags "\\Flagged" "Flagged";
+removeflag "$Junk";
+if hasflag :is "\\SEEN" { keep; }`)
+	assert.Equal(t, 2, len(actions))
+	assert.Equal(t, []string{`\Flagged`}, actions[0].Flags)
+	assert.Equal(t, []string{`\Seen`}, actions[1].Flags)
+}
+
+func TestStopAndRedirect(t *testing.T) {
+	actions := run(t, `redirect "carol@example.org"; stop; discard;`)
+	assert.Equal(t, 1, len(actions))
+	assert.Equal(t, ACTION_REDIRECT, actions[0].Type)
+	assert.Equal(t, "carol@example.org", actions[0].Address)
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	script, err := Compile(`require "reject"; keep; reject "no";`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = script.Execute(testMessage(t))
+	assert.Error(t, err, "reject is incompatible with keep")
+}
+
+func TestCompileErrors(t *testing.T) {
+	var cases = []struct {
+		src  string
+		line int
+	}{
+		{`fileinto "x";`, 1},
+		{"keep;\r\nrequire \"fileinto\";", 2},
+		{`require "nonsense";`, 1},
+		{"if true {\r\n  keep\r\n}", 3},
+		{"\r\n\r\nelse { keep; }", 3},
+		{`if header :is :contains "a" "b" { keep; }`, 1},
+		{`if header "a" { keep; }`, 1},
+		{`if size 100 { keep; }`, 1},
+		{`redirect;`, 1},
+		{`keep {}`, 1},
+		{`if header :comparator "i;unicode" "a" "b" { keep; }`, 1},
+		{"\"unterminated", 1},
+		{"/* open\r\n comment", 1},
+		{"if true { keep; }\r\nbogus;", 2},
+	}
+	for _, c := range cases {
+		_, err := Compile(c.src)
+		if assert.Error(t, err, c.src) {
+			if serr, ok := err.(*Error); assert.True(t, ok, c.src) {
+				assert.Equal(t, c.line, serr.Line, c.src)
+			}
+		}
+	}
+}
@@ -0,0 +1,710 @@
+package sieved
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+	"github.com/egggo/inbucket/sieve"
+	"github.com/egggo/inbucket/smtpd"
+)
+
+type State int
+
+const (
+	AUTHENTICATE  State = iota // The client must authenticate or start TLS
+	AUTHENTICATED              // Client may now manage its scripts
+	LOGOUT
+)
+
+func (s State) String() string {
+	switch s {
+	case AUTHENTICATE:
+		return "AUTHENTICATE"
+	case AUTHENTICATED:
+		return "AUTHENTICATED"
+	case LOGOUT:
+		return "LOGOUT"
+	}
+	return "Unknown"
+}
+
+var commands = map[string]bool{
+	"AUTHENTICATE": true,
+	"STARTTLS":     true,
+	"LOGOUT":       true,
+	"CAPABILITY":   true,
+	"HAVESPACE":    true,
+	"PUTSCRIPT":    true,
+	"LISTSCRIPTS":  true,
+	"SETACTIVE":    true,
+	"GETSCRIPT":    true,
+	"DELETESCRIPT": true,
+	"RENAMESCRIPT": true,
+	"CHECKSCRIPT":  true,
+	"NOOP":         true,
+}
+
+// syntaxError is returned by readCommand when the client sent something we
+// could not parse, the session carries on with the next line
+type syntaxError string
+
+func (e syntaxError) Error() string {
+	return string(e)
+}
+
+// errTooBig is returned by readCommand when a literal exceeded the maximum
+// size, its contents are discarded
+var errTooBig = syntaxError("Literal too big")
+
+// errTooManyLiterals is returned by readCommand when a command has more
+// literals than allowed, the session ends as the rest cannot be skipped
+var errTooManyLiterals = errors.New("Too many literals")
+
+// Limits on the literals of a command before the client has logged in, when
+// they can only hold a SASL response
+const (
+	MAX_AUTH_LITERALS      = 2
+	MAX_AUTH_LITERAL_BYTES = 4096
+)
+
+type Session struct {
+	server     *Server       // Reference to the server we belong to
+	id         int           // Session ID number
+	conn       net.Conn      // Our network connection
+	remoteHost string        // IP address of client
+	sendError  error         // Used to bail out of read loop on send error
+	state      State         // Current session state
+	reader     *bufio.Reader // Buffered reader for our net conn
+	tls        bool          // Whether STARTTLS has completed
+	user       *db.User      // Authenticated user
+}
+
+func NewSession(server *Server, id int, conn net.Conn) *Session {
+	reader := bufio.NewReader(conn)
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return &Session{server: server, id: id, conn: conn, state: AUTHENTICATE,
+		reader: reader, remoteHost: host}
+}
+
+func (ses *Session) String() string {
+	return fmt.Sprintf("Session{id: %v, state: %v}", ses.id, ses.state)
+}
+
+/* Session flow:
+ *  1. Send capabilities as greeting
+ *  2. Receive cmd
+ *  3. If good cmd, respond, optionally change state
+ *  4. If bad cmd, respond error
+ *  5. Goto 2
+ */
+func (s *Server) startSession(id int, conn net.Conn) {
+	log.LogInfo("ManageSieve connection from %v, starting session <%v>", conn.RemoteAddr(), id)
+	ses := NewSession(s, id, conn)
+	defer func() {
+		// ses.conn rather than conn, STARTTLS may have replaced it
+		ses.conn.Close()
+		s.waitgroup.Done()
+	}()
+
+	ses.sendCapabilities()
+
+	// This is our command reading loop
+	for ses.state != LOGOUT && ses.sendError == nil {
+		args, err := ses.readCommand()
+		if err == nil {
+			if len(args) == 0 {
+				ses.no("", "Speak up")
+				continue
+			}
+			cmd := strings.ToUpper(args[0])
+			args = args[1:]
+			if !commands[cmd] {
+				ses.no("", fmt.Sprintf("Syntax error, %v command unrecognized", cmd))
+				ses.logWarn("Unrecognized command: %v", cmd)
+				continue
+			}
+
+			// Commands we handle in any state
+			switch cmd {
+			case "CAPABILITY":
+				ses.sendCapabilities()
+				continue
+			case "LOGOUT":
+				ses.ok("Goodnight and good luck")
+				ses.enterState(LOGOUT)
+				continue
+			case "NOOP":
+				if len(args) > 0 {
+					ses.send(fmt.Sprintf("OK (TAG %v) \"Done\"", quote(args[0])))
+				} else {
+					ses.ok("Done")
+				}
+				continue
+			}
+
+			// Send command to handler for current state
+			switch ses.state {
+			case AUTHENTICATE:
+				ses.authenticateHandler(cmd, args)
+				continue
+			case AUTHENTICATED:
+				ses.authenticatedHandler(cmd, args)
+				continue
+			}
+			ses.logError("Session entered unexpected state %v", ses.state)
+			break
+		} else {
+			if serr, ok := err.(syntaxError); ok {
+				if serr == errTooBig && ses.state == AUTHENTICATED {
+					ses.no("QUOTA/MAXSIZE", "Script too big")
+				} else {
+					ses.no("", fmt.Sprintf("Syntax error, %v", serr))
+				}
+				continue
+			}
+			// readCommand() returned an error
+			if err == io.EOF {
+				switch ses.state {
+				case AUTHENTICATE:
+					// EOF is common here
+					ses.logInfo("Client closed connection (state %v)", ses.state)
+				default:
+					ses.logWarn("Got EOF while in state %v", ses.state)
+				}
+				break
+			}
+			// not an EOF
+			ses.logWarn("Connection error: %v", err)
+			if netErr, ok := err.(net.Error); ok {
+				if netErr.Timeout() {
+					ses.send("BYE \"Idle timeout, bye bye\"")
+					break
+				}
+			}
+			ses.send("BYE \"Connection error, sorry\"")
+			break
+		}
+	}
+	if ses.sendError != nil {
+		ses.logWarn("Network send error: %v", ses.sendError)
+	}
+	ses.logInfo("Closing connection")
+}
+
+// AUTHENTICATE state
+func (ses *Session) authenticateHandler(cmd string, args []string) {
+	switch cmd {
+	case "STARTTLS":
+		if ses.server.tlsConfig == nil || ses.tls {
+			ses.no("", "STARTTLS not available")
+			return
+		}
+		ses.ok("Begin TLS negotiation now")
+		conn := tls.Server(ses.conn, ses.server.tlsConfig)
+		if err := conn.SetDeadline(ses.nextDeadline()); err != nil {
+			ses.sendError = err
+			return
+		}
+		if err := conn.Handshake(); err != nil {
+			ses.logWarn("TLS handshake failed: %v", err)
+			ses.enterState(LOGOUT)
+			return
+		}
+		ses.conn = conn
+		ses.reader = bufio.NewReader(conn)
+		ses.tls = true
+		// RFC 5804 has the server restate its capabilities over TLS
+		ses.sendCapabilities()
+	case "AUTHENTICATE":
+		if len(args) < 1 || len(args) > 2 {
+			ses.no("", "AUTHENTICATE requires a mechanism name")
+			return
+		}
+		if strings.ToUpper(args[0]) != "PLAIN" {
+			ses.no("", fmt.Sprintf("Unsupported mechanism %v", args[0]))
+			return
+		}
+		if ses.server.requireTLS && !ses.tls {
+			ses.logWarn("Refusing AUTHENTICATE before STARTTLS")
+			ses.no("ENCRYPT-NEEDED", "Must issue STARTTLS first")
+			return
+		}
+		var initial string
+		if len(args) == 2 {
+			initial = args[1]
+		}
+		authz, name, pass, err := smtpd.SaslAuthenticate(args[0], initial, ses.challenge)
+		if err != nil {
+			if ses.sendError == nil {
+				ses.no("", err.Error())
+			}
+			return
+		}
+		ses.logIn(authz, name, pass)
+	default:
+		ses.ooSeq(cmd)
+	}
+}
+
+// challenge sends a SASL challenge and reads the client's response, which
+// comes as a string of its own
+func (ses *Session) challenge(text string) (string, error) {
+	ses.send(strconv.Quote(base64.StdEncoding.EncodeToString([]byte(text))))
+	answer, err := ses.readCommand()
+	if err != nil {
+		if _, ok := err.(syntaxError); ok {
+			return "", fmt.Errorf("Syntax error in SASL response")
+		}
+		ses.sendError = err
+		return "", err
+	}
+	if len(answer) != 1 || answer[0] == "*" {
+		return "", smtpd.ErrSaslCancelled
+	}
+	return answer[0], nil
+}
+
+// logIn checks the credentials of a SASL PLAIN response (RFC 4616)
+func (ses *Session) logIn(authz string, name string, pass string) {
+	if authz != "" && authz != name {
+		ses.logWarn("%v tried to authorize as %v", name, authz)
+		ses.no("", "Authorization identity not permitted")
+		return
+	}
+
+	user, err := smtpd.LogIn(ses.server.db, ses.server.throttle, "SIEVE", ses.remoteHost, name,
+		smtpd.PasswordCheck(ses.server.db, pass))
+	if err == smtpd.ErrThrottled {
+		ses.logWarn("Refusing login for %v - %v", name, err)
+		ses.no("TRYLATER", err.Error())
+		return
+	}
+	if err != nil {
+		ses.logError("Failed to auth for %v - %v", name, err)
+		ses.no("", "Authentication failed")
+		return
+	}
+
+	ses.user = user
+	ses.logInfo("Authenticated as %v", name)
+	ses.ok(fmt.Sprintf("Welcome %v", name))
+	ses.enterState(AUTHENTICATED)
+}
+
+// AUTHENTICATED state
+func (ses *Session) authenticatedHandler(cmd string, args []string) {
+	database := ses.server.db
+	userId := ses.user.Id
+
+	switch cmd {
+	case "HAVESPACE":
+		if len(args) != 2 {
+			ses.no("", "HAVESPACE requires a script name and size")
+			return
+		}
+		size, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			ses.no("", "HAVESPACE size must be a number")
+			return
+		}
+		if int(size) > ses.server.maxScriptBytes {
+			ses.no("QUOTA/MAXSIZE", "Script too big")
+			return
+		}
+		if ses.checkScriptCount(args[0]) {
+			ses.ok("Putscript would succeed")
+		}
+	case "PUTSCRIPT":
+		if len(args) != 2 {
+			ses.no("", "PUTSCRIPT requires a script name and content")
+			return
+		}
+		name, content := args[0], args[1]
+		if !sieve.ValidName(name) {
+			ses.no("", "Invalid script name")
+			return
+		}
+		if !ses.checkScript(content) || !ses.checkScriptCount(name) {
+			return
+		}
+		script := &db.SieveScript{UserId: userId, Name: name, Script: content}
+		if err := database.SieveScriptSave(script); err != nil {
+			ses.logError("Failed to save script %v - %v", name, err)
+			ses.no("TRYLATER", "Failed to save script")
+			return
+		}
+		ses.ok("Script stored")
+	case "CHECKSCRIPT":
+		if len(args) != 1 {
+			ses.no("", "CHECKSCRIPT requires script content")
+			return
+		}
+		if ses.checkScript(args[0]) {
+			ses.ok("Script is valid")
+		}
+	case "LISTSCRIPTS":
+		scripts, err := database.SieveScriptList(userId)
+		if err != nil {
+			ses.logError("Failed to list scripts - %v", err)
+			ses.no("TRYLATER", "Failed to list scripts")
+			return
+		}
+		for _, script := range scripts {
+			if script.Active {
+				ses.send(quote(script.Name) + " ACTIVE")
+			} else {
+				ses.send(quote(script.Name))
+			}
+		}
+		ses.ok("Listscripts completed")
+	case "SETACTIVE":
+		if len(args) != 1 {
+			ses.no("", "SETACTIVE requires a script name")
+			return
+		}
+		if args[0] != "" && ses.getScript(args[0]) == nil {
+			return
+		}
+		if err := database.SieveScriptSetActive(userId, args[0]); err != nil {
+			ses.logError("Failed to activate script %v - %v", args[0], err)
+			ses.no("TRYLATER", "Failed to activate script")
+			return
+		}
+		ses.ok("Active script changed")
+	case "GETSCRIPT":
+		if len(args) != 1 {
+			ses.no("", "GETSCRIPT requires a script name")
+			return
+		}
+		if script := ses.getScript(args[0]); script != nil {
+			ses.send(literal(script.Script))
+			ses.ok("Getscript completed")
+		}
+	case "DELETESCRIPT":
+		if len(args) != 1 {
+			ses.no("", "DELETESCRIPT requires a script name")
+			return
+		}
+		script := ses.getScript(args[0])
+		if script == nil {
+			return
+		}
+		if script.Active {
+			ses.no("ACTIVE", "You may not delete an active script")
+			return
+		}
+		if err := database.SieveScriptDel(userId, script.Name); err != nil {
+			ses.logError("Failed to delete script %v - %v", script.Name, err)
+			ses.no("TRYLATER", "Failed to delete script")
+			return
+		}
+		ses.ok("Script deleted")
+	case "RENAMESCRIPT":
+		if len(args) != 2 {
+			ses.no("", "RENAMESCRIPT requires old and new script names")
+			return
+		}
+		if !sieve.ValidName(args[1]) {
+			ses.no("", "Invalid script name")
+			return
+		}
+		if ses.getScript(args[0]) == nil {
+			return
+		}
+		existing, err := database.SieveScriptGet(userId, args[1])
+		if err != nil {
+			ses.logError("Failed to get script %v - %v", args[1], err)
+			ses.no("TRYLATER", "Failed to rename script")
+			return
+		}
+		if existing != nil {
+			ses.no("ALREADYEXISTS", fmt.Sprintf("Script %v already exists", args[1]))
+			return
+		}
+		if err = database.SieveScriptRename(userId, args[0], args[1]); err != nil {
+			ses.logError("Failed to rename script %v - %v", args[0], err)
+			ses.no("TRYLATER", "Failed to rename script")
+			return
+		}
+		ses.ok("Script renamed")
+	default:
+		ses.ooSeq(cmd)
+	}
+}
+
+// getScript fetches the named script of the session user, responding NO when
+// it could not be found
+func (ses *Session) getScript(name string) *db.SieveScript {
+	script, err := ses.server.db.SieveScriptGet(ses.user.Id, name)
+	if err != nil {
+		ses.logError("Failed to get script %v - %v", name, err)
+		ses.no("TRYLATER", "Failed to get script")
+		return nil
+	}
+	if script == nil {
+		ses.no("NONEXISTENT", fmt.Sprintf("There is no script named %v", name))
+		return nil
+	}
+	return script
+}
+
+// checkScript compiles content, responding NO with the reason when it is too
+// big or invalid
+func (ses *Session) checkScript(content string) bool {
+	if len(content) > ses.server.maxScriptBytes {
+		ses.no("QUOTA/MAXSIZE", "Script too big")
+		return false
+	}
+	if _, err := sieve.Compile(content); err != nil {
+		ses.logTrace("Bad script: %v", err)
+		ses.no("", err.Error())
+		return false
+	}
+	return true
+}
+
+// checkScriptCount makes sure storing a script called name would not exceed
+// the per user limit, responding NO when it would
+func (ses *Session) checkScriptCount(name string) bool {
+	scripts, err := ses.server.db.SieveScriptList(ses.user.Id)
+	if err != nil {
+		ses.logError("Failed to list scripts - %v", err)
+		ses.no("TRYLATER", "Failed to list scripts")
+		return false
+	}
+	for _, script := range scripts {
+		if script.Name == name {
+			// Replacing an existing script
+			return true
+		}
+	}
+	if len(scripts) >= ses.server.maxScripts {
+		ses.no("QUOTA/MAXSCRIPTS", "Too many scripts")
+		return false
+	}
+	return true
+}
+
+func (ses *Session) sendCapabilities() {
+	ses.send("\"IMPLEMENTATION\" \"Inbucket\"")
+	if ses.server.requireTLS && !ses.tls {
+		// RFC 5804 has no mechanisms listed until they may be used
+		ses.send("\"SASL\" \"\"")
+	} else {
+		ses.send("\"SASL\" \"PLAIN\"")
+	}
+	ses.send("\"SIEVE\" " + quote(strings.Join(sieve.Extensions, " ")))
+	if ses.server.tlsConfig != nil && !ses.tls {
+		ses.send("\"STARTTLS\"")
+	}
+	if ses.state == AUTHENTICATED {
+		ses.send("\"OWNER\" " + quote(ses.user.Username))
+	}
+	ses.send(fmt.Sprintf("\"MAXREDIRECTS\" \"%v\"", sieve.MAX_REDIRECTS))
+	ses.send("\"VERSION\" \"1.0\"")
+	ses.ok(fmt.Sprintf("Inbucket ManageSieve server ready on %v", ses.server.domain))
+}
+
+func (ses *Session) enterState(state State) {
+	ses.state = state
+	ses.logTrace("Entering state %v", state)
+}
+
+// Calculate the next read or write deadline based on maxIdleSeconds
+func (ses *Session) nextDeadline() time.Time {
+	return time.Now().Add(time.Duration(ses.server.maxIdleSeconds) * time.Second)
+}
+
+// Send requested message, store errors in Session.sendError
+func (ses *Session) send(msg string) {
+	if err := ses.conn.SetWriteDeadline(ses.nextDeadline()); err != nil {
+		ses.sendError = err
+		return
+	}
+	if _, err := fmt.Fprint(ses.conn, msg+"\r\n"); err != nil {
+		ses.sendError = err
+		ses.logWarn("Failed to send: '%v'", msg)
+		return
+	}
+	ses.logTrace(">> %v >>", msg)
+}
+
+func (ses *Session) ok(msg string) {
+	ses.send("OK " + quote(msg))
+}
+
+// no sends a NO response, with a response code when code is not empty
+func (ses *Session) no(code string, msg string) {
+	if code != "" {
+		ses.send(fmt.Sprintf("NO (%v) %v", code, quote(msg)))
+		return
+	}
+	ses.send("NO " + quote(msg))
+}
+
+// Reads a command and its arguments
+func (ses *Session) readCommand() ([]string, error) {
+	if err := ses.conn.SetReadDeadline(ses.nextDeadline()); err != nil {
+		return nil, err
+	}
+	maxLiteral, maxLiterals := ses.server.maxScriptBytes, 0
+	if ses.state == AUTHENTICATE {
+		maxLiteral, maxLiterals = MAX_AUTH_LITERAL_BYTES, MAX_AUTH_LITERALS
+	}
+	args, err := readCommand(ses.reader, maxLiteral, maxLiterals)
+	if err == nil && len(args) > 0 {
+		// Arguments may hold credentials or whole scripts, keep them out of
+		// the log
+		ses.logTrace("<< %v (%v arguments) <<", args[0], len(args)-1)
+	}
+	return args, err
+}
+
+// readCommand reads a line from r and splits it into atoms and strings.  A
+// line ending in a literal continues after the literal's contents, so a
+// single command may span several lines.  maxLiterals limits how many, 0
+// means no limit.
+func readCommand(r *bufio.Reader, maxLiteral int, maxLiterals int) ([]string, error) {
+	args := make([]string, 0, 4)
+	for literals := 1; ; literals++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		var size int
+		args, size, err = scanLine(line, args)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return args, nil
+		}
+
+		if maxLiterals > 0 && literals > maxLiterals {
+			return nil, errTooManyLiterals
+		}
+		if size > maxLiteral {
+			// Skip the literal and the remainder of the command
+			if _, err = io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+				return nil, err
+			}
+			if _, err = r.ReadString('\n'); err != nil {
+				return nil, err
+			}
+			return nil, errTooBig
+		}
+		buf := make([]byte, size)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf))
+	}
+}
+
+// scanLine appends the arguments in line to args.  If the line ends with a
+// literal its size is returned, otherwise size is -1.
+func scanLine(line string, args []string) ([]string, int, error) {
+	i := 0
+	for {
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		if i >= len(line) {
+			return args, -1, nil
+		}
+
+		switch line[i] {
+		case '"':
+			var buf bytes.Buffer
+			i++
+			for {
+				if i >= len(line) {
+					return nil, 0, syntaxError("Unterminated quoted string")
+				}
+				c := line[i]
+				i++
+				if c == '"' {
+					break
+				}
+				if c == '\\' {
+					if i >= len(line) || (line[i] != '"' && line[i] != '\\') {
+						return nil, 0, syntaxError("Bad escape in quoted string")
+					}
+					c = line[i]
+					i++
+				}
+				buf.WriteByte(c)
+			}
+			args = append(args, buf.String())
+		case '{':
+			end := strings.IndexByte(line[i:], '}')
+			if end < 0 || i+end != len(line)-1 {
+				return nil, 0, syntaxError("Literal must end the line")
+			}
+			digits := strings.TrimSuffix(line[i+1:i+end], "+")
+			size, err := strconv.ParseUint(digits, 10, 31)
+			if err != nil {
+				return nil, 0, syntaxError("Bad literal size")
+			}
+			return args, int(size), nil
+		default:
+			start := i
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+			args = append(args, line[start:i])
+		}
+	}
+}
+
+// quote formats s as a quoted string, falling back to a literal when it
+// contains line breaks
+func quote(s string) string {
+	if strings.ContainsAny(s, "\r\n\x00") {
+		return literal(s)
+	}
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + s + "\""
+}
+
+// literal formats s as a literal string, send() adds the closing line break
+func literal(s string) string {
+	return fmt.Sprintf("{%v}\r\n%v", len(s), s)
+}
+
+func (ses *Session) ooSeq(cmd string) {
+	ses.no("", fmt.Sprintf("Command %v is out of sequence", cmd))
+	ses.logWarn("Wasn't expecting %v here", cmd)
+}
+
+// Session specific logging methods
+func (ses *Session) logTrace(msg string, args ...interface{}) {
+	log.LogTrace("SIEVE[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
+
+func (ses *Session) logInfo(msg string, args ...interface{}) {
+	log.LogInfo("SIEVE[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
+
+func (ses *Session) logWarn(msg string, args ...interface{}) {
+	log.LogWarn("SIEVE[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
+
+func (ses *Session) logError(msg string, args ...interface{}) {
+	log.LogError("SIEVE[%v]<%v> %v", ses.remoteHost, ses.id, fmt.Sprintf(msg, args...))
+}
@@ -0,0 +1,109 @@
+package sieved
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func read(t *testing.T, input string) ([]string, error) {
+	return readCommand(bufio.NewReader(strings.NewReader(input)), 16, 0)
+}
+
+func TestReadCommand(t *testing.T) {
+	args, err := read(t, "CAPABILITY\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"CAPABILITY"}, args)
+
+	args, err = read(t, "Authenticate \"PLAIN\" \"AGJvYgBzZWNyZXQ=\"\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Authenticate", "PLAIN", "AGJvYgBzZWNyZXQ="}, args)
+
+	args, err = read(t, "HAVESPACE \"a \\\"b\\\" \\\\c\" 100\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"HAVESPACE", "a \"b\" \\c", "100"}, args)
+
+	args, err = read(t, "PUTSCRIPT \"x\" {7+}\r\nkeep;\r\n\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"PUTSCRIPT", "x", "keep;\r\n"}, args)
+
+	// A literal in the middle of a command
+	args, err = read(t, "RENAMESCRIPT {3}\r\nold \"new\"\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"RENAMESCRIPT", "old", "new"}, args)
+
+	args, err = read(t, "\r\n")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(args))
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	_, err := read(t, "GETSCRIPT \"open\r\n")
+	assert.IsType(t, syntaxError(""), err)
+
+	_, err = read(t, "GETSCRIPT \"bad\\escape\"\r\n")
+	assert.IsType(t, syntaxError(""), err)
+
+	_, err = read(t, "PUTSCRIPT {3+} \"x\"\r\n")
+	assert.IsType(t, syntaxError(""), err)
+
+	// Oversized literals are skipped so the next command can be read
+	r := bufio.NewReader(strings.NewReader(
+		"PUTSCRIPT \"x\" {20+}\r\n01234567890123456789\r\nNOOP\r\n"))
+	_, err = readCommand(r, 16, 0)
+	assert.Equal(t, errTooBig, err)
+	args, err := readCommand(r, 16, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"NOOP"}, args)
+
+	// Before login a command may only carry a few literals
+	input := "AUTHENTICATE {5}\r\nPLAIN {4}\r\nAAAA {4}\r\nBBBB\r\n"
+	_, err = readCommand(bufio.NewReader(strings.NewReader(input)), 16, 2)
+	assert.Equal(t, errTooManyLiterals, err)
+	args, err = readCommand(bufio.NewReader(strings.NewReader(input)), 16, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"AUTHENTICATE", "PLAIN", "AAAA", "BBBB"}, args)
+}
+
+func TestQuote(t *testing.T) {
+	assert.Equal(t, "\"main\"", quote("main"))
+	assert.Equal(t, "\"a \\\"b\\\" \\\\c\"", quote("a \"b\" \\c"))
+	assert.Equal(t, "{7}\r\nkeep;\r\n", quote("keep;\r\n"))
+}
+
+// Test that credentials are refused in the clear when TLS is required
+func TestAuthenticateRequiresTLS(t *testing.T) {
+	server := &Server{domain: "inbucket.local", maxIdleSeconds: 5, maxScriptBytes: 1024,
+		requireTLS: true, waitgroup: new(sync.WaitGroup)}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	server.waitgroup.Add(1)
+	go server.startSession(1, serverConn)
+
+	r := bufio.NewReader(clientConn)
+	response := func() []string {
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+			if strings.HasPrefix(line, "OK") || strings.HasPrefix(line, "NO") {
+				return lines
+			}
+		}
+	}
+	assert.Contains(t, response(), "\"SASL\" \"\"")
+
+	// bob, secret
+	if _, err := clientConn.Write([]byte("AUTHENTICATE \"PLAIN\" \"AGJvYgBzZWNyZXQ=\"\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	lines := response()
+	assert.True(t, strings.HasPrefix(lines[len(lines)-1], "NO (ENCRYPT-NEEDED)"), "%v", lines)
+}
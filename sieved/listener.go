@@ -0,0 +1,116 @@
+package sieved
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+	"github.com/egggo/inbucket/smtpd"
+)
+
+// Real server code starts here
+type Server struct {
+	domain         string
+	maxIdleSeconds int
+	maxScriptBytes int
+	maxScripts     int
+	tlsConfig      *tls.Config
+	requireTLS     bool
+	throttle       *smtpd.AuthThrottle
+	listener       net.Listener
+	shutdown       bool
+	waitgroup      *sync.WaitGroup
+	db             *db.Database
+}
+
+// Init a new Server object
+func New(db *db.Database) *Server {
+	cfg := config.GetManageSieveConfig()
+
+	return &Server{domain: cfg.Domain, maxIdleSeconds: cfg.MaxIdleSeconds,
+		maxScriptBytes: cfg.MaxScriptBytes, maxScripts: cfg.MaxScripts,
+		requireTLS: cfg.RequireTLS,
+		throttle:   smtpd.DefaultAuthThrottle(),
+		waitgroup:  new(sync.WaitGroup),
+		db:         db}
+}
+
+// Main listener loop
+func (s *Server) Start() {
+	cfg := config.GetManageSieveConfig()
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			log.LogError("ManageSieve failed to load TLS certificate: %v", err)
+			// TODO More graceful early-shutdown procedure
+			panic(err)
+		}
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%v:%v",
+		cfg.Ip4address, cfg.Ip4port))
+	if err != nil {
+		log.LogError("ManageSieve Failed to build tcp4 address: %v", err)
+		// TODO More graceful early-shutdown procedure
+		panic(err)
+	}
+
+	log.LogInfo("ManageSieve listening on TCP4 %v", addr)
+	s.listener, err = net.ListenTCP("tcp4", addr)
+	if err != nil {
+		log.LogError("ManageSieve failed to start tcp4 listener: %v", err)
+		// TODO More graceful early-shutdown procedure
+		panic(err)
+	}
+
+	// Handle incoming connections
+	var tempDelay time.Duration
+	for sid := 1; ; sid++ {
+		if conn, err := s.listener.Accept(); err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				// Temporary error, sleep for a bit and try again
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.LogError("ManageSieve accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			} else {
+				if s.shutdown {
+					log.LogTrace("ManageSieve listener shutting down on request")
+					return
+				}
+				panic(err)
+			}
+		} else {
+			tempDelay = 0
+			s.waitgroup.Add(1)
+			go s.startSession(sid, conn)
+		}
+	}
+}
+
+// Stop requests the ManageSieve server closes it's listener
+func (s *Server) Stop() {
+	log.LogTrace("ManageSieve shutdown requested, connections will be drained")
+	s.shutdown = true
+	s.listener.Close()
+}
+
+// Drain causes the caller to block until all active ManageSieve sessions have
+// finished
+func (s *Server) Drain() {
+	s.waitgroup.Wait()
+	log.LogTrace("ManageSieve connections drained")
+}
@@ -0,0 +1,219 @@
+package smtpd
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/egggo/inbucket/database"
+)
+
+// AliasTargets returns the addresses that mail for addr goes to according to
+// aliases, nil when no alias matches.
+//
+// A pattern is either an address or a bare local part, which matches at any
+// domain, and may use * as a wildcard.  A * in the target stands for the
+// text matched by the first wildcard of the pattern, so *@old.example.com can
+// be aliased to *@new.example.com.  Exact patterns win over wildcards, and
+// longer wildcard patterns over shorter ones.  A plus address such as
+// sales+orders@example.com without an exact pattern of its own is tried again
+// without its tag, which is then added to the targets.
+func AliasTargets(aliases []*db.Alias, addr string) []string {
+	addr = strings.ToLower(addr)
+	targets, exact := aliasTargets(aliases, addr)
+	if exact {
+		return targets
+	}
+
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		at = len(addr)
+	}
+	plus := strings.Index(addr[:at], "+")
+	if plus < 0 {
+		return targets
+	}
+	// Untagged exact patterns also beat wildcards
+	tag := addr[plus:at]
+	base, baseExact := aliasTargets(aliases, addr[:plus]+addr[at:])
+	if base == nil || (targets != nil && !baseExact) {
+		return targets
+	}
+	for i, t := range base {
+		if at := strings.LastIndex(t, "@"); at >= 0 && !strings.Contains(t[:at], "+") {
+			base[i] = t[:at] + tag + t[at:]
+		}
+	}
+	return base
+}
+
+// aliasTargets finds the best alias for addr, exact is set when its pattern
+// has no wildcard
+func aliasTargets(aliases []*db.Alias, addr string) ([]string, bool) {
+	local := addr
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		local = addr[:at]
+	}
+
+	var best *db.Alias
+	var bestCapture string
+	bestScore := -1
+	for _, a := range aliases {
+		pattern := strings.ToLower(a.Pattern)
+		subject := addr
+		if !strings.Contains(pattern, "@") {
+			subject = local
+		}
+		capture, ok := matchPattern(pattern, subject)
+		if !ok {
+			continue
+		}
+		// Exact patterns outrank any wildcard
+		score := len(strings.Replace(pattern, "*", "", -1))
+		if !strings.Contains(pattern, "*") {
+			score += 1000
+		}
+		if score > bestScore {
+			best, bestCapture, bestScore = a, capture, score
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+
+	targets := make([]string, 0, 1)
+	for _, t := range strings.Split(best.Target, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, strings.Replace(t, "*", bestCapture, -1))
+		}
+	}
+	return targets, bestScore >= 1000
+}
+
+// MAX_CACHED_PATTERNS bounds the compiled wildcard patterns kept by
+// matchPattern, the cache starts afresh when it fills up
+const MAX_CACHED_PATTERNS = 1000
+
+var wildcardPatterns = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+// matchPattern reports whether s matches the wildcard pattern, returning the
+// text matched by its first *
+func matchPattern(pattern string, s string) (string, bool) {
+	if !strings.Contains(pattern, "*") {
+		return "", pattern == s
+	}
+	re := compilePattern(pattern)
+	if re == nil {
+		return "", false
+	}
+	m := re.FindStringSubmatch(s)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// compilePattern turns a wildcard pattern into a regular expression, once
+func compilePattern(pattern string) *regexp.Regexp {
+	wildcardPatterns.Lock()
+	defer wildcardPatterns.Unlock()
+	if re, ok := wildcardPatterns.compiled[pattern]; ok {
+		return re
+	}
+	parts := strings.Split(pattern, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	re, err := regexp.Compile("^" + strings.Join(parts, "(.*?)") + "$")
+	if err != nil {
+		re = nil
+	}
+	if len(wildcardPatterns.compiled) >= MAX_CACHED_PATTERNS {
+		wildcardPatterns.compiled = make(map[string]*regexp.Regexp)
+	}
+	wildcardPatterns.compiled[pattern] = re
+	return re
+}
+
+// aliasCandidates returns the exact patterns that could match addr in
+// AliasTargets: the address and its local part, with and without a plus tag
+func aliasCandidates(addr string) []string {
+	addr = strings.ToLower(addr)
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		at = len(addr)
+	}
+	candidates := []string{addr, addr[:at]}
+	if plus := strings.Index(addr[:at], "+"); plus >= 0 {
+		candidates = append(candidates, addr[:plus]+addr[at:], addr[:plus])
+	}
+	return candidates
+}
+
+// expandRecipient resolves recip through aliases and groups into the
+// addresses to deliver to, and the moderated groups to hold the message for.
+// expanded is false when recip is neither an alias nor a group and so is
+// delivered as addressed.  errGroupPolicy is returned when the sender may not
+// post to one of the groups.
+func (ss *Session) expandRecipient(recip string) ([]string, []*db.Group, bool, error) {
+	if ss.server.db == nil {
+		return []string{recip}, nil, false, nil
+	}
+	// Exact patterns come by index, wildcards have to be tried in turn
+	aliases, err := ss.server.db.AliasFind(aliasCandidates(recip)...)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	wildcards, err := ss.server.db.AliasWildcards()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	targets := AliasTargets(append(aliases, wildcards...), recip)
+	expanded := targets != nil
+	if !expanded {
+		targets = []string{recip}
+	}
+
+	var addrs []string
+	var held []*db.Group
+	for _, t := range targets {
+		// Only local targets can name groups
+		var members []string
+		if !expanded || ss.server.isLocal(t) {
+			group, err := ss.server.db.GroupGetByName(strings.Split(t, "@")[0])
+			if err != nil {
+				return nil, nil, false, err
+			}
+			if group != nil {
+				if members, err = ss.server.db.GroupExpand(group.Id); err != nil {
+					return nil, nil, false, err
+				}
+			}
+			if len(members) > 0 {
+				hold, err := ss.groupPolicy(group)
+				if err != nil {
+					return nil, nil, false, err
+				}
+				if hold {
+					held = append(held, group)
+					expanded = true
+					continue
+				}
+			}
+		}
+		if len(members) > 0 {
+			expanded = true
+		} else {
+			members = []string{t}
+		}
+		for _, m := range members {
+			if !containsFold(addrs, m) {
+				addrs = append(addrs, m)
+			}
+		}
+	}
+	return addrs, held, expanded, nil
+}
@@ -0,0 +1,72 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAliasTargets(t *testing.T) {
+	aliases := []*db.Alias{
+		{Pattern: "sales@example.com", Target: "bob@example.com, alice@example.com"},
+		{Pattern: "support", Target: "carol@example.com"},
+		{Pattern: "*@old.example.com", Target: "*@new.example.com"},
+		{Pattern: "noreply-*@example.com", Target: "dev-null@example.com"},
+		{Pattern: "*@example.com", Target: "catchall@example.com"},
+	}
+
+	assert.Equal(t, []string{"bob@example.com", "alice@example.com"},
+		AliasTargets(aliases, "Sales@Example.com"))
+	assert.Equal(t, []string{"carol@example.com"}, AliasTargets(aliases, "support@example.org"))
+	assert.Equal(t, []string{"jim@new.example.com"}, AliasTargets(aliases, "jim@old.example.com"))
+	assert.Equal(t, []string{"dev-null@example.com"},
+		AliasTargets(aliases, "noreply-billing@example.com"), "longer wildcard wins")
+	assert.Equal(t, []string{"catchall@example.com"}, AliasTargets(aliases, "who@example.com"))
+	assert.Nil(t, AliasTargets(aliases, "who@example.org"))
+
+	// Plus addresses fall back to the untagged alias, keeping the tag
+	assert.Equal(t, []string{"bob+orders@example.com", "alice+orders@example.com"},
+		AliasTargets(aliases, "sales+orders@example.com"))
+	assert.Equal(t, []string{"carol+x@example.com"}, AliasTargets(aliases, "support+x@example.net"))
+}
+
+func TestAliasCandidates(t *testing.T) {
+	assert.Equal(t, []string{"sales@example.com", "sales"}, aliasCandidates("Sales@Example.com"))
+	assert.Equal(t, []string{"sales+orders@example.com", "sales+orders", "sales@example.com",
+		"sales"}, aliasCandidates("sales+orders@example.com"))
+
+	// Exact aliases found by candidate and the wildcards match as all of them do
+	aliases := []*db.Alias{
+		{Pattern: "sales@example.com", Target: "bob@example.com"},
+		{Pattern: "sales+orders", Target: "orders@example.com"},
+		{Pattern: "support", Target: "carol@example.com"},
+		{Pattern: "*@old.example.com", Target: "*@new.example.com"},
+		{Pattern: "support-*", Target: "carol@example.com"},
+	}
+	for _, addr := range []string{"sales@example.com", "sales+orders@example.org",
+		"sales+misc@example.com", "support+x@example.net", "jim@old.example.com",
+		"support-eu@example.com", "nobody@example.com"} {
+		var found []*db.Alias
+		candidates := aliasCandidates(addr)
+		for _, a := range aliases {
+			if containsFold(candidates, a.Pattern) || strings.Contains(a.Pattern, "*") {
+				found = append(found, a)
+			}
+		}
+		assert.Equal(t, AliasTargets(aliases, addr), AliasTargets(found, addr), addr)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	capture, ok := matchPattern("*@old.example.com", "jim@old.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "jim", capture)
+	_, ok = matchPattern("*@old.example.com", "jim@old-example.com")
+	assert.False(t, ok, "dots are not wildcards")
+
+	// Compiled once and reused
+	re := compilePattern("noreply-*@example.com")
+	assert.True(t, re == compilePattern("noreply-*@example.com"))
+}
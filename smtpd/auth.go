@@ -0,0 +1,135 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// authHandler runs the AUTH command (RFC 4954), only the PLAIN mechanism is
+// offered
+func (ss *Session) authHandler(arg string) {
+	if ss.server.db == nil {
+		ss.send("502 5.5.1 AUTH not available")
+		return
+	}
+	if !ss.tls {
+		ss.logWarn("Refusing AUTH before STARTTLS")
+		ss.send("538 5.7.11 Encryption required for requested authentication mechanism")
+		return
+	}
+	if ss.authUser != nil {
+		ss.send("503 5.5.1 Already authenticated")
+		return
+	}
+	args := strings.Fields(arg)
+	if len(args) == 0 || len(args) > 2 {
+		ss.send("501 5.5.4 Was expecting AUTH mechanism [initial-response]")
+		return
+	}
+	if strings.ToUpper(args[0]) != "PLAIN" {
+		ss.send("504 5.5.4 Unrecognized authentication type")
+		return
+	}
+
+	var initial string
+	if len(args) == 2 {
+		initial = args[1]
+	}
+	authz, name, pass, err := SaslAuthenticate(args[0], initial, ss.challenge)
+	if err == ErrSaslCancelled {
+		ss.send("501 5.0.0 Authentication cancelled")
+		return
+	}
+	if err != nil {
+		if ss.sendError == nil {
+			ss.send(fmt.Sprintf("501 5.5.2 %v", err))
+		}
+		return
+	}
+	if authz != "" && authz != name {
+		ss.logWarn("%v tried to authorize as %v", name, authz)
+		ss.send("535 5.7.8 Authorization identity not permitted")
+		return
+	}
+
+	user, err := LogIn(ss.server.db, ss.server.throttle, "SMTP", ss.remoteHost, name,
+		PasswordCheck(ss.server.db, pass))
+	if err == ErrThrottled {
+		ss.logWarn("Refusing AUTH for %v - %v", name, err)
+		ss.send("454 4.7.0 Too many failed logins, try again later")
+		return
+	}
+	if err != nil {
+		ss.logWarn("Failed to auth for %v - %v", name, err)
+		ss.send("535 5.7.8 Authentication credentials invalid")
+		return
+	}
+
+	ss.authUser = user
+	ss.logInfo("Authenticated as %v", name)
+	ss.send("235 2.7.0 Authentication successful")
+}
+
+// challenge sends a SASL challenge and reads the client's response
+func (ss *Session) challenge(text string) (string, error) {
+	ss.send("334 " + base64.StdEncoding.EncodeToString([]byte(text)))
+	line, err := ss.readLine()
+	if err != nil {
+		ss.sendError = err
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "*" {
+		return "", ErrSaslCancelled
+	}
+	return line, nil
+}
+
+// canSendAs reports whether the authenticated user may use from as the
+// sender: their own address, or that of a shared mailbox granting them
+// send-as
+func (ss *Session) canSendAs(from string) (bool, error) {
+	local, _, err := ParseEmailAddress(from)
+	if err != nil {
+		return false, err
+	}
+	if !ss.server.isLocal(from) {
+		return false, nil
+	}
+	name, err := ParseMailboxName(local)
+	if err != nil {
+		return false, nil
+	}
+	rights, err := ss.server.db.MailboxRights(name, ss.authUser)
+	if err != nil || rights == nil {
+		return false, err
+	}
+	return rights.SendAs, nil
+}
+
+// checkSender applies canSendAs to the MAIL FROM of an authenticated session,
+// returning false after refusing the sender.  Without AUTH our own addresses
+// are refused, anybody could claim them.
+func (ss *Session) checkSender(from string) bool {
+	if ss.authUser == nil {
+		if ss.server.db == nil || !ss.server.isLocal(from) {
+			return true
+		}
+		ss.logWarn("Refusing <%v> as sender before AUTH", from)
+		ss.send(fmt.Sprintf("530 5.7.0 Authentication required to send as <%v>", from))
+		return false
+	}
+	ok, err := ss.canSendAs(from)
+	if err != nil {
+		ss.logError("Failed to check sender %v - %v", from, err)
+		ss.send("451 4.3.0 Failed to check sender - try again later")
+		return false
+	}
+	if !ok {
+		ss.logWarn("User %v may not send as <%v>", ss.authUser.Username, from)
+		ss.send(fmt.Sprintf("550 5.7.1 Not allowed to send as <%v>", from))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package smtpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanSendAs(t *testing.T) {
+	server := &Server{domain: "inbucket.local", db: &db.Database{}}
+	ss := &Session{server: server, authUser: &db.User{Id: 1, Username: "fred"}}
+
+	for _, from := range []string{"fred@inbucket.local", "Fred@INBUCKET.local",
+		"fred+lists@inbucket.local"} {
+		ok, err := ss.canSendAs(from)
+		assert.Nil(t, err)
+		assert.True(t, ok, "Expected fred to send as %v", from)
+	}
+	_, err := ss.canSendAs("not an address")
+	assert.NotNil(t, err)
+}
+
+// Test that AUTH and our own sender addresses need TLS and AUTH
+func TestSmtpAuthTLS(t *testing.T) {
+	server, logbuf := setupSmtpServer(&MockDataStore{})
+	defer teardownSmtpServer(server)
+	server.db = &db.Database{}
+	server.tlsConfig = testTLSConfig(t)
+
+	pipe := setupSmtpSession(server)
+	c := textproto.NewConn(pipe)
+	if _, _, err := c.ReadCodeLine(220); err != nil {
+		t.Fatal(err)
+	}
+	ehlo := func(c *textproto.Conn) string {
+		id, _ := c.Cmd("EHLO localhost")
+		c.StartResponse(id)
+		defer c.EndResponse(id)
+		_, msg, err := c.ReadResponse(250)
+		assert.Nil(t, err)
+		return msg
+	}
+	msg := ehlo(c)
+	assert.Contains(t, msg, "STARTTLS")
+	assert.NotContains(t, msg, "AUTH")
+
+	script := []scriptStep{
+		// fred, secret
+		{"AUTH PLAIN AGZyZWQAc2VjcmV0", 538},
+		{"MAIL FROM:<fred@inbucket.local>", 530},
+		{"STARTTLS extra", 501},
+		{"STARTTLS", 220},
+	}
+	if err := playScriptAgainst(t, c, script); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := tls.Client(pipe, &tls.Config{InsecureSkipVerify: true})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c = textproto.NewConn(conn)
+	msg = ehlo(c)
+	assert.Contains(t, msg, "AUTH PLAIN")
+	assert.NotContains(t, msg, "STARTTLS")
+	if err := playScriptAgainst(t, c, []scriptStep{{"STARTTLS", 502}, {"QUIT", 221}}); err != nil {
+		t.Error(err)
+	}
+
+	if t.Failed() {
+		time.Sleep(time.Second)
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// testTLSConfig returns a server configuration with a self-signed certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:   pkix.Name{CommonName: "inbucket.local"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
@@ -0,0 +1,73 @@
+package smtpd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Size of the chunks we stream to clamd, must be below its StreamMaxLength
+const CLAMD_CHUNK_SIZE = 64 * 1024
+
+// ScanClamd streams msg to the clamd daemon listening on socket using the
+// INSTREAM command.  The name of the virus is returned if one was found, an
+// empty string if the message is clean.
+func ScanClamd(socket string, timeout time.Duration, msg []byte) (string, error) {
+	conn, err := DialSocket(socket, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+
+	// The z prefix selects NUL terminated commands and replies
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	size := make([]byte, 4)
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > CLAMD_CHUNK_SIZE {
+			n = CLAMD_CHUNK_SIZE
+		}
+		binary.BigEndian.PutUint32(size, uint32(n))
+		if _, err = conn.Write(size); err != nil {
+			return "", err
+		}
+		if _, err = conn.Write(msg[:n]); err != nil {
+			return "", err
+		}
+		msg = msg[n:]
+	}
+	// A zero length chunk ends the stream
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err = conn.Write(size); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply interprets the result line of a scan, which looks like
+// "stream: OK", "stream: Eicar-Signature FOUND" or "... ERROR"
+func parseClamdReply(reply string) (string, error) {
+	result := reply
+	if idx := strings.Index(reply, ": "); idx >= 0 {
+		result = reply[idx+2:]
+	}
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd scan failed: %v", reply)
+}
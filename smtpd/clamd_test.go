@@ -0,0 +1,110 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// startFakeClamd listens for INSTREAM requests, reporting anything containing
+// the EICAR marker as infected.  It returns the socket in config notation.
+func startFakeClamd(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeClamd(conn)
+		}
+	}()
+	return "inet:" + l.Addr().String(), func() { l.Close() }
+}
+
+func serveFakeClamd(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	if cmd != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+	var stream bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+			return
+		}
+	}
+	if bytes.Contains(stream.Bytes(), []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+		io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+	} else {
+		io.WriteString(conn, "stream: OK\x00")
+	}
+}
+
+func TestScanClamd(t *testing.T) {
+	socket, stop := startFakeClamd(t)
+	defer stop()
+
+	virus, err := ScanClamd(socket, time.Second, []byte("Subject: Hi\r\n\r\nHello\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "", virus)
+
+	// Large enough to need several chunks
+	body := bytes.Repeat([]byte("0123456789abcdef"), CLAMD_CHUNK_SIZE/8)
+	body = append(body, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")...)
+	virus, err = ScanClamd(socket, time.Second, body)
+	assert.Nil(t, err)
+	assert.Equal(t, "Eicar-Signature", virus)
+
+	stop()
+	_, err = ScanClamd(socket, time.Second, body)
+	assert.NotNil(t, err)
+}
+
+func TestParseClamdReply(t *testing.T) {
+	virus, err := parseClamdReply("stream: OK")
+	assert.Nil(t, err)
+	assert.Equal(t, "", virus)
+
+	virus, err = parseClamdReply("stream: Win.Test.EICAR_HDB-1 FOUND")
+	assert.Nil(t, err)
+	assert.Equal(t, "Win.Test.EICAR_HDB-1", virus)
+
+	_, err = parseClamdReply("INSTREAM size limit exceeded. ERROR")
+	assert.NotNil(t, err)
+}
+
+func TestVirusScanHeader(t *testing.T) {
+	socket, stop := startFakeClamd(t)
+	defer stop()
+
+	ss := &Session{server: &Server{clamdConfig: config.ClamdConfig{Socket: socket,
+		TimeoutSeconds: 1, Action: "tag"}}}
+	data, reply := ss.virusScan([]byte("X-Virus-Status: Clean\r\nSubject: Hi\r\n\r\n" +
+		"EICAR-STANDARD-ANTIVIRUS-TEST-FILE\r\n"))
+	assert.Equal(t, "", reply)
+	assert.Equal(t, "X-Virus-Status: Infected (Eicar-Signature)\r\nSubject: Hi\r\n\r\n"+
+		"EICAR-STANDARD-ANTIVIRUS-TEST-FILE\r\n", string(data))
+}
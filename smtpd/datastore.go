@@ -6,26 +6,74 @@ import (
 	"net/mail"
 	"time"
 
+	"github.com/egggo/inbucket/config"
 	"github.com/jhillyerd/go.enmime"
 )
 
 var ErrNotExist = errors.New("Message does not exist")
 
+var ErrFolderNotExist = errors.New("Folder does not exist")
+
+var ErrFolderExists = errors.New("Folder already exists")
+
+// ErrBadFolderName is returned for a folder name that is empty, names the
+// INBOX where that is not allowed, or has an empty, "." or ".." level
+var ErrBadFolderName = errors.New("Invalid folder name")
+
 type DataStore interface {
 	MailboxFor(emailAddress string) (Mailbox, error)
 	AllMailboxes() ([]Mailbox, error)
 }
 
+// NewDataStore creates the DataStore for the configured backend
+func NewDataStore(cfg config.DataStoreConfig) DataStore {
+	if cfg.Backend == "maildir" {
+		return NewMaildirDataStore(cfg)
+	}
+	return NewFileDataStore(cfg)
+}
+
+// DefaultDataStore creates the DataStore described by the [datastore] section
+// of the configuration
+func DefaultDataStore() DataStore {
+	return NewDataStore(config.GetDataStoreConfig())
+}
+
 type Mailbox interface {
 	GetMessages() ([]Message, error)
 	GetMessage(id string) (Message, error)
 	Purge() error
 	NewMessage() (Message, error)
+	// UidValidity and UidNext describe message UIDs for IMAP (RFC 3501), a
+	// UID is never reused while the mailbox keeps its UidValidity
+	UidValidity() (uint32, error)
+	UidNext() (uint32, error)
+	// Lock takes exclusive use of the mailbox for owner, or returns
+	// ErrMailboxLocked at once if another owner has it
+	Lock(owner string) error
+	Unlock()
+	// Folders lists the names of the folders in the mailbox, "/" separating
+	// the levels of the hierarchy.  The mailbox itself is the INBOX, the
+	// folder methods of a folder act on the mailbox it belongs to.
+	Folders() ([]string, error)
+	// Folder opens the named folder, or returns ErrFolderNotExist
+	Folder(name string) (Mailbox, error)
+	// CreateFolder creates the named folder along with any missing parents
+	CreateFolder(name string) (Mailbox, error)
+	// RenameFolder renames a folder and the folders beneath it
+	RenameFolder(name string, newName string) error
+	// DeleteFolder deletes a folder and its messages, the folders beneath it
+	// are kept
+	DeleteFolder(name string) error
+	// MoveMessage moves the message with id to dest, another folder of the
+	// mailbox, and returns it as found there
+	MoveMessage(id string, dest Mailbox) (Message, error)
 	String() string
 }
 
 type Message interface {
 	Id() string
+	Uid() uint32
 	From() string
 	Date() time.Time
 	Subject() string
@@ -38,4 +86,18 @@ type Message interface {
 	Delete() error
 	String() string
 	Size() int64
+	AuthResults() *AuthResults
+	// SetAuthResults records the verdicts CheckAuthentication reached for a
+	// message not yet closed
+	SetAuthResults(results *AuthResults)
+	SpamResult() *SpamResult
+	// SetSpamResult records the score the spam engine gave a message not yet
+	// closed
+	SetSpamResult(result *SpamResult)
+	// Flags lists the system flags, such as \Seen, and keywords set on the
+	// message
+	Flags() []string
+	// SetFlags replaces the flags of the message, returning ErrBadFlag if
+	// one is invalid
+	SetFlags(flags []string) error
 }
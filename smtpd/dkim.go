@@ -0,0 +1,497 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIM, SPF and DMARC verification results, as used in Authentication-Results
+const (
+	AUTH_NONE      = "none"
+	AUTH_PASS      = "pass"
+	AUTH_FAIL      = "fail"
+	AUTH_SOFTFAIL  = "softfail"
+	AUTH_NEUTRAL   = "neutral"
+	AUTH_TEMPERROR = "temperror"
+	AUTH_PERMERROR = "permerror"
+)
+
+var ErrDkimBadKey = errors.New("DKIM private key could not be decoded")
+
+var wspRunRE = regexp.MustCompile("[ \t]+")
+
+// Matches the value of the b= tag so it can be blanked out for verification
+var dkimSigValueRE = regexp.MustCompile("([;:][ \t\r\n]*b[ \t\r\n]*=)[^;]*")
+
+// lookupTXT is swapped out by unit tests
+var lookupTXT = net.LookupTXT
+
+// DkimResult is the outcome of verifying a single DKIM-Signature header
+type DkimResult struct {
+	Result   string
+	Domain   string
+	Selector string
+	Reason   string
+}
+
+// A DkimSigner produces rsa-sha256 DKIM-Signature headers with relaxed/relaxed
+// canonicalization for a single signing domain.
+type DkimSigner struct {
+	Domain   string
+	Selector string
+	Headers  []string
+	key      *rsa.PrivateKey
+}
+
+// GenerateDkimKey creates a new RSA private key and returns it PEM encoded
+func GenerateDkimKey(bits int) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return "", err
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// parseDkimKey decodes a PEM encoded RSA private key
+func parseDkimKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, ErrDkimBadKey
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// DkimTxtRecord builds the DNS TXT record value that publishes the public half
+// of the provided PEM encoded private key
+func DkimTxtRecord(pemKey string) (string, error) {
+	key, err := parseDkimKey(pemKey)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+}
+
+// DkimRecordName returns the DNS name the TXT record for selector and domain
+// must be published under
+func DkimRecordName(selector string, domain string) string {
+	return selector + "._domainkey." + domain
+}
+
+// NewDkimSigner creates a signer for domain using the PEM encoded private key
+func NewDkimSigner(domain string, selector string, pemKey string, headers []string) (*DkimSigner,
+	error) {
+	key, err := parseDkimKey(pemKey)
+	if err != nil {
+		return nil, err
+	}
+	// RFC 6376 requires the From header to always be signed
+	signed := []string{"from"}
+	for _, h := range headers {
+		h = strings.ToLower(h)
+		if h != "from" {
+			signed = append(signed, h)
+		}
+	}
+	return &DkimSigner{Domain: domain, Selector: selector, Headers: signed, key: key}, nil
+}
+
+// Sign computes a DKIM-Signature header for the provided message, the returned
+// header (including the trailing CRLF) should be prepended to the message.
+func (s *DkimSigner) Sign(msg []byte) ([]byte, error) {
+	headers, body := splitMessage(msg)
+	fields := parseHeaderFields(headers)
+
+	bodyHash := sha256.Sum256(canonicalBodyRelaxed(body))
+
+	// Only list headers that are present, each instance is signed bottom-up
+	used := make(map[string]int)
+	signed := make([]string, 0, len(s.Headers))
+	hashed := new(bytes.Buffer)
+	for _, name := range s.Headers {
+		if f := findHeaderField(fields, name, used); f != "" {
+			signed = append(signed, name)
+			hashed.WriteString(canonicalHeaderRelaxed(f))
+		}
+	}
+
+	sig := fmt.Sprintf("DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s;\r\n"+
+		"\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		s.Domain, s.Selector, time.Now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	// The signature header itself is hashed without a trailing CRLF
+	hashed.WriteString(strings.TrimRight(canonicalHeaderRelaxed(sig), "\r\n"))
+
+	digest := sha256.Sum256(hashed.Bytes())
+	b, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(sig + base64.StdEncoding.EncodeToString(b) + "\r\n"), nil
+}
+
+// splitMessage separates the header block (including the final CRLF of the
+// last header) from the body
+func splitMessage(msg []byte) (headers []byte, body []byte) {
+	if bytes.HasPrefix(msg, []byte("\r\n")) {
+		return nil, msg[2:]
+	}
+	if idx := bytes.Index(msg, []byte("\r\n\r\n")); idx >= 0 {
+		return msg[:idx+2], msg[idx+4:]
+	}
+	return msg, nil
+}
+
+// parseHeaderFields splits a header block into raw (still folded) fields
+func parseHeaderFields(headers []byte) []string {
+	fields := make([]string, 0, 20)
+	for _, line := range strings.SplitAfter(string(headers), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			// Continuation of a folded header
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// headerFieldName returns the lowercased name of a raw header field
+func headerFieldName(field string) string {
+	if idx := strings.IndexByte(field, ':'); idx >= 0 {
+		return strings.ToLower(strings.TrimRight(field[:idx], " \t"))
+	}
+	return ""
+}
+
+// findHeaderField returns the next unused instance of the named header,
+// working from the bottom of the header block up as RFC 6376 5.4.2 requires.
+func findHeaderField(fields []string, name string, used map[string]int) string {
+	skip := used[name]
+	for i := len(fields) - 1; i >= 0; i-- {
+		if headerFieldName(fields[i]) == name {
+			if skip == 0 {
+				used[name]++
+				return fields[i]
+			}
+			skip--
+		}
+	}
+	return ""
+}
+
+// canonicalHeaderRelaxed applies the "relaxed" header canonicalization
+// algorithm from RFC 6376 3.4.2
+func canonicalHeaderRelaxed(field string) string {
+	idx := strings.IndexByte(field, ':')
+	if idx < 0 {
+		return field
+	}
+	name := strings.ToLower(strings.TrimRight(field[:idx], " \t"))
+	value := strings.Replace(field[idx+1:], "\r\n", "", -1)
+	value = wspRunRE.ReplaceAllString(value, " ")
+	value = strings.Trim(value, " ")
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalBodyRelaxed applies the "relaxed" body canonicalization algorithm
+// from RFC 6376 3.4.4
+func canonicalBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	buf := new(bytes.Buffer)
+	blank := 0
+	for i, line := range lines {
+		if i == len(lines)-1 && line == "" {
+			// Text after the final CRLF
+			break
+		}
+		line = strings.TrimRight(wspRunRE.ReplaceAllString(line, " "), " ")
+		if line == "" {
+			blank++
+			continue
+		}
+		for ; blank > 0; blank-- {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// canonicalHeaderSimple applies the "simple" header canonicalization
+// algorithm from RFC 6376 3.4.1, which leaves the field untouched
+func canonicalHeaderSimple(field string) string {
+	return field
+}
+
+// canonicalBodySimple applies the "simple" body canonicalization algorithm
+// from RFC 6376 3.4.3
+func canonicalBodySimple(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) == 0 || bytes.Equal(body, []byte("\r\n")) {
+		return []byte("\r\n")
+	}
+	if !bytes.HasSuffix(body, []byte("\r\n")) {
+		body = append(body, '\r', '\n')
+	}
+	return body
+}
+
+// parseTagList parses a DKIM style "tag=value; tag=value" list, folding
+// whitespace is removed from the values
+func parseTagList(list string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(list, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		idx := strings.IndexByte(spec, '=')
+		if idx < 1 {
+			return nil, fmt.Errorf("Malformed tag %q", spec)
+		}
+		name := strings.TrimSpace(spec[:idx])
+		value := strings.TrimSpace(spec[idx+1:])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("Duplicate tag %q", name)
+		}
+		tags[name] = value
+	}
+	return tags, nil
+}
+
+// stripFWS removes all whitespace, as used in base64 tag values
+func stripFWS(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// DkimVerify checks every DKIM-Signature header in msg, returning one result
+// per signature.  An empty slice is returned for unsigned messages.
+func DkimVerify(msg []byte) []*DkimResult {
+	headers, body := splitMessage(msg)
+	fields := parseHeaderFields(headers)
+	results := make([]*DkimResult, 0)
+	for _, f := range fields {
+		if headerFieldName(f) == "dkim-signature" {
+			results = append(results, dkimVerifySignature(f, fields, body))
+		}
+	}
+	return results
+}
+
+// dkimVerifySignature verifies a single DKIM-Signature field against the
+// message headers and body
+func dkimVerifySignature(sigField string, fields []string, body []byte) *DkimResult {
+	result := &DkimResult{Result: AUTH_PERMERROR}
+	value := sigField[strings.IndexByte(sigField, ':')+1:]
+	tags, err := parseTagList(value)
+	if err != nil {
+		result.Reason = err.Error()
+		return result
+	}
+	result.Domain = strings.ToLower(tags["d"])
+	result.Selector = tags["s"]
+
+	for _, t := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[t] == "" {
+			result.Reason = fmt.Sprintf("Missing required tag %v", t)
+			return result
+		}
+	}
+	if tags["v"] != "1" {
+		result.Reason = "Unsupported version"
+		return result
+	}
+
+	var hashNew func() hash.Hash
+	var hashId crypto.Hash
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		hashNew, hashId = sha256.New, crypto.SHA256
+	case "rsa-sha1":
+		hashNew, hashId = sha1.New, crypto.SHA1
+	default:
+		result.Reason = "Unsupported algorithm " + tags["a"]
+		return result
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c := strings.ToLower(tags["c"]); c != "" {
+		parts := strings.SplitN(c, "/", 2)
+		headerCanon = parts[0]
+		if len(parts) == 2 {
+			bodyCanon = parts[1]
+		}
+	}
+	canonHeader := canonicalHeaderSimple
+	switch headerCanon {
+	case "simple":
+	case "relaxed":
+		canonHeader = canonicalHeaderRelaxed
+	default:
+		result.Reason = "Unsupported header canonicalization " + headerCanon
+		return result
+	}
+	var canonBody []byte
+	switch bodyCanon {
+	case "simple":
+		canonBody = canonicalBodySimple(body)
+	case "relaxed":
+		canonBody = canonicalBodyRelaxed(body)
+	default:
+		result.Reason = "Unsupported body canonicalization " + bodyCanon
+		return result
+	}
+
+	signed := make([]string, 0)
+	for _, h := range strings.Split(tags["h"], ":") {
+		signed = append(signed, strings.ToLower(strings.TrimSpace(h)))
+	}
+	hasFrom := false
+	for _, h := range signed {
+		if h == "from" {
+			hasFrom = true
+		}
+	}
+	if !hasFrom {
+		result.Reason = "From header not signed"
+		return result
+	}
+
+	if x := tags["x"]; x != "" {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			result.Reason = "Malformed expiration"
+			return result
+		}
+		if time.Now().Unix() > expires {
+			result.Result = AUTH_FAIL
+			result.Reason = "Signature expired"
+			return result
+		}
+	}
+
+	if l := tags["l"]; l != "" {
+		length, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || length < 0 {
+			result.Reason = "Malformed body length"
+			return result
+		}
+		if length < int64(len(canonBody)) {
+			canonBody = canonBody[:length]
+		}
+	}
+
+	key, res, reason := dkimLookupKey(tags["s"], result.Domain)
+	if key == nil {
+		result.Result = res
+		result.Reason = reason
+		return result
+	}
+
+	bh := hashNew()
+	bh.Write(canonBody)
+	if base64.StdEncoding.EncodeToString(bh.Sum(nil)) != stripFWS(tags["bh"]) {
+		result.Result = AUTH_FAIL
+		result.Reason = "Body hash did not verify"
+		return result
+	}
+
+	hh := hashNew()
+	used := make(map[string]int)
+	for _, h := range signed {
+		// Non-existent headers are hashed as the null string
+		if f := findHeaderField(fields, h, used); f != "" {
+			hh.Write([]byte(canonHeader(f)))
+		}
+	}
+	blanked := dkimSigValueRE.ReplaceAllString(sigField, "$1")
+	hh.Write([]byte(strings.TrimRight(canonHeader(blanked), "\r\n")))
+
+	sig, err := base64.StdEncoding.DecodeString(stripFWS(tags["b"]))
+	if err != nil {
+		result.Reason = "Malformed signature"
+		return result
+	}
+	if err := rsa.VerifyPKCS1v15(key, hashId, hh.Sum(nil), sig); err != nil {
+		result.Result = AUTH_FAIL
+		result.Reason = "Signature did not verify"
+		return result
+	}
+
+	result.Result = AUTH_PASS
+	return result
+}
+
+// dkimLookupKey fetches the public key for selector and domain from DNS, on
+// failure the appropriate result and a reason are returned instead.
+func dkimLookupKey(selector string, domain string) (*rsa.PublicKey, string, string) {
+	txts, err := lookupTXT(DkimRecordName(selector, domain))
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.Temporary() {
+			return nil, AUTH_PERMERROR, "No key for signature"
+		}
+		return nil, AUTH_TEMPERROR, "Key unavailable"
+	}
+	if len(txts) == 0 {
+		return nil, AUTH_PERMERROR, "No key for signature"
+	}
+	tags, err := parseTagList(strings.Join(txts, ""))
+	if err != nil {
+		return nil, AUTH_PERMERROR, "Malformed key record"
+	}
+	if k := tags["k"]; k != "" && k != "rsa" {
+		return nil, AUTH_PERMERROR, "Unsupported key type " + k
+	}
+	p := stripFWS(tags["p"])
+	if p == "" {
+		return nil, AUTH_FAIL, "Key revoked"
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, AUTH_PERMERROR, "Malformed public key"
+	}
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		if rsaPub, ok := pub.(*rsa.PublicKey); ok {
+			return rsaPub, "", ""
+		}
+		return nil, AUTH_PERMERROR, "Unsupported key type"
+	}
+	// Some publishers use a bare PKCS#1 key
+	if rsaPub, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return rsaPub, "", ""
+	}
+	return nil, AUTH_PERMERROR, "Malformed public key"
+}
@@ -0,0 +1,153 @@
+package smtpd
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Example from RFC 6376 3.4.5
+func TestDkimCanonicalRelaxed(t *testing.T) {
+	fields := parseHeaderFields([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n"))
+	assert.Equal(t, 2, len(fields))
+	assert.Equal(t, "a:X\r\n", canonicalHeaderRelaxed(fields[0]))
+	assert.Equal(t, "b:Y Z\r\n", canonicalHeaderRelaxed(fields[1]))
+
+	body := []byte(" C \r\nD \t E\r\n\r\n\r\n")
+	assert.Equal(t, " C\r\nD E\r\n", string(canonicalBodyRelaxed(body)))
+
+	// Missing final CRLF is added, empty body stays empty
+	assert.Equal(t, "a\r\n", string(canonicalBodyRelaxed([]byte("a"))))
+	assert.Equal(t, "", string(canonicalBodyRelaxed([]byte("\r\n\r\n"))))
+}
+
+func TestDkimFindHeaderBottomUp(t *testing.T) {
+	fields := parseHeaderFields([]byte("Received: one\r\nReceived: two\r\nFrom: a@b\r\n"))
+	used := make(map[string]int)
+	assert.Equal(t, "Received: two\r\n", findHeaderField(fields, "received", used))
+	assert.Equal(t, "Received: one\r\n", findHeaderField(fields, "received", used))
+	assert.Equal(t, "", findHeaderField(fields, "received", used))
+}
+
+func TestDkimSign(t *testing.T) {
+	pemKey, err := GenerateDkimKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewDkimSigner("example.com", "sel", pemKey, []string{"subject", "to"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"from", "subject", "to"}, signer.Headers)
+
+	msg := []byte("From: Joe <joe@example.com>\r\nSubject:  Hello\r\n\r\nHi there \r\n\r\n")
+	sig, err := signer.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := string(sig)
+	assert.True(t, strings.HasPrefix(header, "DKIM-Signature: v=1; a=rsa-sha256;"))
+	assert.Contains(t, header, "d=example.com; s=sel;")
+	// To is not present, so must not be listed
+	assert.Contains(t, header, "h=from:subject;")
+
+	bh := sha256.Sum256([]byte("Hi there\r\n"))
+	assert.Contains(t, header, "bh="+base64.StdEncoding.EncodeToString(bh[:])+";")
+
+	// Verify the signature against the public key
+	idx := strings.LastIndex(header, "b=")
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[idx+2:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := "from:Joe <joe@example.com>\r\nsubject:Hello\r\n" +
+		strings.TrimRight(canonicalHeaderRelaxed(header[:idx+2]), "\r\n")
+	digest := sha256.Sum256([]byte(hashed))
+	key, _ := parseDkimKey(pemKey)
+	assert.Nil(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], b))
+
+	txt, err := DkimTxtRecord(pemKey)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(txt, "v=DKIM1; k=rsa; p="))
+	assert.Equal(t, "sel._domainkey.example.com", DkimRecordName("sel", "example.com"))
+}
+
+// fakeTXT replaces lookupTXT with a map backed resolver for the duration of a
+// test, returning a function that restores the real resolver
+func fakeTXT(records map[string][]string) func() {
+	lookupTXT = func(name string) ([]string, error) {
+		if txts, ok := records[name]; ok {
+			return txts, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name}
+	}
+	return func() { lookupTXT = net.LookupTXT }
+}
+
+func TestDkimVerify(t *testing.T) {
+	pemKey, err := GenerateDkimKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt, _ := DkimTxtRecord(pemKey)
+	defer fakeTXT(map[string][]string{"sel._domainkey.example.com": {txt}})()
+
+	signer, _ := NewDkimSigner("example.com", "sel", pemKey, []string{"subject"})
+	msg := []byte("From: joe@example.com\r\nSubject: Hello\r\n\r\nHi there\r\n")
+	sig, err := signer.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := append(sig, msg...)
+
+	results := DkimVerify(signed)
+	if assert.Equal(t, 1, len(results)) {
+		assert.Equal(t, AUTH_PASS, results[0].Result, results[0].Reason)
+		assert.Equal(t, "example.com", results[0].Domain)
+		assert.Equal(t, "sel", results[0].Selector)
+	}
+
+	// Tampered body
+	tampered := append(append([]byte{}, sig...),
+		[]byte("From: joe@example.com\r\nSubject: Hello\r\n\r\nHi There\r\n")...)
+	results = DkimVerify(tampered)
+	assert.Equal(t, AUTH_FAIL, results[0].Result)
+	assert.Equal(t, "Body hash did not verify", results[0].Reason)
+
+	// Tampered header
+	tampered = append(append([]byte{}, sig...),
+		[]byte("From: joe@example.com\r\nSubject: Hello!\r\n\r\nHi there\r\n")...)
+	results = DkimVerify(tampered)
+	assert.Equal(t, AUTH_FAIL, results[0].Result)
+	assert.Equal(t, "Signature did not verify", results[0].Reason)
+
+	// Unknown selector
+	other, _ := NewDkimSigner("example.com", "other", pemKey, nil)
+	sig, _ = other.Sign(msg)
+	results = DkimVerify(append(sig, msg...))
+	assert.Equal(t, AUTH_PERMERROR, results[0].Result)
+
+	// Unsigned
+	assert.Equal(t, 0, len(DkimVerify(msg)))
+}
+
+func TestDkimCanonicalSimple(t *testing.T) {
+	assert.Equal(t, " C \r\nD \t E\r\n",
+		string(canonicalBodySimple([]byte(" C \r\nD \t E\r\n\r\n\r\n"))))
+	assert.Equal(t, "\r\n", string(canonicalBodySimple(nil)))
+}
+
+// Mail from unauthenticated clients is never signed, whatever its From says
+func TestDkimSignUnauthenticated(t *testing.T) {
+	ss := &Session{from: "joe@example.com"}
+	msg := []byte("From: joe@example.com\r\nSubject: Hello!\r\n\r\nHi there\r\n")
+	assert.Equal(t, msg, ss.dkimSign(msg))
+	assert.Equal(t, "joe@example.com", ss.authorAddress(msg))
+	assert.Equal(t, "joe@example.com", ss.authorAddress([]byte("Subject: x\r\n\r\n")))
+}
@@ -0,0 +1,201 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+)
+
+// Second level labels commonly used beneath country code TLDs, we have no
+// public suffix list to consult so this covers the usual suspects.
+var secondLevelLabels = map[string]bool{
+	"ac": true, "co": true, "com": true, "edu": true, "gov": true, "net": true,
+	"org": true, "ne": true, "or": true,
+}
+
+// AuthResults holds the verdicts recorded in the Authentication-Results
+// header when a message was received
+type AuthResults struct {
+	Dkim        string
+	DkimDomain  string
+	Spf         string
+	SpfDomain   string
+	Dmarc       string
+	DmarcPolicy string
+	HeaderFrom  string
+}
+
+// DmarcResult is the outcome of a DMARC policy evaluation
+type DmarcResult struct {
+	Result string
+	Policy string
+	Domain string
+}
+
+// OrganizationalDomain approximates the RFC 7489 3.2 organizational domain
+func OrganizationalDomain(domain string) string {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+	n := 2
+	if len(labels) >= 3 && len(labels[len(labels)-1]) == 2 &&
+		secondLevelLabels[labels[len(labels)-2]] {
+		n = 3
+	}
+	if len(labels) <= n {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+// aligned checks identifier alignment in either relaxed or strict mode
+func aligned(authDomain string, fromDomain string, strict bool) bool {
+	authDomain = strings.ToLower(authDomain)
+	fromDomain = strings.ToLower(fromDomain)
+	if strict {
+		return authDomain == fromDomain
+	}
+	return OrganizationalDomain(authDomain) == OrganizationalDomain(fromDomain)
+}
+
+// dmarcRecord looks up the policy record published for domain
+func dmarcRecord(domain string) (map[string]string, string) {
+	txts, err := lookupTXT("_dmarc." + domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.Temporary() {
+			return nil, AUTH_NONE
+		}
+		return nil, AUTH_TEMPERROR
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			tags, err := parseTagList(txt)
+			if err != nil {
+				return nil, AUTH_PERMERROR
+			}
+			return tags, ""
+		}
+	}
+	return nil, AUTH_NONE
+}
+
+// CheckDMARC evaluates the DMARC policy for fromDomain given the SPF result
+// for spfDomain and the DKIM results for the message
+func CheckDMARC(fromDomain string, spfResult string, spfDomain string,
+	dkim []*DkimResult) *DmarcResult {
+	result := &DmarcResult{Result: AUTH_NONE, Domain: strings.ToLower(fromDomain)}
+	if fromDomain == "" {
+		return result
+	}
+
+	tags, res := dmarcRecord(result.Domain)
+	policyTag := "p"
+	if tags == nil && res == AUTH_NONE {
+		org := OrganizationalDomain(result.Domain)
+		if org != result.Domain {
+			tags, res = dmarcRecord(org)
+			policyTag = "sp"
+		}
+	}
+	if tags == nil {
+		result.Result = res
+		return result
+	}
+
+	result.Policy = tags["p"]
+	if policyTag == "sp" && tags["sp"] != "" {
+		result.Policy = tags["sp"]
+	}
+
+	strictDkim := tags["adkim"] == "s"
+	strictSpf := tags["aspf"] == "s"
+
+	result.Result = AUTH_FAIL
+	for _, d := range dkim {
+		if d.Result == AUTH_PASS && aligned(d.Domain, result.Domain, strictDkim) {
+			result.Result = AUTH_PASS
+			return result
+		}
+	}
+	if spfResult == AUTH_PASS && aligned(spfDomain, result.Domain, strictSpf) {
+		result.Result = AUTH_PASS
+	}
+	return result
+}
+
+// CheckAuthentication runs SPF, DKIM and DMARC checks against a received
+// message, returning the verdicts and the Authentication-Results header
+// (including trailing CRLF) to be prepended to the message.
+func CheckAuthentication(authServId string, ip net.IP, helo string, mailFrom string,
+	msg []byte) (*AuthResults, []byte) {
+	results := &AuthResults{}
+
+	// SPF, RFC 7208 2.4 says use postmaster@helo for the null sender
+	sender := mailFrom
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	if idx := strings.LastIndex(sender, "@"); idx >= 0 {
+		results.SpfDomain = strings.ToLower(sender[idx+1:])
+	}
+	results.Spf = CheckSPF(ip, results.SpfDomain, sender, helo)
+
+	// DKIM
+	dkim := DkimVerify(msg)
+	results.Dkim = AUTH_NONE
+	for _, d := range dkim {
+		if results.Dkim != AUTH_PASS {
+			results.Dkim = d.Result
+			results.DkimDomain = d.Domain
+		}
+	}
+
+	// DMARC
+	if m, err := mail.ReadMessage(strings.NewReader(string(msg))); err == nil {
+		if addr, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+			if idx := strings.LastIndex(addr.Address, "@"); idx >= 0 {
+				results.HeaderFrom = strings.ToLower(addr.Address[idx+1:])
+			}
+		}
+	}
+	dmarc := CheckDMARC(results.HeaderFrom, results.Spf, results.SpfDomain, dkim)
+	results.Dmarc = dmarc.Result
+	results.DmarcPolicy = dmarc.Policy
+
+	// Build the header, one method result per line
+	lines := make([]string, 0, len(dkim)+2)
+	if len(dkim) == 0 {
+		lines = append(lines, "dkim=none")
+	}
+	for _, d := range dkim {
+		line := fmt.Sprintf("dkim=%s header.d=%s header.s=%s", d.Result, d.Domain, d.Selector)
+		if d.Reason != "" {
+			line += fmt.Sprintf(" reason=%q", d.Reason)
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, fmt.Sprintf("spf=%s smtp.mailfrom=%s", results.Spf, sender))
+	dline := "dmarc=" + dmarc.Result
+	if dmarc.Policy != "" {
+		dline += " (p=" + dmarc.Policy + ")"
+	}
+	if results.HeaderFrom != "" {
+		dline += " header.from=" + results.HeaderFrom
+	}
+	lines = append(lines, dline)
+
+	header := "Authentication-Results: " + authServId + ";\r\n\t" +
+		strings.Join(lines, ";\r\n\t") + "\r\n"
+	return results, []byte(header)
+}
+
+// removeAuthResults drops the Authentication-Results header fields that claim
+// to come from authServId, only we may add those (RFC 8601 section 5)
+func removeAuthResults(data []byte, authServId string) []byte {
+	return filterHeaders(data, func(name string, value string) bool {
+		if !strings.EqualFold(name, "Authentication-Results") {
+			return false
+		}
+		id := strings.Fields(strings.SplitN(value, ";", 2)[0])
+		return len(id) > 0 && strings.EqualFold(id[0], authServId)
+	})
+}
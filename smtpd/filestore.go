@@ -21,6 +21,12 @@ import (
 // Name of index file in each mailbox
 const INDEX_FILE = "index.gob"
 
+// Name of the file holding the UID validity and next UID of each mailbox
+const UID_FILE = "uid"
+
+// Name of the directory in each mailbox holding its folders
+const FOLDERS_DIR = "folders"
+
 // We lock this when reading/writing an index file, this is a bottleneck because
 // it's a single lock even if we have a million index files
 var indexLock = new(sync.RWMutex)
@@ -35,6 +41,26 @@ func init() {
 	go countGenerator(countChannel)
 }
 
+// The last UID validity handed out, so a mailbox purged and recreated within
+// the same second still gets a new one
+var lastUidValidity struct {
+	sync.Mutex
+	value uint32
+}
+
+// newUidValidity returns a UID validity greater than any before it
+func newUidValidity() uint32 {
+	lastUidValidity.Lock()
+	defer lastUidValidity.Unlock()
+
+	v := uint32(time.Now().Unix())
+	if v <= lastUidValidity.value {
+		v = lastUidValidity.value + 1
+	}
+	lastUidValidity.value = v
+	return v
+}
+
 // Populates the channel with numbers
 func countGenerator(c chan int) {
 	for i := 0; true; i = (i + 1) % 10000 {
@@ -84,9 +110,10 @@ func (ds *FileDataStore) MailboxFor(emailAddress string) (Mailbox, error) {
 	s2 := dir[0:6]
 	path := filepath.Join(ds.mailPath, s1, s2, dir)
 	indexPath := filepath.Join(path, INDEX_FILE)
+	uidPath := filepath.Join(path, UID_FILE)
 
 	return &FileMailbox{store: ds, name: name, dirName: dir, path: path,
-		indexPath: indexPath}, nil
+		indexPath: indexPath, uidPath: uidPath}, nil
 }
 
 // AllMailboxes returns a slice with all Mailboxes
@@ -119,8 +146,16 @@ func (ds *FileDataStore) AllMailboxes() ([]Mailbox, error) {
 							mbpath := filepath.Join(ds.mailPath, l1, l2, mbdir)
 							idx := filepath.Join(mbpath, INDEX_FILE)
 							mb := &FileMailbox{store: ds, dirName: mbdir, path: mbpath,
-								indexPath: idx}
+								indexPath: idx, uidPath: filepath.Join(mbpath, UID_FILE)}
 							mailboxes = append(mailboxes, mb)
+							// Followed by its folders
+							folders, err := mb.Folders()
+							if err != nil {
+								return nil, err
+							}
+							for _, folder := range folders {
+								mailboxes = append(mailboxes, mb.folderMailbox(folder))
+							}
 						}
 					}
 				}
@@ -132,21 +167,47 @@ func (ds *FileDataStore) AllMailboxes() ([]Mailbox, error) {
 }
 
 // A Mailbox manages the mail for a specific user and correlates to a particular
-// directory on disk.
+// directory on disk.  Folders are FileMailboxes too, in directories beneath
+// that of the mailbox they belong to.
 type FileMailbox struct {
 	store       *FileDataStore
 	name        string
 	dirName     string
+	folder      string
+	inbox       *FileMailbox
 	path        string
 	indexLoaded bool
 	indexPath   string
+	uidPath     string
+	uidValidity uint32
+	uidNext     uint32
 	messages    []*FileMessage
 }
 
 func (mb *FileMailbox) String() string {
+	if mb.inbox != nil {
+		return mb.name + "/" + mb.folder + "[" + mb.dirName + "]"
+	}
 	return mb.name + "[" + mb.dirName + "]"
 }
 
+// lockName is the name the mailbox is locked under, each folder is locked
+// separately from the INBOX
+func (mb *FileMailbox) lockName() string {
+	if mb.inbox != nil {
+		return mb.dirName + "/" + mb.folder
+	}
+	return mb.dirName
+}
+
+func (mb *FileMailbox) Lock(owner string) error {
+	return lockMailbox(mb.lockName(), owner)
+}
+
+func (mb *FileMailbox) Unlock() {
+	unlockMailbox(mb.lockName())
+}
+
 // GetMessages scans the mailbox directory for .gob files and decodes them into
 // a slice of Message objects.
 func (mb *FileMailbox) GetMessages() ([]Message, error) {
@@ -180,29 +241,70 @@ func (mb *FileMailbox) GetMessage(id string) (Message, error) {
 	return nil, ErrNotExist
 }
 
+// UidValidity returns the UID validity of the mailbox, it changes when the
+// mailbox is emptied and created anew
+func (mb *FileMailbox) UidValidity() (uint32, error) {
+	if !mb.indexLoaded {
+		if err := mb.readIndex(); err != nil {
+			return 0, err
+		}
+	}
+	return mb.uidValidity, nil
+}
+
+// UidNext returns the UID the next message delivered will get
+func (mb *FileMailbox) UidNext() (uint32, error) {
+	if !mb.indexLoaded {
+		if err := mb.readIndex(); err != nil {
+			return 0, err
+		}
+	}
+	return mb.uidNext, nil
+}
+
 // Delete all messages in this mailbox
 func (mb *FileMailbox) Purge() error {
+	if !mb.indexLoaded {
+		// An emptied folder keeps its UIDs
+		if err := mb.readIndex(); err != nil {
+			return err
+		}
+	}
 	mb.messages = mb.messages[:0]
 	return mb.writeIndex()
 }
 
 // readIndex loads the mailbox index data from disk
 func (mb *FileMailbox) readIndex() error {
+	assigned, err := mb.loadIndex()
+	if err != nil || !assigned {
+		return err
+	}
+	// Messages stored before we kept UIDs were just given theirs
+	return mb.writeIndex()
+}
+
+// loadIndex does the work of readIndex, it returns true if it had to assign
+// UIDs that are not yet on disk
+func (mb *FileMailbox) loadIndex() (bool, error) {
 	// Clear message slice, open index
 	mb.messages = mb.messages[:0]
 	// Lock for reading
 	indexLock.RLock()
 	defer indexLock.RUnlock()
+	if err := mb.readUids(); err != nil {
+		return false, err
+	}
 	// Check if index exists
 	if _, err := os.Stat(mb.indexPath); err != nil {
 		// Does not exist, but that's not an error in our world
 		log.LogTrace("Index %v does not exist (yet)", mb.indexPath)
 		mb.indexLoaded = true
-		return nil
+		return false, nil
 	}
 	file, err := os.Open(mb.indexPath)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer file.Close()
 
@@ -216,14 +318,40 @@ func (mb *FileMailbox) readIndex() error {
 				// It's OK to get an EOF here
 				break
 			}
-			return fmt.Errorf("While decoding message: %v", err)
+			return false, fmt.Errorf("While decoding message: %v", err)
 		}
 		msg.mailbox = mb
 		log.LogTrace("Found: %v", msg)
 		mb.messages = append(mb.messages, msg)
 	}
 
+	assigned := false
+	for _, msg := range mb.messages {
+		if msg.Fuid == 0 {
+			msg.Fuid = mb.uidNext
+			mb.uidNext++
+			assigned = true
+		}
+	}
+
 	mb.indexLoaded = true
+	return assigned, nil
+}
+
+// readUids loads the UID validity and next UID, a mailbox without them is
+// given a new validity
+func (mb *FileMailbox) readUids() error {
+	data, err := ioutil.ReadFile(mb.uidPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		mb.uidValidity, mb.uidNext = newUidValidity(), 1
+		return nil
+	}
+	if _, err = fmt.Sscan(string(data), &mb.uidValidity, &mb.uidNext); err != nil {
+		return fmt.Errorf("While reading %v: %v", mb.uidPath, err)
+	}
 	return nil
 }
 
@@ -265,6 +393,13 @@ func (mb *FileMailbox) writeIndex() error {
 			}
 		}
 		writer.Flush()
+
+		if err = mb.writeUids(); err != nil {
+			return err
+		}
+	} else if mb.inbox != nil || mb.hasFolders() {
+		// No messages, but the folder or the folders in the mailbox stay
+		return mb.clear()
 	} else {
 		// No messages, delete index+maildir
 		log.LogTrace("Removing mailbox %v", mb.path)
@@ -274,16 +409,52 @@ func (mb *FileMailbox) writeIndex() error {
 	return nil
 }
 
+// writeUids saves the UID validity and next UID
+func (mb *FileMailbox) writeUids() error {
+	uids := fmt.Sprintf("%v %v\n", mb.uidValidity, mb.uidNext)
+	return ioutil.WriteFile(mb.uidPath, []byte(uids), 0660)
+}
+
+// clear removes the index and messages of an empty mailbox that must be kept.
+// A folder keeps its UIDs, the INBOX gets a new UID validity when next used
+// as it would have were the whole mailbox removed.
+func (mb *FileMailbox) clear() error {
+	infos, err := ioutil.ReadDir(mb.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, inf := range infos {
+		name := inf.Name()
+		if name == FOLDERS_DIR || (name == UID_FILE && mb.inbox != nil) {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(mb.path, name)); err != nil {
+			return err
+		}
+	}
+	if mb.inbox != nil {
+		return mb.writeUids()
+	}
+	return nil
+}
+
 // Message contains a little bit of data about a particular email message, and
 // methods to retrieve the rest of it from disk.
 type FileMessage struct {
 	mailbox *FileMailbox
 	// Stored in GOB
 	Fid      string
+	Fuid     uint32
 	Fdate    time.Time
 	Ffrom    string
 	Fsubject string
 	Fsize    int64
+	Fauth    *AuthResults
+	Fspam    *SpamResult
+	Fflags   []string
 	// These are for creating new messages only
 	writable   bool
 	writerFile *os.File
@@ -319,6 +490,10 @@ func (m *FileMessage) Id() string {
 	return m.Fid
 }
 
+func (m *FileMessage) Uid() uint32 {
+	return m.Fuid
+}
+
 func (m *FileMessage) Date() time.Time {
 	return m.Fdate
 }
@@ -339,6 +514,61 @@ func (m *FileMessage) Size() int64 {
 	return m.Fsize
 }
 
+// AuthResults returns the DKIM, SPF and DMARC verdicts recorded when the
+// message was received, or nil if it was not verified
+func (m *FileMessage) AuthResults() *AuthResults {
+	return m.Fauth
+}
+
+// SetAuthResults records the verdicts reached when the message was received,
+// they are saved to the index when it is closed
+func (m *FileMessage) SetAuthResults(results *AuthResults) {
+	m.Fauth = results
+}
+
+// SpamResult returns the spam score recorded when the message was received,
+// or nil if it was not scored
+func (m *FileMessage) SpamResult() *SpamResult {
+	return m.Fspam
+}
+
+// SetSpamResult records the spam score given when the message was received,
+// it is saved to the index when it is closed
+func (m *FileMessage) SetSpamResult(result *SpamResult) {
+	m.Fspam = result
+}
+
+// Flags returns the system flags and keywords set on the message
+func (m *FileMessage) Flags() []string {
+	return m.Fflags
+}
+
+// SetFlags replaces the flags of the message and saves them to the index.  A
+// message not yet closed keeps them until it is.
+func (m *FileMessage) SetFlags(flags []string) error {
+	flags, err := CanonicalFlags(flags)
+	if err != nil {
+		return err
+	}
+	if m.Fuid == 0 {
+		m.Fflags = flags
+		return nil
+	}
+	// Refresh the index so we don't undo changes made since we read it
+	mb := m.mailbox
+	if err = mb.readIndex(); err != nil {
+		return err
+	}
+	for _, mm := range mb.messages {
+		if mm.Fid == m.Fid {
+			mm.Fflags = flags
+			m.Fflags = flags
+			return mb.writeIndex()
+		}
+	}
+	return ErrNotExist
+}
+
 func (m *FileMessage) rawPath() string {
 	return filepath.Join(m.mailbox.path, m.Fid+".raw")
 }
@@ -462,25 +692,31 @@ func (m *FileMessage) Close() error {
 	}
 
 	// Made it this far without errors, add it to the index
+	m.Fuid = m.mailbox.uidNext
+	m.mailbox.uidNext++
 	m.mailbox.messages = append(m.mailbox.messages, m)
 	return m.mailbox.writeIndex()
 }
 
-// Delete this Message from disk by removing both the gob and raw files
-func (m *FileMessage) Delete() error {
-	messages := m.mailbox.messages
-	for i, mm := range messages {
-		if m == mm {
+// remove takes m out of the mailbox index, without writing it
+func (mb *FileMailbox) remove(m *FileMessage) {
+	for i, mm := range mb.messages {
+		if m.Fid == mm.Fid {
 			// Slice around message we are deleting
-			m.mailbox.messages = append(messages[:i], messages[i+1:]...)
+			mb.messages = append(mb.messages[:i], mb.messages[i+1:]...)
 			break
 		}
 	}
+}
+
+// Delete this Message from disk by removing both the gob and raw files
+func (m *FileMessage) Delete() error {
+	m.mailbox.remove(m)
 	m.mailbox.writeIndex()
 
 	if len(m.mailbox.messages) == 0 {
-		// This was the last message, writeIndex() has removed the entire
-		// directory
+		// This was the last message, writeIndex() has removed its file along
+		// with the rest of the mailbox
 		return nil
 	}
 
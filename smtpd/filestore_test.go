@@ -378,6 +378,296 @@ func TestFSMissing(t *testing.T) {
 	}
 }
 
+// Test UIDs are kept across mailbox objects and never reused, until the
+// mailbox is emptied and gets a new UID validity
+func TestFSUids(t *testing.T) {
+	ds, logbuf := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+
+	mbName := "fred"
+	for _, subj := range []string{"alpha", "bravo", "charlie"} {
+		deliverMessage(ds, mbName, subj, time.Now())
+	}
+
+	mb, err := ds.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	validity, err := mb.UidValidity()
+	assert.Nil(t, err)
+	assert.NotEqual(t, uint32(0), validity)
+	next, err := mb.UidNext()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(4), next)
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		t.Fatalf("Failed to GetMessages for %q: %v", mbName, err)
+	}
+	for i, msg := range msgs {
+		assert.Equal(t, uint32(i+1), msg.Uid())
+	}
+
+	// Deleting the newest message must not free its UID
+	msgs[2].Delete()
+	deliverMessage(ds, mbName, "delta", time.Now())
+
+	mb, err = ds.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	msgs, err = mb.GetMessages()
+	if err != nil {
+		t.Fatalf("Failed to GetMessages for %q: %v", mbName, err)
+	}
+	if assert.Equal(t, 3, len(msgs)) {
+		assert.Equal(t, uint32(1), msgs[0].Uid())
+		assert.Equal(t, uint32(2), msgs[1].Uid())
+		assert.Equal(t, uint32(4), msgs[2].Uid())
+	}
+	v, _ := mb.UidValidity()
+	assert.Equal(t, validity, v)
+
+	// A mailbox created anew starts over with a new validity
+	assert.Nil(t, mb.Purge())
+	deliverMessage(ds, mbName, "echo", time.Now())
+	mb, err = ds.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	v, _ = mb.UidValidity()
+	assert.NotEqual(t, validity, v)
+	msgs, _ = mb.GetMessages()
+	if assert.Equal(t, 1, len(msgs)) {
+		assert.Equal(t, uint32(1), msgs[0].Uid())
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test the exclusive lock on a mailbox, it must be shared by every Mailbox
+// object for the same name
+func TestFSLock(t *testing.T) {
+	ds, logbuf := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+
+	mbName := "fred"
+	deliverMessage(ds, mbName, "a", time.Now())
+
+	mb1, err := ds.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	mb2, err := ds.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	other, err := ds.MailboxFor("wilma")
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", "wilma", err)
+	}
+
+	assert.Nil(t, mb1.Lock("first"))
+	assert.Equal(t, ErrMailboxLocked, mb2.Lock("second"))
+	mboxes, err := ds.AllMailboxes()
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(mboxes)) {
+		assert.Equal(t, ErrMailboxLocked, mboxes[0].Lock("scanner"))
+	}
+
+	// Other mailboxes are unaffected
+	assert.Nil(t, other.Lock("other"))
+	other.Unlock()
+
+	mb1.Unlock()
+	assert.Nil(t, mb2.Lock("second"))
+	mb2.Unlock()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test creating, listing, renaming and deleting folders
+func TestFSFolders(t *testing.T) {
+	ds, logbuf := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+
+	mb, err := ds.MailboxFor("fred")
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", "fred", err)
+	}
+	folders, err := mb.Folders()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, folders)
+
+	// Parents are created along with the folder
+	_, err = mb.CreateFolder("Lists/Go")
+	assert.Nil(t, err)
+	_, err = mb.CreateFolder("Junk")
+	assert.Nil(t, err)
+	folders, _ = mb.Folders()
+	assert.Equal(t, []string{"Junk", "Lists", "Lists/Go"}, folders)
+
+	_, err = mb.CreateFolder("Junk")
+	assert.Equal(t, ErrFolderExists, err)
+	_, err = mb.CreateFolder("inbox")
+	assert.Equal(t, ErrFolderExists, err)
+	for _, name := range []string{"", "/a", "a//b", "a/", "..", "a/./b", "a\rb"} {
+		_, err = mb.CreateFolder(name)
+		assert.Equal(t, ErrBadFolderName, err, "Expected %q to be refused", name)
+	}
+
+	inbox, err := mb.Folder("Inbox")
+	assert.Nil(t, err)
+	assert.Equal(t, mb, inbox)
+	_, err = mb.Folder("Trash")
+	assert.Equal(t, ErrFolderNotExist, err)
+
+	// Folders beneath the one renamed go with it
+	assert.Nil(t, mb.RenameFolder("Lists", "Archive/Lists"))
+	folders, _ = mb.Folders()
+	assert.Equal(t, []string{"Archive", "Archive/Lists", "Archive/Lists/Go", "Junk"}, folders)
+	assert.Equal(t, ErrFolderNotExist, mb.RenameFolder("Lists", "Old"))
+	assert.Equal(t, ErrFolderExists, mb.RenameFolder("Junk", "Archive"))
+	assert.Equal(t, ErrBadFolderName, mb.RenameFolder("Junk", "INBOX"))
+
+	// Folders beneath the one deleted are kept
+	assert.Nil(t, mb.DeleteFolder("Archive/Lists"))
+	folders, _ = mb.Folders()
+	assert.Equal(t, []string{"Archive", "Archive/Lists/Go", "Junk"}, folders)
+	assert.Equal(t, ErrFolderNotExist, mb.DeleteFolder("Archive/Lists"))
+	assert.Equal(t, ErrBadFolderName, mb.DeleteFolder("INBOX"))
+
+	// Folders are found by AllMailboxes and locked apart from the INBOX
+	mboxes, err := ds.AllMailboxes()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(mboxes))
+	junk, _ := mb.Folder("Junk")
+	assert.Nil(t, mb.Lock("pop3"))
+	assert.Nil(t, junk.Lock("imap"))
+	junk.Unlock()
+	mb.Unlock()
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test moving messages between folders, and that an emptied INBOX keeps them
+func TestFSMoveMessage(t *testing.T) {
+	ds, logbuf := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+
+	mbName := "fred"
+	deliverMessage(ds, mbName, "a", time.Now())
+	deliverMessage(ds, mbName, "b", time.Now())
+
+	mb, err := ds.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	junk, err := FolderFor(mb, "Junk")
+	if err != nil {
+		t.Fatalf("Failed to open folder: %v", err)
+	}
+	validity, _ := junk.UidValidity()
+	msgs, _ := mb.GetMessages()
+	moved, err := mb.MoveMessage(msgs[0].Id(), junk)
+	if err != nil {
+		t.Fatalf("Failed to MoveMessage: %v", err)
+	}
+	assert.Equal(t, "a", moved.Subject())
+	assert.Equal(t, uint32(1), moved.Uid())
+	raw, err := moved.ReadRaw()
+	if assert.Nil(t, err) {
+		assert.Contains(t, *raw, "Subject: a")
+	}
+	_, err = mb.GetMessage(msgs[0].Id())
+	assert.Equal(t, ErrNotExist, err)
+
+	// Emptying the INBOX leaves its folders and their UIDs alone
+	assert.Nil(t, mb.Purge())
+	folders, _ := mb.Folders()
+	assert.Equal(t, []string{"Junk"}, folders)
+	junk, _ = mb.Folder("Junk")
+	msgs, err = junk.GetMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(msgs))
+
+	// As does emptying a folder
+	assert.Nil(t, msgs[0].Delete())
+	junk, _ = mb.Folder("Junk")
+	v, _ := junk.UidValidity()
+	next, _ := junk.UidNext()
+	assert.Equal(t, validity, v)
+	assert.Equal(t, uint32(2), next)
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test flags are kept in the index and go with moved messages
+func TestFSFlags(t *testing.T) {
+	ds, logbuf := setupDataStore(config.DataStoreConfig{})
+	defer teardownDataStore(ds)
+
+	mbName := "fred"
+	deliverMessage(ds, mbName, "a", time.Now())
+	deliverMessage(ds, mbName, "b", time.Now())
+
+	mb, err := ds.MailboxFor(mbName)
+	if err != nil {
+		t.Fatalf("Failed to MailboxFor(%q): %v", mbName, err)
+	}
+	msgs, _ := mb.GetMessages()
+	assert.Equal(t, 0, len(msgs[0].Flags()))
+	assert.Nil(t, msgs[0].SetFlags([]string{`\seen`, "$Label1", `\Seen`}))
+	assert.Equal(t, []string{`\Seen`, "$Label1"}, msgs[0].Flags())
+	assert.Equal(t, ErrBadFlag, msgs[0].SetFlags([]string{`\Recent`}))
+	assert.Equal(t, ErrBadFlag, msgs[0].SetFlags([]string{"two words"}))
+
+	// Changes through a stale copy don't undo those made since
+	assert.Nil(t, AddFlags(msgs[1], `\Flagged`))
+	mb, _ = ds.MailboxFor(mbName)
+	msgs, _ = mb.GetMessages()
+	assert.True(t, HasFlag(msgs[0], `\SEEN`))
+	assert.Equal(t, []string{`\Flagged`}, msgs[1].Flags())
+	assert.Nil(t, RemoveFlags(msgs[0], `\Seen`))
+	assert.Equal(t, []string{"$Label1"}, msgs[0].Flags())
+
+	junk, err := FolderFor(mb, "Junk")
+	if err != nil {
+		t.Fatalf("Failed to open folder: %v", err)
+	}
+	moved, err := mb.MoveMessage(msgs[1].Id(), junk)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{`\Flagged`}, moved.Flags())
+	}
+	assert.Equal(t, ErrNotExist, msgs[1].SetFlags(nil))
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
 // Test delivering several messages to the same mailbox, see if message cap works
 func TestFSMessageCap(t *testing.T) {
 	mbCap := 10
@@ -0,0 +1,99 @@
+package smtpd
+
+import (
+	"errors"
+	"strings"
+)
+
+// The system flags (RFC 3501 section 2.3.2) kept with each message, \Recent
+// belongs to IMAP sessions and is never stored
+var SystemFlags = []string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`}
+
+// ErrBadFlag is returned for a flag that is neither a system flag nor a valid
+// keyword
+var ErrBadFlag = errors.New("Invalid flag")
+
+// CanonicalFlags checks flags, putting the system flags in their usual case
+// and dropping duplicates.  Keywords are atoms and, like the system flags,
+// are compared without regard to case.
+func CanonicalFlags(flags []string) ([]string, error) {
+	canonical := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, `\`) {
+			system := ""
+			for _, f := range SystemFlags {
+				if strings.EqualFold(flag, f) {
+					system = f
+				}
+			}
+			if system == "" {
+				return nil, ErrBadFlag
+			}
+			flag = system
+		} else if !isKeyword(flag) {
+			return nil, ErrBadFlag
+		}
+		if !containsFlag(canonical, flag) {
+			canonical = append(canonical, flag)
+		}
+	}
+	return canonical, nil
+}
+
+// isKeyword reports whether flag is an IMAP atom
+func isKeyword(flag string) bool {
+	if flag == "" {
+		return false
+	}
+	for i := 0; i < len(flag); i++ {
+		c := flag[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`(){%*"\]`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFlag reports whether msg has flag set
+func HasFlag(msg Message, flag string) bool {
+	return containsFlag(msg.Flags(), flag)
+}
+
+// AddFlags sets flags on msg in addition to those it has
+func AddFlags(msg Message, flags ...string) error {
+	current := msg.Flags()
+	changed := append([]string{}, current...)
+	for _, flag := range flags {
+		if !containsFlag(changed, flag) {
+			changed = append(changed, flag)
+		}
+	}
+	if len(changed) == len(current) {
+		return nil
+	}
+	return msg.SetFlags(changed)
+}
+
+// RemoveFlags clears flags from msg
+func RemoveFlags(msg Message, flags ...string) error {
+	current := msg.Flags()
+	changed := make([]string, 0, len(current))
+	for _, f := range current {
+		if !containsFlag(flags, f) {
+			changed = append(changed, f)
+		}
+	}
+	if len(changed) == len(current) {
+		return nil
+	}
+	return msg.SetFlags(changed)
+}
@@ -0,0 +1,298 @@
+package smtpd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/egggo/inbucket/log"
+)
+
+// Name of the folder that is the mailbox itself, matched without regard to
+// case as in IMAP
+const INBOX = "INBOX"
+
+// IsInbox reports whether the folder name refers to the mailbox itself
+func IsInbox(name string) bool {
+	return strings.EqualFold(name, INBOX)
+}
+
+// CheckFolderName returns ErrBadFolderName unless name may be used for a
+// folder: "/" separates the levels of the hierarchy, none of which may be
+// empty, "." or "..", and control characters are not allowed
+func CheckFolderName(name string) error {
+	if name == "" || IsInbox(name) {
+		return ErrBadFolderName
+	}
+	for _, level := range strings.Split(name, "/") {
+		if level == "" || level == "." || level == ".." {
+			return ErrBadFolderName
+		}
+	}
+	for _, r := range name {
+		if r < ' ' || r == 0x7f {
+			return ErrBadFolderName
+		}
+	}
+	if len(url.QueryEscape(name)) > 255 {
+		// Too long for a file name
+		return ErrBadFolderName
+	}
+	return nil
+}
+
+// FolderFor opens the named folder of mb, creating it if it does not yet
+// exist.  The INBOX is mb itself.
+func FolderFor(mb Mailbox, name string) (Mailbox, error) {
+	folder, err := mb.Folder(name)
+	if err != ErrFolderNotExist {
+		return folder, err
+	}
+	folder, err = mb.CreateFolder(name)
+	if err == ErrFolderExists {
+		// Created meanwhile
+		return mb.Folder(name)
+	}
+	return folder, err
+}
+
+// root returns the mailbox the folder mb belongs to, mb itself for the INBOX
+func (mb *FileMailbox) root() *FileMailbox {
+	if mb.inbox != nil {
+		return mb.inbox
+	}
+	return mb
+}
+
+// foldersPath is the directory holding the folders of the mailbox
+func (mb *FileMailbox) foldersPath() string {
+	return filepath.Join(mb.root().path, FOLDERS_DIR)
+}
+
+// hasFolders reports whether the directory for folders exists, even if empty
+func (mb *FileMailbox) hasFolders() bool {
+	_, err := os.Stat(mb.foldersPath())
+	return err == nil
+}
+
+// folderMailbox returns the FileMailbox for the named folder, whether or not
+// it exists
+func (mb *FileMailbox) folderMailbox(name string) *FileMailbox {
+	root := mb.root()
+	path := filepath.Join(mb.foldersPath(), url.QueryEscape(name))
+	return &FileMailbox{store: root.store, name: root.name, dirName: root.dirName,
+		folder: name, inbox: root, path: path, indexPath: filepath.Join(path, INDEX_FILE),
+		uidPath: filepath.Join(path, UID_FILE)}
+}
+
+// exists reports whether the folder has a directory
+func (mb *FileMailbox) exists() bool {
+	_, err := os.Stat(mb.path)
+	return err == nil
+}
+
+// Folders lists the folders of the mailbox in order of name
+func (mb *FileMailbox) Folders() ([]string, error) {
+	f, err := os.Open(mb.foldersPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	dirs, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	folders := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		name, err := url.QueryUnescape(dir)
+		if err != nil {
+			log.LogWarn("Ignoring folder directory %v in %v", dir, mb.root())
+			continue
+		}
+		folders = append(folders, name)
+	}
+	sort.Strings(folders)
+	return folders, nil
+}
+
+// Folder opens the named folder of the mailbox
+func (mb *FileMailbox) Folder(name string) (Mailbox, error) {
+	if IsInbox(name) {
+		return mb.root(), nil
+	}
+	if err := CheckFolderName(name); err != nil {
+		return nil, err
+	}
+	folder := mb.folderMailbox(name)
+	if !folder.exists() {
+		return nil, ErrFolderNotExist
+	}
+	return folder, nil
+}
+
+// CreateFolder creates the named folder, and the folders above it in the
+// hierarchy that do not exist yet
+func (mb *FileMailbox) CreateFolder(name string) (Mailbox, error) {
+	if IsInbox(name) {
+		return nil, ErrFolderExists
+	}
+	if err := CheckFolderName(name); err != nil {
+		return nil, err
+	}
+	folder := mb.folderMailbox(name)
+	if folder.exists() {
+		return nil, ErrFolderExists
+	}
+	if err := mb.createParents(name); err != nil {
+		return nil, err
+	}
+	if err := folder.create(); err != nil {
+		return nil, err
+	}
+	log.LogTrace("Created folder %v", folder)
+	return folder, nil
+}
+
+// createParents creates the missing folders above name
+func (mb *FileMailbox) createParents(name string) error {
+	levels := strings.Split(name, "/")
+	for i := 1; i < len(levels); i++ {
+		parent := mb.folderMailbox(strings.Join(levels[:i], "/"))
+		if !parent.exists() {
+			if err := parent.create(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// create makes the directory of a new folder and gives it a UID validity
+func (mb *FileMailbox) create() error {
+	if err := mb.createDir(); err != nil {
+		return err
+	}
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	mb.uidValidity, mb.uidNext = newUidValidity(), 1
+	return mb.writeUids()
+}
+
+// RenameFolder renames the named folder and those beneath it, creating any
+// missing folders above the new name
+func (mb *FileMailbox) RenameFolder(name string, newName string) error {
+	if IsInbox(name) || IsInbox(newName) {
+		return ErrBadFolderName
+	}
+	if err := CheckFolderName(name); err != nil {
+		return err
+	}
+	if err := CheckFolderName(newName); err != nil {
+		return err
+	}
+	if !mb.folderMailbox(name).exists() {
+		return ErrFolderNotExist
+	}
+	if mb.folderMailbox(newName).exists() {
+		return ErrFolderExists
+	}
+	folders, err := mb.Folders()
+	if err != nil {
+		return err
+	}
+	if err = mb.createParents(newName); err != nil {
+		return err
+	}
+
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	for _, folder := range folders {
+		if folder != name && !strings.HasPrefix(folder, name+"/") {
+			continue
+		}
+		to := newName + folder[len(name):]
+		if CheckFolderName(to) != nil {
+			return fmt.Errorf("Cannot rename folder %v to %v", folder, to)
+		}
+		err = os.Rename(mb.folderMailbox(folder).path, mb.folderMailbox(to).path)
+		if err != nil {
+			return err
+		}
+	}
+	log.LogTrace("Renamed folder %v of %v to %v", name, mb.root(), newName)
+	return nil
+}
+
+// DeleteFolder removes the named folder with its messages
+func (mb *FileMailbox) DeleteFolder(name string) error {
+	if IsInbox(name) {
+		return ErrBadFolderName
+	}
+	if err := CheckFolderName(name); err != nil {
+		return err
+	}
+	folder := mb.folderMailbox(name)
+	if !folder.exists() {
+		return ErrFolderNotExist
+	}
+
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	log.LogTrace("Removing folder %v", folder)
+	if err := os.RemoveAll(folder.path); err != nil {
+		return err
+	}
+	// Fails unless that was the last folder
+	os.Remove(mb.foldersPath())
+	return nil
+}
+
+// MoveMessage moves the message with id to dest, its verdicts and flags go
+// with it but it is given a new UID
+func (mb *FileMailbox) MoveMessage(id string, dest Mailbox) (Message, error) {
+	to, ok := dest.(*FileMailbox)
+	if !ok || to.store != mb.store {
+		return nil, fmt.Errorf("Cannot move messages from %v to %v", mb, dest)
+	}
+	found, err := mb.GetMessage(id)
+	if err != nil {
+		return nil, err
+	}
+	if to.path == mb.path {
+		return found, nil
+	}
+	m := found.(*FileMessage)
+
+	// Refresh the index before adding the message
+	if err = to.readIndex(); err != nil {
+		return nil, err
+	}
+	if err = to.createDir(); err != nil {
+		return nil, err
+	}
+	moved := &FileMessage{mailbox: to, Fid: m.Fid, Fdate: m.Fdate, Ffrom: m.Ffrom,
+		Fsubject: m.Fsubject, Fsize: m.Fsize, Fauth: m.Fauth, Fspam: m.Fspam,
+		Fflags: m.Fflags}
+	if err = os.Rename(m.rawPath(), moved.rawPath()); err != nil {
+		return nil, err
+	}
+	moved.Fuid = to.uidNext
+	to.uidNext++
+	to.messages = append(to.messages, moved)
+	if err = to.writeIndex(); err != nil {
+		return nil, err
+	}
+
+	mb.remove(m)
+	if err = mb.writeIndex(); err != nil {
+		return nil, err
+	}
+	log.LogTrace("Moved %v from %v to %v", moved, mb, to)
+	return moved, nil
+}
@@ -0,0 +1,145 @@
+package smtpd
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/egggo/inbucket/database"
+)
+
+// MAX_FORWARD_HOPS limits how many local users a forwarding chain may pass
+// through while expanding a single recipient
+const MAX_FORWARD_HOPS = 10
+
+// Forward is a copy of the message for Recipient, relayed to Address
+// outside Inbucket
+type Forward struct {
+	Recipient string
+	Address   string
+}
+
+// forwardRecipient follows the forwarding rules starting at recip.  It
+// returns the addresses to deliver locally and the forwards to relay, a
+// chain that loops back on itself is delivered where the loop closes.
+func (ss *Session) forwardRecipient(recip string) ([]string, []Forward, error) {
+	if ss.server.db == nil {
+		return []string{recip}, nil, nil
+	}
+	var local []string
+	var remote []Forward
+	seen := make(map[string]bool)
+	addr := recip
+	for hops := 0; ; hops++ {
+		seen[strings.ToLower(addr)] = true
+		user, err := ss.server.db.UserGetByAddress(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if user == nil {
+			return append(local, addr), remote, nil
+		}
+		fwd, err := ss.server.db.ForwardGet(user.Id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if fwd == nil || fwd.Address == "" {
+			return append(local, addr), remote, nil
+		}
+		if fwd.KeepCopy {
+			local = append(local, addr)
+		}
+
+		target := fwd.Address
+		switch {
+		case seen[strings.ToLower(target)] || hops >= MAX_FORWARD_HOPS:
+			ss.logWarn("Forwarding loop for %v at %v, delivering locally", recip, addr)
+			if !fwd.KeepCopy {
+				local = append(local, addr)
+			}
+			return local, remote, nil
+		case ss.server.isLocal(target):
+			ss.logTrace("Forwarding %v to local %v", addr, target)
+			addr = target
+		case ss.server.outbound == nil:
+			ss.logWarn("No outbound delivery, cannot forward %v to %v", addr, target)
+			if !fwd.KeepCopy {
+				local = append(local, addr)
+			}
+			return local, remote, nil
+		default:
+			ss.logTrace("Forwarding %v to %v", addr, target)
+			return local, append(remote, Forward{Recipient: addr, Address: target}), nil
+		}
+	}
+}
+
+// hasForward reports whether the message is already being forwarded as f
+func (ss *Session) hasForward(f Forward) bool {
+	for _, existing := range ss.forwards {
+		if strings.EqualFold(existing.Recipient, f.Recipient) &&
+			strings.EqualFold(existing.Address, f.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocal reports whether addr is delivered by us rather than relayed
+func (s *Server) isLocal(addr string) bool {
+	return IsLocal(s.db, s.domain, addr)
+}
+
+// IsLocal reports whether addr is delivered to a mailbox here rather than
+// relayed: it is at our domain, or the address of one of the users
+func IsLocal(database *db.Database, domain string, addr string) bool {
+	_, addrDomain, err := ParseEmailAddress(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(addrDomain, domain) {
+		return true
+	}
+	user, err := database.UserGetByAddress(addr)
+	return err == nil && user != nil
+}
+
+// forwardLoop returns the first recipient the message was already delivered
+// to according to its Delivered-To headers, meaning it has come back to us
+func (ss *Session) forwardLoop(header mail.Header) string {
+	delivered := make(map[string]bool)
+	for _, v := range header["Delivered-To"] {
+		delivered[strings.ToLower(strings.Trim(strings.TrimSpace(v), "<>"))] = true
+	}
+	if len(delivered) == 0 {
+		return ""
+	}
+	for e := ss.recipients.Front(); e != nil; e = e.Next() {
+		if recip := e.Value.(string); delivered[strings.ToLower(recip)] {
+			return recip
+		}
+	}
+	for _, f := range ss.forwards {
+		if delivered[strings.ToLower(f.Recipient)] {
+			return f.Recipient
+		}
+	}
+	return ""
+}
+
+// sendForwards relays the message to each forwarding address, marked with
+// a Delivered-To header for loop detection
+func (ss *Session) sendForwards(data []byte, stamp string) {
+	for _, f := range ss.forwards {
+		ss.logInfo("Forwarding message for %v to %v", f.Recipient, f.Address)
+		ss.server.outbound.Send(ss.from, []string{f.Address},
+			append(ss.forwardHeader(f, stamp), data...))
+	}
+}
+
+// forwardHeader returns the header lines added to a message forwarded for f
+func (ss *Session) forwardHeader(f Forward, stamp string) []byte {
+	return []byte(fmt.Sprintf("Delivered-To: %s\r\n"+
+		"Received: from %s ([%s]) by %s\r\n  for <%s>; %s\r\n",
+		f.Recipient, ss.remoteDomain, ss.remoteHost, ss.server.domain, f.Address, stamp))
+}
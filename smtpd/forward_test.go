@@ -0,0 +1,26 @@
+package smtpd
+
+import (
+	"container/list"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardLoop(t *testing.T) {
+	ss := &Session{server: &Server{}, recipients: list.New()}
+	ss.recipients.PushBack("james@inbucket.org")
+	ss.forwards = []Forward{{Recipient: "bob@inbucket.org", Address: "bob@example.com"}}
+
+	header := readHeader(t, "Subject: hi\r\n")
+	assert.Equal(t, "", ss.forwardLoop(header))
+
+	header = readHeader(t, "Delivered-To: other@inbucket.org\r\n")
+	assert.Equal(t, "", ss.forwardLoop(header))
+
+	header = readHeader(t, "Delivered-To: other@inbucket.org\r\nDelivered-To: <James@Inbucket.org>\r\n")
+	assert.Equal(t, "james@inbucket.org", ss.forwardLoop(header))
+
+	header = readHeader(t, "Delivered-To: bob@inbucket.org\r\n")
+	assert.Equal(t, "bob@inbucket.org", ss.forwardLoop(header))
+}
@@ -4,15 +4,20 @@ import (
 	"bufio"
 	"bytes"
 	"container/list"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"net/mail"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/egggo/inbucket/config"
+	"github.com/egggo/inbucket/database"
 	"github.com/egggo/inbucket/log"
+	"github.com/egggo/inbucket/sieve"
 )
 
 type State int
@@ -44,21 +49,23 @@ func (s State) String() string {
 }
 
 var commands = map[string]bool{
-	"HELO": true,
-	"EHLO": true,
-	"MAIL": true,
-	"RCPT": true,
-	"DATA": true,
-	"RSET": true,
-	"SEND": true,
-	"SOML": true,
-	"SAML": true,
-	"VRFY": true,
-	"EXPN": true,
-	"HELP": true,
-	"NOOP": true,
-	"QUIT": true,
-	"TURN": true,
+	"HELO":     true,
+	"EHLO":     true,
+	"MAIL":     true,
+	"RCPT":     true,
+	"DATA":     true,
+	"RSET":     true,
+	"SEND":     true,
+	"SOML":     true,
+	"SAML":     true,
+	"VRFY":     true,
+	"EXPN":     true,
+	"HELP":     true,
+	"NOOP":     true,
+	"QUIT":     true,
+	"TURN":     true,
+	"AUTH":     true,
+	"STARTTLS": true,
 }
 
 type Session struct {
@@ -70,8 +77,18 @@ type Session struct {
 	sendError    error
 	state        State
 	reader       *bufio.Reader
+	tls          bool // Whether STARTTLS has completed
 	from         string
 	recipients   *list.List
+	forwards     []Forward
+	lists        []*listTarget
+	held         []heldTarget
+	authUser     *db.User
+	authResults  *AuthResults
+	spamResult   *SpamResult
+	milters      []*Milter
+	discard      bool
+	releaseAt    time.Time
 }
 
 func NewSession(server *Server, id int, conn net.Conn) *Session {
@@ -84,13 +101,6 @@ func (ss *Session) String() string {
 	return fmt.Sprintf("Session{id: %v, state: %v}", ss.id, ss.state)
 }
 
-/* Session flow:
- *  1. Send initial greeting
- *  2. Receive cmd
- *  3. If good cmd, respond, optionally change state
- *  4. If bad cmd, respond error
- *  5. Goto 2
- */
 func (s *Server) startSession(id int, conn net.Conn) {
 	log.LogInfo("SMTP Connection from %v, starting session <%v>", conn.RemoteAddr(), id)
 	expConnectsCurrent.Add(1)
@@ -100,7 +110,23 @@ func (s *Server) startSession(id int, conn net.Conn) {
 		expConnectsCurrent.Add(-1)
 	}()
 
-	ss := NewSession(s, id, conn)
+	NewSession(s, id, conn).serve()
+}
+
+/* Session flow:
+ *  1. Send initial greeting
+ *  2. Receive cmd
+ *  3. If good cmd, respond, optionally change state
+ *  4. If bad cmd, respond error
+ *  5. Goto 2
+ */
+func (ss *Session) serve() {
+	defer ss.closeMilters()
+	if reply := ss.openMilters(); reply != "" {
+		ss.send(reply)
+		ss.logInfo("Connection rejected by milter")
+		return
+	}
 	ss.greet()
 
 	// This is our command reading loop
@@ -205,6 +231,9 @@ func (ss *Session) greetHandler(cmd string, arg string) {
 			ss.send("501 Domain/address argument required for HELO")
 			return
 		}
+		if !ss.milterHelo(domain) {
+			return
+		}
 		ss.remoteDomain = domain
 		ss.send("250 Great, let's get this show on the road")
 		ss.enterState(READY)
@@ -214,9 +243,22 @@ func (ss *Session) greetHandler(cmd string, arg string) {
 			ss.send("501 Domain/address argument required for EHLO")
 			return
 		}
+		if !ss.milterHelo(domain) {
+			return
+		}
 		ss.remoteDomain = domain
 		ss.send("250-Great, let's get this show on the road")
 		ss.send("250-8BITMIME")
+		if ss.server.tlsConfig != nil && !ss.tls {
+			ss.send("250-STARTTLS")
+		}
+		// Passwords are not sent in the clear
+		if ss.server.db != nil && ss.tls {
+			ss.send("250-AUTH PLAIN")
+		}
+		if ss.server.futureRelease() {
+			ss.send("250-" + ss.server.futureReleaseKeyword(time.Now()))
+		}
 		ss.send(fmt.Sprintf("250 SIZE %v", ss.server.maxMessageBytes))
 		ss.enterState(READY)
 	default:
@@ -235,12 +277,47 @@ func parseHelloArgument(arg string) (string, error) {
 	return domain, nil
 }
 
+// startTLS runs the STARTTLS command (RFC 3207), the client must then send
+// EHLO again
+func (ss *Session) startTLS(arg string) {
+	if arg != "" {
+		ss.send("501 5.5.4 STARTTLS takes no arguments")
+		return
+	}
+	if ss.server.tlsConfig == nil || ss.tls {
+		ss.send("502 5.5.1 STARTTLS not available")
+		return
+	}
+	ss.send("220 2.0.0 Ready to start TLS")
+	conn := tls.Server(ss.conn, ss.server.tlsConfig)
+	if err := conn.SetDeadline(ss.nextDeadline()); err != nil {
+		ss.sendError = err
+		return
+	}
+	if err := conn.Handshake(); err != nil {
+		ss.logWarn("TLS handshake failed: %v", err)
+		ss.enterState(QUIT)
+		return
+	}
+	// Plain text buffered before the handshake is discarded, as is what the
+	// client told us
+	ss.conn = conn
+	ss.reader = bufio.NewReader(conn)
+	ss.tls = true
+	ss.remoteDomain = ""
+	ss.enterState(GREET)
+}
+
 // READY state -> waiting for MAIL
 func (ss *Session) readyHandler(cmd string, arg string) {
-	if cmd == "MAIL" {
+	if cmd == "AUTH" {
+		ss.authHandler(arg)
+	} else if cmd == "STARTTLS" {
+		ss.startTLS(arg)
+	} else if cmd == "MAIL" {
 		// Match FROM, while accepting '>' as quoted pair and in double quoted strings
 		// (?i) makes the regex case insensitive, (?:) is non-grouping sub-match
-		re := regexp.MustCompile("(?i)^FROM:\\s*<((?:\\\\>|[^>])+|\"[^\"]+\"@[^>]+)>( [\\w= ]+)?$")
+		re := regexp.MustCompile("(?i)^FROM:\\s*<((?:\\\\>|[^>])+|\"[^\"]+\"@[^>]+)>( [\\w=:.+\\- ]+)?$")
 		m := re.FindStringSubmatch(arg)
 		if m == nil {
 			ss.send("501 Was expecting MAIL arg syntax of FROM:<address>")
@@ -255,6 +332,7 @@ func (ss *Session) readyHandler(cmd string, arg string) {
 		}
 		// This is where the client may put BODY=8BITMIME, but we already
 		// read the DATA as bytes, so it does not effect our processing.
+		var releaseAt time.Time
 		if m[2] != "" {
 			args, ok := ss.parseArgs(m[2])
 			if !ok {
@@ -275,8 +353,21 @@ func (ss *Session) readyHandler(cmd string, arg string) {
 					return
 				}
 			}
+			var reply string
+			if releaseAt, reply = ss.holdParam(args, time.Now()); reply != "" {
+				ss.send(reply)
+				ss.logWarn("Refused hold in MAIL argument: %q", arg)
+				return
+			}
+		}
+		if !ss.checkSender(from) {
+			return
+		}
+		if !ss.milterMail(from, m[2]) {
+			return
 		}
 		ss.from = from
+		ss.releaseAt = releaseAt
 		ss.recipients = list.New()
 		ss.logTrace("Mail from: %v", from)
 		ss.send(fmt.Sprintf("250 Roger, accepting mail from <%v>", from))
@@ -302,27 +393,102 @@ func (ss *Session) mailHandler(cmd string, arg string) {
 			ss.logWarn("Bad address as RCPT arg: %q, %s", recip, err)
 			return
 		}
-		if ss.recipients.Len() >= ss.server.maxRecips {
+		if reply := ss.recipientLimit(1); reply != "" {
 			ss.logWarn("Maximum limit of %v recipients reached", ss.server.maxRecips)
-			ss.send(fmt.Sprintf("552 Maximum limit of %v recipients reached", ss.server.maxRecips))
+			ss.send(reply)
+			return
+		}
+
+		if !ss.milterRcpt(recip) {
 			return
 		}
 
-		members, err := ss.server.db.IsGroup(recip)
+		// Mailing lists handle their own distribution after DATA
+		target, err := ss.listTargetFor(recip)
+		if err != nil {
+			ss.logError("Failed to look up mailing list for %v - %v", recip, err)
+			ss.send("451 4.3.0 Failed to look up recipient - try again later")
+			return
+		}
+		if target != nil {
+			if ss.refuseHold(recip) || ss.refuseUnstored(recip) {
+				return
+			}
+			hold := false
+			if target.kind == LIST_POST {
+				if hold, err = ss.groupPolicy(target.group); err != nil {
+					ss.rejectPolicy(recip, err)
+					return
+				}
+			}
+			if hold {
+				ss.addHeld(target.group, recip)
+			} else if !ss.hasListTarget(target) {
+				ss.lists = append(ss.lists, target)
+			}
+			ss.logTrace("Mailing list recipient: %v", recip)
+			ss.send(fmt.Sprintf("250 I'll make sure <%v> gets this", recip))
+			return
+		}
+
+		members, held, group, err := ss.expandRecipient(recip)
+		if err == errGroupPolicy {
+			ss.rejectPolicy(recip, err)
+			return
+		}
 		if err != nil {
 			ss.logWarn("Bad recipient address %v - %v", recip, err)
 			ss.send(fmt.Sprintf("501 Bad recipient address %v", recip))
 			return
 		}
+		if len(held) > 0 && ss.refuseHold(recip) {
+			return
+		}
 
-		if len(members) > 0 {
-			// 此地址是别名
-			for _, v := range members {
-				ss.recipients.PushBack(v)
+		// Aliases and groups may expand to addresses already present, those are skipped
+		var locals []string
+		var forwards []Forward
+		for _, v := range members {
+			if group && ss.server.outbound != nil && !ss.server.isLocal(v) {
+				// Outside member of a distribution list or alias target
+				f := Forward{Recipient: recip, Address: v}
+				if !ss.hasForward(f) {
+					forwards = append(forwards, f)
+				}
+				continue
 			}
-
-		} else {
-			ss.recipients.PushBack(recip)
+			local, remote, err := ss.forwardRecipient(v)
+			if err != nil {
+				ss.logError("Failed to look up forwarding for %v - %v", v, err)
+				ss.send("451 4.3.0 Failed to look up recipient - try again later")
+				return
+			}
+			for _, addr := range local {
+				if !ss.hasRecipient(addr) && !containsFold(locals, addr) {
+					locals = append(locals, addr)
+				}
+			}
+			for _, f := range remote {
+				if !ss.hasForward(f) {
+					forwards = append(forwards, f)
+				}
+			}
+		}
+		if (len(held) > 0 || len(forwards) > 0) && ss.refuseUnstored(recip) {
+			return
+		}
+		if reply := ss.recipientLimit(len(locals) + len(forwards)); reply != "" {
+			ss.logWarn("Maximum limit of %v recipients reached expanding %v", ss.server.maxRecips,
+				recip)
+			ss.send(reply)
+			return
+		}
+		for _, addr := range locals {
+			ss.recipients.PushBack(addr)
+		}
+		ss.forwards = append(ss.forwards, forwards...)
+		for _, g := range held {
+			ss.addHeld(g, recip)
 		}
 
 		ss.logTrace("Recipient: %v", recip)
@@ -335,7 +501,11 @@ func (ss *Session) mailHandler(cmd string, arg string) {
 			ss.logWarn("Got unexpected args on DATA: %q", arg)
 			return
 		}
-		if ss.recipients.Len() > 0 {
+		if ss.recipients.Len() > 0 || len(ss.forwards) > 0 || len(ss.lists) > 0 ||
+			len(ss.held) > 0 {
+			if !ss.milterData() {
+				return
+			}
 			// We have recipients, go to accept data
 			ss.enterState(DATA)
 			return
@@ -348,6 +518,28 @@ func (ss *Session) mailHandler(cmd string, arg string) {
 	ss.ooSeq(cmd)
 }
 
+// recipientLimit returns the reply refusing a recipient that expands to
+// added addresses when the message would then have more than the maximum,
+// or "" if they fit
+func (ss *Session) recipientLimit(added int) string {
+	if ss.recipients.Len()+len(ss.forwards)+added > ss.server.maxRecips {
+		return fmt.Sprintf("552 Maximum limit of %v recipients reached", ss.server.maxRecips)
+	}
+	return ""
+}
+
+// refuseUnstored refuses recip, which would be forwarded, posted to a list or
+// held for a moderator, when messages are not stored: in load test mode the
+// message is thrown away and nothing is sent on
+func (ss *Session) refuseUnstored(recip string) bool {
+	if ss.server.storeMessages {
+		return false
+	}
+	ss.logWarn("Not storing messages, refusing %v", recip)
+	ss.send(fmt.Sprintf("550 5.3.2 Not delivering mail for <%v>, messages are not stored", recip))
+	return true
+}
+
 // DATA
 func (ss *Session) dataHandler() {
 	// Timestamp for Received header
@@ -355,6 +547,7 @@ func (ss *Session) dataHandler() {
 	// Get a Mailbox and a new Message for each recipient
 	mailboxes := make([]Mailbox, ss.recipients.Len())
 	messages := make([]Message, ss.recipients.Len())
+	received := make([][]byte, ss.recipients.Len())
 	msgSize := 0
 	if ss.server.storeMessages {
 		i := 0
@@ -368,26 +561,31 @@ func (ss *Session) dataHandler() {
 				return
 			}
 			if strings.ToLower(domain) != ss.server.domainNoStore {
-				// Not our "no store" domain, so store the message
-				mb, err := ss.server.dataStore.MailboxFor(local)
-				if err != nil {
-					ss.logError("Failed to open mailbox for %q: %s", local, err)
-					ss.send(fmt.Sprintf("451 Failed to open mailbox for %v", local))
-					ss.reset()
-					return
-				}
-				mailboxes[i] = mb
-				if messages[i], err = mb.NewMessage(); err != nil {
-					ss.logError("Failed to create message for %q: %s", local, err)
-					ss.send(fmt.Sprintf("451 Failed to create message for %v", local))
-					ss.reset()
-					return
-				}
-
-				// Generate Received header
+				// Not our "no store" domain, so store the message.  Generate
+				// Received header, written out once the message has been
+				// filtered as it may be routed elsewhere
 				recd := fmt.Sprintf("Received: from %s ([%s]) by %s\r\n  for <%s>; %s\r\n",
 					ss.remoteDomain, ss.remoteHost, ss.server.domain, recip, stamp)
-				messages[i].Append([]byte(recd))
+				received[i] = []byte(recd)
+
+				// A message held for release waits in the database, opening
+				// one now could evict the oldest message to make room for it
+				if ss.releaseAt.IsZero() {
+					mb, err := ss.server.dataStore.MailboxFor(local)
+					if err != nil {
+						ss.logError("Failed to open mailbox for %q: %s", local, err)
+						ss.send(fmt.Sprintf("451 Failed to open mailbox for %v", local))
+						ss.reset()
+						return
+					}
+					mailboxes[i] = mb
+					if messages[i], err = mb.NewMessage(); err != nil {
+						ss.logError("Failed to create message for %q: %s", local, err)
+						ss.send(fmt.Sprintf("451 Failed to create message for %v", local))
+						ss.reset()
+						return
+					}
+				}
 			} else {
 				log.LogTrace("Not storing message for %q", recip)
 			}
@@ -397,6 +595,7 @@ func (ss *Session) dataHandler() {
 
 	ss.send("354 Start mail input; end with <CRLF>.<CRLF>")
 	var buf bytes.Buffer
+	var msgBuf bytes.Buffer
 	for {
 		buf.Reset()
 		err := ss.readByteLine(&buf)
@@ -412,17 +611,128 @@ func (ss *Session) dataHandler() {
 		}
 		line := buf.Bytes()
 		if string(line) == ".\r\n" {
-			// Mail data complete
-			if ss.server.storeMessages {
-				for _, m := range messages {
+			// Mail data complete, any verdicts claiming to be ours are forged
+			data := removeAuthResults(msgBuf.Bytes(), ss.server.domain)
+			if len(ss.milters) > 0 {
+				var resp *MilterResponse
+				if data, resp = ss.milterMessage(data); resp != nil {
+					ss.send(resp.SmtpReply("Message"))
+					ss.reset()
+					return
+				}
+			}
+			if ss.server.clamdConfig.Socket != "" && !ss.discard {
+				var reply string
+				if data, reply = ss.virusScan(data); reply != "" {
+					ss.send(reply)
+					ss.reset()
+					return
+				}
+			}
+			junk := false
+			if ss.server.spamConfig.Engine != "" && !ss.discard {
+				var reply string
+				if data, reply, junk = ss.spamCheck(data); reply != "" {
+					ss.send(reply)
+					ss.reset()
+					return
+				}
+				if junk && len(ss.lists) > 0 {
+					// Rather than pass spam on to the whole list
+					ss.logInfo("Rejecting junk to mailing list from <%v>", ss.from)
+					ss.send("550 5.7.1 Message rejected as spam")
+					ss.reset()
+					return
+				}
+				if junk && ss.server.storeMessages {
+					if err := ss.junkMessages(mailboxes, messages); err != nil {
+						ss.logError("Failed to open junk folder: %v", err)
+						ss.send("451 4.3.0 Failed to open mailbox - try again later")
+						ss.reset()
+						return
+					}
+				}
+			}
+			if ss.discard {
+				ss.logInfo("Message discarded by milter")
+			} else if ss.server.storeMessages {
+				var authHeader []byte
+				if ss.server.verifyAuth {
+					// Verify before signing so our own signature isn't evaluated
+					ss.authResults, authHeader = CheckAuthentication(ss.server.domain,
+						net.ParseIP(ss.remoteHost), ss.remoteDomain, ss.from, data)
+					ss.logTrace("Authentication results: %+v", *ss.authResults)
+				}
+				data = append(authHeader, ss.dkimSign(data)...)
+
+				// Run each recipient's Sieve script, the message is refused
+				// outright only if every recipient rejected it
+				header := mail.Header{}
+				if m, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+					header = m.Header
+				}
+				if recip := ss.forwardLoop(header); recip != "" {
+					ss.logWarn("Message from <%v> has looped back to %v", ss.from, recip)
+					ss.send(fmt.Sprintf("554 5.4.6 Mail forwarding loop for %v", recip))
+					ss.reset()
+					return
+				}
+				if !ss.releaseAt.IsZero() {
+					err := ss.holdForRelease(received, data, header, junk, stamp)
+					if err != nil {
+						ss.logError("Failed to hold message for release: %v", err)
+						ss.send("451 4.3.0 Failed to hold message - try again later")
+					} else {
+						ss.send(fmt.Sprintf("250 Mail held for release at %v",
+							ss.releaseAt.UTC().Format(RELEASE_FMT)))
+					}
+					ss.reset()
+					return
+				}
+
+				recips := make([]string, 0, len(messages))
+				plans := make([][]*sieve.Action, len(messages))
+				stored, rejected := 0, 0
+				var reject *sieve.Action
+				for e := ss.recipients.Front(); e != nil; e = e.Next() {
+					i := len(recips)
+					recips = append(recips, e.Value.(string))
+					if messages[i] == nil {
+						continue
+					}
+					stored++
+					plans[i] = ss.sieveActions(recips[i], header, len(data))
+					if r := rejection(plans[i]); r != nil {
+						rejected++
+						reject = r
+					}
+				}
+				if stored > 0 && rejected == stored {
+					ss.logInfo("Message from <%v> rejected by Sieve", ss.from)
+					ss.send(rejectReply(reject.Reason))
+					ss.reset()
+					return
+				}
+
+				for i, m := range messages {
 					if m != nil {
-						if err := m.Close(); err != nil {
-							ss.logError("Error: %v while writing message", err)
-							// TODO Report to client?
+						err := ss.deliver(recips[i], mailboxes[i], m, received[i], data, header,
+							plans[i])
+						if err != nil {
+							ss.logError("Failed to append to mailbox %v: %v", mailboxes[i], err)
+							ss.send("554 Something went wrong")
+							ss.reset()
+							// TODO: Should really cleanup the crap on filesystem...
+							return
+						}
+						if !junk {
+							ss.vacation(recips[i], header, plans[i])
 						}
-						expReceivedTotal.Add(1)
 					}
 				}
+				ss.sendForwards(data, stamp)
+				ss.holdMessages(data, header, stamp)
+				ss.deliverLists(data, header)
 			} else {
 				expReceivedTotal.Add(1)
 			}
@@ -444,21 +754,334 @@ func (ss *Session) dataHandler() {
 			// TODO: Should really cleanup the crap on filesystem...
 			return
 		}
-		// Append to message objects
-		if ss.server.storeMessages {
-			for i, m := range messages {
-				if m != nil {
-					if err := m.Append(line); err != nil {
-						ss.logError("Failed to append to mailbox %v: %v", mailboxes[i], err)
-						ss.send("554 Something went wrong")
-						ss.reset()
-						// TODO: Should really cleanup the crap on filesystem...
-						return
-					}
-				}
+		// Buffer the message, it is written out once complete so that it can
+		// be filtered and signed
+		if ss.server.storeMessages || len(ss.milters) > 0 {
+			msgBuf.Write(line)
+		}
+	}
+}
+
+// virusScan passes the message to clamd.  It returns the message to deliver,
+// tagged with its virus status, or the reply to end the transaction with if
+// the message was rejected or quarantined.  An X-Virus-Status header sent
+// by the client is removed first, it would otherwise be taken for ours.
+func (ss *Session) virusScan(data []byte) ([]byte, string) {
+	cfg := ss.server.clamdConfig
+	data = RemoveHeaders(data, "X-Virus-Status")
+	virus, err := ScanClamd(cfg.Socket, time.Duration(cfg.TimeoutSeconds)*time.Second, data)
+	if err != nil {
+		ss.logError("Virus scan failed: %v", err)
+		switch cfg.DefaultAction {
+		case "accept":
+			return data, ""
+		case "reject":
+			return nil, "554 5.7.1 Unable to scan message for viruses"
+		}
+		return nil, "451 4.7.1 Unable to scan message for viruses - try again later"
+	}
+	if virus == "" {
+		return append([]byte("X-Virus-Status: Clean\r\n"), data...), ""
+	}
+
+	ss.logInfo("Found virus %v in message from <%v>", virus, ss.from)
+	data = append([]byte(fmt.Sprintf("X-Virus-Status: Infected (%v)\r\n", virus)), data...)
+	switch cfg.Action {
+	case "tag":
+		return data, ""
+	case "quarantine":
+		if err := ss.quarantine(data); err != nil {
+			ss.logError("Failed to quarantine message: %v", err)
+			return nil, "451 4.3.0 Failed to quarantine message - try again later"
+		}
+		// The client is not told, it would only try another route
+		return nil, "250 Mail accepted for delivery"
+	}
+	return nil, fmt.Sprintf("554 5.7.1 Message rejected, virus found: %v", virus)
+}
+
+// spamCheck has the spam engine score the message.  It returns the message
+// tagged with its score, or the reply to end the transaction with if it was
+// rejected.  junk is true when the score calls for junk folder delivery.
+// Any X-Spam- headers the client sent are removed first, they would
+// otherwise be taken for ours.
+func (ss *Session) spamCheck(data []byte) ([]byte, string, bool) {
+	cfg := ss.server.spamConfig
+	data = removeSpamHeaders(data)
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	var result *SpamResult
+	var err error
+	switch cfg.Engine {
+	case "rspamd":
+		recips := make([]string, 0, ss.recipients.Len())
+		for e := ss.recipients.Front(); e != nil; e = e.Next() {
+			recips = append(recips, e.Value.(string))
+		}
+		result, err = ScoreRspamd(cfg.Address, timeout, ss.remoteHost, ss.remoteDomain,
+			ss.from, recips, data)
+	default:
+		result, err = ScoreSpamd(cfg.Address, timeout, data)
+	}
+	if err != nil {
+		// Better to deliver unscored mail than lose it
+		ss.logError("Spam scoring failed: %v", err)
+		return data, "", false
+	}
+
+	ss.logTrace("Spam score %.1f (required %.1f)", result.Score, result.Threshold)
+	ss.spamResult = result
+	if cfg.RejectScore > 0 && result.Score >= cfg.RejectScore {
+		ss.logInfo("Rejecting spam scoring %.1f from <%v>", result.Score, ss.from)
+		return nil, "550 5.7.1 Message rejected as spam", false
+	}
+	junk := cfg.JunkScore > 0 && result.Score >= cfg.JunkScore
+	return append(result.Headers(), data...), "", junk
+}
+
+// junkMessages replaces the message for each recipient with one in the junk
+// folder of their mailbox
+func (ss *Session) junkMessages(mailboxes []Mailbox, messages []Message) error {
+	for i := range messages {
+		if messages[i] != nil {
+			mb, err := FolderFor(mailboxes[i], ss.server.spamConfig.JunkFolder)
+			if err != nil {
+				return err
+			}
+			if messages[i], err = mb.NewMessage(); err != nil {
+				return err
 			}
+			mailboxes[i] = mb
 		}
 	}
+	return nil
+}
+
+// quarantine stores the message in the quarantine mailbox instead of the
+// recipients' mailboxes
+func (ss *Session) quarantine(data []byte) error {
+	if !ss.server.storeMessages {
+		return nil
+	}
+	mb, err := ss.server.dataStore.MailboxFor(ss.server.clamdConfig.QuarantineMailbox)
+	if err != nil {
+		return err
+	}
+	msg, err := mb.NewMessage()
+	if err != nil {
+		return err
+	}
+	recips := make([]string, 0, ss.recipients.Len())
+	for e := ss.recipients.Front(); e != nil; e = e.Next() {
+		recips = append(recips, e.Value.(string))
+	}
+	header := fmt.Sprintf("X-Quarantine-Recipients: %v\r\n", strings.Join(recips, ", "))
+	if err = msg.Append(append([]byte(header), data...)); err != nil {
+		return err
+	}
+	return msg.Close()
+}
+
+// dkimSign prepends a DKIM-Signature header to data when it was submitted by
+// an authenticated user who may send as the author, and the author's domain
+// has a signing key configured, otherwise data is returned untouched.
+func (ss *Session) dkimSign(data []byte) []byte {
+	if ss.authUser == nil {
+		// Anybody can forge a From header in mail from outside
+		return data
+	}
+	author := ss.authorAddress(data)
+	_, domain, err := ParseEmailAddress(author)
+	if err != nil {
+		return data
+	}
+	domain = strings.ToLower(domain)
+	if ok, err := ss.canSendAs(author); err != nil || !ok {
+		ss.logWarn("Not DKIM signing message from %v for user %v: %v", author,
+			ss.authUser.Username, err)
+		return data
+	}
+	key, err := ss.server.db.DkimKeyGet(domain)
+	if err != nil {
+		ss.logError("Failed to load DKIM key for %v: %v", domain, err)
+		return data
+	}
+	if key == nil {
+		return data
+	}
+	signer, err := NewDkimSigner(key.Domain, key.Selector, key.PrivateKey,
+		config.GetDkimConfig().Headers)
+	if err != nil {
+		ss.logError("Bad DKIM key for %v: %v", domain, err)
+		return data
+	}
+	sig, err := signer.Sign(data)
+	if err != nil {
+		ss.logError("Failed to DKIM sign message for %v: %v", domain, err)
+		return data
+	}
+	ss.logTrace("DKIM signed message for %v with selector %v", domain, key.Selector)
+	return append(sig, data...)
+}
+
+// authorAddress returns the From header address, falling back to the envelope
+// sender
+func (ss *Session) authorAddress(data []byte) string {
+	if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			return addr.Address
+		}
+	}
+	return ss.from
+}
+
+// openMilters connects to the configured milters and passes on the client
+// connection details, returning the reply to send if it was rejected
+func (ss *Session) openMilters() string {
+	cfg := ss.server.milterConfig
+	for _, socket := range cfg.Sockets {
+		m, err := DialMilter(socket, time.Duration(cfg.TimeoutSeconds)*time.Second)
+		if err != nil {
+			ss.logError("Failed to connect to milter %v: %v", socket, err)
+			switch cfg.DefaultAction {
+			case "accept":
+				continue
+			case "reject":
+				return "554 5.7.1 Connection rejected"
+			}
+			return "421 4.7.0 Service unavailable - try again later"
+		}
+		ss.milters = append(ss.milters, m)
+	}
+
+	ip := net.ParseIP(ss.remoteHost)
+	port := milterPort(ss.conn.RemoteAddr())
+	resp := ss.runMilters(func(m *Milter) (*MilterResponse, error) {
+		if err := m.Macros(SMFIC_CONNECT, "j", ss.server.domain,
+			"{daemon_name}", "inbucket", "{client_addr}", ss.remoteHost); err != nil {
+			return nil, err
+		}
+		return m.Connect("["+ss.remoteHost+"]", ip, port)
+	})
+	switch {
+	case resp == nil:
+		return ""
+	case resp.Action == SMFIR_REPLYCODE:
+		return resp.Reply
+	case resp.Temporary():
+		return "421 4.7.0 Service unavailable - try again later"
+	}
+	return "554 5.7.1 Connection rejected"
+}
+
+// closeMilters ends the session with each milter
+func (ss *Session) closeMilters() {
+	for _, m := range ss.milters {
+		m.Close()
+	}
+	ss.milters = nil
+}
+
+// runMilters passes a session event to each milter in turn, returning the
+// response of the first one to reject it.  A milter that fails is dropped
+// from the session, and the configured default action applied.
+func (ss *Session) runMilters(event func(m *Milter) (*MilterResponse, error)) *MilterResponse {
+	for i := 0; i < len(ss.milters); i++ {
+		m := ss.milters[i]
+		resp, err := event(m)
+		if err != nil {
+			ss.logError("Dropping %v: %v", m, err)
+			m.Close()
+			ss.milters = append(ss.milters[:i], ss.milters[i+1:]...)
+			i--
+			switch ss.server.milterConfig.DefaultAction {
+			case "accept":
+				continue
+			case "reject":
+				return &MilterResponse{Action: SMFIR_REJECT}
+			}
+			return &MilterResponse{Action: SMFIR_TEMPFAIL}
+		}
+		if resp.Rejected() {
+			ss.logInfo("Rejected by %v: %q", m, resp.SmtpReply("Command"))
+			return resp
+		}
+		if resp.Action == SMFIR_DISCARD {
+			ss.logTrace("%v will discard the message", m)
+			ss.discard = true
+		}
+	}
+	return nil
+}
+
+// milterHelo passes HELO/EHLO to the milters, returns false if rejected
+func (ss *Session) milterHelo(domain string) bool {
+	resp := ss.runMilters(func(m *Milter) (*MilterResponse, error) {
+		return m.Helo(domain)
+	})
+	if resp != nil {
+		ss.send(resp.SmtpReply("HELO"))
+		return false
+	}
+	return true
+}
+
+// milterMail passes MAIL FROM to the milters, returns false if rejected
+func (ss *Session) milterMail(from string, args string) bool {
+	resp := ss.runMilters(func(m *Milter) (*MilterResponse, error) {
+		if err := m.Macros(SMFIC_MAIL, "{mail_addr}", from); err != nil {
+			return nil, err
+		}
+		return m.Mail(from, strings.Fields(args)...)
+	})
+	if resp != nil {
+		ss.send(resp.SmtpReply("Sender"))
+		ss.reset()
+		return false
+	}
+	return true
+}
+
+// milterRcpt passes RCPT TO to the milters, returns false if rejected
+func (ss *Session) milterRcpt(recip string) bool {
+	resp := ss.runMilters(func(m *Milter) (*MilterResponse, error) {
+		if err := m.Macros(SMFIC_RCPT, "{rcpt_addr}", recip); err != nil {
+			return nil, err
+		}
+		return m.Rcpt(recip)
+	})
+	if resp != nil {
+		ss.send(resp.SmtpReply("Recipient"))
+		return false
+	}
+	return true
+}
+
+// milterData passes DATA to the milters, returns false if rejected
+func (ss *Session) milterData() bool {
+	resp := ss.runMilters(func(m *Milter) (*MilterResponse, error) {
+		return m.Data()
+	})
+	if resp != nil {
+		ss.send(resp.SmtpReply("Message"))
+		ss.reset()
+		return false
+	}
+	return true
+}
+
+// milterMessage passes the message content to the milters, each sees the
+// header changes made by those before it.  The modified message is returned,
+// along with the rejection if there was one.
+func (ss *Session) milterMessage(data []byte) ([]byte, *MilterResponse) {
+	resp := ss.runMilters(func(m *Milter) (*MilterResponse, error) {
+		resp, changes, err := m.Message(data)
+		if err == nil && len(changes) > 0 {
+			ss.logTrace("Applying %v header changes from %v", len(changes), m)
+			data = ApplyHeaderChanges(data, changes)
+		}
+		return resp, err
+	})
+	return data, resp
 }
 
 func (ss *Session) enterState(state State) {
@@ -532,6 +1155,10 @@ func (ss *Session) readLine() (line string, err error) {
 func (ss *Session) parseCmd(line string) (cmd string, arg string, ok bool) {
 	line = strings.TrimRight(line, "\r\n")
 	l := len(line)
+	// STARTTLS is the only command longer than four letters
+	if l >= 8 && strings.EqualFold(line[:8], "STARTTLS") && (l == 8 || line[8] == ' ') {
+		return "STARTTLS", strings.Trim(line[8:], " "), true
+	}
 	switch {
 	case l == 0:
 		return "", "", true
@@ -562,7 +1189,7 @@ func (ss *Session) parseCmd(line string) (cmd string, arg string, ok bool) {
 // The leading space is mandatory.
 func (ss *Session) parseArgs(arg string) (args map[string]string, ok bool) {
 	args = make(map[string]string)
-	re := regexp.MustCompile(" (\\w+)=(\\w+)")
+	re := regexp.MustCompile(" (\\w+)=([\\w:.+\\-]+)")
 	pm := re.FindAllStringSubmatch(arg, -1)
 	if pm == nil {
 		ss.logWarn("Failed to parse arg string: %q")
@@ -575,10 +1202,41 @@ func (ss *Session) parseArgs(arg string) (args map[string]string, ok bool) {
 	return args, true
 }
 
+// hasRecipient reports whether addr is already a recipient of the message
+func (ss *Session) hasRecipient(addr string) bool {
+	for e := ss.recipients.Front(); e != nil; e = e.Next() {
+		if strings.EqualFold(e.Value.(string), addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
 func (ss *Session) reset() {
 	ss.enterState(READY)
 	ss.from = ""
 	ss.recipients = nil
+	ss.forwards = nil
+	ss.lists = nil
+	ss.held = nil
+	ss.discard = false
+	ss.authResults = nil
+	ss.spamResult = nil
+	ss.releaseAt = time.Time{}
+	for _, m := range ss.milters {
+		if err := m.Abort(); err != nil {
+			ss.logWarn("Failed to abort %v: %v", m, err)
+		}
+	}
 }
 
 func (ss *Session) ooSeq(cmd string) {
@@ -2,6 +2,7 @@ package smtpd
 
 import (
 	"bytes"
+	"container/list"
 	"fmt"
 	"io"
 
@@ -13,6 +14,9 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 type scriptStep struct {
@@ -154,6 +158,8 @@ func TestMailState(t *testing.T) {
 	msg1 := &MockMessage{}
 	mds.On("MailboxFor").Return(mb1, nil)
 	mb1.On("NewMessage").Return(msg1, nil)
+	msg1.On("SetAuthResults", mock.Anything).Return()
+	msg1.On("SetSpamResult", mock.Anything).Return()
 	msg1.On("Close").Return(nil)
 
 	server, logbuf := setupSmtpServer(mds)
@@ -256,6 +262,18 @@ func TestMailState(t *testing.T) {
 	}
 }
 
+// Test that addresses a recipient expands to count against the limit
+func TestRecipientLimit(t *testing.T) {
+	ss := &Session{server: &Server{maxRecips: 5}, recipients: list.New()}
+	assert.Equal(t, "", ss.recipientLimit(5))
+	assert.Equal(t, "552 Maximum limit of 5 recipients reached", ss.recipientLimit(6))
+
+	ss.recipients.PushBack("u1@gmail.com")
+	ss.forwards = []Forward{{Recipient: "u2@inbucket.local", Address: "u2@example.com"}}
+	assert.Equal(t, "", ss.recipientLimit(3), "a group of three still fits")
+	assert.NotEqual(t, "", ss.recipientLimit(4), "a group of four does not")
+}
+
 // Test commands in DATA state
 func TestDataState(t *testing.T) {
 	// Setup mock objects
@@ -264,6 +282,8 @@ func TestDataState(t *testing.T) {
 	msg1 := &MockMessage{}
 	mds.On("MailboxFor").Return(mb1, nil)
 	mb1.On("NewMessage").Return(msg1, nil)
+	msg1.On("SetAuthResults", mock.Anything).Return()
+	msg1.On("SetSpamResult", mock.Anything).Return()
 	msg1.On("Close").Return(nil)
 
 	server, logbuf := setupSmtpServer(mds)
@@ -0,0 +1,665 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+)
+
+const (
+	// Bounces after which a list member stops receiving posts
+	LIST_BOUNCE_LIMIT = 5
+	// A digest is sent once this many posts have queued, or once the oldest
+	// has waited LIST_DIGEST_HOURS
+	LIST_DIGEST_MESSAGES = 20
+	LIST_DIGEST_HOURS    = 24
+)
+
+type listKind int
+
+const (
+	LIST_POST    listKind = iota // Post to the list
+	LIST_REQUEST                 // Command to the -request address
+	LIST_BOUNCE                  // Bounce to the -bounces address
+)
+
+// listTarget is a mailing list address a message was sent to
+type listTarget struct {
+	kind   listKind
+	group  *db.Group
+	member string // Member a bounce was for, decoded from the VERP address
+}
+
+// Words accepted as commands by a list's -request address
+var listCommands = []string{"subscribe", "unsubscribe", "digest", "nodigest", "help"}
+
+var confirmPattern = regexp.MustCompile(`(?i)\bconfirm\s+([0-9a-f]{32})\b`)
+
+// ListCommand finds the request in a message to a list's -request address,
+// looking at the subject and then the first lines of the body.  For confirm
+// the token is also returned.
+func ListCommand(subject string, body string) (string, string) {
+	if m := confirmPattern.FindStringSubmatch(subject); m != nil {
+		return "confirm", strings.ToLower(m[1])
+	}
+	lines := []string{subject}
+	for i, line := range strings.Split(body, "\n") {
+		if i >= 10 {
+			break
+		}
+		lines = append(lines, line)
+	}
+	for _, line := range lines[1:] {
+		if m := confirmPattern.FindStringSubmatch(line); m != nil {
+			return "confirm", strings.ToLower(m[1])
+		}
+	}
+	for _, line := range lines {
+		words := strings.Fields(strings.ToLower(line))
+		for len(words) > 0 && (words[0] == "re:" || words[0] == "fwd:") {
+			words = words[1:]
+		}
+		if len(words) == 0 {
+			continue
+		}
+		for _, cmd := range listCommands {
+			if words[0] == cmd {
+				return cmd, ""
+			}
+		}
+	}
+	return "", ""
+}
+
+// VerpAddress returns the bounce address of the list for posts sent to
+// member, so a bounce identifies the member without parsing it
+func VerpAddress(list string, domain string, member string) string {
+	at := strings.LastIndex(member, "@")
+	if at < 0 {
+		return list + "-bounces@" + domain
+	}
+	return list + "-bounces+" + member[:at] + "=" + member[at+1:] + "@" + domain
+}
+
+// verpMember decodes the member from the tag of a VERP bounce address
+func verpMember(tag string) string {
+	eq := strings.LastIndex(tag, "=")
+	if eq < 0 {
+		return ""
+	}
+	return tag[:eq] + "@" + tag[eq+1:]
+}
+
+// listDomain returns the domain of the list's addresses
+func (s *Server) listDomain(group *db.Group) string {
+	if group.Domain != "" {
+		return strings.ToLower(group.Domain)
+	}
+	return s.domain
+}
+
+// ListMessage prepares a post for distribution, replacing any List-* headers
+// with ours and applying the list's Reply-To setting
+func ListMessage(group *db.Group, domain string, data []byte) []byte {
+	list := group.Name + "@" + domain
+	request := group.Name + "-request@" + domain
+	remove := []string{"List-Id", "List-Post", "List-Subscribe", "List-Unsubscribe",
+		"List-Help", "Precedence"}
+	if group.ReplyTo != "" {
+		remove = append(remove, "Reply-To")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "List-Id: <%v.%v>\r\n", group.Name, domain)
+	fmt.Fprintf(&buf, "List-Post: <mailto:%v>\r\n", list)
+	fmt.Fprintf(&buf, "List-Help: <mailto:%v?subject=help>\r\n", request)
+	fmt.Fprintf(&buf, "List-Subscribe: <mailto:%v?subject=subscribe>\r\n", request)
+	fmt.Fprintf(&buf, "List-Unsubscribe: <mailto:%v?subject=unsubscribe>\r\n", request)
+	fmt.Fprintf(&buf, "Precedence: list\r\n")
+	switch strings.ToLower(group.ReplyTo) {
+	case "":
+	case "list":
+		fmt.Fprintf(&buf, "Reply-To: <%v>\r\n", list)
+	default:
+		fmt.Fprintf(&buf, "Reply-To: <%v>\r\n", group.ReplyTo)
+	}
+	buf.Write(RemoveHeaders(data, remove...))
+	return buf.Bytes()
+}
+
+// RemoveHeaders returns data without the named header fields, including
+// their continuation lines
+func RemoveHeaders(data []byte, names ...string) []byte {
+	return filterHeaders(data, func(name string, value string) bool {
+		for _, n := range names {
+			if strings.EqualFold(name, n) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// filterHeaders returns data without the header fields drop is true for, it
+// is given the name and the unfolded value of each field
+func filterHeaders(data []byte, drop func(name string, value string) bool) []byte {
+	out := make([]byte, 0, len(data))
+	var field []byte
+	flush := func() {
+		colon := bytes.IndexByte(field, ':')
+		if colon <= 0 || !drop(string(bytes.TrimSpace(field[:colon])),
+			strings.Join(strings.Fields(string(field[colon+1:])), " ")) {
+			out = append(out, field...)
+		}
+		field = nil
+	}
+	rest := data
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line := rest[:end]
+		rest = rest[end:]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of header
+			flush()
+			out = append(out, line...)
+			return append(out, rest...)
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			flush()
+		}
+		field = append(field, line...)
+	}
+	flush()
+	return out
+}
+
+// messageBody returns the text after the header of a raw message
+func messageBody(data []byte) string {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		return strings.Replace(string(data[i+4:]), "\r\n", "\n", -1)
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+		return string(data[i+2:])
+	}
+	return ""
+}
+
+// listTargetFor recognizes recip as the address of a mailing list, or its
+// -request or -bounces address.  nil means recip is none of these.
+func (ss *Session) listTargetFor(recip string) (*listTarget, error) {
+	if ss.server.db == nil {
+		return nil, nil
+	}
+	local, _, err := ParseEmailAddress(recip)
+	if err != nil {
+		return nil, err
+	}
+	local = strings.ToLower(local)
+
+	target := &listTarget{kind: LIST_POST}
+	name := local
+	if strings.HasSuffix(local, "-request") {
+		target.kind = LIST_REQUEST
+		name = strings.TrimSuffix(local, "-request")
+	} else if i := strings.LastIndex(local, "-bounces"); i > 0 {
+		rest := local[i+len("-bounces"):]
+		if rest == "" || rest[0] == '+' {
+			target.kind = LIST_BOUNCE
+			target.member = verpMember(strings.TrimPrefix(rest, "+"))
+			name = local[:i]
+		}
+	}
+
+	group, err := ss.server.db.GroupGetByName(name)
+	if err != nil || group == nil || !group.IsList {
+		return nil, err
+	}
+	target.group = group
+	return target, nil
+}
+
+// hasListTarget reports whether the message is already going to t
+func (ss *Session) hasListTarget(t *listTarget) bool {
+	for _, existing := range ss.lists {
+		if existing.kind == t.kind && existing.group.Id == t.group.Id &&
+			existing.member == t.member {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverLists handles the message for each mailing list address it was
+// sent to
+func (ss *Session) deliverLists(data []byte, header mail.Header) {
+	for _, t := range ss.lists {
+		switch t.kind {
+		case LIST_POST:
+			ss.server.listPost(t.group, ss.from, data, header)
+		case LIST_REQUEST:
+			ss.listRequest(t.group, data, header)
+		case LIST_BOUNCE:
+			ss.listBounce(t.group, t.member, data)
+		}
+	}
+}
+
+// listPost distributes a post to the members of the list, queueing it for
+// digest members
+func (s *Server) listPost(group *db.Group, from string, data []byte, header mail.Header) {
+	domain := s.listDomain(group)
+	id := fmt.Sprintf("<%v.%v>", group.Name, domain)
+	for _, v := range header["List-Id"] {
+		if strings.Contains(strings.ToLower(v), id) {
+			log.LogWarn("Post from <%v> to list %v has looped, dropping it", from, group.Name)
+			return
+		}
+	}
+
+	post := ListMessage(group, domain, data)
+	members, err := s.db.GroupMemberAll(group.Id)
+	if err != nil {
+		log.LogError("Failed to load members of list %v: %v", group.Name, err)
+		return
+	}
+
+	log.LogInfo("Distributing post from <%v> to list %v", from, group.Name)
+	seen := make(map[string]bool)
+	digest := false
+	for _, m := range members {
+		if m.Disabled {
+			continue
+		}
+		var addrs []string
+		if m.MemberGroupId != 0 {
+			if addrs, err = s.db.GroupExpand(m.MemberGroupId); err != nil {
+				log.LogError("Failed to expand group %v: %v", m.MemberGroupId, err)
+				continue
+			}
+		} else {
+			addr, err := s.db.GroupMemberAddress(m)
+			if err != nil {
+				log.LogError("Failed to look up list member %v: %v", m.Id, err)
+				continue
+			}
+			if addr == "" {
+				continue
+			}
+			if m.Digest {
+				digest = true
+				continue
+			}
+			addrs = []string{addr}
+		}
+		for _, addr := range addrs {
+			if key := strings.ToLower(addr); !seen[key] {
+				seen[key] = true
+				s.listSend(group, addr, post)
+			}
+		}
+	}
+
+	if digest {
+		if err = s.db.ListDigestAdd(group.Id, post); err != nil {
+			log.LogError("Failed to queue digest post for %v: %v", group.Name, err)
+		}
+	}
+}
+
+// listSend delivers a list message to one member, with the member's VERP
+// bounce address as envelope sender when it leaves Inbucket
+func (s *Server) listSend(group *db.Group, addr string, data []byte) {
+	if s.isLocal(addr) {
+		if err := s.storeLocal(addr, data); err != nil {
+			log.LogError("Failed to deliver list %v message to %v: %v", group.Name, addr, err)
+		}
+		return
+	}
+	if s.outbound == nil {
+		log.LogWarn("No outbound delivery, cannot send list %v message to %v", group.Name, addr)
+		return
+	}
+	s.outbound.Send(VerpAddress(group.Name, s.listDomain(group), addr), []string{addr}, data)
+}
+
+// storeLocal writes data straight into the mailbox for addr
+func (s *Server) storeLocal(addr string, data []byte) error {
+	local, _, err := ParseEmailAddress(addr)
+	if err != nil {
+		return err
+	}
+	mb, err := s.dataStore.MailboxFor(local)
+	if err != nil {
+		return err
+	}
+	msg, err := mb.NewMessage()
+	if err != nil {
+		return err
+	}
+	if err = msg.Append(data); err != nil {
+		return err
+	}
+	if err = msg.Close(); err != nil {
+		return err
+	}
+	expReceivedTotal.Add(1)
+	return nil
+}
+
+// listRequest carries out a command sent to the list's -request address.
+// Changes to membership only happen once the sender confirms them, by
+// replying to a message containing a token.
+func (ss *Session) listRequest(group *db.Group, data []byte, header mail.Header) {
+	if ss.from == "" {
+		ss.logTrace("Ignoring request to list %v with null sender", group.Name)
+		return
+	}
+	domain := ss.server.listDomain(group)
+	request := group.Name + "-request@" + domain
+
+	cmd, token := ListCommand(originalSubject(header), messageBody(data))
+	ss.logInfo("List %v request %q from <%v>", group.Name, cmd, ss.from)
+	var subject, reply string
+	switch cmd {
+	case "confirm":
+		confirm, err := ss.server.db.ListConfirmTake(token)
+		if err != nil {
+			ss.logError("Failed to look up list confirmation: %v", err)
+			return
+		}
+		if confirm == nil || confirm.GroupId != group.Id {
+			subject = "Unknown confirmation"
+			reply = "The confirmation you sent is unknown or has already been used."
+			break
+		}
+		subject, reply = ss.listApply(group, confirm)
+	case "subscribe", "unsubscribe", "digest", "nodigest":
+		token, err := newListToken()
+		if err == nil {
+			err = ss.server.db.ListConfirmAdd(&db.ListConfirm{GroupId: group.Id,
+				Address: ss.from, Action: cmd, Token: token})
+		}
+		if err != nil {
+			ss.logError("Failed to store list confirmation: %v", err)
+			return
+		}
+		subject = "confirm " + token
+		reply = fmt.Sprintf("We received a request to %v <%v> for the %v mailing list.\n\n"+
+			"To confirm it, reply to this message keeping the subject intact.  If\n"+
+			"you did not ask for this, ignore this message.\n", listActionText(cmd), ss.from,
+			group.Name)
+	default:
+		subject = "Help for " + group.Name
+		reply = fmt.Sprintf("Send a message to %v with one of these words as its\n"+
+			"subject to manage your membership of the %v mailing list:\n\n"+
+			"  subscribe    join the list\n"+
+			"  unsubscribe  leave the list\n"+
+			"  digest       receive posts in batches\n"+
+			"  nodigest     receive each post as it arrives\n", request, group.Name)
+	}
+
+	ss.server.sendNotice(ss.from, AutoReply(domain, request, ss.from, header, subject, reply, false))
+}
+
+// sendNotice delivers a message generated by Inbucket to addr, with the null
+// sender so that it cannot bounce back
+func (s *Server) sendNotice(addr string, msg []byte) {
+	if s.isLocal(addr) {
+		if err := s.storeLocal(addr, msg); err != nil {
+			log.LogError("Failed to deliver notice to %v: %v", addr, err)
+		}
+	} else if s.outbound != nil {
+		s.outbound.Send("", []string{addr}, msg)
+	}
+}
+
+func listActionText(action string) string {
+	switch action {
+	case "subscribe":
+		return "subscribe"
+	case "unsubscribe":
+		return "unsubscribe"
+	case "digest":
+		return "send digests to"
+	}
+	return "send each post to"
+}
+
+// listApply makes a confirmed membership change, returning the subject and
+// text of the reply
+func (ss *Session) listApply(group *db.Group, confirm *db.ListConfirm) (string, string) {
+	member, err := ss.server.db.GroupMemberFind(group.Id, confirm.Address)
+	if err != nil {
+		ss.logError("Failed to look up list member %v: %v", confirm.Address, err)
+		return "Request failed", "Your request could not be completed, please try again later."
+	}
+
+	switch confirm.Action {
+	case "subscribe":
+		if member == nil {
+			err = ss.server.db.GroupMemberAdd(&db.GroupMember{GroupId: group.Id,
+				Address: confirm.Address})
+		} else if member.Disabled {
+			member.Disabled, member.Bounces = false, 0
+			err = ss.server.db.GroupMemberUpdate(member)
+		}
+	case "unsubscribe":
+		if member != nil {
+			err = ss.server.db.GroupMemberDel(member.Id)
+		}
+	case "digest", "nodigest":
+		if member == nil {
+			return "Not subscribed", fmt.Sprintf("<%v> is not subscribed to the %v mailing list.",
+				confirm.Address, group.Name)
+		}
+		member.Digest = confirm.Action == "digest"
+		err = ss.server.db.GroupMemberUpdate(member)
+	}
+	if err != nil {
+		ss.logError("Failed to %v %v: %v", confirm.Action, confirm.Address, err)
+		return "Request failed", "Your request could not be completed, please try again later."
+	}
+
+	ss.logInfo("List %v confirmed %v for %v", group.Name, confirm.Action, confirm.Address)
+	switch confirm.Action {
+	case "subscribe":
+		return "Welcome to " + group.Name, fmt.Sprintf(
+			"<%v> is now subscribed to the %v mailing list.", confirm.Address, group.Name)
+	case "unsubscribe":
+		return "Goodbye from " + group.Name, fmt.Sprintf(
+			"<%v> has been unsubscribed from the %v mailing list.", confirm.Address, group.Name)
+	}
+	return "Delivery changed", fmt.Sprintf("Delivery for <%v> on the %v mailing list has been "+
+		"changed.", confirm.Address, group.Name)
+}
+
+// listBounce counts a bounce against the member, disabling their delivery
+// once there have been too many.  Anybody can write to the member's VERP
+// address, so only a failure report from the null sender counts.
+func (ss *Session) listBounce(group *db.Group, addr string, data []byte) {
+	if addr == "" {
+		ss.logTrace("Ignoring bounce for list %v with no member", group.Name)
+		return
+	}
+	if ss.from != "" || !deliveryFailed(data) {
+		ss.logInfo("Ignoring message from <%v> to list %v bounce address of %v, it is not "+
+			"a delivery failure report", ss.from, group.Name, addr)
+		return
+	}
+	member, err := ss.server.db.GroupMemberFind(group.Id, addr)
+	if err != nil {
+		ss.logError("Failed to look up list member %v: %v", addr, err)
+		return
+	}
+	if member == nil || member.Disabled {
+		return
+	}
+	member.Bounces++
+	if member.Bounces >= LIST_BOUNCE_LIMIT {
+		ss.logInfo("Disabling %v on list %v after %v bounces", addr, group.Name, member.Bounces)
+		member.Disabled = true
+	}
+	if err = ss.server.db.GroupMemberUpdate(member); err != nil {
+		ss.logError("Failed to record bounce for %v: %v", addr, err)
+	}
+}
+
+// deliveryFailed reports whether data is a delivery status notification, RFC
+// 3464, for a recipient whose delivery failed
+func deliveryFailed(data []byte) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" ||
+		!strings.EqualFold(params["report-type"], "delivery-status") {
+		return false
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			return false
+		}
+		mediaType, _, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if mediaType != "message/delivery-status" {
+			continue
+		}
+		status, err := ioutil.ReadAll(part)
+		if err != nil {
+			return false
+		}
+		// Per-recipient fields, a delayed delivery is not a bounce
+		for _, line := range strings.Split(string(status), "\n") {
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "Action") &&
+				strings.EqualFold(strings.TrimSpace(kv[1]), "failed") {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func newListToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// groupScanner periodically releases the messages moderators have decided
+// on and sends the digests of lists whose queues are due
+func (s *Server) groupScanner() {
+	for !s.shutdown {
+		time.Sleep(time.Minute)
+		if err := s.releaseHeld(); err != nil {
+			log.LogError("Error releasing held messages: %v", err)
+		}
+		if err := s.sendDigests(time.Now()); err != nil {
+			log.LogError("Error sending list digests: %v", err)
+		}
+	}
+}
+
+// sendDigests sends each list's queued posts to its digest members once
+// LIST_DIGEST_MESSAGES have queued or the oldest is LIST_DIGEST_HOURS old
+func (s *Server) sendDigests(now time.Time) error {
+	queued, err := s.db.ListDigestAll()
+	if err != nil {
+		return err
+	}
+	byGroup := make(map[uint64][]*db.ListDigest)
+	var order []uint64
+	for _, d := range queued {
+		if byGroup[d.GroupId] == nil {
+			order = append(order, d.GroupId)
+		}
+		byGroup[d.GroupId] = append(byGroup[d.GroupId], d)
+	}
+
+	for _, groupId := range order {
+		posts := byGroup[groupId]
+		if len(posts) < LIST_DIGEST_MESSAGES &&
+			now.Sub(posts[0].Created) < LIST_DIGEST_HOURS*time.Hour {
+			continue
+		}
+		group, err := s.db.GroupGet(groupId)
+		if err != nil {
+			return err
+		}
+		if group != nil {
+			members, err := s.db.GroupMemberAll(groupId)
+			if err != nil {
+				return err
+			}
+			data := make([][]byte, len(posts))
+			for i, p := range posts {
+				data[i] = p.Data
+			}
+			digest := DigestMessage(group, s.listDomain(group), data, now)
+			log.LogInfo("Sending digest of %v posts for list %v", len(posts), group.Name)
+			for _, m := range members {
+				if !m.Digest || m.Disabled {
+					continue
+				}
+				addr, err := s.db.GroupMemberAddress(m)
+				if err != nil {
+					return err
+				}
+				if addr != "" {
+					s.listSend(group, addr, digest)
+				}
+			}
+		}
+		for _, p := range posts {
+			if err = s.db.ListDigestDel(p.Id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DigestMessage bundles posts into a single multipart/digest message
+func DigestMessage(group *db.Group, domain string, posts [][]byte, now time.Time) []byte {
+	boundary := "digest-" + generateId(now)
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "From: %v <%v@%v>\r\n", group.Name, group.Name, domain)
+	fmt.Fprintf(&head, "To: <%v@%v>\r\n", group.Name, domain)
+	fmt.Fprintf(&head, "Subject: %v digest, %v, %v messages\r\n", group.Name,
+		now.Format("2 Jan 2006"), len(posts))
+	fmt.Fprintf(&head, "Date: %v\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&head, "Message-ID: <%v@%v>\r\n", generateId(now), domain)
+	fmt.Fprintf(&head, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&head, "Content-Type: multipart/digest; boundary=\"%v\"\r\n\r\n", boundary)
+
+	var body bytes.Buffer
+	for _, p := range posts {
+		fmt.Fprintf(&body, "--%v\r\n\r\n", boundary)
+		body.Write(p)
+		if !bytes.HasSuffix(p, []byte("\r\n")) {
+			body.WriteString("\r\n")
+		}
+	}
+	fmt.Fprintf(&body, "--%v--\r\n", boundary)
+
+	// The digest itself carries the list headers too
+	return append(ListMessage(group, domain, head.Bytes()), body.Bytes()...)
+}
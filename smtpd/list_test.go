@@ -0,0 +1,106 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListCommand(t *testing.T) {
+	cmd, token := ListCommand("subscribe", "")
+	assert.Equal(t, "subscribe", cmd)
+	assert.Equal(t, "", token)
+
+	cmd, _ = ListCommand("", "\nUnsubscribe me please\n")
+	assert.Equal(t, "unsubscribe", cmd, "command in the body")
+
+	cmd, token = ListCommand("Re: confirm 0123456789ABCDEF0123456789abcdef", "")
+	assert.Equal(t, "confirm", cmd)
+	assert.Equal(t, "0123456789abcdef0123456789abcdef", token)
+
+	cmd, _ = ListCommand("Re: nodigest", "")
+	assert.Equal(t, "nodigest", cmd)
+
+	cmd, _ = ListCommand("hello", "what is this list about?")
+	assert.Equal(t, "", cmd)
+}
+
+func TestVerpAddress(t *testing.T) {
+	addr := VerpAddress("dev", "lists.example.com", "bob@example.org")
+	assert.Equal(t, "dev-bounces+bob=example.org@lists.example.com", addr)
+
+	local := addr[:strings.LastIndex(addr, "@")]
+	assert.Equal(t, "bob@example.org", verpMember(strings.TrimPrefix(local, "dev-bounces+")))
+	assert.Equal(t, "", verpMember("nothing"))
+}
+
+func TestListMessage(t *testing.T) {
+	group := &db.Group{Name: "dev", IsList: true, ReplyTo: "list"}
+	data := []byte("From: bob@example.org\r\n" +
+		"Reply-To: bob@example.org\r\n" +
+		"List-Id: <other.example.net>\r\n" +
+		"List-Unsubscribe: <mailto:x@example.net>,\r\n" +
+		"  <http://example.net/x>\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"List-Id: body text is left alone\r\n")
+
+	msg := string(ListMessage(group, "example.com", data))
+	assert.Contains(t, msg, "List-Id: <dev.example.com>\r\n")
+	assert.Contains(t, msg, "List-Post: <mailto:dev@example.com>\r\n")
+	assert.Contains(t, msg, "List-Unsubscribe: <mailto:dev-request@example.com?subject=unsubscribe>\r\n")
+	assert.Contains(t, msg, "Reply-To: <dev@example.com>\r\n")
+	assert.Contains(t, msg, "Precedence: list\r\n")
+	assert.NotContains(t, msg, "other.example.net")
+	assert.NotContains(t, msg, "example.net/x")
+	assert.NotContains(t, msg, "Reply-To: bob@example.org")
+	assert.Contains(t, msg, "Subject: hello\r\n")
+	assert.Contains(t, msg, "\r\n\r\nList-Id: body text is left alone\r\n")
+
+	// Without munging the poster's Reply-To stays
+	group.ReplyTo = ""
+	msg = string(ListMessage(group, "example.com", data))
+	assert.Contains(t, msg, "Reply-To: bob@example.org\r\n")
+}
+
+func TestRemoveHeaders(t *testing.T) {
+	data := "From: a@example.com\r\nBcc: b@example.com,\r\n c@example.com\r\n" +
+		"Subject: hi\r\n\r\nBcc: stays in the body\r\n"
+	want := "From: a@example.com\r\nSubject: hi\r\n\r\nBcc: stays in the body\r\n"
+	assert.Equal(t, want, string(RemoveHeaders([]byte(data), "bcc")))
+}
+
+func TestDigestMessage(t *testing.T) {
+	group := &db.Group{Name: "dev", IsList: true}
+	posts := [][]byte{
+		[]byte("Subject: one\r\n\r\nfirst\r\n"),
+		[]byte("Subject: two\r\n\r\nsecond"),
+	}
+	msg := string(DigestMessage(group, "example.com", posts, time.Now()))
+	assert.Contains(t, msg, "Content-Type: multipart/digest; boundary=")
+	assert.Contains(t, msg, "List-Id: <dev.example.com>\r\n")
+	assert.Contains(t, msg, "2 messages")
+	assert.Contains(t, msg, "Subject: one\r\n\r\nfirst\r\n")
+	assert.Contains(t, msg, "Subject: two\r\n\r\nsecond\r\n")
+	assert.True(t, strings.HasSuffix(msg, "--\r\n"))
+}
+
+func TestDeliveryFailed(t *testing.T) {
+	dsn := func(action string) []byte {
+		return []byte("From: MAILER-DAEMON@example.org\r\nMIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b\"\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain\r\n\r\nAction: failed in the text is not enough\r\n" +
+			"--b\r\nContent-Type: message/delivery-status\r\n\r\nReporting-MTA: dns; example.org\r\n\r\n" +
+			"Final-Recipient: rfc822; bob@example.org\r\nAction: " + action + "\r\nStatus: 5.1.1\r\n" +
+			"--b--\r\n")
+	}
+	assert.True(t, deliveryFailed(dsn("failed")))
+	assert.False(t, deliveryFailed(dsn("delayed")))
+	// A plain message claiming to be a bounce
+	assert.False(t, deliveryFailed([]byte("Subject: Undelivered Mail\r\n\r\nAction: failed\r\n")))
+	assert.False(t, deliveryFailed([]byte("Content-Type: multipart/report; "+
+		"report-type=disposition-notification; boundary=b\r\n\r\n--b--\r\n")))
+}
@@ -2,6 +2,7 @@ package smtpd
 
 import (
 	"container/list"
+	"crypto/tls"
 	"expvar"
 	"fmt"
 	"net"
@@ -23,6 +24,14 @@ type Server struct {
 	maxMessageBytes int
 	dataStore       DataStore
 	storeMessages   bool
+	verifyAuth      bool
+	maxHoldSeconds  int
+	milterConfig    config.MilterConfig
+	clamdConfig     config.ClamdConfig
+	spamConfig      config.SpamConfig
+	outbound        *Outbound
+	throttle        *AuthThrottle
+	tlsConfig       *tls.Config
 	listener        net.Listener
 	shutdown        bool
 	waitgroup       *sync.WaitGroup
@@ -54,13 +63,25 @@ func NewSmtpServer(cfg config.SmtpConfig, ds DataStore, db *db.Database) *Server
 	return &Server{dataStore: ds, domain: cfg.Domain, maxRecips: cfg.MaxRecipients,
 		maxIdleSeconds: cfg.MaxIdleSeconds, maxMessageBytes: cfg.MaxMessageBytes,
 		storeMessages: cfg.StoreMessages, domainNoStore: strings.ToLower(cfg.DomainNoStore),
-		waitgroup: new(sync.WaitGroup),
-		db:        db}
+		verifyAuth:     cfg.VerifyAuth,
+		maxHoldSeconds: cfg.MaxHoldSeconds,
+		waitgroup:      new(sync.WaitGroup),
+		db:             db}
 }
 
 // Main listener loop
 func (s *Server) Start() {
 	cfg := config.GetSmtpConfig()
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			log.LogError("SMTP failed to load TLS certificate: %v", err)
+			// TODO More graceful early-shutdown procedure
+			panic(err)
+		}
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
 	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%v:%v",
 		cfg.Ip4address, cfg.Ip4port))
 	if err != nil {
@@ -83,9 +104,39 @@ func (s *Server) Start() {
 		log.LogInfo("Messages sent to domain '%v' will be discarded", s.domainNoStore)
 	}
 
+	s.milterConfig = config.GetMilterConfig()
+	if len(s.milterConfig.Sockets) > 0 {
+		log.LogInfo("Messages will be passed through milters %v", s.milterConfig.Sockets)
+	}
+	s.clamdConfig = config.GetClamdConfig()
+	if s.clamdConfig.Socket != "" {
+		log.LogInfo("Messages will be scanned for viruses by clamd at %v", s.clamdConfig.Socket)
+	}
+	s.spamConfig = config.GetSpamConfig()
+	if s.spamConfig.Engine != "" {
+		log.LogInfo("Messages will be scored by %v at %v", s.spamConfig.Engine,
+			s.spamConfig.Address)
+	}
+
+	s.outbound = NewOutbound(config.GetOutboundConfig())
+	s.outbound.Start()
+
+	s.throttle = DefaultAuthThrottle()
+
 	// Start retention scanner
 	StartRetentionScanner(s.dataStore)
 
+	// Start scanner for moderated messages and list digests
+	if s.db != nil {
+		go s.groupScanner()
+	}
+
+	// Start scanner for messages held with FUTURERELEASE, it also sends the
+	// messages submitted over JMAP
+	if s.db != nil {
+		go s.releaseScanner()
+	}
+
 	// Handle incoming connections
 	var tempDelay time.Duration
 	for sid := 1; ; sid++ {
@@ -132,6 +183,9 @@ func (s *Server) Stop() {
 func (s *Server) Drain() {
 	s.waitgroup.Wait()
 	log.LogTrace("SMTP connections drained")
+	if s.outbound != nil {
+		s.outbound.Stop()
+	}
 }
 
 // When the provided Ticker ticks, we update our metrics history
@@ -0,0 +1,41 @@
+package smtpd
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/egggo/inbucket/log"
+)
+
+// ErrMailboxLocked is returned by Mailbox.Lock while another session holds
+// the mailbox
+var ErrMailboxLocked = errors.New("Mailbox is in use")
+
+// mailboxLocks hands out the exclusive maildrop locks RFC 1939 asks for, to
+// POP3 sessions and anything else deleting messages.  Keys are mailbox
+// directory names, so mailboxes found by AllMailboxes share the lock of the
+// same mailbox opened by name.
+var mailboxLocks = struct {
+	sync.Mutex
+	owners map[string]string
+}{owners: make(map[string]string)}
+
+// lockMailbox takes the lock on key for owner without waiting
+func lockMailbox(key string, owner string) error {
+	mailboxLocks.Lock()
+	defer mailboxLocks.Unlock()
+
+	if holder, ok := mailboxLocks.owners[key]; ok {
+		log.LogTrace("Mailbox %v wanted by %v is locked by %v", key, owner, holder)
+		return ErrMailboxLocked
+	}
+	mailboxLocks.owners[key] = owner
+	return nil
+}
+
+func unlockMailbox(key string) {
+	mailboxLocks.Lock()
+	defer mailboxLocks.Unlock()
+
+	delete(mailboxLocks.owners, key)
+}
@@ -0,0 +1,149 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/egggo/inbucket/database"
+)
+
+// Errors returned by SaslAuthenticate and LogIn, their text is meant for the
+// client
+var (
+	ErrSaslMechanism = errors.New("Unsupported authentication mechanism")
+	ErrSaslBase64    = errors.New("Invalid base64 in SASL response")
+	ErrSaslMalformed = errors.New("Malformed SASL PLAIN response")
+	ErrSaslCancelled = errors.New("Authentication cancelled")
+	ErrAuthFailed    = errors.New("Authentication failed")
+)
+
+// SaslChallenge sends text to the client as a SASL challenge and returns its
+// base64 response, or ErrSaslCancelled if the client gave up
+type SaslChallenge func(text string) (string, error)
+
+// SaslAuthenticate runs the PLAIN (RFC 4616) or LOGIN mechanism, returning
+// the authorization identity, user name and password the client gave.
+// initial is the initial response, "" if there was none and "=" if it was
+// empty.  Errors from challenge are returned as they are.
+func SaslAuthenticate(mech string, initial string, challenge SaslChallenge) (authz string,
+	name string, pass string, err error) {
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		response := initial
+		if response == "" {
+			if response, err = challenge(""); err != nil {
+				return
+			}
+		} else if response == "=" {
+			response = ""
+		}
+		return ParseSaslPlain(response)
+	case "LOGIN":
+		if initial != "" {
+			name, err = decodeSasl(initial)
+		} else {
+			name, err = challengeDecoded(challenge, "Username:")
+		}
+		if err == nil {
+			pass, err = challengeDecoded(challenge, "Password:")
+		}
+		return
+	}
+	err = ErrSaslMechanism
+	return
+}
+
+// ParseSaslPlain splits a base64 SASL PLAIN response into the authorization
+// identity, user name and password
+func ParseSaslPlain(response string) (authz string, name string, pass string, err error) {
+	decoded, err := decodeSasl(response)
+	if err != nil {
+		return
+	}
+	parts := strings.Split(decoded, "\x00")
+	if len(parts) != 3 {
+		err = ErrSaslMalformed
+		return
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+func challengeDecoded(challenge SaslChallenge, text string) (string, error) {
+	response, err := challenge(text)
+	if err != nil {
+		return "", err
+	}
+	return decodeSasl(response)
+}
+
+func decodeSasl(response string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", ErrSaslBase64
+	}
+	return string(decoded), nil
+}
+
+// SaslLogin turns SASL identities into a mailbox*user login name for
+// SplitLogin, the authorization identity may name a shared mailbox to open
+func SaslLogin(authz string, name string) string {
+	name = strings.Split(name, "@")[0]
+	if authz = strings.Split(authz, "@")[0]; authz != "" && authz != name {
+		return authz + "*" + name
+	}
+	return name
+}
+
+// SplitLogin splits a mailbox*user login name into the mailbox to open and
+// the user to authenticate as, a plain user name opens their own mailbox
+func SplitLogin(name string) (mailbox string, login string) {
+	if i := strings.Index(name, "*"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, name
+}
+
+// PasswordCheck returns a check for LogIn accepting users whose password is
+// pass
+func PasswordCheck(database *db.Database, pass string) func(user *db.User) (bool, error) {
+	return func(user *db.User) (bool, error) {
+		return database.Auth(user.Id, pass)
+	}
+}
+
+// LogIn looks up the user name, or address, logging in to service from ip
+// and has check verify their credentials.  Failures count against throttle
+// and are delayed by it.  It returns ErrThrottled while ip or name is locked
+// out, ErrAuthFailed if the user is unknown or check refuses them, and
+// database errors as they are.
+func LogIn(database *db.Database, throttle *AuthThrottle, service string, ip string,
+	name string, check func(user *db.User) (bool, error)) (*db.User, error) {
+	if err := throttle.Check(ip, name); err != nil {
+		return nil, err
+	}
+
+	var user *db.User
+	var err error
+	if strings.Contains(name, "@") {
+		user, err = database.UserGetByAddress(name)
+	} else {
+		user, err = database.UserGetByName(name)
+	}
+	if err == nil && user != nil {
+		var ok bool
+		if ok, err = check(user); !ok && err == nil {
+			user = nil
+		}
+	}
+	if err == nil && user == nil {
+		err = ErrAuthFailed
+	}
+	if err != nil {
+		time.Sleep(throttle.Failure(service, ip, name))
+		return nil, err
+	}
+	throttle.Success(ip, name)
+	return user, nil
+}
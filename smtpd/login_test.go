@@ -0,0 +1,105 @@
+package smtpd
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func saslResponse(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestSaslAuthenticate(t *testing.T) {
+	noChallenge := func(text string) (string, error) {
+		t.Errorf("Unexpected challenge %q", text)
+		return "", errors.New("unexpected challenge")
+	}
+
+	authz, name, pass, err := SaslAuthenticate("plain", saslResponse("support\x00fred\x00secret"),
+		noChallenge)
+	assert.Nil(t, err)
+	assert.Equal(t, "support", authz)
+	assert.Equal(t, "fred", name)
+	assert.Equal(t, "secret", pass)
+
+	// Without an initial response the client answers an empty challenge
+	var challenges []string
+	answers := []string{saslResponse("\x00fred\x00secret")}
+	challenge := func(text string) (string, error) {
+		challenges = append(challenges, text)
+		answer := answers[0]
+		answers = answers[1:]
+		return answer, nil
+	}
+	_, name, pass, err = SaslAuthenticate("PLAIN", "", challenge)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{""}, challenges)
+	assert.Equal(t, "fred", name)
+	assert.Equal(t, "secret", pass)
+
+	challenges = nil
+	answers = []string{saslResponse("secret")}
+	_, name, pass, err = SaslAuthenticate("LOGIN", saslResponse("fred"), challenge)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Password:"}, challenges)
+	assert.Equal(t, "fred", name)
+	assert.Equal(t, "secret", pass)
+
+	challenges = nil
+	answers = []string{saslResponse("fred"), saslResponse("secret")}
+	_, name, pass, err = SaslAuthenticate("LOGIN", "", challenge)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Username:", "Password:"}, challenges)
+	assert.Equal(t, "fred", name)
+	assert.Equal(t, "secret", pass)
+
+	_, _, _, err = SaslAuthenticate("CRAM-MD5", "", noChallenge)
+	assert.Equal(t, ErrSaslMechanism, err)
+	_, _, _, err = SaslAuthenticate("PLAIN", "=", noChallenge)
+	assert.Equal(t, ErrSaslMalformed, err)
+	_, _, _, err = SaslAuthenticate("PLAIN", "not base64!", noChallenge)
+	assert.Equal(t, ErrSaslBase64, err)
+	_, _, _, err = SaslAuthenticate("PLAIN", saslResponse("fred\x00secret"), noChallenge)
+	assert.Equal(t, ErrSaslMalformed, err)
+	_, _, _, err = SaslAuthenticate("LOGIN", "", func(string) (string, error) {
+		return "", ErrSaslCancelled
+	})
+	assert.Equal(t, ErrSaslCancelled, err)
+}
+
+func TestSaslLogin(t *testing.T) {
+	assert.Equal(t, "fred", SaslLogin("", "fred@inbucket.local"))
+	assert.Equal(t, "fred", SaslLogin("fred", "fred"))
+	// The authorization identity names the shared mailbox to open
+	assert.Equal(t, "support*fred", SaslLogin("support@inbucket.local", "fred"))
+}
+
+func TestSplitLogin(t *testing.T) {
+	mailbox, login := SplitLogin("fred")
+	assert.Equal(t, "fred", mailbox)
+	assert.Equal(t, "fred", login)
+
+	mailbox, login = SplitLogin("support*fred")
+	assert.Equal(t, "support", mailbox)
+	assert.Equal(t, "fred", login)
+}
+
+// Test that a locked out client is refused before the database is asked
+func TestLogInThrottled(t *testing.T) {
+	th, _ := newTestThrottle()
+	for i := 0; i < 3; i++ {
+		th.Failure("SMTP", "192.0.2.1", "fred")
+	}
+
+	check := func(user *db.User) (bool, error) {
+		t.Error("Unexpected credential check")
+		return false, nil
+	}
+	user, err := LogIn(&db.Database{}, th, "SMTP", "192.0.2.1", "fred", check)
+	assert.Nil(t, user)
+	assert.Equal(t, ErrThrottled, err)
+}
@@ -0,0 +1,905 @@
+package smtpd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/egggo/inbucket/log"
+)
+
+// Subdirectories of a Maildir: messages are written to tmp, delivered to new
+// and moved to cur once they have flags
+const (
+	MAILDIR_TMP = "tmp"
+	MAILDIR_NEW = "new"
+	MAILDIR_CUR = "cur"
+)
+
+// Name of the file in each Maildir holding the UID validity, next UID and the
+// UID of each message, in the format Dovecot uses
+const MAILDIR_UIDLIST = "dovecot-uidlist"
+
+// Name of the file in each Maildir naming the keywords behind the lowercase
+// flag letters
+const MAILDIR_KEYWORDS = "dovecot-keywords"
+
+// Name of the file in each Maildir holding the verdicts reached for the
+// messages we received, which other programs leave alone
+const MAILDIR_RESULTS = "inbucket-results"
+
+// Maildir++ marks folder directories with this empty file
+const MAILDIR_FOLDER_FILE = "maildirfolder"
+
+// How long we wait for another process to release dovecot-uidlist, and how old
+// a lock must be before we take it to have been abandoned
+const (
+	MAILDIR_LOCK_WAIT  = 10 * time.Second
+	MAILDIR_LOCK_STALE = 2 * time.Minute
+)
+
+// We lock this when reading or changing a Maildir, the dotlock on
+// dovecot-uidlist keeps other processes out
+var maildirLock = new(sync.Mutex)
+
+var errUidlistVersion = errors.New("Unsupported dovecot-uidlist version")
+
+// MaildirDataStore keeps each mailbox as a Maildir++ directory beneath path, so
+// it can be shared with Dovecot and other tools that read Maildir
+type MaildirDataStore struct {
+	path       string
+	messageCap int
+}
+
+// NewMaildirDataStore creates a new DataStore object using the specified path
+func NewMaildirDataStore(cfg config.DataStoreConfig) DataStore {
+	path := cfg.Path
+	if path == "" {
+		log.LogError("No value configured for datastore path")
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		// Mail datastore does not yet exist
+		os.MkdirAll(path, 0770)
+	}
+	return &MaildirDataStore{path: path, messageCap: cfg.MailboxMsgCap}
+}
+
+// maildirName turns a mailbox name into the name of its directory, "/" may
+// appear in mailbox names and a leading "." would make it a hidden directory
+func maildirName(name string) string {
+	dir := strings.Replace(strings.Replace(name, "%", "%25", -1), "/", "%2f", -1)
+	if strings.HasPrefix(dir, ".") {
+		dir = "%2e" + dir[1:]
+	}
+	return dir
+}
+
+// MailboxFor retrieves the Mailbox object for a specified email address, its
+// directory is created when the first message is delivered
+func (ds *MaildirDataStore) MailboxFor(emailAddress string) (Mailbox, error) {
+	name, err := ParseMailboxName(emailAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &MaildirMailbox{store: ds, name: name,
+		path: filepath.Join(ds.path, maildirName(name))}, nil
+}
+
+// AllMailboxes returns a slice with all Mailboxes, each followed by its folders
+func (ds *MaildirDataStore) AllMailboxes() ([]Mailbox, error) {
+	infos, err := ioutil.ReadDir(ds.path)
+	if err != nil {
+		return nil, err
+	}
+	mailboxes := make([]Mailbox, 0, len(infos))
+	for _, inf := range infos {
+		dir := inf.Name()
+		if !inf.IsDir() || strings.HasPrefix(dir, ".") {
+			continue
+		}
+		name, err := url.PathUnescape(dir)
+		if err != nil {
+			log.LogWarn("Ignoring mailbox directory %v in %v", dir, ds.path)
+			continue
+		}
+		mb := &MaildirMailbox{store: ds, name: name, path: filepath.Join(ds.path, dir)}
+		mailboxes = append(mailboxes, mb)
+		folders, err := mb.Folders()
+		if err != nil {
+			return nil, err
+		}
+		for _, folder := range folders {
+			mailboxes = append(mailboxes, mb.folderMailbox(folder))
+		}
+	}
+	return mailboxes, nil
+}
+
+// MaildirMailbox is a Maildir, the INBOX of a mailbox or one of its Maildir++
+// folders
+type MaildirMailbox struct {
+	store       *MaildirDataStore
+	name        string
+	folder      string
+	inbox       *MaildirMailbox
+	path        string
+	loaded      bool
+	uidValidity uint32
+	uidNext     uint32
+	keywords    []string
+	results     map[string]*maildirResults
+	messages    []*MaildirMessage
+}
+
+// maildirResults are the verdicts for a message in MAILDIR_RESULTS
+type maildirResults struct {
+	Auth *AuthResults `json:",omitempty"`
+	Spam *SpamResult  `json:",omitempty"`
+}
+
+func (mb *MaildirMailbox) String() string {
+	if mb.inbox != nil {
+		return mb.name + "/" + mb.folder + "[maildir]"
+	}
+	return mb.name + "[maildir]"
+}
+
+// Each folder is locked separately from the INBOX, under its path
+func (mb *MaildirMailbox) Lock(owner string) error {
+	return lockMailbox(mb.path, owner)
+}
+
+func (mb *MaildirMailbox) Unlock() {
+	unlockMailbox(mb.path)
+}
+
+// load reads the Maildir unless it has been already
+func (mb *MaildirMailbox) load() error {
+	if mb.loaded {
+		return nil
+	}
+	maildirLock.Lock()
+	defer maildirLock.Unlock()
+	return mb.sync()
+}
+
+// GetMessages lists the messages in new and cur in order of UID
+func (mb *MaildirMailbox) GetMessages() ([]Message, error) {
+	if err := mb.load(); err != nil {
+		return nil, err
+	}
+	messages := make([]Message, len(mb.messages))
+	for i, m := range mb.messages {
+		messages[i] = m
+	}
+	return messages, nil
+}
+
+// GetMessage returns the message whose file name, less its flags, is id
+func (mb *MaildirMailbox) GetMessage(id string) (Message, error) {
+	if err := mb.load(); err != nil {
+		return nil, err
+	}
+	if m := mb.find(id); m != nil {
+		return m, nil
+	}
+	return nil, ErrNotExist
+}
+
+func (mb *MaildirMailbox) find(id string) *MaildirMessage {
+	for _, m := range mb.messages {
+		if m.id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// UidValidity returns the UID validity recorded in dovecot-uidlist
+func (mb *MaildirMailbox) UidValidity() (uint32, error) {
+	if err := mb.load(); err != nil {
+		return 0, err
+	}
+	return mb.uidValidity, nil
+}
+
+// UidNext returns the UID the next message delivered will get
+func (mb *MaildirMailbox) UidNext() (uint32, error) {
+	if err := mb.load(); err != nil {
+		return 0, err
+	}
+	return mb.uidNext, nil
+}
+
+// Purge deletes all messages in the Maildir.  Unlike the file backend the
+// directory stays, with its UIDs, as other programs may be using it.
+func (mb *MaildirMailbox) Purge() error {
+	maildirLock.Lock()
+	defer maildirLock.Unlock()
+	if err := mb.sync(); err != nil {
+		return err
+	}
+	for _, m := range mb.messages {
+		if err := os.Remove(m.path()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	mb.messages = mb.messages[:0]
+	return nil
+}
+
+// exists reports whether the Maildir has been created
+func (mb *MaildirMailbox) exists() bool {
+	_, err := os.Stat(filepath.Join(mb.path, MAILDIR_CUR))
+	return err == nil
+}
+
+// create makes the directories of the Maildir if they are missing, a new
+// Maildir is given a UID validity.  Called with maildirLock held.
+func (mb *MaildirMailbox) create() error {
+	if mb.exists() {
+		return nil
+	}
+	for _, dir := range []string{MAILDIR_TMP, MAILDIR_NEW, MAILDIR_CUR} {
+		if err := os.MkdirAll(filepath.Join(mb.path, dir), 0770); err != nil {
+			log.LogError("Failed to create directory %v, %v", mb.path, err)
+			return err
+		}
+	}
+	if mb.inbox != nil {
+		marker := filepath.Join(mb.path, MAILDIR_FOLDER_FILE)
+		if err := ioutil.WriteFile(marker, nil, 0660); err != nil {
+			return err
+		}
+	}
+	return mb.sync()
+}
+
+// sync lists the messages in new and cur and reads their UIDs, giving those
+// delivered by other programs the next ones.  Called with maildirLock held.
+func (mb *MaildirMailbox) sync() error {
+	found, err := mb.list()
+	if err != nil {
+		return err
+	}
+	if err = mb.readKeywords(); err != nil {
+		return err
+	}
+	if err = mb.readResults(); err != nil {
+		return err
+	}
+	uids, err := mb.readUidlist()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	missing := err != nil
+	for _, m := range found {
+		if uids[m.id] == 0 {
+			missing = true
+		}
+	}
+	if missing && mb.exists() {
+		if uids, err = mb.assignUids(found); err != nil {
+			return err
+		}
+	} else if missing {
+		// Nothing delivered yet
+		mb.uidValidity, mb.uidNext = newUidValidity(), 1
+	}
+
+	// Messages we had keep what was read from their header
+	cached := make(map[string]*MaildirMessage, len(mb.messages))
+	for _, m := range mb.messages {
+		cached[m.id] = m
+	}
+	for i, m := range found {
+		m.uid = uids[m.id]
+		m.flags, _ = parseMaildirInfo(m.info, mb.keywords)
+		if r := mb.results[m.id]; r != nil {
+			m.auth, m.spam = r.Auth, r.Spam
+		}
+		if old := cached[m.id]; old != nil {
+			old.uid, old.dir, old.info, old.flags = m.uid, m.dir, m.info, m.flags
+			if m.auth != nil || m.spam != nil {
+				// A message being delivered is not saved in MAILDIR_RESULTS yet
+				old.auth, old.spam = m.auth, m.spam
+			}
+			found[i] = old
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].uid < found[j].uid })
+	mb.messages = found
+	mb.loaded = true
+	return nil
+}
+
+// list reads the message files in new and cur, a Maildir not yet created has
+// none
+func (mb *MaildirMailbox) list() ([]*MaildirMessage, error) {
+	found := make([]*MaildirMessage, 0, len(mb.messages))
+	for _, dir := range []string{MAILDIR_NEW, MAILDIR_CUR} {
+		infos, err := ioutil.ReadDir(filepath.Join(mb.path, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, inf := range infos {
+			if inf.IsDir() || strings.HasPrefix(inf.Name(), ".") {
+				continue
+			}
+			id, info := splitMaildirName(inf.Name())
+			found = append(found, &MaildirMessage{mailbox: mb, id: id, dir: dir, info: info,
+				date: inf.ModTime(), size: inf.Size()})
+		}
+	}
+	return found, nil
+}
+
+// splitMaildirName separates the unique part of a message file name, which
+// we use as its ID, from the info part after the ":"
+func splitMaildirName(name string) (id string, info string) {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// readUidlist reads dovecot-uidlist, version 3 of its format has a header
+// line with the UID validity and next UID as V and N fields, then for each
+// message its UID, any extension fields and ":" before its file name
+func (mb *MaildirMailbox) readUidlist() (map[string]uint32, error) {
+	file, err := os.Open(filepath.Join(mb.path, MAILDIR_UIDLIST))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("Empty %v in %v", MAILDIR_UIDLIST, mb)
+	}
+	header := strings.Fields(scanner.Text())
+	if len(header) == 0 || header[0] != "3" {
+		log.LogWarn("Ignoring %v in %v: %v", MAILDIR_UIDLIST, mb, errUidlistVersion)
+		return nil, os.ErrNotExist
+	}
+	var validity, next uint64
+	for _, field := range header[1:] {
+		switch field[0] {
+		case 'V':
+			validity, err = strconv.ParseUint(field[1:], 10, 32)
+		case 'N':
+			next, err = strconv.ParseUint(field[1:], 10, 32)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("While reading %v in %v: %v", MAILDIR_UIDLIST, mb, err)
+		}
+	}
+	if validity == 0 || next == 0 {
+		return nil, fmt.Errorf("No UID validity in %v in %v", MAILDIR_UIDLIST, mb)
+	}
+
+	uids := make(map[string]uint32)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, " :")
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(line[:i])
+		if len(fields) == 0 {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || uid == 0 {
+			continue
+		}
+		uids[line[i+2:]] = uint32(uid)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	mb.uidValidity, mb.uidNext = uint32(validity), uint32(next)
+	return uids, nil
+}
+
+// assignUids gives the messages in found without a UID the next ones, in
+// order of file name as Dovecot does, and writes dovecot-uidlist
+func (mb *MaildirMailbox) assignUids(found []*MaildirMessage) (map[string]uint32, error) {
+	lock, err := mb.lockUidlist()
+	if err != nil {
+		return nil, err
+	}
+	// Read again now nobody else can change it
+	uids, err := mb.readUidlist()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			mb.unlockUidlist(lock)
+			return nil, err
+		}
+		uids = make(map[string]uint32)
+		mb.uidValidity, mb.uidNext = newUidValidity(), 1
+	}
+	ids := make([]string, 0, len(found))
+	for _, m := range found {
+		ids = append(ids, m.id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if uids[id] == 0 {
+			uids[id] = mb.uidNext
+			mb.uidNext++
+		}
+	}
+
+	// Messages that are gone are dropped from the list
+	w := bufio.NewWriter(lock)
+	fmt.Fprintf(w, "3 V%v N%v\n", mb.uidValidity, mb.uidNext)
+	sort.Slice(ids, func(i, j int) bool { return uids[ids[i]] < uids[ids[j]] })
+	for _, id := range ids {
+		fmt.Fprintf(w, "%v :%v\n", uids[id], id)
+	}
+	if err = w.Flush(); err != nil {
+		mb.unlockUidlist(lock)
+		return nil, err
+	}
+	if err = lock.Close(); err != nil {
+		os.Remove(lock.Name())
+		return nil, err
+	}
+	// Replacing the list releases the lock
+	if err = os.Rename(lock.Name(), filepath.Join(mb.path, MAILDIR_UIDLIST)); err != nil {
+		os.Remove(lock.Name())
+		return nil, err
+	}
+	return uids, nil
+}
+
+// lockUidlist takes the dotlock Dovecot uses for dovecot-uidlist, waiting for
+// another holder and breaking a lock left behind by one that went away
+func (mb *MaildirMailbox) lockUidlist() (*os.File, error) {
+	path := filepath.Join(mb.path, MAILDIR_UIDLIST+".lock")
+	deadline := time.Now().Add(MAILDIR_LOCK_WAIT)
+	for {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+		if err == nil {
+			return file, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if inf, err := os.Stat(path); err == nil && time.Since(inf.ModTime()) > MAILDIR_LOCK_STALE {
+			log.LogWarn("Removing stale lock %v", path)
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for %v", path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// unlockUidlist gives up the dotlock without changing dovecot-uidlist
+func (mb *MaildirMailbox) unlockUidlist(lock *os.File) {
+	lock.Close()
+	os.Remove(lock.Name())
+}
+
+// readKeywords reads dovecot-keywords, each line of which pairs the index of a
+// flag letter from "a" with the keyword it stands for
+func (mb *MaildirMailbox) readKeywords() error {
+	mb.keywords = mb.keywords[:0]
+	file, err := os.Open(filepath.Join(mb.path, MAILDIR_KEYWORDS))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		i, err := strconv.Atoi(fields[0])
+		if err != nil || i < 0 || i >= MAILDIR_MAX_KEYWORDS {
+			continue
+		}
+		for len(mb.keywords) <= i {
+			mb.keywords = append(mb.keywords, "")
+		}
+		mb.keywords[i] = fields[1]
+	}
+	return scanner.Err()
+}
+
+// addKeywords gives letters to the keywords in flags that have none yet.
+// Called with maildirLock held.
+func (mb *MaildirMailbox) addKeywords(flags []string) error {
+	added := false
+	for _, flag := range flags {
+		if !strings.HasPrefix(flag, `\`) && keywordIndex(mb.keywords, flag) < 0 {
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+
+	lock, err := mb.lockUidlist()
+	if err != nil {
+		return err
+	}
+	defer mb.unlockUidlist(lock)
+	// Read again now nobody else can change it
+	if err = mb.readKeywords(); err != nil {
+		return err
+	}
+	for _, flag := range flags {
+		if strings.HasPrefix(flag, `\`) || keywordIndex(mb.keywords, flag) >= 0 {
+			continue
+		}
+		i := keywordIndex(mb.keywords, "")
+		if i < 0 {
+			if len(mb.keywords) >= MAILDIR_MAX_KEYWORDS {
+				return ErrTooManyKeywords
+			}
+			i = len(mb.keywords)
+			mb.keywords = append(mb.keywords, "")
+		}
+		mb.keywords[i] = flag
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(mb.path, MAILDIR_TMP), MAILDIR_KEYWORDS)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for i, keyword := range mb.keywords {
+		if keyword != "" {
+			fmt.Fprintf(w, "%v %v\n", i, keyword)
+		}
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(mb.path, MAILDIR_KEYWORDS))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// keywordIndex returns the index of keyword, compared without regard to case,
+// or -1
+func keywordIndex(keywords []string, keyword string) int {
+	for i, k := range keywords {
+		if strings.EqualFold(k, keyword) {
+			return i
+		}
+	}
+	return -1
+}
+
+// readResults reads MAILDIR_RESULTS, a JSON object of the verdicts for each
+// message ID
+func (mb *MaildirMailbox) readResults() error {
+	mb.results = make(map[string]*maildirResults)
+	data, err := ioutil.ReadFile(filepath.Join(mb.path, MAILDIR_RESULTS))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err = json.Unmarshal(data, &mb.results); err != nil {
+		log.LogWarn("Ignoring %v in %v: %v", MAILDIR_RESULTS, mb, err)
+	}
+	return nil
+}
+
+// saveResults records the verdicts for m, dropping those of messages that
+// are gone.  Called with maildirLock held after a sync.
+func (mb *MaildirMailbox) saveResults(m *MaildirMessage) error {
+	r := m.results()
+	if r == nil && mb.results[m.id] == nil {
+		return nil
+	}
+	results := make(map[string]*maildirResults, len(mb.messages))
+	for _, mm := range mb.messages {
+		if mm.id == m.id {
+			if r != nil {
+				results[mm.id] = r
+			}
+		} else if old := mb.results[mm.id]; old != nil {
+			results[mm.id] = old
+		}
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(mb.path, MAILDIR_TMP), MAILDIR_RESULTS)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(mb.path, MAILDIR_RESULTS))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	mb.results = results
+	return nil
+}
+
+// root returns the mailbox the folder mb belongs to, mb itself for the INBOX
+func (mb *MaildirMailbox) root() *MaildirMailbox {
+	if mb.inbox != nil {
+		return mb.inbox
+	}
+	return mb
+}
+
+// checkMaildirFolder returns ErrBadFolderName unless name may be used for a
+// folder, Maildir++ separates levels with "." so none may contain one
+func checkMaildirFolder(name string) error {
+	if err := CheckFolderName(name); err != nil {
+		return err
+	}
+	if strings.Contains(name, ".") {
+		return ErrBadFolderName
+	}
+	return nil
+}
+
+// folderMailbox returns the MaildirMailbox for the named folder, whether or
+// not it exists
+func (mb *MaildirMailbox) folderMailbox(name string) *MaildirMailbox {
+	root := mb.root()
+	dir := "." + strings.Replace(name, "/", ".", -1)
+	return &MaildirMailbox{store: root.store, name: root.name, folder: name, inbox: root,
+		path: filepath.Join(root.path, dir)}
+}
+
+// Folders lists the folders of the mailbox in order of name
+func (mb *MaildirMailbox) Folders() ([]string, error) {
+	infos, err := ioutil.ReadDir(mb.root().path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	folders := make([]string, 0, len(infos))
+	for _, inf := range infos {
+		dir := inf.Name()
+		if !inf.IsDir() || !strings.HasPrefix(dir, ".") {
+			continue
+		}
+		name := strings.Replace(dir[1:], ".", "/", -1)
+		if CheckFolderName(name) != nil {
+			log.LogWarn("Ignoring folder directory %v in %v", dir, mb.root())
+			continue
+		}
+		folders = append(folders, name)
+	}
+	sort.Strings(folders)
+	return folders, nil
+}
+
+// Folder opens the named folder of the mailbox
+func (mb *MaildirMailbox) Folder(name string) (Mailbox, error) {
+	if IsInbox(name) {
+		return mb.root(), nil
+	}
+	if err := checkMaildirFolder(name); err != nil {
+		return nil, err
+	}
+	folder := mb.folderMailbox(name)
+	if !folder.exists() {
+		return nil, ErrFolderNotExist
+	}
+	return folder, nil
+}
+
+// CreateFolder creates the named folder, and the folders above it in the
+// hierarchy that do not exist yet
+func (mb *MaildirMailbox) CreateFolder(name string) (Mailbox, error) {
+	if IsInbox(name) {
+		return nil, ErrFolderExists
+	}
+	if err := checkMaildirFolder(name); err != nil {
+		return nil, err
+	}
+	folder := mb.folderMailbox(name)
+	if folder.exists() {
+		return nil, ErrFolderExists
+	}
+
+	maildirLock.Lock()
+	defer maildirLock.Unlock()
+	// Folders live inside the Maildir of the INBOX
+	if err := mb.root().create(); err != nil {
+		return nil, err
+	}
+	levels := strings.Split(name, "/")
+	for i := 1; i <= len(levels); i++ {
+		if err := mb.folderMailbox(strings.Join(levels[:i], "/")).create(); err != nil {
+			return nil, err
+		}
+	}
+	log.LogTrace("Created folder %v", folder)
+	return folder, nil
+}
+
+// RenameFolder renames the named folder and those beneath it, creating any
+// missing folders above the new name
+func (mb *MaildirMailbox) RenameFolder(name string, newName string) error {
+	if IsInbox(name) || IsInbox(newName) {
+		return ErrBadFolderName
+	}
+	if err := checkMaildirFolder(name); err != nil {
+		return err
+	}
+	if err := checkMaildirFolder(newName); err != nil {
+		return err
+	}
+	if !mb.folderMailbox(name).exists() {
+		return ErrFolderNotExist
+	}
+	if mb.folderMailbox(newName).exists() {
+		return ErrFolderExists
+	}
+	folders, err := mb.Folders()
+	if err != nil {
+		return err
+	}
+
+	maildirLock.Lock()
+	defer maildirLock.Unlock()
+	levels := strings.Split(newName, "/")
+	for i := 1; i < len(levels); i++ {
+		if err = mb.folderMailbox(strings.Join(levels[:i], "/")).create(); err != nil {
+			return err
+		}
+	}
+	for _, folder := range folders {
+		if folder != name && !strings.HasPrefix(folder, name+"/") {
+			continue
+		}
+		to := newName + folder[len(name):]
+		if checkMaildirFolder(to) != nil {
+			return fmt.Errorf("Cannot rename folder %v to %v", folder, to)
+		}
+		err = os.Rename(mb.folderMailbox(folder).path, mb.folderMailbox(to).path)
+		if err != nil {
+			return err
+		}
+	}
+	log.LogTrace("Renamed folder %v of %v to %v", name, mb.root(), newName)
+	return nil
+}
+
+// DeleteFolder removes the named folder with its messages, Maildir++ keeps
+// folders side by side so those beneath it are untouched
+func (mb *MaildirMailbox) DeleteFolder(name string) error {
+	if IsInbox(name) {
+		return ErrBadFolderName
+	}
+	if err := checkMaildirFolder(name); err != nil {
+		return err
+	}
+	folder := mb.folderMailbox(name)
+	if !folder.exists() {
+		return ErrFolderNotExist
+	}
+
+	maildirLock.Lock()
+	defer maildirLock.Unlock()
+	log.LogTrace("Removing folder %v", folder)
+	return os.RemoveAll(folder.path)
+}
+
+// MoveMessage moves the message with id to dest, its file keeps its name and
+// so the message keeps its ID and flags, but it is given a new UID
+func (mb *MaildirMailbox) MoveMessage(id string, dest Mailbox) (Message, error) {
+	to, ok := dest.(*MaildirMailbox)
+	if !ok || to.store != mb.store {
+		return nil, fmt.Errorf("Cannot move messages from %v to %v", mb, dest)
+	}
+	found, err := mb.GetMessage(id)
+	if err != nil {
+		return nil, err
+	}
+	if to.path == mb.path {
+		return found, nil
+	}
+	m := found.(*MaildirMessage)
+
+	maildirLock.Lock()
+	defer maildirLock.Unlock()
+	if err = to.create(); err != nil {
+		return nil, err
+	}
+	if err = m.locate(); err != nil {
+		return nil, err
+	}
+	name := m.id
+	if m.info != "" {
+		name += ":" + m.info
+	}
+	if err = os.Rename(m.path(), filepath.Join(to.path, m.dir, name)); err != nil {
+		return nil, err
+	}
+	mb.remove(m)
+
+	// Keywords are named separately in each Maildir
+	if err = to.sync(); err != nil {
+		return nil, err
+	}
+	moved := to.find(id)
+	if moved == nil {
+		return nil, ErrNotExist
+	}
+	if !sameFlags(moved.flags, m.flags) {
+		if err = moved.rename(m.flags); err != nil {
+			return nil, err
+		}
+	}
+	moved.auth, moved.spam = m.auth, m.spam
+	if err = to.saveResults(moved); err != nil {
+		return nil, err
+	}
+	log.LogTrace("Moved %v from %v to %v", moved, mb, to)
+	return moved, nil
+}
+
+// sameFlags reports whether a and b hold the same flags in any order
+func sameFlags(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, f := range a {
+		if !containsFlag(b, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// remove takes m out of the list of messages
+func (mb *MaildirMailbox) remove(m *MaildirMessage) {
+	for i, mm := range mb.messages {
+		if mm.id == m.id {
+			mb.messages = append(mb.messages[:i], mb.messages[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package smtpd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/egggo/inbucket/log"
+	"github.com/jhillyerd/go.enmime"
+)
+
+// Keywords are flag letters "a" to "z" in Maildir file names
+const MAILDIR_MAX_KEYWORDS = 26
+
+// ErrTooManyKeywords is returned when a Maildir has no letter left for a new
+// keyword
+var ErrTooManyKeywords = errors.New("Too many keywords in mailbox")
+
+// maildirFlags pairs the info letters of Maildir file names with the system
+// flags they stand for.  P (passed) has no IMAP flag and is kept as found.
+var maildirFlags = map[byte]string{'D': `\Draft`, 'F': `\Flagged`, 'R': `\Answered`,
+	'S': `\Seen`, 'T': `\Deleted`}
+
+// Host name for the unique names of the messages we deliver, "/" and ":" are
+// escaped as the Maildir specification asks
+var maildirHost = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+}()
+
+// MaildirMessage is a message file in the new or cur directory of a Maildir,
+// its ID is the unique part of the file name before the flags
+type MaildirMessage struct {
+	mailbox *MaildirMailbox
+	id      string
+	uid     uint32
+	dir     string
+	info    string
+	date    time.Time
+	size    int64
+	flags   []string
+	// Verdicts reached when we received the message
+	auth *AuthResults
+	spam *SpamResult
+	// Read from the header when first asked for
+	summary *maildirSummary
+	// These are for creating new messages only
+	writable   bool
+	writerFile *os.File
+	writer     *bufio.Writer
+}
+
+// maildirSummary holds what the file backend keeps in its index
+type maildirSummary struct {
+	from    string
+	subject string
+}
+
+// newMaildirName returns a unique file name in the form Dovecot uses, from the
+// time, process ID and a counter
+func newMaildirName(date time.Time) string {
+	return fmt.Sprintf("%v.M%vP%vQ%v.%v", date.Unix(), date.Nanosecond()/1000, os.Getpid(),
+		<-countChannel, maildirHost)
+}
+
+// parseMaildirInfo returns the flags set in the info part of a file name, and
+// the letters it does not know
+func parseMaildirInfo(info string, keywords []string) (flags []string, extra string) {
+	if !strings.HasPrefix(info, "2,") {
+		return []string{}, ""
+	}
+	flags = make([]string, 0, len(info)-2)
+	for i := 2; i < len(info); i++ {
+		c := info[i]
+		if flag, ok := maildirFlags[c]; ok {
+			flags = append(flags, flag)
+		} else if n := int(c - 'a'); c >= 'a' && n < len(keywords) && keywords[n] != "" {
+			flags = append(flags, keywords[n])
+		} else {
+			extra += string(c)
+		}
+	}
+	return flags, extra
+}
+
+// NewMessage creates a new Message object and sets the Date and Id fields.
+// It will also delete messages over messageCap if configured.
+func (mb *MaildirMailbox) NewMessage() (Message, error) {
+	if err := mb.load(); err != nil {
+		return nil, err
+	}
+
+	// Delete old messages over messageCap
+	if mb.store.messageCap > 0 {
+		for len(mb.messages) >= mb.store.messageCap {
+			log.LogInfo("Mailbox %q over configured message cap", mb.name)
+			if err := mb.messages[0].Delete(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	date := time.Now()
+	return &MaildirMessage{mailbox: mb, id: newMaildirName(date), date: date, flags: []string{},
+		writable: true}, nil
+}
+
+func (m *MaildirMessage) Id() string {
+	return m.id
+}
+
+func (m *MaildirMessage) Uid() uint32 {
+	return m.uid
+}
+
+// Date returns the time the message was delivered, the modification time of
+// its file as in Dovecot
+func (m *MaildirMessage) Date() time.Time {
+	return m.date
+}
+
+func (m *MaildirMessage) From() string {
+	return m.summarize().from
+}
+
+func (m *MaildirMessage) Subject() string {
+	return m.summarize().subject
+}
+
+func (m *MaildirMessage) String() string {
+	return fmt.Sprintf("\"%v\" from %v", m.Subject(), m.From())
+}
+
+func (m *MaildirMessage) Size() int64 {
+	return m.size
+}
+
+// AuthResults returns the DKIM, SPF and DMARC verdicts recorded when the
+// message was received, or nil if it was not verified
+func (m *MaildirMessage) AuthResults() *AuthResults {
+	return m.auth
+}
+
+// SetAuthResults records the verdicts reached when the message was received,
+// they are saved when it is closed
+func (m *MaildirMessage) SetAuthResults(results *AuthResults) {
+	m.auth = results
+}
+
+// results returns the verdicts to save for the message, or nil if it has
+// none
+func (m *MaildirMessage) results() *maildirResults {
+	if m.auth == nil && m.spam == nil {
+		return nil
+	}
+	return &maildirResults{Auth: m.auth, Spam: m.spam}
+}
+
+// SpamResult returns the spam score recorded when the message was received,
+// or nil if it was not scored
+func (m *MaildirMessage) SpamResult() *SpamResult {
+	return m.spam
+}
+
+// SetSpamResult records the spam score given when the message was received,
+// it is saved when it is closed
+func (m *MaildirMessage) SetSpamResult(result *SpamResult) {
+	m.spam = result
+}
+
+// summarize reads the header fields the file backend keeps in its index, a
+// message that cannot be read has an empty summary.  Verdicts are never read
+// from the header, anybody could have written one.
+func (m *MaildirMessage) summarize() *maildirSummary {
+	if m.summary != nil {
+		return m.summary
+	} else if m.writable {
+		// Nothing to read until the message is closed
+		return new(maildirSummary)
+	}
+	m.summary = new(maildirSummary)
+	msg, err := m.ReadHeader()
+	if err != nil {
+		log.LogWarn("Failed to read header of %v in %v: %v", m.id, m.mailbox, err)
+		return m.summary
+	}
+	dec := new(mime.WordDecoder)
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{{"From", &m.summary.from}, {"Subject", &m.summary.subject}} {
+		*f.value = msg.Header.Get(f.name)
+		if d, err := dec.DecodeHeader(*f.value); err == nil {
+			*f.value = d
+		}
+	}
+	return m.summary
+}
+
+// Flags returns the system flags and keywords set on the message
+func (m *MaildirMessage) Flags() []string {
+	return m.flags
+}
+
+// SetFlags replaces the flags of the message by renaming its file into cur.  A
+// message not yet closed keeps them until it is.
+func (m *MaildirMessage) SetFlags(flags []string) error {
+	flags, err := CanonicalFlags(flags)
+	if err != nil {
+		return err
+	}
+	if m.writable {
+		m.flags = flags
+		return nil
+	}
+	maildirLock.Lock()
+	defer maildirLock.Unlock()
+	return m.rename(flags)
+}
+
+// rename moves the message file into cur with the info letters for flags,
+// keeping those we do not know.  Called with maildirLock held.
+func (m *MaildirMessage) rename(flags []string) error {
+	mb := m.mailbox
+	if err := m.locate(); err != nil {
+		return err
+	}
+	if err := mb.addKeywords(flags); err != nil {
+		return err
+	}
+	_, extra := parseMaildirInfo(m.info, mb.keywords)
+	letters := []byte(extra)
+	for _, flag := range flags {
+		for c, f := range maildirFlags {
+			if f == flag {
+				letters = append(letters, c)
+			}
+		}
+		if !strings.HasPrefix(flag, `\`) {
+			letters = append(letters, byte('a'+keywordIndex(mb.keywords, flag)))
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	info := "2," + string(letters)
+
+	to := filepath.Join(mb.path, MAILDIR_CUR, m.id+":"+info)
+	if err := os.Rename(m.path(), to); err != nil {
+		return err
+	}
+	m.dir, m.info, m.flags = MAILDIR_CUR, info, flags
+	return nil
+}
+
+// locate finds the file of the message again after another program has
+// renamed it to change its flags.  Called with maildirLock held.
+func (m *MaildirMessage) locate() error {
+	if _, err := os.Stat(m.path()); !os.IsNotExist(err) {
+		return err
+	}
+	found, err := m.mailbox.list()
+	if err != nil {
+		return err
+	}
+	for _, f := range found {
+		if f.id == m.id {
+			m.dir, m.info = f.dir, f.info
+			m.flags, _ = parseMaildirInfo(f.info, m.mailbox.keywords)
+			return nil
+		}
+	}
+	m.mailbox.remove(m)
+	return ErrNotExist
+}
+
+// path returns the path to the message file, in tmp while it is written
+func (m *MaildirMessage) path() string {
+	if m.writable {
+		return filepath.Join(m.mailbox.path, MAILDIR_TMP, m.id)
+	}
+	name := m.id
+	if m.info != "" {
+		name += ":" + m.info
+	}
+	return filepath.Join(m.mailbox.path, m.dir, name)
+}
+
+// open opens the message file, looking for it again if it has been renamed
+func (m *MaildirMessage) open() (*os.File, error) {
+	file, err := os.Open(m.path())
+	if os.IsNotExist(err) && !m.writable {
+		maildirLock.Lock()
+		err = m.locate()
+		maildirLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		file, err = os.Open(m.path())
+	}
+	return file, err
+}
+
+// ReadHeader opens the message file and returns a standard Go mail.Message object
+func (m *MaildirMessage) ReadHeader() (msg *mail.Message, err error) {
+	file, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return mail.ReadMessage(bufio.NewReader(file))
+}
+
+// ReadBody opens the message file and returns a MIMEBody object
+func (m *MaildirMessage) ReadBody() (body *enmime.MIMEBody, err error) {
+	file, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	msg, err := mail.ReadMessage(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	return enmime.ParseMIMEBody(msg)
+}
+
+// RawReader opens the message file as an io.ReadCloser
+func (m *MaildirMessage) RawReader() (reader io.ReadCloser, err error) {
+	return m.open()
+}
+
+// ReadRaw reads the message file and returns it as a string
+func (m *MaildirMessage) ReadRaw() (raw *string, err error) {
+	reader, err := m.RawReader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	bodyBytes, err := ioutil.ReadAll(bufio.NewReader(reader))
+	if err != nil {
+		return nil, err
+	}
+	bodyString := string(bodyBytes)
+	return &bodyString, nil
+}
+
+// Append data to a newly opened Message, it is written to tmp until Close.
+// This will fail on a pre-existing Message and after Close() is called.
+func (m *MaildirMessage) Append(data []byte) error {
+	// Prevent Appending to a pre-existing Message
+	if !m.writable {
+		return ErrNotWritable
+	}
+	// Open file for writing if we haven't yet
+	if m.writer == nil {
+		maildirLock.Lock()
+		err := m.mailbox.create()
+		maildirLock.Unlock()
+		if err != nil {
+			return err
+		}
+		file, err := os.Create(m.path())
+		if err != nil {
+			// Set writable false just in case something calls me a million times
+			m.writable = false
+			return err
+		}
+		m.writerFile = file
+		m.writer = bufio.NewWriter(file)
+	}
+	_, err := m.writer.Write(data)
+	m.size += int64(len(data))
+	return err
+}
+
+// Close this Message for writing - no more data may be Appended.  The file is
+// moved from tmp into new, or into cur if flags were set on the message.
+func (m *MaildirMessage) Close() error {
+	// nil out the writer fields so they can't be used
+	writer := m.writer
+	writerFile := m.writerFile
+	m.writer = nil
+	m.writerFile = nil
+
+	if writer == nil {
+		return ErrNotWritable
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := writerFile.Close(); err != nil {
+		return err
+	}
+	tmp := m.path()
+	if err := os.Chtimes(tmp, m.date, m.date); err != nil {
+		return err
+	}
+
+	maildirLock.Lock()
+	defer maildirLock.Unlock()
+	m.writable = false
+	m.dir = MAILDIR_NEW
+	if err := os.Rename(tmp, m.path()); err != nil {
+		return err
+	}
+	if len(m.flags) > 0 {
+		// Delivered into new with no info, then given its flags
+		if err := m.rename(m.flags); err != nil {
+			return err
+		}
+	}
+
+	// Made it this far without errors, give it a UID
+	mb := m.mailbox
+	mb.messages = append(mb.messages, m)
+	if err := mb.sync(); err != nil {
+		return err
+	}
+	if mb.find(m.id) != m {
+		return ErrNotExist
+	}
+	return mb.saveResults(m)
+}
+
+// Delete this Message by removing its file
+func (m *MaildirMessage) Delete() error {
+	maildirLock.Lock()
+	defer maildirLock.Unlock()
+	if err := m.locate(); err != nil {
+		return err
+	}
+	log.LogTrace("Deleting %v", m.path())
+	m.mailbox.remove(m)
+	return os.Remove(m.path())
+}
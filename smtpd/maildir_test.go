@@ -0,0 +1,281 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test Maildir layout and dovecot-uidlist written by the maildir backend
+func TestMaildirDeliver(t *testing.T) {
+	ds, logbuf := setupMaildir(config.DataStoreConfig{})
+	defer os.RemoveAll(ds.path)
+
+	mbPath := filepath.Join(ds.path, "james")
+	assert.False(t, isDir(mbPath), "Expected %q to not exist", mbPath)
+
+	id1 := deliverMaildir(ds, "james", "test 1")
+	id2 := deliverMaildir(ds, "James+tag", "=?utf-8?q?test_2?=")
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		expect := filepath.Join(mbPath, dir)
+		assert.True(t, isDir(expect), "Expected %q to be a directory", expect)
+	}
+	expect := filepath.Join(mbPath, "new", id1)
+	assert.True(t, isFile(expect), "Expected %q to be a file", expect)
+
+	data, err := ioutil.ReadFile(filepath.Join(mbPath, "dovecot-uidlist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	assert.Regexp(t, `^3 V\d+ N3$`, lines[0])
+	assert.Equal(t, []string{"1 :" + id1, "2 :" + id2, ""}, lines[1:])
+
+	mb, _ := ds.MailboxFor("james")
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 2, len(msgs)) {
+		assert.Equal(t, id1, msgs[0].Id())
+		assert.Equal(t, uint32(1), msgs[0].Uid())
+		assert.Equal(t, "test 1", msgs[0].Subject())
+		assert.Equal(t, "somebodyelse@host", msgs[0].From())
+		assert.Equal(t, "test 2", msgs[1].Subject())
+		assert.Equal(t, uint32(2), msgs[1].Uid())
+		raw, err := msgs[1].ReadRaw()
+		if assert.Nil(t, err) {
+			assert.True(t, strings.HasSuffix(*raw, "Test Body\r\n"))
+			assert.Equal(t, int64(len(*raw)), msgs[1].Size())
+		}
+	}
+	next, _ := mb.UidNext()
+	assert.Equal(t, uint32(3), next)
+
+	// Deleting keeps the Maildir and the UIDs
+	assert.Nil(t, mb.Purge())
+	mb, _ = ds.MailboxFor("james")
+	msgs, _ = mb.GetMessages()
+	assert.Equal(t, 0, len(msgs))
+	next, _ = mb.UidNext()
+	assert.Equal(t, uint32(3), next)
+
+	if t.Failed() {
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test that messages left by other programs are given UIDs and flags
+func TestMaildirForeign(t *testing.T) {
+	ds, logbuf := setupMaildir(config.DataStoreConfig{})
+	defer os.RemoveAll(ds.path)
+
+	id1 := deliverMaildir(ds, "james", "ours")
+	mbPath := filepath.Join(ds.path, "james")
+	ioutil.WriteFile(filepath.Join(mbPath, "dovecot-keywords"), []byte("0 $Label1\n2 Junk\n"), 0660)
+	msg := []byte("Subject: theirs\r\n\r\nBody\r\n")
+	ioutil.WriteFile(filepath.Join(mbPath, "new", "1500000000.M1P2.other"), msg, 0660)
+	ioutil.WriteFile(filepath.Join(mbPath, "cur", "1400000000.M1P2.other,S=25:2,PSc"), msg, 0660)
+	ioutil.WriteFile(filepath.Join(mbPath, "tmp", "1600000000.M1P2.other"), msg, 0660)
+
+	mb, _ := ds.MailboxFor("james")
+	msgs, err := mb.GetMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 3, len(msgs)) {
+		assert.Equal(t, id1, msgs[0].Id())
+		assert.Equal(t, "1400000000.M1P2.other,S=25", msgs[1].Id())
+		assert.Equal(t, uint32(2), msgs[1].Uid())
+		assert.Equal(t, []string{`\Seen`, "Junk"}, msgs[1].Flags())
+		assert.Equal(t, "theirs", msgs[1].Subject())
+		assert.Equal(t, "1500000000.M1P2.other", msgs[2].Id())
+		assert.Equal(t, uint32(3), msgs[2].Uid())
+		assert.Equal(t, []string{}, msgs[2].Flags())
+	}
+
+	// Unknown letters are kept, new keywords take a free letter
+	assert.Nil(t, msgs[1].SetFlags([]string{`\Answered`, "junk", "$label1", "todo"}))
+	expect := filepath.Join(mbPath, "cur", "1400000000.M1P2.other,S=25:2,PRabc")
+	assert.True(t, isFile(expect), "Expected %q to be a file", expect)
+	data, _ := ioutil.ReadFile(filepath.Join(mbPath, "dovecot-keywords"))
+	assert.Equal(t, "0 $Label1\n1 todo\n2 Junk\n", string(data))
+
+	// Renamed behind our back
+	os.Rename(filepath.Join(mbPath, "new", "1500000000.M1P2.other"),
+		filepath.Join(mbPath, "cur", "1500000000.M1P2.other:2,S"))
+	_, err = msgs[2].ReadHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{`\Seen`}, msgs[2].Flags())
+	assert.Nil(t, AddFlags(msgs[2], `\Flagged`))
+	expect = filepath.Join(mbPath, "cur", "1500000000.M1P2.other:2,FS")
+	assert.True(t, isFile(expect), "Expected %q to be a file", expect)
+
+	mb, _ = ds.MailboxFor("james")
+	msg2, err := mb.GetMessage("1400000000.M1P2.other,S=25")
+	if assert.Nil(t, err) {
+		assert.Equal(t, uint32(2), msg2.Uid())
+		assert.Equal(t, []string{`\Answered`, "$Label1", "todo", "Junk"}, msg2.Flags())
+		assert.Nil(t, msg2.Delete())
+	}
+	msgs, _ = mb.GetMessages()
+	assert.Equal(t, 2, len(msgs))
+
+	if t.Failed() {
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test Maildir++ folders and moving messages between them
+func TestMaildirFolders(t *testing.T) {
+	ds, logbuf := setupMaildir(config.DataStoreConfig{})
+	defer os.RemoveAll(ds.path)
+
+	id1 := deliverMaildir(ds, "james", "test 1")
+	mb, _ := ds.MailboxFor("james")
+	mbPath := filepath.Join(ds.path, "james")
+
+	work, err := mb.CreateFolder("Work/Projects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{".Work", ".Work.Projects"} {
+		expect := filepath.Join(mbPath, dir, "maildirfolder")
+		assert.True(t, isFile(expect), "Expected %q to be a file", expect)
+		expect = filepath.Join(mbPath, dir, "dovecot-uidlist")
+		assert.True(t, isFile(expect), "Expected %q to be a file", expect)
+	}
+	_, err = mb.CreateFolder("Work")
+	assert.Equal(t, ErrFolderExists, err)
+	_, err = mb.CreateFolder("v1.0")
+	assert.Equal(t, ErrBadFolderName, err)
+	folders, _ := mb.Folders()
+	assert.Equal(t, []string{"Work", "Work/Projects"}, folders)
+
+	msg, _ := mb.GetMessage(id1)
+	assert.Nil(t, msg.SetFlags([]string{`\Seen`, "todo"}))
+	moved, err := mb.MoveMessage(id1, work)
+	if assert.Nil(t, err) {
+		assert.Equal(t, id1, moved.Id())
+		assert.Equal(t, uint32(1), moved.Uid())
+		assert.Equal(t, []string{`\Seen`, "todo"}, moved.Flags())
+	}
+	msgs, _ := mb.GetMessages()
+	assert.Equal(t, 0, len(msgs))
+	expect := filepath.Join(mbPath, ".Work.Projects", "cur", id1+":2,Sa")
+	assert.True(t, isFile(expect), "Expected %q to be a file", expect)
+
+	assert.Nil(t, mb.RenameFolder("Work", "Job"))
+	folders, _ = mb.Folders()
+	assert.Equal(t, []string{"Job", "Job/Projects"}, folders)
+	assert.Nil(t, mb.DeleteFolder("Job"))
+	folders, _ = mb.Folders()
+	assert.Equal(t, []string{"Job/Projects"}, folders)
+
+	all, err := ds.AllMailboxes()
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(all)) {
+		assert.Equal(t, "james[maildir]", all[0].String())
+		assert.Equal(t, "james/Job/Projects[maildir]", all[1].String())
+		msgs, _ = all[1].GetMessages()
+		assert.Equal(t, 1, len(msgs))
+	}
+
+	if t.Failed() {
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+// Test that verdicts are kept in MAILDIR_RESULTS and not read from the header
+func TestMaildirResults(t *testing.T) {
+	ds, logbuf := setupMaildir(config.DataStoreConfig{})
+	defer os.RemoveAll(ds.path)
+
+	mb, _ := ds.MailboxFor("james")
+	msg, _ := mb.NewMessage()
+	msg.Append([]byte("Authentication-Results: inbucket.local; dmarc=pass\r\n" +
+		"X-Spam-Status: No, score=-10.0 required=5.0\r\nSubject: forged\r\n\r\nBody\r\n"))
+	assert.Nil(t, msg.Close())
+	id1 := msg.Id()
+	auth := &AuthResults{Spf: "pass", SpfDomain: "example.com", Dmarc: "fail"}
+	spam := &SpamResult{Score: 6.2, Threshold: 5, Spam: true}
+	msg, _ = mb.NewMessage()
+	msg.SetAuthResults(auth)
+	msg.SetSpamResult(spam)
+	msg.Append([]byte("Subject: checked\r\n\r\nBody\r\n"))
+	assert.Nil(t, msg.Close())
+	id2 := msg.Id()
+
+	mb, _ = ds.MailboxFor("james")
+	msg1, _ := mb.GetMessage(id1)
+	assert.Nil(t, msg1.AuthResults())
+	assert.Nil(t, msg1.SpamResult())
+	msg2, _ := mb.GetMessage(id2)
+	assert.Equal(t, auth, msg2.AuthResults())
+	assert.Equal(t, spam, msg2.SpamResult())
+
+	work, _ := mb.CreateFolder("Work")
+	moved, err := mb.MoveMessage(id2, work)
+	if assert.Nil(t, err) {
+		assert.Equal(t, auth, moved.AuthResults())
+	}
+	mb, _ = ds.MailboxFor("james")
+	work, _ = mb.Folder("Work")
+	msg2, err = work.GetMessage(id2)
+	if assert.Nil(t, err) {
+		assert.Equal(t, auth, msg2.AuthResults())
+		assert.Equal(t, spam, msg2.SpamResult())
+	}
+
+	if t.Failed() {
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestMaildirName(t *testing.T) {
+	assert.Equal(t, "james", maildirName("james"))
+	assert.Equal(t, "%2e.%2fetc", maildirName("../etc"))
+	assert.Equal(t, "%2e", maildirName("."))
+	assert.Equal(t, "a%25b", maildirName("a%b"))
+}
+
+// setupMaildir creates a new MaildirDataStore in a temporary directory
+func setupMaildir(cfg config.DataStoreConfig) (*MaildirDataStore, *bytes.Buffer) {
+	path, err := ioutil.TempDir("", "inbucket")
+	if err != nil {
+		panic(err)
+	}
+
+	// Capture log output
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+
+	cfg.Path = path
+	return NewMaildirDataStore(cfg).(*MaildirDataStore), buf
+}
+
+// deliverMaildir delivers a test message to the named mailbox, returning its ID
+func deliverMaildir(ds *MaildirDataStore, mbName string, subject string) string {
+	mb, err := ds.MailboxFor(mbName)
+	if err != nil {
+		panic(err)
+	}
+	msg, err := mb.NewMessage()
+	if err != nil {
+		panic(err)
+	}
+	msg.Append([]byte(fmt.Sprintf("To: somebody@host\r\nFrom: somebodyelse@host\r\n"+
+		"Subject: %s\r\n\r\nTest Body\r\n", subject)))
+	if err = msg.Close(); err != nil {
+		panic(err)
+	}
+	return msg.Id()
+}
@@ -0,0 +1,608 @@
+package smtpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Milter protocol version we speak, as of Sendmail 8.14
+const MILTER_VERSION = 6
+
+// Largest body chunk we send in a single SMFIC_BODY packet
+const MILTER_CHUNK_SIZE = 65535
+
+// Commands sent from the MTA to the milter
+const (
+	SMFIC_ABORT   = 'A'
+	SMFIC_BODY    = 'B'
+	SMFIC_CONNECT = 'C'
+	SMFIC_MACRO   = 'D'
+	SMFIC_BODYEOB = 'E'
+	SMFIC_HELO    = 'H'
+	SMFIC_HEADER  = 'L'
+	SMFIC_MAIL    = 'M'
+	SMFIC_EOH     = 'N'
+	SMFIC_OPTNEG  = 'O'
+	SMFIC_QUIT    = 'Q'
+	SMFIC_RCPT    = 'R'
+	SMFIC_DATA    = 'T'
+)
+
+// Responses sent from the milter to the MTA
+const (
+	SMFIR_ADDRCPT    = '+'
+	SMFIR_DELRCPT    = '-'
+	SMFIR_ACCEPT     = 'a'
+	SMFIR_REPLBODY   = 'b'
+	SMFIR_CONTINUE   = 'c'
+	SMFIR_DISCARD    = 'd'
+	SMFIR_CHGFROM    = 'e'
+	SMFIR_ADDHEADER  = 'h'
+	SMFIR_INSHEADER  = 'i'
+	SMFIR_SETSYMLIST = 'l'
+	SMFIR_CHGHEADER  = 'm'
+	SMFIR_PROGRESS   = 'p'
+	SMFIR_QUARANTINE = 'q'
+	SMFIR_REJECT     = 'r'
+	SMFIR_SKIP       = 's'
+	SMFIR_TEMPFAIL   = 't'
+	SMFIR_REPLYCODE  = 'y'
+)
+
+// Actions a milter may take at end of message, we only offer header changes
+const (
+	SMFIF_ADDHDRS = 0x01
+	SMFIF_CHGHDRS = 0x10
+)
+
+// Protocol flags, a milter uses these to skip stages it has no interest in
+// (SMFIP_NO*) or to avoid replying to them (SMFIP_NR_*)
+const (
+	SMFIP_NOCONNECT = 0x01
+	SMFIP_NOHELO    = 0x02
+	SMFIP_NOMAIL    = 0x04
+	SMFIP_NORCPT    = 0x08
+	SMFIP_NOBODY    = 0x10
+	SMFIP_NOHDRS    = 0x20
+	SMFIP_NOEOH     = 0x40
+	SMFIP_NR_HDR    = 0x80
+	SMFIP_NOUNKNOWN = 0x100
+	SMFIP_NODATA    = 0x200
+	SMFIP_SKIP      = 0x400
+	SMFIP_NR_CONN   = 0x1000
+	SMFIP_NR_HELO   = 0x2000
+	SMFIP_NR_MAIL   = 0x4000
+	SMFIP_NR_RCPT   = 0x8000
+	SMFIP_NR_DATA   = 0x10000
+	SMFIP_NR_UNKN   = 0x20000
+	SMFIP_NR_EOH    = 0x40000
+	SMFIP_NR_BODY   = 0x80000
+)
+
+// The protocol flags we are able to honour
+const milterProtocol = SMFIP_NOCONNECT | SMFIP_NOHELO | SMFIP_NOMAIL | SMFIP_NORCPT |
+	SMFIP_NOBODY | SMFIP_NOHDRS | SMFIP_NOEOH | SMFIP_NR_HDR | SMFIP_NOUNKNOWN |
+	SMFIP_NODATA | SMFIP_SKIP | SMFIP_NR_CONN | SMFIP_NR_HELO | SMFIP_NR_MAIL |
+	SMFIP_NR_RCPT | SMFIP_NR_DATA | SMFIP_NR_UNKN | SMFIP_NR_EOH | SMFIP_NR_BODY
+
+// MilterResponse is the verdict of a milter for a stage of the session
+type MilterResponse struct {
+	Action byte
+	// SMTP reply text for SMFIR_REPLYCODE
+	Reply string
+}
+
+var milterContinue = &MilterResponse{Action: SMFIR_CONTINUE}
+
+// Rejected is true for responses that end the current session stage,
+// discard is handled separately as the client is told we accepted.
+func (r *MilterResponse) Rejected() bool {
+	switch r.Action {
+	case SMFIR_REJECT, SMFIR_TEMPFAIL, SMFIR_REPLYCODE:
+		return true
+	}
+	return false
+}
+
+// SmtpReply builds the reply to send to the SMTP client for a rejection,
+// what describes the thing being rejected
+func (r *MilterResponse) SmtpReply(what string) string {
+	switch r.Action {
+	case SMFIR_REPLYCODE:
+		return r.Reply
+	case SMFIR_TEMPFAIL:
+		return "451 4.7.1 Service unavailable - try again later"
+	}
+	return fmt.Sprintf("550 5.7.1 %v rejected", what)
+}
+
+// Temporary is true when the response asks the client to try again later
+func (r *MilterResponse) Temporary() bool {
+	if r.Action == SMFIR_REPLYCODE {
+		return strings.HasPrefix(r.Reply, "4")
+	}
+	return r.Action == SMFIR_TEMPFAIL
+}
+
+// MilterHeaderChange is a header modification requested at end of message
+type MilterHeaderChange struct {
+	// One of SMFIR_ADDHEADER, SMFIR_INSHEADER or SMFIR_CHGHEADER
+	Action byte
+	// Position for SMFIR_INSHEADER (0 is the top), occurrence of the named
+	// header for SMFIR_CHGHEADER (starting from 1)
+	Index int
+	Name  string
+	Value string
+}
+
+// Milter is a client connection to a single milter
+type Milter struct {
+	Socket   string
+	conn     net.Conn
+	timeout  time.Duration
+	version  uint32
+	actions  uint32
+	protocol uint32
+	// The milter accepted the connection, no further events are passed on
+	done bool
+	// The milter accepted or discarded the current message
+	skip bool
+	// Between MAIL and end of message
+	inMessage bool
+}
+
+// DialMilter connects to a milter listening on socket, given in Sendmail
+// notation: inet:host:port, inet6:host:port or unix:/path, and negotiates
+// the protocol options
+func DialMilter(socket string, timeout time.Duration) (*Milter, error) {
+	conn, err := DialSocket(socket, timeout)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMilter(socket, conn, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// newMilter negotiates with a milter over an established connection
+func newMilter(socket string, conn net.Conn, timeout time.Duration) (*Milter, error) {
+	m := &Milter{Socket: socket, conn: conn, timeout: timeout}
+	if err := m.negotiate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Milter) String() string {
+	return "milter " + m.Socket
+}
+
+// negotiate exchanges SMFIC_OPTNEG with the milter
+func (m *Milter) negotiate() error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:], MILTER_VERSION)
+	binary.BigEndian.PutUint32(data[4:], SMFIF_ADDHDRS|SMFIF_CHGHDRS)
+	binary.BigEndian.PutUint32(data[8:], milterProtocol)
+	if err := m.send(SMFIC_OPTNEG, data); err != nil {
+		return err
+	}
+	cmd, data, err := m.recv()
+	if err != nil {
+		return err
+	}
+	if cmd != SMFIC_OPTNEG || len(data) < 12 {
+		return fmt.Errorf("Bad option negotiation response %q from %v", cmd, m)
+	}
+	m.version = binary.BigEndian.Uint32(data[0:])
+	m.actions = binary.BigEndian.Uint32(data[4:])
+	m.protocol = binary.BigEndian.Uint32(data[8:])
+	if m.version < 2 {
+		return fmt.Errorf("Unsupported milter protocol version %v from %v", m.version, m)
+	}
+	if m.protocol&^milterProtocol != 0 {
+		return fmt.Errorf("Milter %v requested unsupported protocol flags %#x", m.Socket,
+			m.protocol&^milterProtocol)
+	}
+	return nil
+}
+
+// send writes a single packet: 32 bit length, command and data
+func (m *Milter) send(cmd byte, data []byte) error {
+	if err := m.conn.SetWriteDeadline(time.Now().Add(m.timeout)); err != nil {
+		return err
+	}
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = cmd
+	copy(packet[5:], data)
+	_, err := m.conn.Write(packet)
+	return err
+}
+
+// recv reads a single packet
+func (m *Milter) recv() (byte, []byte, error) {
+	if err := m.conn.SetReadDeadline(time.Now().Add(m.timeout)); err != nil {
+		return 0, nil, err
+	}
+	var length uint32
+	if err := binary.Read(m.conn, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 || length > 1024*1024 {
+		return 0, nil, fmt.Errorf("Bad packet length %v from %v", length, m)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(m.conn, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// response reads packets until the milter reaches a verdict
+func (m *Milter) response() (*MilterResponse, error) {
+	for {
+		cmd, data, err := m.recv()
+		if err != nil {
+			return nil, err
+		}
+		switch cmd {
+		case SMFIR_PROGRESS:
+			// The milter is still busy, keep waiting
+			continue
+		case SMFIR_ACCEPT, SMFIR_CONTINUE, SMFIR_DISCARD, SMFIR_REJECT, SMFIR_TEMPFAIL,
+			SMFIR_SKIP:
+			return &MilterResponse{Action: cmd}, nil
+		case SMFIR_REPLYCODE:
+			reply := strings.TrimRight(string(data), "\x00")
+			if len(reply) < 3 || (reply[0] != '4' && reply[0] != '5') {
+				return nil, fmt.Errorf("Bad reply code %q from %v", reply, m)
+			}
+			return &MilterResponse{Action: cmd, Reply: reply}, nil
+		}
+		return nil, fmt.Errorf("Unexpected response %q from %v", cmd, m)
+	}
+}
+
+// stage passes a session event to the milter, unless it asked to skip
+// that event, and waits for the verdict unless it asked not to reply
+func (m *Milter) stage(cmd byte, data []byte, noSend uint32, noReply uint32) (*MilterResponse, error) {
+	if m.protocol&noSend != 0 {
+		return milterContinue, nil
+	}
+	if err := m.send(cmd, data); err != nil {
+		return nil, err
+	}
+	if m.protocol&noReply != 0 {
+		return milterContinue, nil
+	}
+	return m.response()
+}
+
+// Macros defines the values of Sendmail macros for the next command, given
+// as name, value pairs
+func (m *Milter) Macros(cmd byte, pairs ...string) error {
+	if m.done || m.skip || len(pairs) == 0 {
+		return nil
+	}
+	return m.send(SMFIC_MACRO, append([]byte{cmd}, nulTerminate(pairs...)...))
+}
+
+// Connect describes the SMTP client to the milter
+func (m *Milter) Connect(hostname string, ip net.IP, port int) (*MilterResponse, error) {
+	if m.done {
+		return milterContinue, nil
+	}
+	data := nulTerminate(hostname)
+	switch {
+	case ip == nil:
+		data = append(data, 'U')
+	default:
+		family := byte('4')
+		if ip.To4() == nil {
+			family = '6'
+		}
+		data = append(data, family, byte(port>>8), byte(port))
+		data = append(data, nulTerminate(ip.String())...)
+	}
+	resp, err := m.stage(SMFIC_CONNECT, data, SMFIP_NOCONNECT, SMFIP_NR_CONN)
+	return m.verdict(resp, err, true)
+}
+
+// Helo passes the HELO/EHLO argument to the milter
+func (m *Milter) Helo(domain string) (*MilterResponse, error) {
+	if m.done {
+		return milterContinue, nil
+	}
+	resp, err := m.stage(SMFIC_HELO, nulTerminate(domain), SMFIP_NOHELO, SMFIP_NR_HELO)
+	return m.verdict(resp, err, true)
+}
+
+// Mail starts a new message with the envelope sender and ESMTP arguments
+func (m *Milter) Mail(from string, args ...string) (*MilterResponse, error) {
+	m.skip = false
+	if m.done {
+		return milterContinue, nil
+	}
+	m.inMessage = true
+	data := nulTerminate(append([]string{"<" + from + ">"}, args...)...)
+	resp, err := m.stage(SMFIC_MAIL, data, SMFIP_NOMAIL, SMFIP_NR_MAIL)
+	return m.verdict(resp, err, false)
+}
+
+// Rcpt passes a single envelope recipient to the milter
+func (m *Milter) Rcpt(to string) (*MilterResponse, error) {
+	if m.done || m.skip {
+		return milterContinue, nil
+	}
+	resp, err := m.stage(SMFIC_RCPT, nulTerminate("<"+to+">"), SMFIP_NORCPT, SMFIP_NR_RCPT)
+	return m.verdict(resp, err, false)
+}
+
+// Data tells the milter the client issued the DATA command
+func (m *Milter) Data() (*MilterResponse, error) {
+	if m.done || m.skip {
+		return milterContinue, nil
+	}
+	resp, err := m.stage(SMFIC_DATA, nil, SMFIP_NODATA, SMFIP_NR_DATA)
+	return m.verdict(resp, err, false)
+}
+
+// Message passes the message content to the milter: each header, end of
+// headers, the body, and finally end of message.  The header changes the
+// milter requested are returned along with the verdict.
+func (m *Milter) Message(msg []byte) (*MilterResponse, []*MilterHeaderChange, error) {
+	if m.done || m.skip {
+		return milterContinue, nil, nil
+	}
+
+	var resp *MilterResponse
+	var err error
+	headers, body := splitMessage(msg)
+	for _, field := range parseHeaderFields(headers) {
+		idx := strings.IndexByte(field, ':')
+		if idx < 0 {
+			continue
+		}
+		name := strings.TrimRight(field[:idx], " \t")
+		value := strings.TrimLeft(strings.TrimSuffix(field[idx+1:], "\r\n"), " \t")
+		value = strings.Replace(value, "\r\n", "\n", -1)
+		resp, err = m.stage(SMFIC_HEADER, nulTerminate(name, value), SMFIP_NOHDRS,
+			SMFIP_NR_HDR)
+		if resp, err = m.verdict(resp, err, false); err != nil || resp.Action != SMFIR_CONTINUE {
+			return resp, nil, err
+		}
+	}
+
+	resp, err = m.stage(SMFIC_EOH, nil, SMFIP_NOEOH, SMFIP_NR_EOH)
+	if resp, err = m.verdict(resp, err, false); err != nil || resp.Action != SMFIR_CONTINUE {
+		return resp, nil, err
+	}
+
+	for len(body) > 0 && m.protocol&SMFIP_NOBODY == 0 {
+		n := len(body)
+		if n > MILTER_CHUNK_SIZE {
+			n = MILTER_CHUNK_SIZE
+		}
+		resp, err = m.stage(SMFIC_BODY, body[:n], 0, SMFIP_NR_BODY)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.Action == SMFIR_SKIP {
+			// Milter has seen enough of the body
+			break
+		}
+		if resp, err = m.verdict(resp, nil, false); err != nil || resp.Action != SMFIR_CONTINUE {
+			return resp, nil, err
+		}
+		body = body[n:]
+	}
+
+	return m.endOfMessage()
+}
+
+// endOfMessage sends SMFIC_BODYEOB and collects modification requests until
+// the milter reaches its verdict
+func (m *Milter) endOfMessage() (*MilterResponse, []*MilterHeaderChange, error) {
+	if err := m.send(SMFIC_BODYEOB, nil); err != nil {
+		m.inMessage = false
+		return nil, nil, err
+	}
+	changes := make([]*MilterHeaderChange, 0)
+	for {
+		cmd, data, err := m.recv()
+		if err != nil {
+			m.inMessage = false
+			return nil, nil, err
+		}
+		switch cmd {
+		case SMFIR_ADDHEADER, SMFIR_INSHEADER, SMFIR_CHGHEADER:
+			if m.actions&(SMFIF_ADDHDRS|SMFIF_CHGHDRS) == 0 {
+				return nil, nil, fmt.Errorf("Unnegotiated header change from %v", m)
+			}
+		}
+		switch cmd {
+		case SMFIR_ADDHEADER:
+			fields := splitNul(data)
+			if len(fields) != 2 {
+				return nil, nil, fmt.Errorf("Bad add header request from %v", m)
+			}
+			changes = append(changes, &MilterHeaderChange{Action: cmd, Name: fields[0],
+				Value: fields[1]})
+			continue
+		case SMFIR_INSHEADER, SMFIR_CHGHEADER:
+			if len(data) < 4 {
+				return nil, nil, fmt.Errorf("Bad header change request from %v", m)
+			}
+			index := int(binary.BigEndian.Uint32(data))
+			fields := splitNul(data[4:])
+			if len(fields) != 2 {
+				return nil, nil, fmt.Errorf("Bad header change request from %v", m)
+			}
+			changes = append(changes, &MilterHeaderChange{Action: cmd, Index: index,
+				Name: fields[0], Value: fields[1]})
+			continue
+		case SMFIR_ADDRCPT, SMFIR_DELRCPT, SMFIR_REPLBODY, SMFIR_CHGFROM, SMFIR_QUARANTINE,
+			SMFIR_SETSYMLIST:
+			// We never offered these actions during negotiation
+			return nil, nil, fmt.Errorf("Unnegotiated action %q from %v", cmd, m)
+		case SMFIR_PROGRESS:
+			continue
+		}
+
+		// Anything else should be the verdict
+		m.inMessage = false
+		var resp *MilterResponse
+		switch cmd {
+		case SMFIR_ACCEPT, SMFIR_CONTINUE, SMFIR_DISCARD, SMFIR_REJECT, SMFIR_TEMPFAIL:
+			resp = &MilterResponse{Action: cmd}
+		case SMFIR_REPLYCODE:
+			resp = &MilterResponse{Action: cmd, Reply: strings.TrimRight(string(data), "\x00")}
+		default:
+			return nil, nil, fmt.Errorf("Unexpected response %q from %v", cmd, m)
+		}
+		if resp.Action != SMFIR_ACCEPT && resp.Action != SMFIR_CONTINUE {
+			changes = nil
+		}
+		return resp, changes, nil
+	}
+}
+
+// verdict records an accept or discard so later events for the connection or
+// message are not passed on
+func (m *Milter) verdict(resp *MilterResponse, err error, connection bool) (*MilterResponse, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch resp.Action {
+	case SMFIR_ACCEPT:
+		if connection {
+			m.done = true
+		} else {
+			m.skip = true
+		}
+		return milterContinue, nil
+	case SMFIR_SKIP:
+		return nil, fmt.Errorf("Unexpected skip response from %v", m)
+	case SMFIR_DISCARD:
+		m.skip = true
+	}
+	if resp.Action != SMFIR_CONTINUE {
+		m.inMessage = false
+	}
+	return resp, nil
+}
+
+// Abort tells the milter the current message was abandoned
+func (m *Milter) Abort() error {
+	m.skip = false
+	if !m.inMessage {
+		return nil
+	}
+	m.inMessage = false
+	return m.send(SMFIC_ABORT, nil)
+}
+
+// Close ends the milter session and closes the connection
+func (m *Milter) Close() error {
+	m.send(SMFIC_QUIT, nil)
+	return m.conn.Close()
+}
+
+// nulTerminate joins the strings, each followed by a NUL
+func nulTerminate(strs ...string) []byte {
+	var buf bytes.Buffer
+	for _, s := range strs {
+		buf.WriteString(s)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// splitNul splits NUL terminated strings
+func splitNul(data []byte) []string {
+	data = bytes.TrimSuffix(data, []byte{0})
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(string(data), "\x00")
+}
+
+// ApplyHeaderChanges returns a copy of msg with the milter header changes
+// applied to it
+func ApplyHeaderChanges(msg []byte, changes []*MilterHeaderChange) []byte {
+	if len(changes) == 0 {
+		return msg
+	}
+	headers, body := splitMessage(msg)
+	fields := parseHeaderFields(headers)
+	for _, c := range changes {
+		field := formatHeaderField(c.Name, c.Value)
+		switch c.Action {
+		case SMFIR_ADDHEADER:
+			fields = append(fields, field)
+		case SMFIR_INSHEADER:
+			idx := c.Index
+			if idx > len(fields) {
+				idx = len(fields)
+			}
+			fields = append(fields[:idx], append([]string{field}, fields[idx:]...)...)
+		case SMFIR_CHGHEADER:
+			name := strings.ToLower(c.Name)
+			n, found := 0, -1
+			for i, f := range fields {
+				if headerFieldName(f) == name {
+					if n++; n == c.Index {
+						found = i
+						break
+					}
+				}
+			}
+			switch {
+			case found >= 0 && c.Value == "":
+				// An empty value deletes the header
+				fields = append(fields[:found], fields[found+1:]...)
+			case found >= 0:
+				fields[found] = field
+			case c.Value != "":
+				fields = append(fields, field)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	for _, f := range fields {
+		buf.WriteString(f)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// formatHeaderField builds a header field from a milter supplied name and
+// value, which uses bare newlines for folding
+func formatHeaderField(name string, value string) string {
+	value = strings.Replace(value, "\r\n", "\n", -1)
+	value = strings.Replace(value, "\n", "\r\n", -1)
+	if value != "" && value[0] != ' ' && value[0] != '\t' {
+		value = " " + value
+	}
+	return name + ":" + value + "\r\n"
+}
+
+// milterPort extracts the numeric port from a net.Addr
+func milterPort(addr net.Addr) int {
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
@@ -0,0 +1,186 @@
+package smtpd
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMilter plays the milter side of the protocol, replying to each command
+// with the packets returned by respond
+type fakeMilter struct {
+	conn     net.Conn
+	protocol uint32
+	seen     []byte
+	respond  func(cmd byte, data []byte) [][]byte
+}
+
+func packet(cmd byte, data ...byte) []byte {
+	p := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(p, uint32(len(data)+1))
+	p[4] = cmd
+	return append(p, data...)
+}
+
+func (f *fakeMilter) serve() {
+	for {
+		var length uint32
+		if err := binary.Read(f.conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(f.conn, data); err != nil {
+			return
+		}
+		cmd := data[0]
+		f.seen = append(f.seen, cmd)
+		var replies [][]byte
+		switch cmd {
+		case SMFIC_OPTNEG:
+			opt := make([]byte, 12)
+			binary.BigEndian.PutUint32(opt[0:], 6)
+			binary.BigEndian.PutUint32(opt[4:], SMFIF_ADDHDRS|SMFIF_CHGHDRS)
+			binary.BigEndian.PutUint32(opt[8:], f.protocol)
+			replies = [][]byte{packet(SMFIC_OPTNEG, opt...)}
+		case SMFIC_MACRO, SMFIC_ABORT:
+		case SMFIC_HEADER:
+			if f.protocol&SMFIP_NR_HDR == 0 {
+				replies = f.respond(cmd, data[1:])
+			}
+		case SMFIC_QUIT:
+			f.conn.Close()
+			return
+		default:
+			replies = f.respond(cmd, data[1:])
+		}
+		for _, r := range replies {
+			f.conn.Write(r)
+		}
+	}
+}
+
+func setupFakeMilter(t *testing.T, protocol uint32,
+	respond func(cmd byte, data []byte) [][]byte) (*Milter, *fakeMilter) {
+	client, server := net.Pipe()
+	f := &fakeMilter{conn: server, protocol: protocol, respond: respond}
+	go f.serve()
+	m, err := newMilter("pipe", client, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, f
+}
+
+func continueAll(cmd byte, data []byte) [][]byte {
+	return [][]byte{packet(SMFIR_CONTINUE)}
+}
+
+func TestMilterSession(t *testing.T) {
+	m, f := setupFakeMilter(t, SMFIP_NOHELO|SMFIP_NR_HDR, func(cmd byte, data []byte) [][]byte {
+		switch cmd {
+		case SMFIC_RCPT:
+			if string(data) == "<bad@example.com>\x00" {
+				return [][]byte{packet(SMFIR_REPLYCODE, []byte("550 5.1.1 No such user\x00")...)}
+			}
+		case SMFIC_BODYEOB:
+			idx := []byte{0, 0, 0, 1}
+			return [][]byte{
+				packet(SMFIR_PROGRESS),
+				packet(SMFIR_ADDHEADER, []byte("X-Spam\x00yes\x00")...),
+				packet(SMFIR_CHGHEADER, append(idx, []byte("Subject\x00[SPAM] Hi\x00")...)...),
+				packet(SMFIR_ACCEPT),
+			}
+		}
+		return continueAll(cmd, data)
+	})
+	defer m.Close()
+
+	resp, err := m.Connect("[192.0.2.1]", net.ParseIP("192.0.2.1"), 25)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(SMFIR_CONTINUE), resp.Action)
+
+	// HELO was negotiated away, so must not be sent
+	resp, err = m.Helo("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, byte(SMFIR_CONTINUE), resp.Action)
+
+	resp, _ = m.Mail("joe@example.com", "SIZE=100")
+	assert.Equal(t, byte(SMFIR_CONTINUE), resp.Action)
+	resp, _ = m.Rcpt("bad@example.com")
+	assert.True(t, resp.Rejected())
+	assert.False(t, resp.Temporary())
+	assert.Equal(t, "550 5.1.1 No such user", resp.SmtpReply("Recipient"))
+	resp, _ = m.Rcpt("good@example.com")
+	assert.False(t, resp.Rejected())
+	resp, _ = m.Data()
+	assert.False(t, resp.Rejected())
+
+	msg := []byte("From: joe@example.com\r\nSubject: Hi\r\n\r\nBody\r\n")
+	resp, changes, err := m.Message(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(SMFIR_ACCEPT), resp.Action)
+	assert.Equal(t, 2, len(changes))
+	assert.Equal(t, "From: joe@example.com\r\nSubject: [SPAM] Hi\r\nX-Spam: yes\r\n\r\nBody\r\n",
+		string(ApplyHeaderChanges(msg, changes)))
+
+	assert.Equal(t, "OCMRRTLLNBE", string(f.seen))
+}
+
+func TestMilterRejectMessage(t *testing.T) {
+	m, _ := setupFakeMilter(t, 0, func(cmd byte, data []byte) [][]byte {
+		switch cmd {
+		case SMFIC_HEADER:
+			if string(data) == "Subject\x00Buy now\x00" {
+				return [][]byte{packet(SMFIR_REJECT)}
+			}
+		case SMFIC_BODYEOB:
+			return [][]byte{packet(SMFIR_DISCARD)}
+		}
+		return continueAll(cmd, data)
+	})
+	defer m.Close()
+
+	m.Mail("joe@example.com")
+	resp, _, err := m.Message([]byte("Subject: Buy now\r\n\r\nBody\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "550 5.7.1 Message rejected", resp.SmtpReply("Message"))
+	assert.Nil(t, m.Abort())
+
+	m.Mail("joe@example.com")
+	resp, _, _ = m.Message([]byte("Subject: Hello\r\n\r\nBody\r\n"))
+	assert.Equal(t, byte(SMFIR_DISCARD), resp.Action)
+	assert.False(t, resp.Rejected())
+}
+
+func TestMilterAcceptConnection(t *testing.T) {
+	m, f := setupFakeMilter(t, 0, func(cmd byte, data []byte) [][]byte {
+		return [][]byte{packet(SMFIR_ACCEPT)}
+	})
+	defer m.Close()
+
+	m.Connect("[192.0.2.1]", net.ParseIP("192.0.2.1"), 25)
+	m.Helo("example.com")
+	m.Mail("joe@example.com")
+	resp, changes, err := m.Message([]byte("Subject: Hello\r\n\r\nBody\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, byte(SMFIR_CONTINUE), resp.Action)
+	assert.Nil(t, changes)
+	// Only negotiation and connect reached the milter
+	assert.Equal(t, "OC", string(f.seen))
+}
+
+func TestApplyHeaderChanges(t *testing.T) {
+	msg := []byte("Received: one\r\nReceived: two\r\nSubject: Hi\r\n\r\nBody\r\n")
+	changes := []*MilterHeaderChange{
+		{Action: SMFIR_INSHEADER, Index: 0, Name: "X-First", Value: "1"},
+		{Action: SMFIR_CHGHEADER, Index: 2, Name: "received", Value: ""},
+		{Action: SMFIR_ADDHEADER, Name: "X-Folded", Value: "a\n\tb"},
+		{Action: SMFIR_CHGHEADER, Index: 1, Name: "X-Missing", Value: "added"},
+	}
+	assert.Equal(t, "X-First: 1\r\nReceived: one\r\nSubject: Hi\r\nX-Folded: a\r\n\tb\r\n"+
+		"X-Missing: added\r\n\r\nBody\r\n", string(ApplyHeaderChanges(msg, changes)))
+}
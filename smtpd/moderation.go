@@ -0,0 +1,168 @@
+package smtpd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+)
+
+// errGroupPolicy means the sender may not post to a group
+var errGroupPolicy = errors.New("sender not allowed to post to group")
+
+// heldTarget is a moderated group a message was sent to, through recipient
+type heldTarget struct {
+	group     *db.Group
+	recipient string
+}
+
+// groupPolicy applies the group's posting policy to the sender of the
+// message.  It returns errGroupPolicy if they may not post, and sets hold
+// when the message must wait for a moderator.
+func (ss *Session) groupPolicy(group *db.Group) (bool, error) {
+	switch group.Policy {
+	case "", db.GROUP_POLICY_ANYONE:
+		return false, nil
+	case db.GROUP_POLICY_MODERATED:
+		return true, nil
+	case db.GROUP_POLICY_MEMBERS:
+		if ss.from == "" {
+			return false, errGroupPolicy
+		}
+		members, err := ss.server.db.GroupExpand(group.Id)
+		if err != nil {
+			return false, err
+		}
+		if !containsFold(members, ss.from) {
+			return false, errGroupPolicy
+		}
+		return false, nil
+	case db.GROUP_POLICY_SENDERS:
+		if ss.from == "" {
+			return false, errGroupPolicy
+		}
+		listed, err := ss.server.db.GroupSenderHas(group.Id, ss.from)
+		if err != nil {
+			return false, err
+		}
+		if !listed {
+			return false, errGroupPolicy
+		}
+		return false, nil
+	}
+	ss.logWarn("Group %v has unknown posting policy %q", group.Name, group.Policy)
+	return false, errGroupPolicy
+}
+
+// addHeld notes that the message to recip must be held for group's moderator
+func (ss *Session) addHeld(group *db.Group, recip string) {
+	for _, h := range ss.held {
+		if h.group.Id == group.Id {
+			return
+		}
+	}
+	ss.held = append(ss.held, heldTarget{group: group, recipient: recip})
+}
+
+// holdMessages queues the message for the moderators of each group that
+// holds it
+func (ss *Session) holdMessages(data []byte, header mail.Header, stamp string) {
+	subject := originalSubject(header)
+	if len(subject) > 255 {
+		subject = subject[:255]
+	}
+	for _, h := range ss.held {
+		ss.logInfo("Holding message from <%v> to %v for moderation", ss.from, h.recipient)
+		received := fmt.Sprintf("Received: from %s ([%s]) by %s\r\n  for <%s>; %s\r\n",
+			ss.remoteDomain, ss.remoteHost, ss.server.domain, h.recipient, stamp)
+		held := &db.GroupHeld{GroupId: h.group.Id, Sender: ss.from, Recipient: h.recipient,
+			Subject: subject, Data: append([]byte(received), data...)}
+		if err := ss.server.db.GroupHeldAdd(held); err != nil {
+			ss.logError("Failed to hold message for %v: %v", h.recipient, err)
+		}
+	}
+}
+
+// releaseHeld delivers the held messages moderators have approved and tells
+// the senders of rejected ones.  Released messages go straight to the
+// group's members, without their Sieve scripts or forwarding.
+func (s *Server) releaseHeld() error {
+	decided, err := s.db.GroupHeldDecided()
+	if err != nil {
+		return err
+	}
+	for _, held := range decided {
+		group, err := s.db.GroupGet(held.GroupId)
+		if err != nil {
+			return err
+		}
+		if group != nil {
+			header := mail.Header{}
+			if m, err := mail.ReadMessage(bytes.NewReader(held.Data)); err == nil {
+				header = m.Header
+			}
+			if held.State == db.HELD_APPROVED {
+				s.releaseApproved(group, held, header)
+			} else {
+				s.releaseRejected(group, held, header)
+			}
+		}
+		if err = s.db.GroupHeldDel(held.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) releaseApproved(group *db.Group, held *db.GroupHeld, header mail.Header) {
+	log.LogInfo("Releasing approved message %v from <%v> to %v", held.Id, held.Sender,
+		held.Recipient)
+	if group.IsList {
+		s.listPost(group, held.Sender, held.Data, header)
+		return
+	}
+	members, err := s.db.GroupExpand(group.Id)
+	if err != nil {
+		log.LogError("Failed to expand group %v: %v", group.Name, err)
+		return
+	}
+	for _, addr := range members {
+		if s.isLocal(addr) {
+			if err := s.storeLocal(addr, held.Data); err != nil {
+				log.LogError("Failed to deliver held message to %v: %v", addr, err)
+			}
+		} else if s.outbound != nil {
+			s.outbound.Send(held.Sender, []string{addr}, held.Data)
+		}
+	}
+}
+
+func (s *Server) releaseRejected(group *db.Group, held *db.GroupHeld, header mail.Header) {
+	log.LogInfo("Discarding rejected message %v from <%v> to %v", held.Id, held.Sender,
+		held.Recipient)
+	if held.Sender == "" {
+		return
+	}
+	body := fmt.Sprintf("Your message to <%v> was rejected by the moderator.\n",
+		held.Recipient)
+	if held.Reason != "" {
+		body += "\nReason: " + held.Reason + "\n"
+	}
+	from := group.Name + "@" + s.listDomain(group)
+	s.sendNotice(held.Sender, AutoReply(s.listDomain(group), from, held.Sender, header,
+		"Rejected: "+originalSubject(header), body, false))
+}
+
+// rejectPolicy refuses recip after groupPolicy returned err
+func (ss *Session) rejectPolicy(recip string, err error) {
+	if err != errGroupPolicy {
+		ss.logError("Failed to check posting policy for %v - %v", recip, err)
+		ss.send("451 4.3.0 Failed to look up recipient - try again later")
+		return
+	}
+	ss.logWarn("Sender <%v> may not post to %v", ss.from, recip)
+	ss.send(fmt.Sprintf("550 5.7.1 <%v> does not accept mail from <%v>", recip, ss.from))
+}
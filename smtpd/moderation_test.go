@@ -0,0 +1,33 @@
+package smtpd
+
+import (
+	"testing"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupPolicy(t *testing.T) {
+	ss := &Session{server: &Server{}, id: 1, from: "bob@example.com"}
+
+	hold, err := ss.groupPolicy(&db.Group{Name: "all"})
+	assert.Nil(t, err)
+	assert.False(t, hold, "empty policy lets anyone post")
+
+	hold, err = ss.groupPolicy(&db.Group{Name: "all", Policy: db.GROUP_POLICY_ANYONE})
+	assert.Nil(t, err)
+	assert.False(t, hold)
+
+	hold, err = ss.groupPolicy(&db.Group{Name: "news", Policy: db.GROUP_POLICY_MODERATED})
+	assert.Nil(t, err)
+	assert.True(t, hold)
+
+	ss.from = ""
+	_, err = ss.groupPolicy(&db.Group{Name: "staff", Policy: db.GROUP_POLICY_MEMBERS})
+	assert.Equal(t, errGroupPolicy, err, "null sender is never a member")
+	_, err = ss.groupPolicy(&db.Group{Name: "staff", Policy: db.GROUP_POLICY_SENDERS})
+	assert.Equal(t, errGroupPolicy, err)
+
+	_, err = ss.groupPolicy(&db.Group{Name: "odd", Policy: "whoever"})
+	assert.Equal(t, errGroupPolicy, err, "unknown policies refuse")
+}
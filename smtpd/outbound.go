@@ -0,0 +1,315 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/egggo/inbucket/log"
+)
+
+// OutboundMessage is a message we originated, waiting to be relayed
+type OutboundMessage struct {
+	From       string
+	Recipients []string
+	Data       []byte
+	attempts   int
+}
+
+// Outbound delivers messages to remote servers in the background, retrying
+// temporary failures and bouncing permanent ones back to the sender.  The
+// queue is held in memory only, it does not survive a restart.
+type Outbound struct {
+	config    config.OutboundConfig
+	queue     chan *OutboundMessage
+	shutdown  chan bool
+	waitgroup *sync.WaitGroup
+}
+
+// outboundError records whether a delivery failure is worth retrying
+type outboundError struct {
+	err       error
+	permanent bool
+}
+
+// Error gives the remote server's reply as it was sent, for the bounce
+func (e *outboundError) Error() string {
+	if terr, ok := e.err.(*textproto.Error); ok {
+		return fmt.Sprintf("%03d %s", terr.Code, terr.Msg)
+	}
+	return e.err.Error()
+}
+
+func NewOutbound(cfg config.OutboundConfig) *Outbound {
+	return &Outbound{config: cfg, queue: make(chan *OutboundMessage, 100),
+		shutdown: make(chan bool), waitgroup: new(sync.WaitGroup)}
+}
+
+// Start begins delivering queued messages
+func (o *Outbound) Start() {
+	o.waitgroup.Add(1)
+	go func() {
+		defer o.waitgroup.Done()
+		for {
+			select {
+			case msg := <-o.queue:
+				o.deliver(msg)
+			case <-o.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for the message being delivered to finish.  Anything still
+// queued, waiting for a retry or not yet queued by Send is dropped, as
+// nothing is written to disk.
+func (o *Outbound) Stop() {
+	close(o.shutdown)
+	o.waitgroup.Wait()
+}
+
+// Send queues data for delivery to recipients with the envelope sender from,
+// an empty from is the null sender used by bounces and automatic replies
+func (o *Outbound) Send(from string, recipients []string, data []byte) {
+	if len(recipients) == 0 {
+		return
+	}
+	o.enqueue(&OutboundMessage{From: from, Recipients: recipients, Data: data})
+}
+
+func (o *Outbound) enqueue(msg *OutboundMessage) {
+	select {
+	case o.queue <- msg:
+	case <-o.shutdown:
+		log.LogWarn("Outbound shutting down, dropped message from <%v>", msg.From)
+	}
+}
+
+// deliver makes one attempt at sending msg, scheduling a retry for the
+// recipients that failed temporarily
+func (o *Outbound) deliver(msg *OutboundMessage) {
+	msg.attempts++
+	retry := make([]string, 0)
+	failed := make(map[string]error)
+
+	for host, rcpts := range o.route(msg.Recipients) {
+		for rcpt, err := range o.sendDomain(host, msg.From, rcpts, msg.Data) {
+			if permanent(err) || msg.attempts >= o.config.MaxAttempts {
+				failed[rcpt] = err
+			} else {
+				retry = append(retry, rcpt)
+			}
+		}
+	}
+
+	if len(retry) > 0 {
+		log.LogInfo("Outbound delivery to %v deferred, attempt %v of %v", retry,
+			msg.attempts, o.config.MaxAttempts)
+		next := &OutboundMessage{From: msg.From, Recipients: retry, Data: msg.Data,
+			attempts: msg.attempts}
+		time.AfterFunc(time.Duration(o.config.RetryMinutes)*time.Minute, func() {
+			o.enqueue(next)
+		})
+	}
+	if len(failed) > 0 {
+		for rcpt, err := range failed {
+			log.LogWarn("Outbound delivery to <%v> failed: %v", rcpt, err)
+		}
+		// Never bounce a bounce.  We are the only reader of the queue, so
+		// the bounce is queued from another goroutine in case it is full.
+		if msg.From != "" {
+			bounce := &OutboundMessage{Recipients: []string{msg.From},
+				Data: BounceMessage(o.config.Helo, msg.From, failed, msg.Data)}
+			go o.enqueue(bounce)
+		}
+	}
+}
+
+// route groups recipients by the domain they will be delivered to, or all
+// under the smarthost when there is one
+func (o *Outbound) route(recipients []string) map[string][]string {
+	routes := make(map[string][]string)
+	for _, rcpt := range recipients {
+		key := o.config.SmartHost
+		if key == "" {
+			if idx := strings.LastIndex(rcpt, "@"); idx >= 0 {
+				key = strings.ToLower(rcpt[idx+1:])
+			}
+		}
+		routes[key] = append(routes[key], rcpt)
+	}
+	return routes
+}
+
+// sendDomain delivers to the smarthost or the MX hosts of domain in order of
+// preference, returning the recipients that could not be delivered
+func (o *Outbound) sendDomain(domain string, from string, rcpts []string,
+	data []byte) map[string]error {
+	hosts := make([]string, 0)
+	if o.config.SmartHost != "" {
+		hosts = append(hosts, o.config.SmartHost)
+	} else if domain == "" {
+		return failAll(rcpts, &outboundError{fmt.Errorf("no domain in address"), true})
+	} else {
+		mxs, err := lookupMX(domain)
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); !ok || dnsErr.Temporary() {
+				return failAll(rcpts, &outboundError{err, false})
+			}
+		}
+		// RFC 7505, a null MX says the domain accepts no mail
+		if len(mxs) == 1 && mxs[0].Host == "." {
+			return failAll(rcpts, &outboundError{
+				fmt.Errorf("%v does not accept mail (null MX)", domain), true})
+		}
+		sort.Slice(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+		for _, mx := range mxs {
+			hosts = append(hosts, net.JoinHostPort(strings.TrimSuffix(mx.Host, "."), "25"))
+		}
+		// RFC 5321 5.1, fall back to the implicit MX
+		if len(hosts) == 0 {
+			hosts = append(hosts, net.JoinHostPort(domain, "25"))
+		}
+	}
+
+	var result map[string]error
+	for _, host := range hosts {
+		result = o.sendHost(host, from, rcpts, data)
+		if result == nil {
+			return nil
+		}
+		// Only move on to the next host when this one failed us entirely
+		if len(result) != len(rcpts) || permanent(result[rcpts[0]]) {
+			return result
+		}
+	}
+	return result
+}
+
+func permanent(err error) bool {
+	oerr, ok := err.(*outboundError)
+	return ok && oerr.permanent
+}
+
+func failAll(rcpts []string, err error) map[string]error {
+	result := make(map[string]error)
+	for _, rcpt := range rcpts {
+		result[rcpt] = err
+	}
+	return result
+}
+
+// classify turns an SMTP reply error into an outboundError, 5xx replies are
+// permanent and everything else is worth another try
+func classify(err error) *outboundError {
+	if terr, ok := err.(*textproto.Error); ok {
+		return &outboundError{err, terr.Code >= 500}
+	}
+	return &outboundError{err, false}
+}
+
+// sendHost runs a single SMTP transaction against host
+func (o *Outbound) sendHost(host string, from string, rcpts []string,
+	data []byte) map[string]error {
+	timeout := time.Duration(o.config.TimeoutSeconds) * time.Second
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return failAll(rcpts, &outboundError{err, false})
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return failAll(rcpts, &outboundError{err, false})
+	}
+
+	hostname, _, _ := net.SplitHostPort(host)
+	c, err := smtp.NewClient(conn, hostname)
+	if err != nil {
+		return failAll(rcpts, classify(err))
+	}
+	defer c.Close()
+	if err = c.Hello(o.config.Helo); err != nil {
+		return failAll(rcpts, classify(err))
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok && o.config.StartTLS {
+		// Opportunistic TLS to MX hosts can't insist on a valid certificate
+		tlsConfig := &tls.Config{ServerName: hostname,
+			InsecureSkipVerify: o.config.SmartHost == ""}
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return failAll(rcpts, classify(err))
+		}
+	}
+	if o.config.SmartHost != "" && o.config.Username != "" {
+		auth := smtp.PlainAuth("", o.config.Username, o.config.Password, hostname)
+		if err = c.Auth(auth); err != nil {
+			return failAll(rcpts, classify(err))
+		}
+	}
+
+	if err = c.Mail(from); err != nil {
+		return failAll(rcpts, classify(err))
+	}
+	result := make(map[string]error)
+	accepted := 0
+	for _, rcpt := range rcpts {
+		if err = c.Rcpt(rcpt); err != nil {
+			result[rcpt] = classify(err)
+		} else {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		return result
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return failAll(rcpts, classify(err))
+	}
+	if _, err = w.Write(data); err != nil {
+		return failAll(rcpts, classify(err))
+	}
+	if err = w.Close(); err != nil {
+		return failAll(rcpts, classify(err))
+	}
+	c.Quit()
+
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// BounceMessage builds a non-delivery report for the recipients in failed,
+// including the header of the original message
+func BounceMessage(domain string, sender string, failed map[string]error, data []byte) []byte {
+	header := data
+	if idx := bytes.Index(data, []byte("\r\n\r\n")); idx >= 0 {
+		header = data[:idx+2]
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: Mail Delivery System <MAILER-DAEMON@%v>\r\n", domain)
+	fmt.Fprintf(&buf, "To: <%v>\r\n", sender)
+	fmt.Fprintf(&buf, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&buf, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%v@%v>\r\n", generateId(time.Now()), domain)
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "Your message could not be delivered to the following recipients:\r\n\r\n")
+	for rcpt, err := range failed {
+		fmt.Fprintf(&buf, "  <%v>: %v\r\n", rcpt, err)
+	}
+	fmt.Fprintf(&buf, "\r\n----- Original message header -----\r\n\r\n")
+	buf.Write(header)
+	return buf.Bytes()
+}
@@ -0,0 +1,168 @@
+package smtpd
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// startFakeSmtp accepts mail for any recipient except those starting with
+// bad (refused permanently) or later (refused temporarily), received
+// messages are sent on the returned channel
+func startFakeSmtp(t *testing.T) (string, chan string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				tp := textproto.NewConn(conn)
+				tp.PrintfLine("220 fake ESMTP")
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+					switch {
+					case cmd == "EHLO" || cmd == "HELO" || cmd == "MAIL":
+						tp.PrintfLine("250 OK")
+					case cmd == "RCPT" && strings.HasPrefix(line[8:], "<bad"):
+						tp.PrintfLine("550 No such user")
+					case cmd == "RCPT" && strings.HasPrefix(line[8:], "<later"):
+						tp.PrintfLine("451 Try again")
+					case cmd == "RCPT":
+						tp.PrintfLine("250 OK")
+					case cmd == "DATA":
+						tp.PrintfLine("354 Go ahead")
+						data, _ := tp.ReadDotBytes()
+						received <- string(data)
+						tp.PrintfLine("250 Queued")
+					case cmd == "QUIT":
+						tp.PrintfLine("221 Bye")
+						return
+					default:
+						tp.PrintfLine("502 Unknown")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().String(), received, func() { l.Close() }
+}
+
+func TestOutboundSendHost(t *testing.T) {
+	addr, received, stop := startFakeSmtp(t)
+	defer stop()
+
+	o := NewOutbound(config.OutboundConfig{SmartHost: addr, Helo: "inbucket.local",
+		TimeoutSeconds: 5, RetryMinutes: 1, MaxAttempts: 3})
+	failed := o.sendHost(addr, "james@inbucket.local",
+		[]string{"bob@example.com", "bad@example.com", "later@example.com"},
+		[]byte("Subject: hi\r\n\r\nHello\r\n"))
+
+	assert.Equal(t, 2, len(failed))
+	assert.True(t, permanent(failed["bad@example.com"]))
+	assert.False(t, permanent(failed["later@example.com"]))
+	assert.Equal(t, "Subject: hi\n\nHello\n", <-received)
+}
+
+func TestOutboundBounce(t *testing.T) {
+	addr, received, stop := startFakeSmtp(t)
+	defer stop()
+
+	o := NewOutbound(config.OutboundConfig{SmartHost: addr, Helo: "inbucket.local",
+		TimeoutSeconds: 5, RetryMinutes: 1, MaxAttempts: 3})
+	o.deliver(&OutboundMessage{From: "james@inbucket.local",
+		Recipients: []string{"bad@example.com"}, Data: []byte("Subject: hi\r\n\r\nHello\r\n")})
+
+	// The bounce is queued with the null sender
+	select {
+	case bounce := <-o.queue:
+		assert.Equal(t, "", bounce.From)
+		assert.Equal(t, []string{"james@inbucket.local"}, bounce.Recipients)
+		assert.Contains(t, string(bounce.Data), "<bad@example.com>: 550 No such user")
+		assert.Contains(t, string(bounce.Data), "Subject: hi\r\n")
+		assert.Contains(t, string(bounce.Data), "Auto-Submitted: auto-generated\r\n")
+	case <-time.After(time.Second):
+		t.Error("Expected a bounce to be queued")
+	}
+	assert.Equal(t, 0, len(received))
+
+	// Bounces are never bounced
+	o.deliver(&OutboundMessage{From: "", Recipients: []string{"bad@example.com"},
+		Data: []byte("Subject: bounce\r\n\r\n")})
+	assert.Equal(t, 0, len(o.queue))
+}
+
+// The queue's only reader must not block queueing a bounce
+func TestOutboundBounceQueueFull(t *testing.T) {
+	addr, _, stop := startFakeSmtp(t)
+	defer stop()
+
+	o := NewOutbound(config.OutboundConfig{SmartHost: addr, Helo: "inbucket.local",
+		TimeoutSeconds: 5, RetryMinutes: 1, MaxAttempts: 3})
+	for len(o.queue) < cap(o.queue) {
+		o.queue <- &OutboundMessage{From: "queued@inbucket.local"}
+	}
+	done := make(chan bool)
+	go func() {
+		o.deliver(&OutboundMessage{From: "james@inbucket.local",
+			Recipients: []string{"bad@example.com"}, Data: []byte("Subject: hi\r\n\r\n")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliver blocked on a full queue")
+	}
+
+	// The bounce is queued once there is room
+	for i := 0; i < cap(o.queue); i++ {
+		<-o.queue
+	}
+	select {
+	case bounce := <-o.queue:
+		assert.Equal(t, []string{"james@inbucket.local"}, bounce.Recipients)
+	case <-time.After(time.Second):
+		t.Error("Expected a bounce to be queued")
+	}
+}
+
+func TestOutboundRoute(t *testing.T) {
+	o := NewOutbound(config.OutboundConfig{})
+	routes := o.route([]string{"a@example.com", "b@Example.com", "c@example.org"})
+	assert.Equal(t, []string{"a@example.com", "b@Example.com"}, routes["example.com"])
+	assert.Equal(t, []string{"c@example.org"}, routes["example.org"])
+
+	o = NewOutbound(config.OutboundConfig{SmartHost: "relay:25"})
+	routes = o.route([]string{"a@example.com", "c@example.org"})
+	assert.Equal(t, 2, len(routes["relay:25"]))
+}
+
+// A domain with a null MX (RFC 7505) fails at once rather than being dialed
+func TestOutboundNullMX(t *testing.T) {
+	lookupMX = func(name string) ([]*net.MX, error) {
+		return []*net.MX{{Host: ".", Pref: 0}}, nil
+	}
+	defer func() { lookupMX = net.LookupMX }()
+
+	o := NewOutbound(config.OutboundConfig{Helo: "inbucket.local", TimeoutSeconds: 5})
+	failed := o.sendDomain("example.com", "james@inbucket.local",
+		[]string{"bob@example.com", "sue@example.com"}, []byte("Subject: hi\r\n\r\n"))
+	assert.Equal(t, 2, len(failed))
+	assert.True(t, permanent(failed["bob@example.com"]))
+	assert.Contains(t, failed["sue@example.com"].Error(), "null MX")
+}
@@ -0,0 +1,298 @@
+package smtpd
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+)
+
+// Format of the latest release time advertised with FUTURERELEASE
+const RELEASE_FMT = "2006-01-02T15:04:05Z"
+
+// Failed releases are retried on each scan, about an hour's worth of times
+const MAX_RELEASE_ATTEMPTS = 60
+
+// futureRelease reports whether we offer FUTURERELEASE (RFC 4865), held
+// messages wait in the database
+func (s *Server) futureRelease() bool {
+	return s.db != nil && s.storeMessages && s.maxHoldSeconds > 0
+}
+
+// futureReleaseKeyword is the FUTURERELEASE EHLO keyword with the longest
+// hold we allow, in seconds and as a time
+func (s *Server) futureReleaseKeyword(now time.Time) string {
+	latest := now.Add(time.Duration(s.maxHoldSeconds) * time.Second)
+	return fmt.Sprintf("FUTURERELEASE %v %v", s.maxHoldSeconds, latest.UTC().Format(RELEASE_FMT))
+}
+
+// holdParam works out when to release the message from the HOLDFOR or
+// HOLDUNTIL parameter of MAIL.  It returns the zero time for immediate
+// delivery, or the reply to refuse the command with.
+func (ss *Session) holdParam(args map[string]string, now time.Time) (time.Time, string) {
+	holdFor, hasFor := args["HOLDFOR"]
+	holdUntil, hasUntil := args["HOLDUNTIL"]
+	if !hasFor && !hasUntil {
+		return time.Time{}, ""
+	}
+	if !ss.server.futureRelease() {
+		return time.Time{}, "555 5.5.4 FUTURERELEASE not available"
+	}
+	if hasFor && hasUntil {
+		return time.Time{}, "501 5.5.4 HOLDFOR and HOLDUNTIL may not be used together"
+	}
+
+	var release time.Time
+	if hasFor {
+		seconds, err := strconv.ParseUint(holdFor, 10, 32)
+		if err != nil {
+			return time.Time{}, "501 5.5.4 Invalid HOLDFOR value"
+		}
+		release = now.Add(time.Duration(seconds) * time.Second)
+	} else {
+		var err error
+		if release, err = time.Parse(time.RFC3339, holdUntil); err != nil {
+			return time.Time{}, "501 5.5.4 Invalid HOLDUNTIL value"
+		}
+	}
+	if release.Sub(now) > time.Duration(ss.server.maxHoldSeconds)*time.Second {
+		return time.Time{}, fmt.Sprintf(
+			"501 5.5.4 Hold time exceeds the maximum of %v seconds", ss.server.maxHoldSeconds)
+	}
+	if !release.After(now) {
+		// The time has already come
+		return time.Time{}, ""
+	}
+	return release, ""
+}
+
+// refuseHold refuses recip, a mailing list or moderated group, if the message
+// is to be held: those have their own schedules
+func (ss *Session) refuseHold(recip string) bool {
+	if ss.releaseAt.IsZero() {
+		return false
+	}
+	ss.logWarn("Refusing FUTURERELEASE for %v", recip)
+	ss.send(fmt.Sprintf("555 5.5.4 FUTURERELEASE not available for <%v>", recip))
+	return true
+}
+
+// holdForRelease stores the message for each local recipient, those with a
+// Received header, and forwarding address until ss.releaseAt.  The copies
+// are saved together so that a failure holds none of them.  Like messages
+// released by a moderator, held messages skip the recipients' Sieve scripts.
+func (ss *Session) holdForRelease(received [][]byte, data []byte, header mail.Header,
+	junk bool, stamp string) error {
+	subject := originalSubject(header)
+	if len(subject) > 255 {
+		subject = subject[:255]
+	}
+
+	releases := make([]*db.FutureRelease, 0, len(received)+len(ss.forwards))
+	i := 0
+	for e := ss.recipients.Front(); e != nil; e = e.Next() {
+		recip := e.Value.(string)
+		if received[i] != nil {
+			local, _, err := ParseEmailAddress(recip)
+			if err != nil {
+				return err
+			}
+			name, err := ParseMailboxName(local)
+			if err != nil {
+				return err
+			}
+			release := &db.FutureRelease{Sender: ss.from, Recipient: recip, Mailbox: name,
+				Subject: subject, Data: append(append([]byte{}, received[i]...), data...),
+				ReleaseAt: ss.releaseAt}
+			if junk {
+				release.Folder = ss.server.spamConfig.JunkFolder
+			}
+			releases = append(releases, release)
+		}
+		i++
+	}
+	for _, f := range ss.forwards {
+		releases = append(releases, &db.FutureRelease{Sender: ss.from, Recipient: f.Address,
+			Remote: true, Subject: subject, Data: append(ss.forwardHeader(f, stamp), data...),
+			ReleaseAt: ss.releaseAt})
+	}
+	if err := ss.server.db.FutureReleaseAddAll(releases); err != nil {
+		return err
+	}
+	ss.logInfo("Holding message from <%v> until %v", ss.from, ss.releaseAt)
+	return nil
+}
+
+// releaseScanner periodically delivers the held messages that have come due
+func (s *Server) releaseScanner() {
+	for !s.shutdown {
+		time.Sleep(time.Minute)
+		if err := s.releaseDue(time.Now()); err != nil {
+			log.LogError("Error releasing future release messages: %v", err)
+		}
+	}
+}
+
+// releaseDue delivers the held messages due at now.  Each is removed from
+// the database first so one cancelled meanwhile is not delivered, a failed
+// delivery worth retrying puts it back to try again on the next scan.
+func (s *Server) releaseDue(now time.Time) error {
+	due, err := s.db.FutureReleaseDue(now)
+	if err != nil {
+		return err
+	}
+	for _, release := range due {
+		taken, err := s.db.FutureReleaseDel(release.Id)
+		if err != nil {
+			return err
+		}
+		if !taken {
+			continue
+		}
+		if err = s.release(release); err != nil && s.releaseFailed(release, err) {
+			release.Id = 0
+			if err = s.db.FutureReleaseAdd(release); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// releaseFailed counts a failed attempt at releasing a held message and
+// reports whether to try again.  A rejection (5xx reply) is final, as is
+// running out of attempts, and bounces the message to its sender.
+func (s *Server) releaseFailed(release *db.FutureRelease, err error) bool {
+	release.Attempts++
+	terr, rejected := err.(*textproto.Error)
+	rejected = rejected && terr.Code >= 500
+	if !rejected && release.Attempts < MAX_RELEASE_ATTEMPTS {
+		log.LogError("Failed to release message %v to %v, attempt %v of %v: %v", release.Id,
+			release.Recipient, release.Attempts, MAX_RELEASE_ATTEMPTS, err)
+		return true
+	}
+	log.LogError("Giving up releasing message %v to %v: %v", release.Id, release.Recipient, err)
+	if release.Sender == "" {
+		return false
+	}
+	bounce := BounceMessage(s.domain, release.Sender, map[string]error{release.Recipient: err},
+		release.Data)
+	if s.isLocal(release.Sender) {
+		if err = s.storeLocal(release.Sender, bounce); err != nil {
+			log.LogError("Failed to bounce message %v to %v: %v", release.Id, release.Sender, err)
+		}
+	} else if s.outbound != nil {
+		s.outbound.Send("", []string{release.Sender}, bounce)
+	} else {
+		log.LogWarn("No outbound delivery, cannot bounce message %v to %v", release.Id,
+			release.Sender)
+	}
+	return false
+}
+
+// release delivers a held message
+func (s *Server) release(release *db.FutureRelease) error {
+	log.LogInfo("Releasing message %v from <%v> to %v", release.Id, release.Sender,
+		release.Recipient)
+	if release.UserId != 0 {
+		return s.releaseSubmission(release)
+	}
+	if release.Remote {
+		if s.outbound == nil {
+			return fmt.Errorf("No outbound delivery")
+		}
+		s.outbound.Send(release.Sender, []string{release.Recipient}, release.Data)
+		return nil
+	}
+	mb, err := s.dataStore.MailboxFor(release.Mailbox)
+	if err != nil {
+		return err
+	}
+	if release.Folder != "" {
+		if mb, err = FolderFor(mb, release.Folder); err != nil {
+			return err
+		}
+	}
+	msg, err := mb.NewMessage()
+	if err != nil {
+		return err
+	}
+	if err = msg.Append(release.Data); err != nil {
+		return err
+	}
+	if err = msg.Close(); err != nil {
+		return err
+	}
+	expReceivedTotal.Add(1)
+	return nil
+}
+
+// releaseSubmission delivers a message submitted over JMAP as if its user had
+// sent it with SMTP AUTH: a remote copy is DKIM signed, a local one goes
+// through a session of its own so that aliases, groups, mailing lists,
+// forwarding and Sieve scripts apply
+func (s *Server) releaseSubmission(release *db.FutureRelease) error {
+	user, err := s.db.UserGet(release.UserId)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		log.LogWarn("Dropping message %v, user %v no longer exists", release.Id, release.UserId)
+		return nil
+	}
+	if !release.Remote {
+		return s.submit(user, release.Sender, release.Recipient, release.Data)
+	}
+	if s.outbound == nil {
+		return fmt.Errorf("No outbound delivery")
+	}
+	ss := &Session{server: s, authUser: user}
+	s.outbound.Send(release.Sender, []string{release.Recipient}, ss.dkimSign(release.Data))
+	return nil
+}
+
+// submit delivers data from user to the local recipient recip by speaking
+// SMTP to a session already authenticated as user
+func (s *Server) submit(user *db.User, from string, recip string, data []byte) error {
+	client, conn := net.Pipe()
+	defer client.Close()
+	ss := NewSession(s, 0, conn)
+	ss.remoteHost = "127.0.0.1"
+	ss.tls = true
+	ss.authUser = user
+	go func() {
+		defer conn.Close()
+		ss.serve()
+	}()
+
+	c, err := smtp.NewClient(client, s.domain)
+	if err != nil {
+		return err
+	}
+	if err = c.Hello(s.domain); err != nil {
+		return err
+	}
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	if err = c.Rcpt(recip); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,98 @@
+package smtpd
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFutureReleaseKeyword(t *testing.T) {
+	s := &Server{maxHoldSeconds: 3600, storeMessages: true}
+	assert.False(t, s.futureRelease(), "held messages need the database")
+	s.db = new(db.Database)
+	assert.True(t, s.futureRelease())
+
+	now := time.Date(2026, 10, 19, 22, 30, 0, 0, time.FixedZone("X", 2*60*60))
+	assert.Equal(t, "FUTURERELEASE 3600 2026-10-19T21:30:00Z", s.futureReleaseKeyword(now))
+}
+
+func TestHoldParam(t *testing.T) {
+	ss := &Session{server: &Server{maxHoldSeconds: 3600, storeMessages: true,
+		db: new(db.Database)}, id: 1}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	at, reply := ss.holdParam(map[string]string{"SIZE": "100"}, now)
+	assert.Equal(t, "", reply)
+	assert.True(t, at.IsZero(), "no hold asked for")
+
+	at, reply = ss.holdParam(map[string]string{"HOLDFOR": "600"}, now)
+	assert.Equal(t, "", reply)
+	assert.Equal(t, now.Add(10*time.Minute), at)
+
+	at, reply = ss.holdParam(map[string]string{"HOLDUNTIL": "2026-10-19T14:30:00+02:00"}, now)
+	assert.Equal(t, "", reply)
+	assert.True(t, now.Add(30*time.Minute).Equal(at))
+
+	at, reply = ss.holdParam(map[string]string{"HOLDUNTIL": "2026-10-19T11:00:00Z"}, now)
+	assert.Equal(t, "", reply)
+	assert.True(t, at.IsZero(), "a time already past is delivered at once")
+
+	_, reply = ss.holdParam(map[string]string{"HOLDFOR": "3601"}, now)
+	assert.True(t, strings.HasPrefix(reply, "501 5.5.4"), reply)
+	_, reply = ss.holdParam(map[string]string{"HOLDFOR": "soon"}, now)
+	assert.True(t, strings.HasPrefix(reply, "501 5.5.4"), reply)
+	_, reply = ss.holdParam(map[string]string{"HOLDUNTIL": "tomorrow"}, now)
+	assert.True(t, strings.HasPrefix(reply, "501 5.5.4"), reply)
+	_, reply = ss.holdParam(map[string]string{"HOLDFOR": "60",
+		"HOLDUNTIL": "2026-10-19T12:10:00Z"}, now)
+	assert.True(t, strings.HasPrefix(reply, "501 5.5.4"), reply)
+
+	ss.server.maxHoldSeconds = 0
+	_, reply = ss.holdParam(map[string]string{"HOLDFOR": "60"}, now)
+	assert.True(t, strings.HasPrefix(reply, "555 5.5.4"), reply)
+}
+
+func TestParseArgsHoldUntil(t *testing.T) {
+	ss := &Session{server: &Server{}, id: 1}
+	args, ok := ss.parseArgs(" BODY=8BITMIME HOLDUNTIL=2026-10-19T14:30:00.5+02:00")
+	assert.True(t, ok)
+	assert.Equal(t, "8BITMIME", args["BODY"])
+	assert.Equal(t, "2026-10-19T14:30:00.5+02:00", args["HOLDUNTIL"])
+}
+
+// Test that a rejected release is bounced instead of put back, and that other
+// failures are retried until the attempts run out
+func TestReleaseFailed(t *testing.T) {
+	mds := &MockDataStore{}
+	mb := &MockMailbox{}
+	msg := &MockMessage{}
+	mds.On("MailboxFor").Return(mb, nil)
+	mb.On("NewMessage").Return(msg, nil)
+	msg.On("Close").Return(nil)
+	s := &Server{domain: "inbucket.local", dataStore: mds}
+
+	release := &db.FutureRelease{Id: 1, Sender: "fred@inbucket.local",
+		Recipient: "bob@inbucket.local", UserId: 1, Data: []byte("Subject: hi\r\n\r\nHello\r\n")}
+	assert.True(t, s.releaseFailed(release, errors.New("connection reset")))
+	assert.True(t, s.releaseFailed(release, &textproto.Error{Code: 451, Msg: "4.3.0 Try again"}))
+	assert.Equal(t, 2, release.Attempts)
+	mb.AssertNotCalled(t, "NewMessage")
+
+	rejected := &textproto.Error{Code: 550, Msg: "5.7.1 Not allowed to send as <fred@inbucket.local>"}
+	assert.False(t, s.releaseFailed(release, rejected), "a rejection is final")
+	mb.AssertNumberOfCalls(t, "NewMessage", 1)
+
+	release.Attempts = MAX_RELEASE_ATTEMPTS - 1
+	assert.False(t, s.releaseFailed(release, errors.New("connection reset")), "out of attempts")
+	mb.AssertNumberOfCalls(t, "NewMessage", 2)
+
+	// Nobody to bounce to
+	release.Sender = ""
+	assert.False(t, s.releaseFailed(release, rejected))
+	mb.AssertNumberOfCalls(t, "NewMessage", 2)
+}
@@ -68,8 +68,14 @@ func doRetentionScan(ds DataStore, maxAge time.Duration, sleep time.Duration) er
 
 	retained := 0
 	for _, mb := range mboxes {
+		if err := mb.Lock("retention scanner"); err != nil {
+			// In use by a POP3 session, leave it for the next scan
+			log.LogTrace("Skipping locked mailbox %v", mb)
+			continue
+		}
 		messages, err := mb.GetMessages()
 		if err != nil {
+			mb.Unlock()
 			return err
 		}
 		for _, msg := range messages {
@@ -86,6 +92,7 @@ func doRetentionScan(ds DataStore, maxAge time.Duration, sleep time.Duration) er
 				retained++
 			}
 		}
+		mb.Unlock()
 		// Sleep after completing a mailbox
 		time.Sleep(sleep)
 	}
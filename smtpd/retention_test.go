@@ -104,6 +104,56 @@ func (m *MockMailbox) NewMessage() (Message, error) {
 	return args.Get(0).(Message), args.Error(1)
 }
 
+func (m *MockMailbox) UidValidity() (uint32, error) {
+	args := m.Called()
+	return uint32(args.Int(0)), args.Error(1)
+}
+
+func (m *MockMailbox) UidNext() (uint32, error) {
+	args := m.Called()
+	return uint32(args.Int(0)), args.Error(1)
+}
+
+func (m *MockMailbox) Lock(owner string) error {
+	return nil
+}
+
+func (m *MockMailbox) Unlock() {
+}
+
+func (m *MockMailbox) Folders() ([]string, error) {
+	args := m.Called()
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockMailbox) Folder(name string) (Mailbox, error) {
+	args := m.Called(name)
+	mb, _ := args.Get(0).(Mailbox)
+	return mb, args.Error(1)
+}
+
+func (m *MockMailbox) CreateFolder(name string) (Mailbox, error) {
+	args := m.Called(name)
+	mb, _ := args.Get(0).(Mailbox)
+	return mb, args.Error(1)
+}
+
+func (m *MockMailbox) RenameFolder(name string, newName string) error {
+	args := m.Called(name, newName)
+	return args.Error(0)
+}
+
+func (m *MockMailbox) DeleteFolder(name string) error {
+	args := m.Called(name)
+	return args.Error(0)
+}
+
+func (m *MockMailbox) MoveMessage(id string, dest Mailbox) (Message, error) {
+	args := m.Called(id, dest)
+	msg, _ := args.Get(0).(Message)
+	return msg, args.Error(1)
+}
+
 func (m *MockMailbox) String() string {
 	args := m.Called()
 	return args.String(0)
@@ -119,6 +169,11 @@ func (m *MockMessage) Id() string {
 	return args.String(0)
 }
 
+func (m *MockMessage) Uid() uint32 {
+	args := m.Called()
+	return uint32(args.Int(0))
+}
+
 func (m *MockMessage) From() string {
 	args := m.Called()
 	return args.String(0)
@@ -178,3 +233,31 @@ func (m *MockMessage) String() string {
 	args := m.Called()
 	return args.String(0)
 }
+
+func (m *MockMessage) AuthResults() *AuthResults {
+	args := m.Called()
+	return args.Get(0).(*AuthResults)
+}
+
+func (m *MockMessage) SetAuthResults(results *AuthResults) {
+	m.Called(results)
+}
+
+func (m *MockMessage) SetSpamResult(result *SpamResult) {
+	m.Called(result)
+}
+
+func (m *MockMessage) SpamResult() *SpamResult {
+	args := m.Called()
+	return args.Get(0).(*SpamResult)
+}
+
+func (m *MockMessage) Flags() []string {
+	args := m.Called()
+	return args.Get(0).([]string)
+}
+
+func (m *MockMessage) SetFlags(flags []string) error {
+	args := m.Called(flags)
+	return args.Error(0)
+}
@@ -0,0 +1,365 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/egggo/inbucket/sieve"
+)
+
+// SieveFolder returns the folder a Sieve fileinto of mailbox delivers to,
+// "INBOX" being the mailbox itself
+func SieveFolder(mailbox string) string {
+	folder := strings.Trim(mailbox, "/ ")
+	if folder == "" || IsInbox(folder) {
+		return INBOX
+	}
+	return folder
+}
+
+// sieveActions runs the recipient's active Sieve script against the message,
+// nil means no script applies and the message should simply be kept
+func (ss *Session) sieveActions(recip string, header mail.Header, size int) []*sieve.Action {
+	if ss.server.db == nil {
+		return nil
+	}
+	user, err := ss.server.db.UserGetByAddress(recip)
+	if err != nil {
+		ss.logError("Failed to look up user %v: %v", recip, err)
+		return nil
+	}
+	if user == nil {
+		return nil
+	}
+	active, err := ss.server.db.SieveScriptActive(user.Id)
+	if err != nil {
+		ss.logError("Failed to load Sieve script for %v: %v", recip, err)
+		return nil
+	}
+	if active == nil {
+		return nil
+	}
+	script, err := sieve.Compile(active.Script)
+	if err != nil {
+		ss.logError("Sieve script %q for %v does not compile: %v", active.Name, recip, err)
+		return nil
+	}
+	actions, err := script.Execute(&sieve.Message{Header: header, Size: size, From: ss.from,
+		To: recip})
+	if err != nil {
+		// RFC 5228 2.10.6, fall back to the implicit keep
+		ss.logWarn("Sieve script %q for %v failed, keeping message: %v", active.Name, recip, err)
+		return nil
+	}
+	return actions
+}
+
+// rejection returns the reject action among actions, if there is one
+func rejection(actions []*sieve.Action) *sieve.Action {
+	for _, a := range actions {
+		if a.Type == sieve.ACTION_REJECT {
+			return a
+		}
+	}
+	return nil
+}
+
+// storeMessage writes the Received header and message data out to msg, along
+// with the verdicts reached for it
+func (ss *Session) storeMessage(msg Message, received []byte, data []byte) error {
+	msg.SetAuthResults(ss.authResults)
+	msg.SetSpamResult(ss.spamResult)
+	err := msg.Append(received)
+	if err == nil {
+		err = msg.Append(data)
+	}
+	if err != nil {
+		return err
+	}
+	if err := msg.Close(); err != nil {
+		ss.logError("Error: %v while writing message", err)
+		// TODO Report to client?
+	}
+	expReceivedTotal.Add(1)
+	return nil
+}
+
+// deliver carries out the Sieve actions for one recipient.  msg is the
+// message already opened in mb, the recipient's mailbox or its junk folder,
+// it is used for keep.
+func (ss *Session) deliver(recip string, mb Mailbox, msg Message, received []byte,
+	data []byte, header mail.Header, actions []*sieve.Action) error {
+	if actions == nil {
+		return ss.storeMessage(msg, received, data)
+	}
+	kept := false
+	keep := func() error {
+		if kept {
+			return nil
+		}
+		kept = true
+		return ss.storeMessage(msg, received, data)
+	}
+	for _, a := range actions {
+		switch a.Type {
+		case sieve.ACTION_KEEP:
+			if err := keep(); err != nil {
+				return err
+			}
+		case sieve.ACTION_FILEINTO:
+			folder := SieveFolder(a.Mailbox)
+			if folder == INBOX {
+				if err := keep(); err != nil {
+					return err
+				}
+				continue
+			}
+			fmb, err := FolderFor(mb, folder)
+			if err == ErrBadFolderName {
+				ss.logWarn("Sieve cannot file into %q for %v, keeping message", a.Mailbox, recip)
+				if err := keep(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			fmsg, err := fmb.NewMessage()
+			if err != nil {
+				return err
+			}
+			ss.logTrace("Sieve filed message for %v into %v", recip, folder)
+			if err := ss.storeMessage(fmsg, received, data); err != nil {
+				return err
+			}
+		case sieve.ACTION_REDIRECT:
+			if ss.server.outbound == nil {
+				ss.logWarn("No outbound delivery, cannot redirect to %v", a.Address)
+				continue
+			}
+			ss.logTrace("Sieve redirected message for %v to %v", recip, a.Address)
+			ss.server.outbound.Send(ss.from, []string{a.Address},
+				append(append([]byte{}, received...), data...))
+		case sieve.ACTION_REJECT:
+			ss.sieveReject(recip, a.Reason, header)
+		case sieve.ACTION_VACATION:
+			ss.sieveVacation(recip, a.Vacation, header)
+		}
+	}
+	if !kept {
+		ss.logTrace("Sieve script for %v did not keep the message", recip)
+	}
+	return nil
+}
+
+// sieveReject sends the sender a notification that recip refused the
+// message, for when the refusal could not be made during the SMTP session
+func (ss *Session) sieveReject(recip string, reason string, header mail.Header) {
+	if ss.from == "" || ss.server.outbound == nil {
+		return
+	}
+	ss.logInfo("Sieve rejected message from <%v> for %v", ss.from, recip)
+	ss.server.outbound.Send("", []string{ss.from},
+		RejectNotification(ss.server.domain, recip, ss.from, reason, header))
+}
+
+// sieveVacation sends a vacation response if RFC 5230 allows it and the
+// sender has not had one within the period
+func (ss *Session) sieveVacation(recip string, v *sieve.Vacation, header mail.Header) {
+	from := v.From
+	if from == "" {
+		from = recip
+	}
+	ss.autoRespond(recip, append([]string{recip}, v.Addresses...), v.Handle,
+		time.Duration(v.Days)*24*time.Hour,
+		AutoReply(ss.server.domain, from, ss.from, header, v.Subject, v.Reason, v.Mime), header)
+}
+
+// autoRespond sends reply to the envelope sender on behalf of recip, unless
+// RFC 3834 forbids it or the sender already had a response with the same
+// handle within period
+func (ss *Session) autoRespond(recip string, addresses []string, handle string,
+	period time.Duration, reply []byte, header mail.Header) {
+	if ss.server.outbound == nil || ss.server.db == nil {
+		return
+	}
+	if !AutoReplyAllowed(header, ss.from, addresses) {
+		ss.logTrace("Automatic response to <%v> for %v not allowed", ss.from, recip)
+		return
+	}
+
+	handle = fmt.Sprintf("%x", sha1.Sum([]byte(handle)))
+	last, err := ss.server.db.VacationResponseGet(recip, handle, ss.from)
+	if err != nil {
+		ss.logError("Failed to check vacation responses: %v", err)
+		return
+	}
+	if last != nil && time.Since(last.Sent) < period {
+		return
+	}
+	if err = ss.server.db.VacationResponseSave(recip, handle, ss.from); err != nil {
+		ss.logError("Failed to record vacation response: %v", err)
+		return
+	}
+
+	ss.logInfo("Sending automatic response to <%v> for %v", ss.from, recip)
+	ss.server.outbound.Send("", []string{ss.from}, reply)
+}
+
+// AutoReplyAllowed applies the RFC 3834 and RFC 5230 4.5 rules on when an
+// automatic response may be sent to sender.  addresses are those of the
+// responding user, one of which must appear in the message's recipients.
+func AutoReplyAllowed(header mail.Header, sender string, addresses []string) bool {
+	if sender == "" {
+		return false
+	}
+	local := strings.ToLower(sender)
+	if idx := strings.LastIndex(local, "@"); idx >= 0 {
+		local = local[:idx]
+	}
+	if local == "mailer-daemon" || local == "listserv" || local == "majordomo" ||
+		strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return false
+	}
+	if auto := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); auto != "" &&
+		auto != "no" {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false
+	}
+	for key := range header {
+		if strings.HasPrefix(key, "List-") {
+			return false
+		}
+	}
+
+	for _, addr := range addresses {
+		if strings.EqualFold(addr, sender) {
+			return false
+		}
+	}
+	for _, field := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc", "Resent-Bcc"} {
+		for _, value := range header[field] {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+			for _, a := range list {
+				for _, addr := range addresses {
+					if strings.EqualFold(a.Address, addr) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// replyHeaders writes the headers common to the automatic messages we send
+// in response to the message with header
+func replyHeaders(buf *bytes.Buffer, domain string, from string, to string, subject string,
+	header mail.Header) {
+	fmt.Fprintf(buf, "From: %v\r\n", from)
+	fmt.Fprintf(buf, "To: <%v>\r\n", to)
+	fmt.Fprintf(buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%v@%v>\r\n", generateId(time.Now()), domain)
+	if id := strings.TrimSpace(header.Get("Message-Id")); id != "" {
+		fmt.Fprintf(buf, "In-Reply-To: %v\r\n", id)
+		refs := strings.TrimSpace(header.Get("References"))
+		if refs == "" {
+			refs = strings.TrimSpace(header.Get("In-Reply-To"))
+		}
+		if refs != "" {
+			refs += " "
+		}
+		fmt.Fprintf(buf, "References: %v%v\r\n", refs, id)
+	}
+	fmt.Fprintf(buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+}
+
+// originalSubject decodes the subject of the message being responded to
+func originalSubject(header mail.Header) string {
+	subject := header.Get("Subject")
+	if dec, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = dec
+	}
+	return subject
+}
+
+// AutoReply builds an automatic response from from to the sender to of the
+// message with header.  The subject defaults to "Auto: " and the original
+// subject.  When isMime is set body is a MIME entity, headers included.
+func AutoReply(domain string, from string, to string, header mail.Header, subject string,
+	body string, isMime bool) []byte {
+	if subject == "" {
+		subject = "Auto: " + originalSubject(header)
+	}
+	var buf bytes.Buffer
+	replyHeaders(&buf, domain, from, to, subject, header)
+	if !isMime {
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+	}
+	buf.WriteString(strings.Replace(strings.Replace(body, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+// RejectNotification builds the RFC 5429 2.1.1 message disposition
+// notification telling the sender that recip refused their message
+func RejectNotification(domain string, recip string, sender string, reason string,
+	header mail.Header) []byte {
+	boundary := "reject-" + generateId(time.Now())
+	var buf bytes.Buffer
+	replyHeaders(&buf, domain, "Mail Delivery System <MAILER-DAEMON@"+domain+">", sender,
+		"Rejected: "+originalSubject(header), header)
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=disposition-notification;\r\n")
+	fmt.Fprintf(&buf, "\tboundary=\"%v\"\r\n\r\n", boundary)
+
+	fmt.Fprintf(&buf, "--%v\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "Your message to <%v> was rejected by the recipient:\r\n\r\n", recip)
+	buf.WriteString(strings.Replace(strings.Replace(reason, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	fmt.Fprintf(&buf, "\r\n")
+
+	fmt.Fprintf(&buf, "--%v\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: message/disposition-notification\r\n\r\n")
+	fmt.Fprintf(&buf, "Reporting-UA: %v; Inbucket\r\n", domain)
+	fmt.Fprintf(&buf, "Final-Recipient: rfc822; %v\r\n", recip)
+	if id := strings.TrimSpace(header.Get("Message-Id")); id != "" {
+		fmt.Fprintf(&buf, "Original-Message-ID: %v\r\n", id)
+	}
+	fmt.Fprintf(&buf, "Disposition: automatic-action/MDN-sent-automatically; deleted\r\n")
+
+	fmt.Fprintf(&buf, "--%v\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: text/rfc822-headers\r\n\r\n")
+	for key, values := range header {
+		for _, v := range values {
+			fmt.Fprintf(&buf, "%v: %v\r\n", key, v)
+		}
+	}
+	fmt.Fprintf(&buf, "\r\n--%v--\r\n", boundary)
+	return buf.Bytes()
+}
+
+// rejectReply formats a Sieve reject reason as a single line SMTP reply
+func rejectReply(reason string) string {
+	reason = strings.Join(strings.Fields(reason), " ")
+	if reason == "" {
+		reason = "Message rejected by recipient"
+	}
+	if len(reason) > 400 {
+		reason = reason[:400]
+	}
+	return "550 5.7.1 " + reason
+}
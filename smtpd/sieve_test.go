@@ -0,0 +1,80 @@
+package smtpd
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readHeader(t *testing.T, raw string) mail.Header {
+	m, err := mail.ReadMessage(strings.NewReader(raw + "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Header
+}
+
+func TestSieveFolder(t *testing.T) {
+	assert.Equal(t, "INBOX", SieveFolder("inbox"))
+	assert.Equal(t, "INBOX", SieveFolder(""))
+	assert.Equal(t, "Lists/Golang", SieveFolder("Lists/Golang"))
+	assert.Equal(t, "My Stuff+", SieveFolder(" /My Stuff+/"))
+}
+
+func TestAutoReplyAllowed(t *testing.T) {
+	me := []string{"james@inbucket.org", "jim@example.com"}
+
+	header := readHeader(t, "From: bob@example.com\r\nTo: James <james@inbucket.org>\r\n")
+	assert.True(t, AutoReplyAllowed(header, "bob@example.com", me))
+	assert.False(t, AutoReplyAllowed(header, "", me), "null sender")
+	assert.False(t, AutoReplyAllowed(header, "MAILER-DAEMON@example.com", me))
+	assert.False(t, AutoReplyAllowed(header, "owner-golang@example.com", me))
+	assert.False(t, AutoReplyAllowed(header, "golang-request@example.com", me))
+	assert.False(t, AutoReplyAllowed(header, "jim@example.com", me), "own address")
+
+	header = readHeader(t, "To: other@inbucket.org\r\nCc: jim@example.com\r\n")
+	assert.True(t, AutoReplyAllowed(header, "bob@example.com", me), "alternate address")
+
+	header = readHeader(t, "To: other@inbucket.org\r\n")
+	assert.False(t, AutoReplyAllowed(header, "bob@example.com", me), "not addressed to us")
+
+	for _, extra := range []string{"Auto-Submitted: auto-replied", "Precedence: bulk",
+		"List-Id: <golang.example.com>"} {
+		header = readHeader(t, "To: james@inbucket.org\r\n"+extra+"\r\n")
+		assert.False(t, AutoReplyAllowed(header, "bob@example.com", me), extra)
+	}
+	header = readHeader(t, "To: james@inbucket.org\r\nAuto-Submitted: no\r\n")
+	assert.True(t, AutoReplyAllowed(header, "bob@example.com", me))
+}
+
+func TestAutoReply(t *testing.T) {
+	header := readHeader(t, "Subject: Lunch?\r\nMessage-ID: <1@example.com>\r\n"+
+		"References: <0@example.com>\r\n")
+	reply := AutoReply("inbucket.org", "james@inbucket.org", "bob@example.com", header, "",
+		"Away\nuntil Monday", false)
+	m, err := mail.ReadMessage(strings.NewReader(string(reply)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "<bob@example.com>", m.Header.Get("To"))
+	assert.Equal(t, "Auto: Lunch?", m.Header.Get("Subject"))
+	assert.Equal(t, "auto-replied", m.Header.Get("Auto-Submitted"))
+	assert.Equal(t, "<1@example.com>", m.Header.Get("In-Reply-To"))
+	assert.Equal(t, "<0@example.com> <1@example.com>", m.Header.Get("References"))
+	assert.Contains(t, string(reply), "\r\n\r\nAway\r\nuntil Monday")
+}
+
+func TestRejectNotification(t *testing.T) {
+	header := readHeader(t, "Subject: Offer\r\nMessage-ID: <2@example.com>\r\n")
+	note := string(RejectNotification("inbucket.org", "james@inbucket.org", "bob@example.com",
+		"No thanks", header))
+	assert.Contains(t, note, "report-type=disposition-notification")
+	assert.Contains(t, note, "Final-Recipient: rfc822; james@inbucket.org")
+	assert.Contains(t, note, "Original-Message-ID: <2@example.com>")
+	assert.Contains(t, note, "No thanks")
+
+	assert.Equal(t, "550 5.7.1 Go away now", rejectReply("Go away\r\n  now\r\n"))
+	assert.Equal(t, "550 5.7.1 Message rejected by recipient", rejectReply(""))
+}
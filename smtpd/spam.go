@@ -0,0 +1,141 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SpamResult is the score given to a message by the spam engine, it is stored
+// in the X-Spam-Status header and the mailbox index
+type SpamResult struct {
+	Score     float64
+	Threshold float64
+	Spam      bool
+}
+
+// Headers formats the result as X-Spam-Score and X-Spam-Status headers
+func (r *SpamResult) Headers() []byte {
+	status := "No"
+	if r.Spam {
+		status = "Yes"
+	}
+	return []byte(fmt.Sprintf("X-Spam-Score: %.1f\r\nX-Spam-Status: %v, score=%.1f required=%.1f\r\n",
+		r.Score, status, r.Score, r.Threshold))
+}
+
+// removeSpamHeaders removes the X-Spam- headers from the header of data
+func removeSpamHeaders(data []byte) []byte {
+	return filterHeaders(data, func(name string, value string) bool {
+		return len(name) > 7 && strings.EqualFold(name[:7], "X-Spam-")
+	})
+}
+
+// ScoreSpamd has the SpamAssassin daemon listening on socket score msg using
+// the SPAMC/1.5 CHECK command
+func ScoreSpamd(socket string, timeout time.Duration, msg []byte) (*SpamResult, error) {
+	conn, err := DialSocket(socket, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	req := fmt.Sprintf("CHECK SPAMC/1.5\r\nContent-length: %v\r\n\r\n", len(msg))
+	if _, err = conn.Write(append([]byte(req), msg...)); err != nil {
+		return nil, err
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	status, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	// SPAMD/1.1 0 EX_OK
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return nil, fmt.Errorf("Bad spamd response %q", status)
+	}
+	if fields[1] != "0" {
+		return nil, fmt.Errorf("spamd failed: %v", status)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && header == nil {
+		return nil, err
+	}
+	return parseSpamdHeader(header.Get("Spam"))
+}
+
+// parseSpamdHeader interprets the Spam header of a spamd response, which
+// looks like "True ; 15.0 / 5.0"
+func parseSpamdHeader(value string) (*SpamResult, error) {
+	parts := strings.Split(value, ";")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Bad spamd Spam header %q", value)
+	}
+	scores := strings.Split(parts[1], "/")
+	if len(scores) != 2 {
+		return nil, fmt.Errorf("Bad spamd Spam header %q", value)
+	}
+	score, err := strconv.ParseFloat(strings.TrimSpace(scores[0]), 64)
+	if err != nil {
+		return nil, err
+	}
+	threshold, err := strconv.ParseFloat(strings.TrimSpace(scores[1]), 64)
+	if err != nil {
+		return nil, err
+	}
+	spam := strings.TrimSpace(parts[0])
+	return &SpamResult{Score: score, Threshold: threshold,
+		Spam: strings.EqualFold(spam, "true") || strings.EqualFold(spam, "yes")}, nil
+}
+
+// rspamdReply holds the fields we use from the rspamd /checkv2 response
+type rspamdReply struct {
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+	Action        string  `json:"action"`
+	Error         string  `json:"error"`
+}
+
+// ScoreRspamd posts msg along with its envelope to the rspamd HTTP API at
+// baseURL
+func ScoreRspamd(baseURL string, timeout time.Duration, ip string, helo string, from string,
+	recipients []string, msg []byte) (*SpamResult, error) {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(baseURL, "/")+"/checkv2",
+		bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("IP", ip)
+	req.Header.Set("Helo", helo)
+	req.Header.Set("From", from)
+	for _, rcpt := range recipients {
+		req.Header.Add("Rcpt", rcpt)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	reply := new(rspamdReply)
+	if err = json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || reply.Error != "" {
+		return nil, fmt.Errorf("rspamd failed: %v %v", resp.Status, reply.Error)
+	}
+	return &SpamResult{Score: reply.Score, Threshold: reply.RequiredScore,
+		Spam: reply.Action != "no action" && reply.Action != "greylist"}, nil
+}
@@ -0,0 +1,92 @@
+package smtpd
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startFakeSpamd scores messages mentioning viagra as spam
+func startFakeSpamd(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := textproto.NewReader(bufio.NewReader(conn))
+				if line, _ := r.ReadLine(); line != "CHECK SPAMC/1.5" {
+					io.WriteString(conn, "SPAMD/1.5 76 Bad header line\r\n\r\n")
+					return
+				}
+				header, _ := r.ReadMIMEHeader()
+				length, _ := strconv.Atoi(header.Get("Content-Length"))
+				body := make([]byte, length)
+				io.ReadFull(r.R, body)
+				if strings.Contains(string(body), "viagra") {
+					io.WriteString(conn, "SPAMD/1.1 0 EX_OK\r\nSpam: True ; 15.3 / 5.0\r\n\r\n")
+				} else {
+					io.WriteString(conn, "SPAMD/1.1 0 EX_OK\r\nSpam: False ; -0.5 / 5.0\r\n\r\n")
+				}
+			}(conn)
+		}
+	}()
+	return "inet:" + l.Addr().String(), func() { l.Close() }
+}
+
+func TestScoreSpamd(t *testing.T) {
+	socket, stop := startFakeSpamd(t)
+	defer stop()
+
+	result, err := ScoreSpamd(socket, time.Second, []byte("Subject: Hi\r\n\r\nHello\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, &SpamResult{Score: -0.5, Threshold: 5, Spam: false}, result)
+
+	result, err = ScoreSpamd(socket, time.Second, []byte("Subject: Hi\r\n\r\nBuy viagra\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, &SpamResult{Score: 15.3, Threshold: 5, Spam: true}, result)
+	assert.Equal(t, "X-Spam-Score: 15.3\r\nX-Spam-Status: Yes, score=15.3 required=5.0\r\n",
+		string(result.Headers()))
+}
+
+func TestScoreRspamd(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/checkv2", req.URL.Path)
+		assert.Equal(t, "192.0.2.1", req.Header.Get("IP"))
+		assert.Equal(t, []string{"a@example.com", "b@example.com"}, req.Header["Rcpt"])
+		body, _ := ioutil.ReadAll(req.Body)
+		assert.Equal(t, "Subject: Hi\r\n\r\nHello\r\n", string(body))
+		io.WriteString(w, `{"is_skipped":false,"score":6.2,"required_score":15.0,`+
+			`"action":"add header","symbols":{}}`)
+	}))
+	defer server.Close()
+
+	result, err := ScoreRspamd(server.URL, time.Second, "192.0.2.1", "mail.example.com",
+		"joe@example.com", []string{"a@example.com", "b@example.com"},
+		[]byte("Subject: Hi\r\n\r\nHello\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, &SpamResult{Score: 6.2, Threshold: 15, Spam: true}, result)
+}
+
+func TestRemoveSpamHeaders(t *testing.T) {
+	data := "X-Spam-Status: No, score=-10.0\r\nSubject: Hi\r\nx-spam-score: -10.0\r\n" +
+		"X-Spam: No\r\n\r\nX-Spam-Status: stays in the body\r\n"
+	want := "Subject: Hi\r\nX-Spam: No\r\n\r\nX-Spam-Status: stays in the body\r\n"
+	assert.Equal(t, want, string(removeSpamHeaders([]byte(data))))
+}
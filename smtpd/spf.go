@@ -0,0 +1,408 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RFC 7208 4.6.4 limits the number of DNS querying terms per evaluation
+const SPF_MAX_LOOKUPS = 10
+
+// These are swapped out by unit tests
+var lookupIP = net.LookupIP
+var lookupMX = net.LookupMX
+
+var errSpfLookupLimit = errors.New("SPF DNS lookup limit exceeded")
+
+// spfCheck holds the state of a single check_host() evaluation
+type spfCheck struct {
+	ip      net.IP
+	sender  string
+	helo    string
+	lookups int
+}
+
+// CheckSPF evaluates the SPF policy of domain for a message from ip with the
+// envelope sender address.  An empty sender should be replaced by
+// postmaster@<helo> by the caller as RFC 7208 2.4 describes.
+func CheckSPF(ip net.IP, domain string, sender string, helo string) string {
+	c := &spfCheck{ip: ip, sender: sender, helo: helo}
+	return c.checkHost(strings.ToLower(domain), 0)
+}
+
+// spfRecord fetches the v=spf1 record for domain
+func spfRecord(domain string) (string, string) {
+	txts, err := lookupTXT(domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.Temporary() {
+			return "", AUTH_NONE
+		}
+		return "", AUTH_TEMPERROR
+	}
+	var record string
+	found := 0
+	for _, txt := range txts {
+		if txt == "v=spf1" || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			record = txt
+			found++
+		}
+	}
+	switch found {
+	case 0:
+		return "", AUTH_NONE
+	case 1:
+		return record, ""
+	}
+	return "", AUTH_PERMERROR
+}
+
+// checkHost implements the check_host() function from RFC 7208 4
+func (c *spfCheck) checkHost(domain string, depth int) string {
+	if !ValidateDomainPart(domain) {
+		return AUTH_NONE
+	}
+	record, res := spfRecord(domain)
+	if record == "" {
+		return res
+	}
+
+	var redirect string
+	terms := strings.Fields(record)[1:]
+	for _, term := range terms {
+		if idx := strings.IndexByte(term, '='); idx > 0 &&
+			!strings.ContainsAny(term[:idx], ":/") {
+			// Modifier
+			name := strings.ToLower(term[:idx])
+			if name == "redirect" {
+				if redirect != "" {
+					return AUTH_PERMERROR
+				}
+				redirect = term[idx+1:]
+			}
+			continue
+		}
+
+		qualifier := AUTH_PASS
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier = AUTH_FAIL
+			term = term[1:]
+		case '~':
+			qualifier = AUTH_SOFTFAIL
+			term = term[1:]
+		case '?':
+			qualifier = AUTH_NEUTRAL
+			term = term[1:]
+		}
+
+		match, err := c.matchMechanism(term, domain, depth)
+		if err != nil {
+			if err == errSpfLookupLimit {
+				return AUTH_PERMERROR
+			}
+			if res, ok := spfErrorResult(err); ok {
+				return res
+			}
+			return AUTH_PERMERROR
+		}
+		if match {
+			return qualifier
+		}
+	}
+
+	if redirect != "" {
+		c.lookups++
+		if c.lookups > SPF_MAX_LOOKUPS {
+			return AUTH_PERMERROR
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return AUTH_PERMERROR
+		}
+		res := c.checkHost(strings.ToLower(target), depth+1)
+		if res == AUTH_NONE {
+			return AUTH_PERMERROR
+		}
+		return res
+	}
+
+	return AUTH_NEUTRAL
+}
+
+// spfResultError carries the result of a nested evaluation that must abort
+// the current one
+type spfResultError string
+
+func (e spfResultError) Error() string {
+	return "SPF " + string(e)
+}
+
+func spfErrorResult(err error) (string, bool) {
+	if r, ok := err.(spfResultError); ok {
+		return string(r), true
+	}
+	return "", false
+}
+
+// splitCIDR separates the optional "/ip4-cidr//ip6-cidr" suffix of a
+// mechanism argument
+func splitCIDR(arg string) (string, int, int, error) {
+	ip4, ip6 := 32, 128
+	if idx := strings.Index(arg, "//"); idx >= 0 {
+		n, err := strconv.Atoi(arg[idx+2:])
+		if err != nil || n < 0 || n > 128 {
+			return "", 0, 0, fmt.Errorf("Bad ip6 CIDR length")
+		}
+		ip6 = n
+		arg = arg[:idx]
+	}
+	if idx := strings.IndexByte(arg, '/'); idx >= 0 {
+		n, err := strconv.Atoi(arg[idx+1:])
+		if err != nil || n < 0 || n > 32 {
+			return "", 0, 0, fmt.Errorf("Bad ip4 CIDR length")
+		}
+		ip4 = n
+		arg = arg[:idx]
+	}
+	return arg, ip4, ip6, nil
+}
+
+// ipMatches checks whether candidate is within the CIDR range of c.ip
+func (c *spfCheck) ipMatches(candidate net.IP, ip4 int, ip6 int) bool {
+	if v4 := c.ip.To4(); v4 != nil {
+		if cand4 := candidate.To4(); cand4 != nil {
+			mask := net.CIDRMask(ip4, 32)
+			return v4.Mask(mask).Equal(cand4.Mask(mask))
+		}
+		return false
+	}
+	if candidate.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(ip6, 128)
+	return c.ip.Mask(mask).Equal(candidate.Mask(mask))
+}
+
+// countLookup enforces the DNS lookup limit
+func (c *spfCheck) countLookup() error {
+	c.lookups++
+	if c.lookups > SPF_MAX_LOOKUPS {
+		return errSpfLookupLimit
+	}
+	return nil
+}
+
+// matchMechanism evaluates a single mechanism (without qualifier)
+func (c *spfCheck) matchMechanism(term string, domain string, depth int) (bool, error) {
+	name, arg := term, ""
+	if idx := strings.IndexAny(term, ":/"); idx >= 0 {
+		name, arg = term[:idx], term[idx:]
+		if arg[0] == ':' {
+			arg = arg[1:]
+		}
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return false, fmt.Errorf("Bad %v address %q", name, arg)
+			}
+			return ip.Equal(c.ip), nil
+		}
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil {
+			return false, err
+		}
+		return network.Contains(c.ip), nil
+	case "a", "mx":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, ip4, ip6, err := splitCIDR(arg)
+		if err != nil {
+			return false, err
+		}
+		if target == "" {
+			target = domain
+		} else if target, err = c.expand(target, domain); err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := lookupMX(target)
+			if err != nil {
+				if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.Temporary() {
+					return false, spfResultError(AUTH_TEMPERROR)
+				}
+				return false, nil
+			}
+			hosts = hosts[:0]
+			for i, mx := range mxs {
+				if i >= SPF_MAX_LOOKUPS {
+					return false, spfResultError(AUTH_PERMERROR)
+				}
+				hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+			}
+		}
+		for _, host := range hosts {
+			ips, err := lookupIP(host)
+			if err != nil {
+				continue
+			}
+			for _, ip := range ips {
+				if c.ipMatches(ip, ip4, ip6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "include":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil || target == "" {
+			return false, fmt.Errorf("Bad include %q", arg)
+		}
+		switch c.checkHost(strings.ToLower(target), depth+1) {
+		case AUTH_PASS:
+			return true, nil
+		case AUTH_FAIL, AUTH_SOFTFAIL, AUTH_NEUTRAL:
+			return false, nil
+		case AUTH_TEMPERROR:
+			return false, spfResultError(AUTH_TEMPERROR)
+		}
+		return false, spfResultError(AUTH_PERMERROR)
+	case "exists":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil || target == "" {
+			return false, fmt.Errorf("Bad exists %q", arg)
+		}
+		ips, err := lookupIP(target)
+		return err == nil && len(ips) > 0, nil
+	case "ptr":
+		// Deprecated by RFC 7208 5.5, we never match it
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("Unknown mechanism %q", name)
+}
+
+// expand performs macro expansion per RFC 7208 7
+func (c *spfCheck) expand(spec string, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+	local, senderDomain := "postmaster", c.helo
+	if idx := strings.LastIndex(c.sender, "@"); idx >= 0 {
+		local, senderDomain = c.sender[:idx], c.sender[idx+1:]
+	}
+
+	out := new(strings.Builder)
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", fmt.Errorf("Truncated macro")
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("Bad macro %q", spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", fmt.Errorf("Bad macro %q", spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		var value string
+		switch macro[0] {
+		case 's', 'S':
+			value = c.sender
+		case 'l', 'L':
+			value = local
+		case 'o', 'O':
+			value = senderDomain
+		case 'd', 'D':
+			value = domain
+		case 'h', 'H':
+			value = c.helo
+		case 'v', 'V':
+			value = "in-addr"
+			if c.ip.To4() == nil {
+				value = "ip6"
+			}
+		case 'i', 'I':
+			if v4 := c.ip.To4(); v4 != nil {
+				value = v4.String()
+			} else {
+				nibbles := make([]string, 0, 32)
+				for _, b := range c.ip.To16() {
+					nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+				}
+				value = strings.Join(nibbles, ".")
+			}
+		default:
+			return "", fmt.Errorf("Unsupported macro %q", macro)
+		}
+
+		// Transformers: optional digits, optional 'r', optional delimiters
+		rest := macro[1:]
+		digits := 0
+		for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+			digits = digits*10 + int(rest[0]-'0')
+			rest = rest[1:]
+		}
+		reverse := false
+		if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+			reverse = true
+			rest = rest[1:]
+		}
+		delims := rest
+		if delims == "" {
+			delims = "."
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delims, r)
+		})
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if digits > 0 && digits < len(parts) {
+			parts = parts[len(parts)-digits:]
+		}
+		out.WriteString(strings.Join(parts, "."))
+	}
+	return out.String(), nil
+}
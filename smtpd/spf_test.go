@@ -0,0 +1,139 @@
+package smtpd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDNS replaces the SPF resolvers for the duration of a test
+func fakeDNS(txt map[string][]string, ips map[string][]string,
+	mxs map[string][]string) func() {
+	restoreTXT := fakeTXT(txt)
+	lookupIP = func(host string) ([]net.IP, error) {
+		addrs, ok := ips[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host}
+		}
+		result := make([]net.IP, len(addrs))
+		for i, a := range addrs {
+			result[i] = net.ParseIP(a)
+		}
+		return result, nil
+	}
+	lookupMX = func(name string) ([]*net.MX, error) {
+		hosts, ok := mxs[name]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: name}
+		}
+		result := make([]*net.MX, len(hosts))
+		for i, h := range hosts {
+			result[i] = &net.MX{Host: h + ".", Pref: uint16(i)}
+		}
+		return result, nil
+	}
+	return func() {
+		restoreTXT()
+		lookupIP = net.LookupIP
+		lookupMX = net.LookupMX
+	}
+}
+
+func TestSpfMechanisms(t *testing.T) {
+	defer fakeDNS(map[string][]string{
+		"example.com":      {"v=spf1 ip4:192.0.2.0/24 a mx include:_spf.example.net ~all"},
+		"_spf.example.net": {"v=spf1 ip6:2001:db8::/32 -all"},
+		"strict.com":       {"some other record", "v=spf1 a:mail.strict.com/28 -all"},
+		"redirect.com":     {"v=spf1 redirect=example.com"},
+		"macro.com":        {"v=spf1 exists:%{ir}.%{l1r-}.spf.macro.com -all"},
+		"double.com":       {"v=spf1 -all", "v=spf1 +all"},
+		"loop.com":         {"v=spf1 include:loop.com"},
+	}, map[string][]string{
+		"example.com":               {"198.51.100.1"},
+		"mx1.example.com":           {"198.51.100.25"},
+		"mail.strict.com":           {"203.0.113.16"},
+		"4.3.2.1.joe.spf.macro.com": {"127.0.0.2"},
+	}, map[string][]string{
+		"example.com": {"mx1.example.com"},
+	})()
+
+	ip := net.ParseIP
+	assert.Equal(t, AUTH_PASS, CheckSPF(ip("192.0.2.10"), "example.com", "a@example.com", "h"))
+	assert.Equal(t, AUTH_PASS, CheckSPF(ip("198.51.100.1"), "example.com", "a@example.com", "h"))
+	assert.Equal(t, AUTH_PASS, CheckSPF(ip("198.51.100.25"), "example.com", "a@example.com", "h"))
+	assert.Equal(t, AUTH_PASS, CheckSPF(ip("2001:db8::1"), "example.com", "a@example.com", "h"))
+	assert.Equal(t, AUTH_SOFTFAIL, CheckSPF(ip("10.0.0.1"), "example.com", "a@example.com", "h"))
+
+	assert.Equal(t, AUTH_PASS, CheckSPF(ip("203.0.113.20"), "strict.com", "a@strict.com", "h"))
+	assert.Equal(t, AUTH_FAIL, CheckSPF(ip("203.0.113.40"), "strict.com", "a@strict.com", "h"))
+
+	assert.Equal(t, AUTH_PASS, CheckSPF(ip("192.0.2.10"), "redirect.com", "a@redirect.com", "h"))
+	assert.Equal(t, AUTH_PASS, CheckSPF(ip("1.2.3.4"), "macro.com", "joe@macro.com", "h"))
+	assert.Equal(t, AUTH_FAIL, CheckSPF(ip("1.2.3.5"), "macro.com", "joe@macro.com", "h"))
+
+	assert.Equal(t, AUTH_NONE, CheckSPF(ip("1.2.3.4"), "nospf.com", "a@nospf.com", "h"))
+	assert.Equal(t, AUTH_PERMERROR, CheckSPF(ip("1.2.3.4"), "double.com", "a@double.com", "h"))
+	assert.Equal(t, AUTH_PERMERROR, CheckSPF(ip("1.2.3.4"), "loop.com", "a@loop.com", "h"))
+}
+
+func TestDmarc(t *testing.T) {
+	defer fakeTXT(map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine; adkim=s"},
+		"_dmarc.relaxed.org": {"v=DMARC1; p=none"},
+	})()
+
+	pass := []*DkimResult{{Result: AUTH_PASS, Domain: "example.com"}}
+	subPass := []*DkimResult{{Result: AUTH_PASS, Domain: "mail.example.com"}}
+
+	r := CheckDMARC("example.com", AUTH_FAIL, "", pass)
+	assert.Equal(t, AUTH_PASS, r.Result)
+	assert.Equal(t, "reject", r.Policy)
+
+	// Strict DKIM alignment, falls back to relaxed SPF alignment
+	r = CheckDMARC("example.com", AUTH_NONE, "", subPass)
+	assert.Equal(t, AUTH_FAIL, r.Result)
+	r = CheckDMARC("example.com", AUTH_PASS, "bounces.example.com", subPass)
+	assert.Equal(t, AUTH_PASS, r.Result)
+
+	// Subdomain policy comes from the organizational domain
+	r = CheckDMARC("news.example.com", AUTH_NONE, "", nil)
+	assert.Equal(t, AUTH_FAIL, r.Result)
+	assert.Equal(t, "quarantine", r.Policy)
+
+	r = CheckDMARC("relaxed.org", AUTH_NONE, "",
+		[]*DkimResult{{Result: AUTH_PASS, Domain: "x.relaxed.org"}})
+	assert.Equal(t, AUTH_PASS, r.Result)
+
+	assert.Equal(t, AUTH_NONE, CheckDMARC("nodmarc.net", AUTH_PASS, "nodmarc.net", nil).Result)
+
+	assert.Equal(t, "example.co.uk", OrganizationalDomain("mail.example.co.uk"))
+	assert.Equal(t, "example.com", OrganizationalDomain("a.b.example.com"))
+}
+
+func TestAuthResultsHeader(t *testing.T) {
+	defer fakeDNS(map[string][]string{
+		"example.com":        {"v=spf1 ip4:192.0.2.1 -all"},
+		"_dmarc.example.com": {"v=DMARC1; p=none"},
+	}, nil, nil)()
+
+	msg := []byte("From: Joe <joe@example.com>\r\nSubject: Hi\r\n\r\nBody\r\n")
+	results, header := CheckAuthentication("inbucket.local", net.ParseIP("192.0.2.1"),
+		"mail.example.com", "joe@example.com", msg)
+	assert.Equal(t, AUTH_PASS, results.Spf)
+	assert.Equal(t, AUTH_NONE, results.Dkim)
+	assert.Equal(t, AUTH_PASS, results.Dmarc)
+	assert.Equal(t, "Authentication-Results: inbucket.local;\r\n\tdkim=none;\r\n\t"+
+		"spf=pass smtp.mailfrom=joe@example.com;\r\n\t"+
+		"dmarc=pass (p=none) header.from=example.com\r\n", string(header))
+}
+
+func TestRemoveAuthResults(t *testing.T) {
+	msg := "Authentication-Results: Inbucket.local;\r\n\tdkim=pass header.d=example.com\r\n" +
+		"Authentication-Results: mx.example.com; spf=pass\r\n" +
+		"Authentication-Results: inbucket.local 1; dmarc=pass\r\n" +
+		"Subject: Hi\r\n\r\nAuthentication-Results: inbucket.local; in the body\r\n"
+	assert.Equal(t, "Authentication-Results: mx.example.com; spf=pass\r\n"+
+		"Subject: Hi\r\n\r\nAuthentication-Results: inbucket.local; in the body\r\n",
+		string(removeAuthResults([]byte(msg), "inbucket.local")))
+}
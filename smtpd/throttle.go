@@ -0,0 +1,234 @@
+package smtpd
+
+import (
+	"errors"
+	"expvar"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/egggo/inbucket/log"
+)
+
+// ErrThrottled is returned by AuthThrottle.Check while the client address or
+// username is locked out
+var ErrThrottled = errors.New("Too many failed logins, try again later")
+
+// Failures are counted separately for the client address and the username,
+// under keys with these prefixes
+const (
+	THROTTLE_KEY_IP   = "ip:"
+	THROTTLE_KEY_USER = "user:"
+)
+
+var expAuthFailuresTotal = new(expvar.Int)
+var expAuthLockoutsTotal = new(expvar.Int)
+
+// AuthBan describes an address or username that is locked out
+type AuthBan struct {
+	Key      string    `json:"key"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+type throttleEntry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// AuthThrottle slows down and then locks out clients guessing passwords over
+// POP3 and SMTP.  A nil *AuthThrottle lets everything through.
+type AuthThrottle struct {
+	sync.Mutex
+	cfg     config.ThrottleConfig
+	entries map[string]*throttleEntry
+	now     func() time.Time
+}
+
+// NewAuthThrottle creates an AuthThrottle with no failures recorded
+func NewAuthThrottle(cfg config.ThrottleConfig) *AuthThrottle {
+	return &AuthThrottle{cfg: cfg, entries: make(map[string]*throttleEntry), now: time.Now}
+}
+
+var defaultThrottle struct {
+	sync.Once
+	throttle *AuthThrottle
+}
+
+// DefaultAuthThrottle returns the AuthThrottle shared by every server, built
+// from the inbucket.Config object
+func DefaultAuthThrottle() *AuthThrottle {
+	defaultThrottle.Do(func() {
+		defaultThrottle.throttle = NewAuthThrottle(config.GetThrottleConfig())
+	})
+	return defaultThrottle.throttle
+}
+
+// Check returns ErrThrottled if either ip or user is locked out
+func (t *AuthThrottle) Check(ip string, user string) error {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	now := t.now()
+	for _, key := range throttleKeys(ip, user) {
+		if e, ok := t.entries[key]; ok && now.Before(e.until) {
+			return ErrThrottled
+		}
+	}
+	return nil
+}
+
+// Failure records a failed login by user from ip, locking either out once it
+// reaches MaxFailures.  It returns how long the caller should wait before
+// answering the client.
+func (t *AuthThrottle) Failure(service string, ip string, user string) time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	expAuthFailuresTotal.Add(1)
+	now := t.now()
+	t.expire(now)
+
+	var failures int
+	for _, key := range throttleKeys(ip, user) {
+		e, ok := t.entries[key]
+		if !ok {
+			e = &throttleEntry{}
+			t.entries[key] = e
+		}
+		e.failures++
+		e.last = now
+		if e.failures > failures {
+			failures = e.failures
+		}
+		if t.cfg.MaxFailures > 0 && e.failures >= t.cfg.MaxFailures && !now.Before(e.until) {
+			e.until = now.Add(time.Duration(t.cfg.LockoutMinutes) * time.Minute)
+			expAuthLockoutsTotal.Add(1)
+			log.LogWarn("%v login failures for %v, locked out until %v", e.failures, key,
+				e.until.Format(time.RFC3339))
+		}
+	}
+	log.LogInfo("%v login failed for %q from %v (%v failures)", service, user, ip, failures)
+
+	// Double the delay with each failure, up to the limit
+	delay := time.Duration(t.cfg.DelayMillis) * time.Millisecond
+	max := time.Duration(t.cfg.MaxDelaySeconds) * time.Second
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Success forgets the failures of user after a good login.  Those of ip are
+// left to expire with the window, or anybody holding one account could clear
+// the address they guess other passwords from.
+func (t *AuthThrottle) Success(ip string, user string) {
+	if t == nil || user == "" {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.entries, THROTTLE_KEY_USER+strings.ToLower(user))
+}
+
+// Bans lists the addresses and usernames currently locked out
+func (t *AuthThrottle) Bans() []AuthBan {
+	t.Lock()
+	defer t.Unlock()
+
+	now := t.now()
+	t.expire(now)
+	bans := make([]AuthBan, 0)
+	for key, e := range t.entries {
+		if now.Before(e.until) {
+			bans = append(bans, AuthBan{Key: key, Failures: e.failures, Until: e.until})
+		}
+	}
+	sort.Sort(authBansByKey(bans))
+	return bans
+}
+
+// Clear forgets the failures recorded against key, lifting any ban.  It
+// returns false if there were none.
+func (t *AuthThrottle) Clear(key string) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.entries[key]; !ok {
+		return false
+	}
+	delete(t.entries, key)
+	log.LogInfo("Cleared login failures for %v", key)
+	return true
+}
+
+// ClearAll forgets every recorded failure, lifting all bans
+func (t *AuthThrottle) ClearAll() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.entries = make(map[string]*throttleEntry)
+	log.LogInfo("Cleared all login failures")
+}
+
+// expire drops entries that are neither locked out nor recent enough to count,
+// the caller must hold the lock
+func (t *AuthThrottle) expire(now time.Time) {
+	window := time.Duration(t.cfg.WindowMinutes) * time.Minute
+	for key, e := range t.entries {
+		if !now.Before(e.until) && now.Sub(e.last) > window {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// banned counts the entries currently locked out, for expvar
+func (t *AuthThrottle) banned() int {
+	t.Lock()
+	defer t.Unlock()
+
+	now := t.now()
+	count := 0
+	for _, e := range t.entries {
+		if now.Before(e.until) {
+			count++
+		}
+	}
+	return count
+}
+
+func throttleKeys(ip string, user string) []string {
+	keys := []string{THROTTLE_KEY_IP + ip}
+	if user != "" {
+		keys = append(keys, THROTTLE_KEY_USER+strings.ToLower(user))
+	}
+	return keys
+}
+
+type authBansByKey []AuthBan
+
+func (b authBansByKey) Len() int           { return len(b) }
+func (b authBansByKey) Less(i, j int) bool { return b[i].Key < b[j].Key }
+func (b authBansByKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func init() {
+	am := expvar.NewMap("auth")
+	am.Set("FailuresTotal", expAuthFailuresTotal)
+	am.Set("LockoutsTotal", expAuthLockoutsTotal)
+	am.Set("BannedCurrent", expvar.Func(func() interface{} {
+		return DefaultAuthThrottle().banned()
+	}))
+}
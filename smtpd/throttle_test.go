@@ -0,0 +1,99 @@
+package smtpd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestThrottle() (*AuthThrottle, *time.Time) {
+	t := NewAuthThrottle(config.ThrottleConfig{MaxFailures: 3, DelayMillis: 100,
+		MaxDelaySeconds: 1, WindowMinutes: 10, LockoutMinutes: 5})
+	now := time.Date(2014, 1, 1, 12, 0, 0, 0, time.UTC)
+	t.now = func() time.Time { return now }
+	return t, &now
+}
+
+func TestThrottleDelay(t *testing.T) {
+	th, _ := newTestThrottle()
+	th.cfg.MaxFailures = 0
+
+	assert.Equal(t, 100*time.Millisecond, th.Failure("POP3", "192.0.2.1", "bob"))
+	assert.Equal(t, 200*time.Millisecond, th.Failure("POP3", "192.0.2.1", "bob"))
+	assert.Equal(t, 400*time.Millisecond, th.Failure("POP3", "192.0.2.1", "bob"))
+	assert.Equal(t, 800*time.Millisecond, th.Failure("POP3", "192.0.2.1", "bob"))
+	assert.Equal(t, time.Second, th.Failure("POP3", "192.0.2.1", "bob"), "capped")
+	assert.Nil(t, th.Check("192.0.2.1", "bob"), "max.failures=0 never locks out")
+
+	// A new address is delayed by the failures against the username
+	assert.Equal(t, time.Second, th.Failure("POP3", "192.0.2.2", "bob"))
+
+	// Success clears the username but not the address
+	th.Success("192.0.2.1", "bob")
+	assert.Equal(t, 100*time.Millisecond, th.Failure("POP3", "192.0.2.3", "bob"))
+	assert.Equal(t, time.Second, th.Failure("POP3", "192.0.2.1", "carol"))
+}
+
+func TestThrottleSuccess(t *testing.T) {
+	th, now := newTestThrottle()
+
+	th.Failure("IMAP", "192.0.2.1", "alice")
+	th.Failure("IMAP", "192.0.2.1", "bob")
+	th.Success("192.0.2.1", "mallory")
+	th.Failure("IMAP", "192.0.2.1", "carol")
+	assert.Equal(t, ErrThrottled, th.Check("192.0.2.1", "mallory"),
+		"a good login does not lift the address lockout")
+
+	// The address counter expires with the window instead
+	*now = now.Add(16 * time.Minute)
+	assert.Nil(t, th.Check("192.0.2.1", "mallory"))
+	th.Failure("IMAP", "192.0.2.1", "dave")
+	assert.Equal(t, 1, th.entries["ip:192.0.2.1"].failures)
+}
+
+func TestThrottleLockout(t *testing.T) {
+	th, now := newTestThrottle()
+
+	th.Failure("SMTP", "192.0.2.1", "bob")
+	th.Failure("SMTP", "192.0.2.1", "Alice")
+	assert.Nil(t, th.Check("192.0.2.1", "carol"))
+	th.Failure("SMTP", "192.0.2.1", "carol")
+	assert.Equal(t, ErrThrottled, th.Check("192.0.2.1", "dave"), "address locked out")
+	assert.Nil(t, th.Check("192.0.2.9", "alice"), "user only failed twice")
+
+	th.Failure("SMTP", "192.0.2.2", "alice")
+	th.Failure("SMTP", "192.0.2.3", "alice")
+	assert.Equal(t, ErrThrottled, th.Check("192.0.2.9", "ALICE"), "username locked out")
+
+	bans := th.Bans()
+	if assert.Equal(t, 2, len(bans)) {
+		assert.Equal(t, "ip:192.0.2.1", bans[0].Key)
+		assert.Equal(t, 3, bans[0].Failures)
+		assert.Equal(t, "user:alice", bans[1].Key)
+		assert.Equal(t, now.Add(5*time.Minute), bans[1].Until)
+	}
+
+	assert.True(t, th.Clear("user:alice"))
+	assert.False(t, th.Clear("user:alice"))
+	assert.Nil(t, th.Check("192.0.2.9", "alice"))
+
+	// Lockouts end on their own, failures are forgotten after the window
+	*now = now.Add(6 * time.Minute)
+	assert.Nil(t, th.Check("192.0.2.1", "dave"))
+	assert.Equal(t, 0, len(th.Bans()))
+	*now = now.Add(5 * time.Minute)
+	th.Failure("SMTP", "192.0.2.1", "dave")
+	assert.Nil(t, th.Check("192.0.2.1", "erin"))
+
+	th.ClearAll()
+	assert.Equal(t, 0, th.banned())
+}
+
+func TestThrottleNil(t *testing.T) {
+	var th *AuthThrottle
+	assert.Nil(t, th.Check("192.0.2.1", "bob"))
+	assert.Equal(t, time.Duration(0), th.Failure("POP3", "192.0.2.1", "bob"))
+	th.Success("192.0.2.1", "bob")
+}
@@ -6,7 +6,9 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"net"
 	"strings"
+	"time"
 )
 
 // Take "user+ext" and return "user", aka the mailbox we'll store it in
@@ -211,3 +213,26 @@ LOOP:
 
 	return buf.String(), domain, nil
 }
+
+// DialSocket connects to a filter daemon listening on socket, given in
+// Sendmail notation: inet:host:port, inet6:host:port or unix:/path.  The
+// Sendmail port@host form is also accepted for inet sockets.
+func DialSocket(socket string, timeout time.Duration) (net.Conn, error) {
+	network, addr := "", ""
+	switch {
+	case strings.HasPrefix(socket, "unix:"):
+		network, addr = "unix", socket[5:]
+	case strings.HasPrefix(socket, "inet:"):
+		network, addr = "tcp", socket[5:]
+	case strings.HasPrefix(socket, "inet6:"):
+		network, addr = "tcp6", socket[6:]
+	default:
+		return nil, fmt.Errorf("Unsupported socket %q", socket)
+	}
+	if network != "unix" {
+		if idx := strings.IndexByte(addr, '@'); idx >= 0 {
+			addr = net.JoinHostPort(addr[idx+1:], addr[:idx])
+		}
+	}
+	return net.DialTimeout(network, addr, timeout)
+}
@@ -0,0 +1,66 @@
+package smtpd
+
+import (
+	"net/mail"
+	"time"
+
+	"github.com/egggo/inbucket/sieve"
+)
+
+// DEFAULT_VACATION_DAYS is how often a sender hears from an out of office
+// reply when the user has not chosen an interval, as suggested by RFC 3834
+const DEFAULT_VACATION_DAYS = 7
+
+// vacation sends recip's out of office reply if they have one in effect and
+// vacationWanted agrees
+func (ss *Session) vacation(recip string, header mail.Header, actions []*sieve.Action) {
+	if ss.server.db == nil || ss.server.outbound == nil || !vacationWanted(actions) {
+		return
+	}
+	user, err := ss.server.db.UserGetByAddress(recip)
+	if err != nil {
+		ss.logError("Failed to look up user %v: %v", recip, err)
+		return
+	}
+	if user == nil {
+		return
+	}
+	v, err := ss.server.db.VacationGet(user.Id)
+	if err != nil {
+		ss.logError("Failed to load vacation settings for %v: %v", recip, err)
+		return
+	}
+	if v == nil || !v.InEffect(time.Now()) {
+		return
+	}
+
+	days := v.IntervalDays
+	if days <= 0 {
+		days = DEFAULT_VACATION_DAYS
+	}
+	// Changing the reply starts afresh, so senders get to see the new one
+	handle := "vacation\x00" + v.Subject + "\x00" + v.Body
+	addresses := []string{recip, user.Username + "@" + user.Domain}
+	ss.autoRespond(recip, addresses, handle, time.Duration(days)*24*time.Hour,
+		AutoReply(ss.server.domain, recip, ss.from, header, v.Subject, v.Body, false), header)
+}
+
+// vacationWanted reports whether a message handled by the Sieve actions
+// deserves an out of office reply: it must have been kept or filed, and not
+// rejected or already answered by the script
+func vacationWanted(actions []*sieve.Action) bool {
+	if actions == nil {
+		// No script, the message is kept
+		return true
+	}
+	delivered := false
+	for _, a := range actions {
+		switch a.Type {
+		case sieve.ACTION_REJECT, sieve.ACTION_VACATION:
+			return false
+		case sieve.ACTION_KEEP, sieve.ACTION_FILEINTO:
+			delivered = true
+		}
+	}
+	return delivered
+}
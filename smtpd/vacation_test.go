@@ -0,0 +1,48 @@
+package smtpd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/sieve"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVacationInEffect(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	v := &db.Vacation{Active: true}
+	assert.True(t, v.InEffect(now), "active without a period")
+
+	v.StartTime = now.Add(time.Hour)
+	assert.False(t, v.InEffect(now), "not started yet")
+	v.StartTime = now
+	assert.True(t, v.InEffect(now), "starts now")
+
+	v.EndTime = now.Add(time.Hour)
+	assert.True(t, v.InEffect(now))
+	assert.False(t, v.InEffect(now.Add(time.Hour)), "the end time is excluded")
+
+	v.Active = false
+	assert.False(t, v.InEffect(now), "inactive")
+}
+
+func TestVacationWanted(t *testing.T) {
+	action := func(types ...string) []*sieve.Action {
+		actions := make([]*sieve.Action, 0, len(types))
+		for _, a := range types {
+			actions = append(actions, &sieve.Action{Type: a})
+		}
+		return actions
+	}
+	assert.True(t, vacationWanted(nil), "no script keeps the message")
+	assert.True(t, vacationWanted(action(sieve.ACTION_KEEP)))
+	assert.True(t, vacationWanted(action(sieve.ACTION_FILEINTO)))
+	assert.True(t, vacationWanted(action(sieve.ACTION_REDIRECT, sieve.ACTION_KEEP)))
+
+	// Discarded, redirected, rejected or already answered messages get no reply
+	assert.False(t, vacationWanted(action()), "discard")
+	assert.False(t, vacationWanted(action(sieve.ACTION_REDIRECT)))
+	assert.False(t, vacationWanted(action(sieve.ACTION_REJECT)))
+	assert.False(t, vacationWanted(action(sieve.ACTION_KEEP, sieve.ACTION_VACATION)))
+}
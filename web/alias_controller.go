@@ -0,0 +1,302 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+)
+
+func AliasAdd(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	alias := new(db.Alias)
+	err = json.Unmarshal(body, alias)
+	if err != nil {
+		log.LogError("unmarshal alias %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	if err = checkAlias(alias); err != nil {
+		log.LogError("bad alias %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	existing, err := ctx.Database.AliasGetByPattern(alias.Pattern)
+	if err != nil {
+		log.LogError("check alias %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	if existing != nil {
+		log.LogError("already exist %v", existing.Pattern)
+		reply["code"] = REPLY_CODE_ALREADY_EXIST
+		reply["msg"] = "already exist alias"
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("add alias %v", alias)
+
+	err = ctx.Database.AliasAdd(alias)
+	if err != nil {
+		log.LogError("add alias %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("add alias suc %v", alias)
+
+	reply["id"] = alias.Id
+	RenderJson(w, reply)
+	return nil
+}
+
+func AliasUpdate(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	id := ctx.Vars["id"]
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	alias := new(db.Alias)
+	err = json.Unmarshal(body, alias)
+	if err != nil {
+		log.LogError("unmarshal alias %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	alias.Id, err = strconv.ParseUint(id, 10, 0)
+	if err != nil {
+		log.LogError("Bad alias id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	if err = checkAlias(alias); err != nil {
+		log.LogError("bad alias %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	existing, err := ctx.Database.AliasGetByPattern(alias.Pattern)
+	if err != nil {
+		log.LogError("check alias %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	if existing != nil && existing.Id != alias.Id {
+		log.LogError("already exist %v", existing.Pattern)
+		reply["code"] = REPLY_CODE_ALREADY_EXIST
+		reply["msg"] = "already exist alias"
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("update alias %v", alias)
+
+	err = ctx.Database.AliasUpdate(alias)
+	if err != nil {
+		log.LogError("update alias %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("update alias suc %v", alias)
+
+	RenderJson(w, reply)
+
+	return nil
+}
+
+func AliasDel(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	id := ctx.Vars["id"]
+	aliasId, err := strconv.ParseUint(id, 10, 0)
+	if err != nil {
+		log.LogError("Bad alias id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del alias id %d", aliasId)
+
+	err = ctx.Database.AliasDel(aliasId)
+	if err != nil {
+		log.LogError("del alias %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del alias suc %d", aliasId)
+
+	RenderJson(w, reply)
+
+	return nil
+}
+
+func AliasGet(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	id := ctx.Vars["id"]
+	aliasId, err := strconv.ParseUint(id, 10, 0)
+	if err != nil {
+		log.LogError("Bad alias id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("get alias id %d", aliasId)
+
+	alias, err := ctx.Database.AliasGet(aliasId)
+	if err != nil {
+		log.LogError("get alias %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	if alias == nil {
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = fmt.Errorf("no such alias").Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	reply["alias"] = alias
+	RenderJson(w, reply)
+
+	return nil
+}
+
+func AliasList(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	pagenoNum, err := strconv.Atoi(ctx.Vars["pageno"])
+	if err != nil {
+		log.LogError("Bad pageno %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	countNum, err := strconv.Atoi(ctx.Vars["count"])
+	if err != nil {
+		log.LogError("Bad count %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("get alias list %d, %d", pagenoNum, countNum)
+
+	total, aliases, err := ctx.Database.AliasList(pagenoNum, countNum)
+	if err != nil {
+		log.LogError("get alias list %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	reply["total"] = total
+	reply["aliases"] = aliases
+	RenderJson(w, reply)
+
+	return nil
+}
+
+// checkAlias validates an alias supplied by a client, tidying the target
+// list
+func checkAlias(alias *db.Alias) error {
+	alias.Pattern = strings.TrimSpace(alias.Pattern)
+	if alias.Pattern == "" || strings.ContainsAny(alias.Pattern, " ,<>") ||
+		strings.Count(alias.Pattern, "@") > 1 {
+		return fmt.Errorf("invalid pattern %q", alias.Pattern)
+	}
+
+	targets := make([]string, 0, 1)
+	for _, t := range strings.Split(alias.Target, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		addr, err := mail.ParseAddress(t)
+		if err != nil {
+			return fmt.Errorf("invalid target %q: %v", t, err)
+		}
+		if addr.Address != t {
+			return fmt.Errorf("target %q must not have a display name", t)
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("at least one target is required")
+	}
+	alias.Target = strings.Join(targets, ", ")
+	return nil
+}
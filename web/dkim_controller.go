@@ -0,0 +1,252 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+	"github.com/egggo/inbucket/smtpd"
+)
+
+type DkimRotation struct {
+	Selector string `json:"selector"`
+}
+
+func DkimGet(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	domain := ctx.Vars["domain"]
+
+	log.LogTrace("get dkim key %v", domain)
+
+	key, err := ctx.Database.DkimKeyGet(domain)
+	if err != nil {
+		log.LogError("get dkim key %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	if key == nil {
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = fmt.Errorf("no such dkim key").Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	txt, err := smtpd.DkimTxtRecord(key.PrivateKey)
+	if err != nil {
+		log.LogError("build dkim record %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	reply["key"] = key
+	reply["record"] = smtpd.DkimRecordName(key.Selector, key.Domain)
+	reply["txt"] = txt
+	RenderJson(w, reply)
+
+	return nil
+}
+
+// DkimRecord prints the DNS TXT record for a domain in zone file format
+func DkimRecord(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	domain := ctx.Vars["domain"]
+
+	key, err := ctx.Database.DkimKeyGet(domain)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		http.NotFound(w, req)
+		return nil
+	}
+	txt, err := smtpd.DkimTxtRecord(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, fmt.Sprintf("%s.\tIN\tTXT\t\"%s\"\n",
+		smtpd.DkimRecordName(key.Selector, key.Domain), txt))
+	return nil
+}
+
+// DkimRotate generates a new signing key for a domain, replacing the existing
+// key if there is one.  A selector may be provided in the request body,
+// otherwise a dated selector is derived from the configured one.
+func DkimRotate(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	domain := ctx.Vars["domain"]
+	if !smtpd.ValidateDomainPart(domain) {
+		log.LogError("Bad dkim domain %v", domain)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = fmt.Errorf("invalid domain %v", domain).Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	rotation := new(DkimRotation)
+	if len(body) > 0 {
+		err = json.Unmarshal(body, rotation)
+		if err != nil {
+			log.LogError("unmarshal dkim rotation %v", err)
+			reply["code"] = REPLY_CODE_FAIL
+			reply["msg"] = err.Error()
+			RenderJson(w, reply)
+			return nil
+		}
+	}
+
+	cfg := config.GetDkimConfig()
+	old, err := ctx.Database.DkimKeyGet(domain)
+	if err != nil {
+		log.LogError("get dkim key %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	selector := rotation.Selector
+	if selector == "" {
+		now := time.Now()
+		selector = cfg.Selector + "-" + now.Format("20060102")
+		if old != nil && old.Selector == selector {
+			selector = cfg.Selector + "-" + strconv.FormatInt(now.Unix(), 10)
+		}
+	}
+
+	log.LogTrace("rotate dkim key %v, selector %v", domain, selector)
+
+	pemKey, err := smtpd.GenerateDkimKey(cfg.KeyBits)
+	if err != nil {
+		log.LogError("generate dkim key %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	key := &db.DkimKey{Domain: domain, Selector: selector, PrivateKey: pemKey}
+	err = ctx.Database.DkimKeySave(key)
+	if err != nil {
+		log.LogError("save dkim key %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	txt, err := smtpd.DkimTxtRecord(pemKey)
+	if err != nil {
+		log.LogError("build dkim record %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("rotate dkim key suc %v", domain)
+
+	reply["key"] = key
+	reply["record"] = smtpd.DkimRecordName(key.Selector, key.Domain)
+	reply["txt"] = txt
+	RenderJson(w, reply)
+	return nil
+}
+
+func DkimDel(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	domain := ctx.Vars["domain"]
+
+	log.LogTrace("del dkim key %v", domain)
+
+	err := ctx.Database.DkimKeyDel(domain)
+	if err != nil {
+		log.LogError("del dkim key %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del dkim key suc %v", domain)
+
+	RenderJson(w, reply)
+
+	return nil
+}
+
+func DkimList(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	pageno := ctx.Vars["pageno"]
+	count := ctx.Vars["count"]
+
+	pagenoNum, err := strconv.Atoi(pageno)
+
+	if err != nil {
+		log.LogError("Bad pageno %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	countNum, err := strconv.Atoi(count)
+
+	if err != nil {
+		log.LogError("Bad count %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("get dkim key list %d, %d", pagenoNum, countNum)
+
+	total, keys, err := ctx.Database.DkimKeyList(pagenoNum, countNum)
+	if err != nil {
+		log.LogError("get dkim key list %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	reply["total"] = total
+	reply["keys"] = keys
+	RenderJson(w, reply)
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/egggo/inbucket/log"
+	"github.com/egggo/inbucket/smtpd"
+)
+
+// FolderList lists the folders of a mailbox, "/" separating the levels of the
+// hierarchy
+func FolderList(w http.ResponseWriter, req *http.Request, ctx *Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	if !mailboxAccess(w, req, ctx, name, false) {
+		return nil
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		return fmt.Errorf("Failed to get mailbox for %v: %v", name, err)
+	}
+	folders, err := mb.Folders()
+	if err != nil {
+		return fmt.Errorf("Failed to get folders for %v: %v", name, err)
+	}
+	return RenderJson(w, folders)
+}
+
+// FolderCreate creates the folder named by the folder form value, along with
+// the folders above it
+func FolderCreate(w http.ResponseWriter, req *http.Request, ctx *Context) (err error) {
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	if !mailboxAccess(w, req, ctx, name, true) {
+		return nil
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		return fmt.Errorf("MailboxFor('%v'): %v", name, err)
+	}
+	folder := req.FormValue("folder")
+	if _, err = mb.CreateFolder(folder); err != nil {
+		return folderError(w, req, err)
+	}
+	log.LogTrace("Created folder %q for %q", folder, name)
+	return folderOK(w, ctx)
+}
+
+// FolderRename renames the folder named by the folder form value, and those
+// beneath it, to newName
+func FolderRename(w http.ResponseWriter, req *http.Request, ctx *Context) (err error) {
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	if !mailboxAccess(w, req, ctx, name, true) {
+		return nil
+	}
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		return fmt.Errorf("MailboxFor('%v'): %v", name, err)
+	}
+	folder := req.FormValue("folder")
+	newName := req.FormValue("newName")
+	if err = mb.RenameFolder(folder, newName); err != nil {
+		return folderError(w, req, err)
+	}
+	log.LogTrace("Renamed folder %q for %q to %q", folder, name, newName)
+	return folderOK(w, ctx)
+}
+
+// FolderDelete deletes the folder named by the folder form value with its
+// messages, the folders beneath it are kept
+func FolderDelete(w http.ResponseWriter, req *http.Request, ctx *Context) (err error) {
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	if !mailboxAccess(w, req, ctx, name, true) {
+		return nil
+	}
+	folder := req.FormValue("folder")
+	if folder == "" || smtpd.IsInbox(folder) {
+		http.Error(w, "The INBOX cannot be deleted", http.StatusBadRequest)
+		return nil
+	}
+	// Lock the folder itself, sessions may have it open
+	mb, err := mailboxFolder(w, req, ctx, name)
+	if err != nil {
+		return fmt.Errorf("MailboxFor('%v'): %v", name, err)
+	}
+	if mb == nil {
+		return nil
+	}
+	if !lockMailbox(w, mb, name) {
+		return nil
+	}
+	defer mb.Unlock()
+	if err = mb.DeleteFolder(folder); err != nil {
+		return folderError(w, req, err)
+	}
+	log.LogTrace("Deleted folder %q for %q", folder, name)
+	return folderOK(w, ctx)
+}
+
+// MailboxMove moves a message from the folder form value, the INBOX if empty,
+// to the folder named by the to form value
+func MailboxMove(w http.ResponseWriter, req *http.Request, ctx *Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	if !mailboxAccess(w, req, ctx, name, true) {
+		return nil
+	}
+	mb, err := mailboxFolder(w, req, ctx, name)
+	if err != nil {
+		return err
+	}
+	if mb == nil {
+		return nil
+	}
+	dest, err := mb.Folder(req.FormValue("to"))
+	if err != nil {
+		return folderError(w, req, err)
+	}
+	if !lockMailbox(w, mb, name) {
+		return nil
+	}
+	defer mb.Unlock()
+	if _, err = mb.MoveMessage(id, dest); err != nil {
+		return folderError(w, req, err)
+	}
+	log.LogTrace("Moved message %v of %q to %v", id, name, dest)
+	return folderOK(w, ctx)
+}
+
+// folderOK answers a successful change the way the mailbox handlers do
+func folderOK(w http.ResponseWriter, ctx *Context) error {
+	if ctx.IsJson {
+		return RenderJson(w, "OK")
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "OK")
+	return nil
+}
@@ -0,0 +1,145 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+)
+
+func ForwardGet(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("get forward %d", user.Id)
+
+	forward, err := ctx.Database.ForwardGet(user.Id)
+	if err != nil {
+		log.LogError("get forward %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	if forward == nil {
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = fmt.Errorf("no forwarding configured").Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	reply["forward"] = forward
+	RenderJson(w, reply)
+
+	return nil
+}
+
+// ForwardPut sets the address the user's mail is forwarded to and whether a
+// local copy is kept
+func ForwardPut(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	forward := new(db.Forward)
+	err = json.Unmarshal(body, forward)
+	if err != nil {
+		log.LogError("unmarshal forward %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	forward.UserId = user.Id
+
+	addr, err := mail.ParseAddress(forward.Address)
+	if err == nil && addr.Address != strings.TrimSpace(forward.Address) {
+		err = fmt.Errorf("address must not have a display name")
+	}
+	if err == nil && strings.EqualFold(addr.Address, user.Username+"@"+user.Domain) {
+		err = fmt.Errorf("cannot forward to yourself")
+	}
+	if err != nil {
+		log.LogError("bad forward address %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	forward.Address = addr.Address
+
+	log.LogTrace("put forward %d %v", user.Id, forward.Address)
+
+	err = ctx.Database.ForwardSave(forward)
+	if err != nil {
+		log.LogError("save forward %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("put forward suc %d", user.Id)
+
+	reply["forward"] = forward
+	RenderJson(w, reply)
+
+	return nil
+}
+
+func ForwardDel(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del forward %d", user.Id)
+
+	err := ctx.Database.ForwardDel(user.Id)
+	if err != nil {
+		log.LogError("del forward %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del forward suc %d", user.Id)
+
+	RenderJson(w, reply)
+
+	return nil
+}
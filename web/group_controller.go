@@ -9,7 +9,9 @@ import (
 	// "errors"
 	"io/ioutil"
 	"net/http"
+	"net/mail"
 	"strconv"
+	"strings"
 )
 
 func GroupAdd(w http.ResponseWriter, req *http.Request, ctx *Context) error {
@@ -37,6 +39,14 @@ func GroupAdd(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 		return nil
 	}
 
+	if err = checkGroupPolicy(group); err != nil {
+		log.LogError("bad group %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
 	user, err := ctx.Database.UserGetByName(group.Name)
 	if err != nil {
 		log.LogError("check group and user %v", err)
@@ -89,8 +99,7 @@ func GroupUpdate(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 	}
 
 	log.LogTrace("body: %v", body)
-	group := new(db.Group)
-	group.Id, err = strconv.ParseUint(id, 10, 0)
+	groupId, err := strconv.ParseUint(id, 10, 0)
 	if err != nil {
 		log.LogError("Bad group id %v", err)
 		reply["code"] = REPLY_CODE_FAIL
@@ -99,7 +108,18 @@ func GroupUpdate(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 		return nil
 	}
 
+	// Fields missing from the body keep their current values
+	group, err := ctx.Database.GroupGet(groupId)
+	if err != nil || group == nil {
+		log.LogError("get group %v %v", groupId, err)
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = "group not found"
+		RenderJson(w, reply)
+		return nil
+	}
+
 	err = json.Unmarshal(body, group)
+	group.Id = groupId
 	if err != nil {
 		log.LogError("unmarshal group %v", err)
 		reply["code"] = REPLY_CODE_FAIL
@@ -108,6 +128,14 @@ func GroupUpdate(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 		return nil
 	}
 
+	if err = checkGroupPolicy(group); err != nil {
+		log.LogError("bad group %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
 	log.LogTrace("update group %v", group)
 
 	err = ctx.Database.GroupUpdate(group)
@@ -272,6 +300,14 @@ func GroupMemberAdd(w http.ResponseWriter, req *http.Request, ctx *Context) erro
 		return nil
 	}
 
+	if err = checkGroupMember(ctx, groupMember); err != nil {
+		log.LogError("bad groupMember %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
 	log.LogTrace("add groupMember %v", groupMember)
 
 	err = ctx.Database.GroupMemberAdd(groupMember)
@@ -323,6 +359,78 @@ func GroupMemberDel(w http.ResponseWriter, req *http.Request, ctx *Context) erro
 	return nil
 }
 
+// GroupMemberUpdate changes the list delivery settings of a member, digest
+// and disabled.  Enabling a member clears its bounce count.
+func GroupMemberUpdate(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	id := ctx.Vars["id"]
+	groupMemberId, err := strconv.ParseUint(id, 10, 0)
+	if err != nil {
+		log.LogError("Bad groupMember id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	groupMember, err := ctx.Database.GroupMemberGet(groupMemberId)
+	if err != nil || groupMember == nil {
+		log.LogError("get groupMember %v %v", groupMemberId, err)
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = "group member not found"
+		RenderJson(w, reply)
+		return nil
+	}
+
+	settings := struct {
+		Digest   *bool `json:"digest"`
+		Disabled *bool `json:"disabled"`
+	}{}
+	err = json.Unmarshal(body, &settings)
+	if err != nil {
+		log.LogError("unmarshal groupMember %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	if settings.Digest != nil {
+		groupMember.Digest = *settings.Digest
+	}
+	if settings.Disabled != nil {
+		groupMember.Disabled = *settings.Disabled
+		if !groupMember.Disabled {
+			groupMember.Bounces = 0
+		}
+	}
+
+	err = ctx.Database.GroupMemberUpdate(groupMember)
+	if err != nil {
+		log.LogError("update groupMember %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("update groupMember suc %v", groupMember)
+
+	RenderJson(w, reply)
+	return nil
+}
+
 func GroupMemberGet(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 	reply := make(Reply)
 	reply["code"] = REPLY_CODE_OK
@@ -418,3 +526,161 @@ func GroupMemberList(w http.ResponseWriter, req *http.Request, ctx *Context) err
 
 	return nil
 }
+
+// checkGroupMember makes sure a new member is exactly one of a user, a group
+// or an address, and that nesting a group would not make a group a member of
+// itself
+func checkGroupMember(ctx *Context, groupMember *db.GroupMember) error {
+	kinds := 0
+	for _, set := range []bool{groupMember.UserId != 0, groupMember.MemberGroupId != 0,
+		groupMember.Address != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("exactly one of userId, memberGroupId and address is required")
+	}
+	if groupMember.MemberGroupId == groupMember.GroupId {
+		return fmt.Errorf("a group cannot contain itself")
+	}
+	if groupMember.Address != "" {
+		addr, err := mail.ParseAddress(groupMember.Address)
+		if err != nil {
+			return err
+		}
+		if addr.Address != strings.TrimSpace(groupMember.Address) {
+			return fmt.Errorf("address must not have a display name")
+		}
+		groupMember.Address = addr.Address
+	}
+	group, err := ctx.Database.GroupGet(groupMember.GroupId)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		return fmt.Errorf("no such group %v", groupMember.GroupId)
+	}
+	if groupMember.Address != "" {
+		existing, err := ctx.Database.GroupMemberGetByAddress(groupMember.GroupId,
+			groupMember.Address)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("%v is already a member", groupMember.Address)
+		}
+		return nil
+	}
+	if groupMember.MemberGroupId == 0 {
+		return nil
+	}
+	member, err := ctx.Database.GroupGet(groupMember.MemberGroupId)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		return fmt.Errorf("no such group %v", groupMember.MemberGroupId)
+	}
+	nested, err := ctx.Database.GroupNested(groupMember.MemberGroupId)
+	if err != nil {
+		return err
+	}
+	if nested[groupMember.GroupId] {
+		return fmt.Errorf("group %v already contains group %v", member.Name, groupMember.GroupId)
+	}
+	return nil
+}
+
+// GroupMemberPutAddress adds the address in the route to the group, for
+// members outside Inbucket
+func GroupMemberPutAddress(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	id := ctx.Vars["id"]
+	groupId, err := strconv.ParseUint(id, 10, 0)
+	if err != nil {
+		log.LogError("Bad group id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	groupMember := &db.GroupMember{GroupId: groupId, Address: ctx.Vars["address"]}
+	if err = checkGroupMember(ctx, groupMember); err != nil {
+		log.LogError("bad groupMember %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("add groupMember %v", groupMember)
+
+	err = ctx.Database.GroupMemberAdd(groupMember)
+	if err != nil {
+		log.LogError("add groupMember %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("add groupMember suc %v", groupMember)
+
+	reply["id"] = groupMember.Id
+	RenderJson(w, reply)
+	return nil
+}
+
+func GroupMemberDelAddress(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	id := ctx.Vars["id"]
+	groupId, err := strconv.ParseUint(id, 10, 0)
+	if err != nil {
+		log.LogError("Bad group id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	address := ctx.Vars["address"]
+
+	log.LogTrace("del groupMember %d %v", groupId, address)
+
+	groupMember, err := ctx.Database.GroupMemberGetByAddress(groupId, address)
+	if err != nil {
+		log.LogError("get groupMember %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	if groupMember == nil {
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = fmt.Errorf("no such group member").Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	err = ctx.Database.GroupMemberDelByAddress(groupId, address)
+	if err != nil {
+		log.LogError("del groupMember %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del groupMember suc %d %v", groupId, address)
+
+	RenderJson(w, reply)
+
+	return nil
+}
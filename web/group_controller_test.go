@@ -0,0 +1,75 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/stretchr/testify/assert"
+)
+
+// The checks that need no database
+func TestCheckGroupMember(t *testing.T) {
+	ctx := &Context{Database: &db.Database{}}
+	for _, m := range []*db.GroupMember{
+		{GroupId: 1},
+		{GroupId: 1, UserId: 2, MemberGroupId: 3},
+		{GroupId: 1, UserId: 2, Address: "bob@example.com"},
+		{GroupId: 1, MemberGroupId: 3, Address: "bob@example.com"},
+	} {
+		err := checkGroupMember(ctx, m)
+		if assert.NotNil(t, err, "%+v", m) {
+			assert.Contains(t, err.Error(), "exactly one of")
+		}
+	}
+
+	err := checkGroupMember(ctx, &db.GroupMember{GroupId: 1, MemberGroupId: 1})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "a group cannot contain itself", err.Error())
+	}
+}
+
+func groupReply(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	reply := make(map[string]interface{})
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// Outside addresses are refused before the database is asked
+func TestGroupMemberPutAddress(t *testing.T) {
+	for _, tc := range []struct {
+		id, address, msg string
+	}{
+		{"staff", "bob@example.com", "invalid syntax"},
+		{"1", "not an address", "mail: "},
+		{"1", "Bob <bob@example.com>", "address must not have a display name"},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "http://localhost/group/1/member/bob@example.com", nil)
+		ctx := &Context{Database: &db.Database{},
+			Vars: map[string]string{"id": tc.id, "address": tc.address}}
+		if err := GroupMemberPutAddress(w, req, ctx); err != nil {
+			t.Fatal(err)
+		}
+		reply := groupReply(t, w)
+		assert.Equal(t, REPLY_CODE_FAIL, reply["code"], "%+v", tc)
+		assert.Contains(t, reply["msg"], tc.msg)
+	}
+}
+
+func TestGroupMemberDelAddress(t *testing.T) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "http://localhost/group/1/member/bob@example.com", nil)
+	ctx := &Context{Database: &db.Database{},
+		Vars: map[string]string{"id": "staff", "address": "bob@example.com"}}
+	if err := GroupMemberDelAddress(w, req, ctx); err != nil {
+		t.Fatal(err)
+	}
+	reply := groupReply(t, w)
+	assert.Equal(t, REPLY_CODE_FAIL, reply["code"])
+	assert.Contains(t, reply["msg"], "invalid syntax")
+}
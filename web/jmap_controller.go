@@ -0,0 +1,697 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+	"github.com/egggo/inbucket/smtpd"
+)
+
+// The capabilities of our JMAP (RFC 8620) service
+const (
+	JMAP_CORE       = "urn:ietf:params:jmap:core"
+	JMAP_MAIL       = "urn:ietf:params:jmap:mail"
+	JMAP_SUBMISSION = "urn:ietf:params:jmap:submission"
+)
+
+// Limits advertised in the core capability
+const (
+	JMAP_MAX_REQUEST = 10 * 1024 * 1024
+	JMAP_MAX_CALLS   = 16
+	JMAP_MAX_OBJECTS = 500
+)
+
+// How often an event source checks the accounts for changes
+const JMAP_POLL_INTERVAL = 5 * time.Second
+
+// jmapAccount is a mailbox the user may open over JMAP, their own or a shared
+// one.  The account ID is u<user id> or s<shared mailbox id>.
+type jmapAccount struct {
+	Id       string
+	Name     string
+	Address  string
+	Personal bool
+	Rights   *db.MailboxAcl
+}
+
+// jmapSession is the state of one authenticated JMAP request
+type jmapSession struct {
+	ctx        *Context
+	user       *db.User
+	accounts   map[string]*jmapAccount
+	primary    string
+	using      map[string]bool
+	createdIds map[string]string
+	responses  []jmapInvocation
+	implicit   []jmapInvocation // Responses of calls made on behalf of the current one
+}
+
+// jmapInvocation is a method call or response: name, arguments and call ID
+type jmapInvocation struct {
+	Name   string
+	Args   interface{}
+	CallId string
+}
+
+func (inv jmapInvocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{inv.Name, inv.Args, inv.CallId})
+}
+
+// jmapCall is a method call as the client sent it
+type jmapCall struct {
+	Name   string
+	Args   map[string]json.RawMessage
+	CallId string
+}
+
+func (call *jmapCall) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	if len(parts) != 3 {
+		return fmt.Errorf("Invocation must have 3 elements")
+	}
+	if err := json.Unmarshal(parts[0], &call.Name); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(parts[1], &call.Args); err != nil {
+		return err
+	}
+	if call.Args == nil {
+		return fmt.Errorf("Invocation arguments must be an object")
+	}
+	return json.Unmarshal(parts[2], &call.CallId)
+}
+
+type jmapRequest struct {
+	Using       []string          `json:"using"`
+	MethodCalls []jmapCall        `json:"methodCalls"`
+	CreatedIds  map[string]string `json:"createdIds"`
+}
+
+type jmapResponse struct {
+	MethodResponses []jmapInvocation  `json:"methodResponses"`
+	CreatedIds      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// jmapError is a method level error, RFC 8620 section 3.6.2
+type jmapError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *jmapError) Error() string {
+	if e.Description == "" {
+		return e.Type
+	}
+	return e.Type + ": " + e.Description
+}
+
+// jmapSetError explains why one object of a /set call was not changed
+type jmapSetError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+	MaxSize     int      `json:"maxSize,omitempty"`
+	// The addresses refused by EmailSubmission/set, and its limit on them
+	InvalidRecipients []string `json:"invalidRecipients,omitempty"`
+	MaxRecipients     int      `json:"maxRecipients,omitempty"`
+}
+
+// jmapMethod handles the arguments of a method call, returning the arguments
+// of its response
+type jmapMethod struct {
+	capability string
+	fn         func(s *jmapSession, args jmapArgs) (interface{}, error)
+}
+
+var jmapMethods = map[string]jmapMethod{
+	"Core/echo":             {JMAP_CORE, jmapEcho},
+	"Mailbox/get":           {JMAP_MAIL, jmapMailboxGet},
+	"Email/query":           {JMAP_MAIL, jmapEmailQuery},
+	"Email/get":             {JMAP_MAIL, jmapEmailGet},
+	"Email/set":             {JMAP_MAIL, jmapEmailSet},
+	"Identity/get":          {JMAP_SUBMISSION, jmapIdentityGet},
+	"EmailSubmission/set":   {JMAP_SUBMISSION, jmapEmailSubmissionSet},
+	"EmailSubmission/get":   {JMAP_SUBMISSION, jmapEmailSubmissionGet},
+	"EmailSubmission/query": {JMAP_SUBMISSION, jmapEmailSubmissionQuery},
+}
+
+// JmapWellKnown points clients at the session resource, RFC 8620 section 2.2
+func JmapWellKnown(w http.ResponseWriter, req *http.Request, ctx *Context) (err error) {
+	http.Redirect(w, req, reverse("JmapSession"), http.StatusMovedPermanently)
+	return nil
+}
+
+// JmapSession describes the service and the accounts of the user
+func JmapSession(w http.ResponseWriter, req *http.Request, ctx *Context) (err error) {
+	s, err := jmapAuth(w, req, ctx)
+	if s == nil {
+		return err
+	}
+
+	base := "http://" + req.Host
+	if req.TLS != nil {
+		base = "https://" + req.Host
+	}
+	accounts := make(map[string]interface{})
+	for _, acct := range s.accounts {
+		capabilities := map[string]interface{}{
+			JMAP_MAIL: map[string]interface{}{
+				"maxMailboxesPerEmail":       1,
+				"maxMailboxDepth":            nil,
+				"maxSizeMailboxName":         255,
+				"maxSizeAttachmentsPerEmail": 0,
+				"emailQuerySortOptions":      []string{"receivedAt", "size", "from", "subject"},
+				"mayCreateTopLevelMailbox":   false,
+			},
+		}
+		if acct.Rights.SendAs {
+			capabilities[JMAP_SUBMISSION] = map[string]interface{}{
+				"maxDelayedSend":       config.GetSmtpConfig().MaxHoldSeconds,
+				"submissionExtensions": map[string][]string{"FUTURERELEASE": {}},
+			}
+		}
+		accounts[acct.Id] = map[string]interface{}{
+			"name":                acct.Address,
+			"isPersonal":          acct.Personal,
+			"isReadOnly":          !acct.Rights.Delete,
+			"accountCapabilities": capabilities,
+		}
+	}
+
+	return RenderJson(w, map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			JMAP_CORE: map[string]interface{}{
+				"maxSizeUpload":         0,
+				"maxConcurrentUpload":   1,
+				"maxSizeRequest":        JMAP_MAX_REQUEST,
+				"maxConcurrentRequests": 4,
+				"maxCallsInRequest":     JMAP_MAX_CALLS,
+				"maxObjectsInGet":       JMAP_MAX_OBJECTS,
+				"maxObjectsInSet":       JMAP_MAX_OBJECTS,
+				"collationAlgorithms":   []string{},
+			},
+			JMAP_MAIL:       map[string]interface{}{},
+			JMAP_SUBMISSION: map[string]interface{}{},
+		},
+		"accounts": accounts,
+		"primaryAccounts": map[string]string{
+			JMAP_MAIL:       s.primary,
+			JMAP_SUBMISSION: s.primary,
+		},
+		"username":       s.user.Username,
+		"apiUrl":         base + reverse("JmapApi"),
+		"downloadUrl":    base + "/jmap/download/{accountId}/{blobId}/{name}?type={type}",
+		"uploadUrl":      base + "/jmap/upload/{accountId}",
+		"eventSourceUrl": base + reverse("JmapEventSource") + "?types={types}&closeafter={closeafter}&ping={ping}",
+		"state":          s.state(),
+	})
+}
+
+// JmapApi runs the method calls of a JMAP request, RFC 8620 section 3
+func JmapApi(w http.ResponseWriter, req *http.Request, ctx *Context) (err error) {
+	s, err := jmapAuth(w, req, ctx)
+	if s == nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, JMAP_MAX_REQUEST+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > JMAP_MAX_REQUEST {
+		return jmapProblem(w, "urn:ietf:params:jmap:error:limit", "maxSizeRequest",
+			"The request is too large")
+	}
+	if !json.Valid(body) {
+		return jmapProblem(w, "urn:ietf:params:jmap:error:notJSON", "",
+			"The request is not valid JSON")
+	}
+	var request jmapRequest
+	if err = json.Unmarshal(body, &request); err != nil || request.MethodCalls == nil {
+		return jmapProblem(w, "urn:ietf:params:jmap:error:notRequest", "",
+			"The request is not a JMAP request object")
+	}
+	s.using = make(map[string]bool)
+	for _, capability := range request.Using {
+		if capability != JMAP_CORE && capability != JMAP_MAIL && capability != JMAP_SUBMISSION {
+			return jmapProblem(w, "urn:ietf:params:jmap:error:unknownCapability", "",
+				fmt.Sprintf("Unknown capability %v", capability))
+		}
+		s.using[capability] = true
+	}
+	if len(request.MethodCalls) > JMAP_MAX_CALLS {
+		return jmapProblem(w, "urn:ietf:params:jmap:error:limit", "maxCallsInRequest",
+			"Too many method calls")
+	}
+
+	s.createdIds = make(map[string]string)
+	for k, v := range request.CreatedIds {
+		s.createdIds[k] = v
+	}
+	for _, call := range request.MethodCalls {
+		s.run(call)
+	}
+
+	response := &jmapResponse{MethodResponses: s.responses, SessionState: s.state()}
+	if request.CreatedIds != nil {
+		response.CreatedIds = s.createdIds
+	}
+	return RenderJson(w, response)
+}
+
+// JmapDownload sends a message, or one of its attachments, as a blob
+func JmapDownload(w http.ResponseWriter, req *http.Request, ctx *Context) (err error) {
+	s, err := jmapAuth(w, req, ctx)
+	if s == nil {
+		return err
+	}
+	acct := s.accounts[ctx.Vars["accountId"]]
+	if acct == nil {
+		http.NotFound(w, req)
+		return nil
+	}
+	data, err := s.blob(acct, ctx.Vars["blobId"])
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	contentType := req.FormValue("type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", ctx.Vars["name"]))
+	w.Header().Set("Cache-Control", "private, immutable, max-age=31536000")
+	_, err = w.Write(data)
+	return err
+}
+
+// JmapUpload refuses uploads, messages can only be created from their text
+func JmapUpload(w http.ResponseWriter, req *http.Request, ctx *Context) (err error) {
+	s, err := jmapAuth(w, req, ctx)
+	if s == nil {
+		return err
+	}
+	http.Error(w, "Uploads are not supported", http.StatusNotImplemented)
+	return nil
+}
+
+// JmapEventSource pushes StateChange events (RFC 8620 section 7.3) as the
+// accounts change.  It answers unbuffered, so is not wrapped as a handler; the
+// server's write timeout ends the stream after a minute and EventSource
+// clients reconnect by themselves.
+func JmapEventSource(w http.ResponseWriter, req *http.Request) {
+	ctx, err := NewContext(req)
+	if err != nil {
+		log.LogError("Failed to create context: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer ctx.Close()
+	log.LogTrace("Web: %v %v %v %v", req.RemoteAddr, req.Proto, req.Method, req.RequestURI)
+
+	s, err := jmapAuth(w, req, ctx)
+	if s == nil {
+		if err != nil {
+			log.LogError("Error handling %v: %v", req.RequestURI, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	types := make(map[string]bool)
+	for _, t := range strings.Split(req.FormValue("types"), ",") {
+		if t != "" {
+			types[t] = true
+		}
+	}
+	closeAfter := req.FormValue("closeafter") == "state"
+	ping, _ := strconv.Atoi(req.FormValue("ping"))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	states := s.typeStates(types)
+	poll := time.NewTicker(JMAP_POLL_INTERVAL)
+	defer poll.Stop()
+	var pings <-chan time.Time
+	if ping > 0 {
+		pinger := time.NewTicker(time.Duration(ping) * time.Second)
+		defer pinger.Stop()
+		pings = pinger.C
+	}
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-pings:
+			fmt.Fprintf(w, "event: ping\ndata: {\"interval\":%v}\n\n", ping)
+		case <-poll.C:
+			current := s.typeStates(types)
+			changed := make(map[string]map[string]string)
+			for id, typeStates := range current {
+				for t, state := range typeStates {
+					if states[id][t] != state {
+						if changed[id] == nil {
+							changed[id] = make(map[string]string)
+						}
+						changed[id][t] = state
+					}
+				}
+			}
+			states = current
+			if len(changed) == 0 {
+				continue
+			}
+			data, _ := json.Marshal(map[string]interface{}{"@type": "StateChange",
+				"changed": changed})
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+			if closeAfter {
+				flusher.Flush()
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// typeStates returns the states of the data types wanted, all if empty, for
+// each account
+func (s *jmapSession) typeStates(types map[string]bool) map[string]map[string]string {
+	all := len(types) == 0 || types["*"]
+	states := make(map[string]map[string]string)
+	for id, acct := range s.accounts {
+		mailboxState, emailState, err := s.accountStates(acct)
+		if err != nil {
+			log.LogError("Failed to read state of JMAP account %v: %v", acct.Name, err)
+			continue
+		}
+		states[id] = make(map[string]string)
+		if all || types["Mailbox"] {
+			states[id]["Mailbox"] = mailboxState
+		}
+		if all || types["Email"] {
+			states[id]["Email"] = emailState
+		}
+	}
+	return states
+}
+
+// jmapAuth signs the user in with HTTP basic authentication against the user
+// database, and finds the accounts they may use.  It returns nil after
+// answering the request if that fails.
+func jmapAuth(w http.ResponseWriter, req *http.Request, ctx *Context) (*jmapSession, error) {
+	if ctx.Database == nil {
+		http.Error(w, "JMAP requires the user database", http.StatusServiceUnavailable)
+		return nil, nil
+	}
+	login, pass, ok := req.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", "Inbucket JMAP"))
+		http.Error(w, "Sign in to use JMAP", http.StatusUnauthorized)
+		return nil, nil
+	}
+	login = strings.Split(login, "@")[0]
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+
+	user, err := smtpd.LogIn(ctx.Database, smtpd.DefaultAuthThrottle(), "JMAP", ip, login,
+		smtpd.PasswordCheck(ctx.Database, pass))
+	if err == smtpd.ErrThrottled {
+		log.LogWarn("Refusing JMAP login for %v - %v", login, err)
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return nil, nil
+	}
+	if err != nil {
+		log.LogWarn("Failed JMAP auth for %v - %v", login, err)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", "Inbucket JMAP"))
+		http.Error(w, "Authentication failed", http.StatusUnauthorized)
+		return nil, nil
+	}
+
+	s := &jmapSession{ctx: ctx, user: user, accounts: make(map[string]*jmapAccount)}
+	name, err := smtpd.ParseMailboxName(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	domain := user.Domain
+	if domain == "" {
+		domain = config.GetSmtpConfig().Domain
+	}
+	s.primary = fmt.Sprintf("u%v", user.Id)
+	s.accounts[s.primary] = &jmapAccount{Id: s.primary, Name: name, Address: name + "@" + domain,
+		Personal: true, Rights: &db.MailboxAcl{UserId: user.Id, Read: true, Delete: true,
+			SendAs: true}}
+
+	acls, err := ctx.Database.MailboxAclListByUser(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, acl := range acls {
+		if !acl.Read {
+			continue
+		}
+		shared, err := ctx.Database.SharedMailboxGet(acl.MailboxId)
+		if err != nil {
+			return nil, err
+		}
+		if shared == nil {
+			continue
+		}
+		id := fmt.Sprintf("s%v", shared.Id)
+		s.accounts[id] = &jmapAccount{Id: id, Name: shared.Name,
+			Address: shared.Name + "@" + config.GetSmtpConfig().Domain, Rights: acl}
+	}
+	return s, nil
+}
+
+// jmapProblem refuses a whole request, RFC 8620 section 3.6.1
+func jmapProblem(w http.ResponseWriter, problem string, limit string, detail string) error {
+	body := map[string]interface{}{"type": problem, "status": http.StatusBadRequest,
+		"detail": detail}
+	if limit != "" {
+		body["limit"] = limit
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	return json.NewEncoder(w).Encode(body)
+}
+
+// run answers one method call, adding the responses
+func (s *jmapSession) run(call jmapCall) {
+	s.implicit = nil
+	args, err := s.resolveReferences(call.Args)
+	var result interface{}
+	if err == nil {
+		result, err = s.invoke(call.Name, args)
+	}
+	if err != nil {
+		jerr, ok := err.(*jmapError)
+		if !ok {
+			log.LogError("JMAP %v failed for %v: %v", call.Name, s.user.Username, err)
+			jerr = &jmapError{Type: "serverFail"}
+		}
+		s.responses = append(s.responses, jmapInvocation{"error", jerr, call.CallId})
+		return
+	}
+	s.responses = append(s.responses, jmapInvocation{call.Name, result, call.CallId})
+	for _, inv := range s.implicit {
+		inv.CallId = call.CallId
+		s.responses = append(s.responses, inv)
+	}
+}
+
+func (s *jmapSession) invoke(name string, args jmapArgs) (interface{}, error) {
+	method, ok := jmapMethods[name]
+	if !ok || !s.using[method.capability] {
+		return nil, &jmapError{Type: "unknownMethod"}
+	}
+	return method.fn(s, args)
+}
+
+// resolveReferences replaces the #name arguments referring to the results of
+// earlier calls, RFC 8620 section 3.7
+func (s *jmapSession) resolveReferences(args map[string]json.RawMessage) (jmapArgs, error) {
+	resolved := make(jmapArgs)
+	for key, value := range args {
+		if !strings.HasPrefix(key, "#") {
+			resolved[key] = value
+			continue
+		}
+		if _, ok := args[key[1:]]; ok {
+			return nil, &jmapError{Type: "invalidArguments",
+				Description: fmt.Sprintf("Both %v and %v given", key, key[1:])}
+		}
+		var ref struct {
+			ResultOf string `json:"resultOf"`
+			Name     string `json:"name"`
+			Path     string `json:"path"`
+		}
+		if err := json.Unmarshal(value, &ref); err != nil {
+			return nil, &jmapError{Type: "invalidResultReference", Description: err.Error()}
+		}
+		var found interface{}
+		ok := false
+		for _, inv := range s.responses {
+			if inv.CallId == ref.ResultOf && inv.Name == ref.Name {
+				data, err := json.Marshal(inv.Args)
+				if err != nil {
+					return nil, err
+				}
+				var result interface{}
+				if err = json.Unmarshal(data, &result); err != nil {
+					return nil, err
+				}
+				found, ok = jmapPointer(result, ref.Path)
+				break
+			}
+		}
+		if !ok {
+			return nil, &jmapError{Type: "invalidResultReference",
+				Description: fmt.Sprintf("Cannot resolve %v", key)}
+		}
+		data, err := json.Marshal(found)
+		if err != nil {
+			return nil, err
+		}
+		resolved[key[1:]] = data
+	}
+	return resolved, nil
+}
+
+// jmapPointer evaluates a JSON pointer, where * maps the rest of the path
+// over an array and flattens the arrays that gives
+func jmapPointer(value interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return value, true
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	path = path[1:]
+	token, rest := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		token, rest = path[:i], path[i:]
+	}
+	token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		child, ok := v[token]
+		if !ok {
+			return nil, false
+		}
+		return jmapPointer(child, rest)
+	case []interface{}:
+		if token == "*" {
+			result := make([]interface{}, 0, len(v))
+			for _, item := range v {
+				found, ok := jmapPointer(item, rest)
+				if !ok {
+					return nil, false
+				}
+				if list, isList := found.([]interface{}); isList {
+					result = append(result, list...)
+				} else {
+					result = append(result, found)
+				}
+			}
+			return result, true
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, false
+		}
+		return jmapPointer(v[i], rest)
+	}
+	return nil, false
+}
+
+// jmapArgs are the arguments of a method call
+type jmapArgs map[string]json.RawMessage
+
+// decode fills the struct v from args, refusing arguments it doesn't have
+func (args jmapArgs) decode(v interface{}) error {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(v); err != nil {
+		return &jmapError{Type: "invalidArguments", Description: err.Error()}
+	}
+	return nil
+}
+
+// account returns the account the accountId argument names
+func (s *jmapSession) account(id string) (*jmapAccount, error) {
+	acct := s.accounts[id]
+	if acct == nil {
+		return nil, &jmapError{Type: "accountNotFound"}
+	}
+	return acct, nil
+}
+
+// resolveId turns a #creation ID into the ID of the object created
+func (s *jmapSession) resolveId(id string) string {
+	if strings.HasPrefix(id, "#") {
+		if created, ok := s.createdIds[id[1:]]; ok {
+			return created
+		}
+	}
+	return id
+}
+
+// state changes when the accounts of the user do
+func (s *jmapSession) state() string {
+	ids := make([]string, 0, len(s.accounts))
+	for id, acct := range s.accounts {
+		ids = append(ids, fmt.Sprintf("%v %v %v %v", id, acct.Rights.Read, acct.Rights.Delete,
+			acct.Rights.SendAs))
+	}
+	sort.Strings(ids)
+	return jmapHash(ids...)
+}
+
+// jmapHash makes a state string of parts
+func jmapHash(parts ...string) string {
+	h := fnv.New64a()
+	for _, p := range parts {
+		io.WriteString(h, p)
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func jmapEcho(s *jmapSession, args jmapArgs) (interface{}, error) {
+	return args, nil
+}
@@ -0,0 +1,1501 @@
+package web
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/egggo/inbucket/smtpd"
+	"github.com/jhillyerd/go.enmime"
+)
+
+// Format of JMAP UTCDate values
+const JMAP_DATE_FMT = "2006-01-02T15:04:05Z"
+
+// The keywords JMAP uses for IMAP system flags, RFC 8621 section 4.1.1.
+// \Deleted is left out: messages are destroyed rather than flagged.
+var jmapKeywords = map[string]string{
+	`\Seen`:     "$seen",
+	`\Flagged`:  "$flagged",
+	`\Answered`: "$answered",
+	`\Draft`:    "$draft",
+}
+
+// Roles given to top level folders by name
+var jmapRoles = map[string]string{
+	"archive": "archive",
+	"drafts":  "drafts",
+	"sent":    "sent",
+	"trash":   "trash",
+}
+
+var jmapEmailProperties = []string{"id", "blobId", "threadId", "mailboxIds", "keywords",
+	"size", "receivedAt", "messageId", "inReplyTo", "references", "sender", "from", "to",
+	"cc", "bcc", "replyTo", "subject", "sentAt", "hasAttachment", "preview", "bodyValues",
+	"textBody", "htmlBody", "attachments"}
+
+var jmapMsgIdRE = regexp.MustCompile(`<([^<>]+)>`)
+
+// jmapFolder is the INBOX or a folder of an account.  Its mailbox ID is inbox,
+// or f followed by the folder name in hex.
+type jmapFolder struct {
+	Id      string
+	Name    string
+	Mailbox smtpd.Mailbox
+}
+
+// jmapEmail is a message of an account, its ID is the message ID which stays
+// the same when it moves between folders.  Header and body are read when
+// first needed.
+type jmapEmail struct {
+	folder *jmapFolder
+	msg    smtpd.Message
+	header mail.Header
+	body   *enmime.MIMEBody
+}
+
+type jmapAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+type jmapBodyPart struct {
+	PartId      string  `json:"partId"`
+	BlobId      *string `json:"blobId"`
+	Size        int     `json:"size"`
+	Name        *string `json:"name"`
+	Type        string  `json:"type"`
+	Charset     *string `json:"charset"`
+	Disposition *string `json:"disposition"`
+}
+
+type jmapBodyValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+func jmapMailboxId(name string) string {
+	if name == "" {
+		return "inbox"
+	}
+	return "f" + hex.EncodeToString([]byte(name))
+}
+
+// folders lists the INBOX and the folders of acct
+func (s *jmapSession) folders(acct *jmapAccount) ([]*jmapFolder, error) {
+	mb, err := s.ctx.DataStore.MailboxFor(acct.Name)
+	if err != nil {
+		return nil, err
+	}
+	names, err := mb.Folders()
+	if err != nil {
+		return nil, err
+	}
+	folders := []*jmapFolder{{Id: jmapMailboxId(""), Mailbox: mb}}
+	for _, name := range names {
+		f, err := mb.Folder(name)
+		if err == smtpd.ErrFolderNotExist {
+			// Deleted since we listed them
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, &jmapFolder{Id: jmapMailboxId(name), Name: name, Mailbox: f})
+	}
+	return folders, nil
+}
+
+// emails lists the messages in folders
+func (s *jmapSession) emails(folders []*jmapFolder) ([]*jmapEmail, error) {
+	var emails []*jmapEmail
+	for _, f := range folders {
+		messages, err := f.Mailbox.GetMessages()
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range messages {
+			emails = append(emails, &jmapEmail{folder: f, msg: msg})
+		}
+	}
+	return emails, nil
+}
+
+// accountStates returns the states of the mailboxes and the emails of acct,
+// which change as messages come, go and have their flags changed
+func (s *jmapSession) accountStates(acct *jmapAccount) (string, string, error) {
+	folders, err := s.folders(acct)
+	if err != nil {
+		return "", "", err
+	}
+	var mailboxParts, emailParts []string
+	for _, f := range folders {
+		messages, err := f.Mailbox.GetMessages()
+		if err != nil {
+			return "", "", err
+		}
+		unread := 0
+		for _, msg := range messages {
+			if !smtpd.HasFlag(msg, `\Seen`) {
+				unread++
+			}
+			emailParts = append(emailParts, f.Id+" "+msg.Id()+" "+strings.Join(msg.Flags(), " "))
+		}
+		mailboxParts = append(mailboxParts, fmt.Sprintf("%v %v %v", f.Id, len(messages), unread))
+	}
+	return jmapHash(mailboxParts...), jmapHash(emailParts...), nil
+}
+
+func (e *jmapEmail) Header() (mail.Header, error) {
+	if e.header == nil {
+		m, err := e.msg.ReadHeader()
+		if err != nil {
+			return nil, err
+		}
+		e.header = m.Header
+	}
+	return e.header, nil
+}
+
+func (e *jmapEmail) Body() (*enmime.MIMEBody, error) {
+	if e.body == nil {
+		body, err := e.msg.ReadBody()
+		if err != nil {
+			return nil, err
+		}
+		e.body = body
+	}
+	return e.body, nil
+}
+
+// keywords returns the flags of the message as JMAP keywords
+func (e *jmapEmail) keywords() map[string]bool {
+	keywords := make(map[string]bool)
+	for _, flag := range e.msg.Flags() {
+		if strings.HasPrefix(flag, `\`) {
+			if keyword, ok := jmapKeywords[flag]; ok {
+				keywords[keyword] = true
+			}
+			continue
+		}
+		keywords[strings.ToLower(flag)] = true
+	}
+	return keywords
+}
+
+// jmapFlags turns JMAP keywords back into flags
+func jmapFlags(keywords map[string]bool) ([]string, error) {
+	var flags []string
+	for keyword, set := range keywords {
+		if !set {
+			return nil, smtpd.ErrBadFlag
+		}
+		flag := keyword
+		for f, k := range jmapKeywords {
+			if strings.EqualFold(keyword, k) {
+				flag = f
+			}
+		}
+		if strings.HasPrefix(keyword, `\`) {
+			return nil, smtpd.ErrBadFlag
+		}
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	return smtpd.CanonicalFlags(flags)
+}
+
+// decodeHeader returns the first value of the header key, RFC 2047 encoded
+// words decoded
+func decodeHeader(header mail.Header, key string) string {
+	v := header.Get(key)
+	if d, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+		return d
+	}
+	return v
+}
+
+func jmapAddresses(header mail.Header, key string) []jmapAddress {
+	list, err := header.AddressList(key)
+	if err != nil {
+		return nil
+	}
+	addresses := make([]jmapAddress, len(list))
+	for i, a := range list {
+		addresses[i].Email = a.Address
+		if a.Name != "" {
+			name := a.Name
+			addresses[i].Name = &name
+		}
+	}
+	return addresses
+}
+
+func jmapMsgIds(header mail.Header, key string) []string {
+	var ids []string
+	for _, m := range jmapMsgIdRE.FindAllStringSubmatch(header.Get(key), -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+// jmapPreview is the start of the text of a message, white space collapsed
+func jmapPreview(text string) string {
+	preview := strings.Join(strings.Fields(text), " ")
+	if runes := []rune(preview); len(runes) > 256 {
+		preview = string(runes[:256])
+	}
+	return preview
+}
+
+// jmapProperties keeps the properties of obj asked for, the ID always
+func jmapProperties(obj map[string]interface{}, properties []string) map[string]interface{} {
+	if properties == nil {
+		return obj
+	}
+	kept := map[string]interface{}{"id": obj["id"]}
+	for _, p := range properties {
+		if v, ok := obj[p]; ok {
+			kept[p] = v
+		}
+	}
+	return kept
+}
+
+// checkProperties refuses properties not in known
+func checkProperties(properties []string, known []string) error {
+	for _, p := range properties {
+		found := false
+		for _, k := range known {
+			if p == k {
+				found = true
+			}
+		}
+		if !found {
+			return &jmapError{Type: "invalidArguments",
+				Description: fmt.Sprintf("Unknown property %v", p)}
+		}
+	}
+	return nil
+}
+
+type jmapGetArgs struct {
+	AccountId  string    `json:"accountId"`
+	Ids        *[]string `json:"ids"`
+	Properties []string  `json:"properties"`
+}
+
+var jmapMailboxProperties = []string{"id", "name", "parentId", "role", "sortOrder",
+	"totalEmails", "unreadEmails", "totalThreads", "unreadThreads", "myRights",
+	"isSubscribed"}
+
+// jmapMailboxGet lists the INBOX and folders of an account.  A folder named
+// a/b is named b under the folder a, or keeps its full name at the top if
+// there is no folder a.
+func jmapMailboxGet(s *jmapSession, args jmapArgs) (interface{}, error) {
+	var a jmapGetArgs
+	if err := args.decode(&a); err != nil {
+		return nil, err
+	}
+	acct, err := s.account(a.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkProperties(a.Properties, jmapMailboxProperties); err != nil {
+		return nil, err
+	}
+	folders, err := s.folders(acct)
+	if err != nil {
+		return nil, err
+	}
+	mailboxState, _, err := s.accountStates(acct)
+	if err != nil {
+		return nil, err
+	}
+
+	byId := make(map[string]*jmapFolder)
+	byName := make(map[string]*jmapFolder)
+	for _, f := range folders {
+		byId[f.Id] = f
+		byName[f.Name] = f
+	}
+	var wanted []*jmapFolder
+	notFound := []string{}
+	if a.Ids == nil {
+		wanted = folders
+	} else {
+		if len(*a.Ids) > JMAP_MAX_OBJECTS {
+			return nil, &jmapError{Type: "requestTooLarge"}
+		}
+		for _, id := range *a.Ids {
+			if f := byId[id]; f != nil {
+				wanted = append(wanted, f)
+			} else {
+				notFound = append(notFound, id)
+			}
+		}
+	}
+
+	junk := config.GetSpamConfig().JunkFolder
+	list := make([]map[string]interface{}, 0, len(wanted))
+	for _, f := range wanted {
+		messages, err := f.Mailbox.GetMessages()
+		if err != nil {
+			return nil, err
+		}
+		unread := 0
+		for _, msg := range messages {
+			if !smtpd.HasFlag(msg, `\Seen`) {
+				unread++
+			}
+		}
+
+		name, parentId, role := f.Name, interface{}(nil), interface{}(nil)
+		if f.Name == "" {
+			name, role = "Inbox", "inbox"
+		} else if i := strings.LastIndex(f.Name, "/"); i >= 0 {
+			if parent := byName[f.Name[:i]]; parent != nil {
+				name, parentId = f.Name[i+1:], parent.Id
+			}
+		} else if strings.EqualFold(f.Name, junk) {
+			role = "junk"
+		} else if r, ok := jmapRoles[strings.ToLower(f.Name)]; ok {
+			role = r
+		}
+		write := acct.Rights.Delete
+		list = append(list, jmapProperties(map[string]interface{}{
+			"id":            f.Id,
+			"name":          name,
+			"parentId":      parentId,
+			"role":          role,
+			"sortOrder":     0,
+			"totalEmails":   len(messages),
+			"unreadEmails":  unread,
+			"totalThreads":  len(messages),
+			"unreadThreads": unread,
+			"myRights": map[string]bool{
+				"mayReadItems":   true,
+				"mayAddItems":    write,
+				"mayRemoveItems": write,
+				"maySetSeen":     write,
+				"maySetKeywords": write,
+				"mayCreateChild": false,
+				"mayRename":      false,
+				"mayDelete":      false,
+				"maySubmit":      acct.Rights.SendAs,
+			},
+			"isSubscribed": true,
+		}, a.Properties))
+	}
+
+	return map[string]interface{}{
+		"accountId": acct.Id,
+		"state":     mailboxState,
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// jmapFilter is a FilterOperator or FilterCondition of Email/query
+type jmapFilter struct {
+	operator   string
+	conditions []*jmapFilter
+	condition  *jmapCondition
+}
+
+type jmapCondition struct {
+	InMailbox               *string    `json:"inMailbox"`
+	InMailboxOtherThan      []string   `json:"inMailboxOtherThan"`
+	Before                  *time.Time `json:"before"`
+	After                   *time.Time `json:"after"`
+	MinSize                 *int64     `json:"minSize"`
+	MaxSize                 *int64     `json:"maxSize"`
+	AllInThreadHaveKeyword  *string    `json:"allInThreadHaveKeyword"`
+	SomeInThreadHaveKeyword *string    `json:"someInThreadHaveKeyword"`
+	NoneInThreadHaveKeyword *string    `json:"noneInThreadHaveKeyword"`
+	HasKeyword              *string    `json:"hasKeyword"`
+	NotKeyword              *string    `json:"notKeyword"`
+	HasAttachment           *bool      `json:"hasAttachment"`
+	Text                    *string    `json:"text"`
+	From                    *string    `json:"from"`
+	To                      *string    `json:"to"`
+	Cc                      *string    `json:"cc"`
+	Bcc                     *string    `json:"bcc"`
+	Subject                 *string    `json:"subject"`
+	Body                    *string    `json:"body"`
+	Header                  []string   `json:"header"`
+}
+
+func parseJmapFilter(data json.RawMessage) (*jmapFilter, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, &jmapError{Type: "invalidArguments", Description: err.Error()}
+	}
+	if _, ok := probe["operator"]; ok {
+		var op struct {
+			Operator   string            `json:"operator"`
+			Conditions []json.RawMessage `json:"conditions"`
+		}
+		if err := json.Unmarshal(data, &op); err != nil {
+			return nil, &jmapError{Type: "invalidArguments", Description: err.Error()}
+		}
+		if op.Operator != "AND" && op.Operator != "OR" && op.Operator != "NOT" {
+			return nil, &jmapError{Type: "unsupportedFilter",
+				Description: fmt.Sprintf("Unknown operator %v", op.Operator)}
+		}
+		f := &jmapFilter{operator: op.Operator}
+		for _, c := range op.Conditions {
+			sub, err := parseJmapFilter(c)
+			if err != nil {
+				return nil, err
+			}
+			if sub != nil {
+				f.conditions = append(f.conditions, sub)
+			}
+		}
+		return f, nil
+	}
+	cond := new(jmapCondition)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cond); err != nil {
+		return nil, &jmapError{Type: "unsupportedFilter", Description: err.Error()}
+	}
+	if len(cond.Header) != 0 && len(cond.Header) != 1 && len(cond.Header) != 2 {
+		return nil, &jmapError{Type: "unsupportedFilter", Description: "Bad header condition"}
+	}
+	return &jmapFilter{condition: cond}, nil
+}
+
+func (f *jmapFilter) match(e *jmapEmail) bool {
+	if f == nil {
+		return true
+	}
+	switch f.operator {
+	case "AND":
+		for _, c := range f.conditions {
+			if !c.match(e) {
+				return false
+			}
+		}
+		return true
+	case "OR":
+		for _, c := range f.conditions {
+			if c.match(e) {
+				return true
+			}
+		}
+		return false
+	case "NOT":
+		for _, c := range f.conditions {
+			if c.match(e) {
+				return false
+			}
+		}
+		return true
+	}
+	return f.condition.match(e)
+}
+
+func (c *jmapCondition) match(e *jmapEmail) bool {
+	if c.InMailbox != nil && e.folder.Id != *c.InMailbox {
+		return false
+	}
+	for _, id := range c.InMailboxOtherThan {
+		if e.folder.Id == id {
+			return false
+		}
+	}
+	date := e.msg.Date()
+	if c.Before != nil && !date.Before(*c.Before) {
+		return false
+	}
+	if c.After != nil && date.Before(*c.After) {
+		return false
+	}
+	if c.MinSize != nil && e.msg.Size() < *c.MinSize {
+		return false
+	}
+	if c.MaxSize != nil && e.msg.Size() >= *c.MaxSize {
+		return false
+	}
+	// Each message is a thread of its own
+	keywords := e.keywords()
+	for _, k := range []*string{c.HasKeyword, c.AllInThreadHaveKeyword, c.SomeInThreadHaveKeyword} {
+		if k != nil && !keywords[strings.ToLower(*k)] {
+			return false
+		}
+	}
+	for _, k := range []*string{c.NotKeyword, c.NoneInThreadHaveKeyword} {
+		if k != nil && keywords[strings.ToLower(*k)] {
+			return false
+		}
+	}
+
+	if c.HasAttachment == nil && c.Text == nil && c.From == nil && c.To == nil &&
+		c.Cc == nil && c.Bcc == nil && c.Subject == nil && c.Body == nil && c.Header == nil {
+		return true
+	}
+	header, err := e.Header()
+	if err != nil {
+		return false
+	}
+	contains := func(s string, sub *string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(*sub))
+	}
+	bodyContains := func(sub *string) bool {
+		body, err := e.Body()
+		return err == nil && (contains(body.Text, sub) || contains(body.Html, sub))
+	}
+	for key, value := range map[string]*string{"From": c.From, "To": c.To, "Cc": c.Cc,
+		"Bcc": c.Bcc, "Subject": c.Subject} {
+		if value != nil && !contains(decodeHeader(header, key), value) {
+			return false
+		}
+	}
+	if c.Body != nil && !bodyContains(c.Body) {
+		return false
+	}
+	if c.Text != nil {
+		found := bodyContains(c.Text)
+		for _, key := range []string{"From", "To", "Cc", "Bcc", "Subject"} {
+			found = found || contains(decodeHeader(header, key), c.Text)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(c.Header) > 0 {
+		values, ok := header[textproto.CanonicalMIMEHeaderKey(c.Header[0])]
+		if !ok {
+			return false
+		}
+		if len(c.Header) == 2 {
+			found := false
+			for _, v := range values {
+				found = found || contains(v, &c.Header[1])
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	if c.HasAttachment != nil {
+		body, err := e.Body()
+		if err != nil || (len(body.Attachments) > 0) != *c.HasAttachment {
+			return false
+		}
+	}
+	return true
+}
+
+type jmapComparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+	Collation   string `json:"collation"`
+}
+
+// jmapEmailQuery searches the messages of an account, newest first unless
+// the client sorts otherwise
+func jmapEmailQuery(s *jmapSession, args jmapArgs) (interface{}, error) {
+	var a struct {
+		AccountId       string           `json:"accountId"`
+		Filter          json.RawMessage  `json:"filter"`
+		Sort            []jmapComparator `json:"sort"`
+		Position        int              `json:"position"`
+		Anchor          *string          `json:"anchor"`
+		AnchorOffset    int              `json:"anchorOffset"`
+		Limit           *int             `json:"limit"`
+		CalculateTotal  bool             `json:"calculateTotal"`
+		CollapseThreads bool             `json:"collapseThreads"`
+	}
+	if err := args.decode(&a); err != nil {
+		return nil, err
+	}
+	acct, err := s.account(a.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := parseJmapFilter(a.Filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range a.Sort {
+		switch c.Property {
+		case "receivedAt", "size", "from", "subject":
+		default:
+			return nil, &jmapError{Type: "unsupportedSort",
+				Description: fmt.Sprintf("Cannot sort by %v", c.Property)}
+		}
+	}
+	if a.Limit != nil && *a.Limit < 0 {
+		return nil, &jmapError{Type: "invalidArguments", Description: "Negative limit"}
+	}
+
+	folders, err := s.folders(acct)
+	if err != nil {
+		return nil, err
+	}
+	emails, err := s.emails(folders)
+	if err != nil {
+		return nil, err
+	}
+	_, emailState, err := s.accountStates(acct)
+	if err != nil {
+		return nil, err
+	}
+	var found []*jmapEmail
+	for _, e := range emails {
+		if filter.match(e) {
+			found = append(found, e)
+		}
+	}
+	sortJmapEmails(found, a.Sort)
+
+	total := len(found)
+	position := a.Position
+	if a.Anchor != nil {
+		position = -1
+		for i, e := range found {
+			if e.msg.Id() == *a.Anchor {
+				position = i + a.AnchorOffset
+			}
+		}
+		if position == -1 {
+			return nil, &jmapError{Type: "anchorNotFound"}
+		}
+	} else if position < 0 {
+		position += total
+	}
+	if position < 0 {
+		position = 0
+	}
+	if position > total {
+		position = total
+	}
+	end := total
+	if a.Limit != nil && position+*a.Limit < end {
+		end = position + *a.Limit
+	}
+	ids := make([]string, 0, end-position)
+	for _, e := range found[position:end] {
+		ids = append(ids, e.msg.Id())
+	}
+
+	result := map[string]interface{}{
+		"accountId":           acct.Id,
+		"queryState":          emailState,
+		"canCalculateChanges": false,
+		"position":            position,
+		"ids":                 ids,
+	}
+	if a.CalculateTotal {
+		result["total"] = total
+	}
+	return result, nil
+}
+
+func sortJmapEmails(emails []*jmapEmail, comparators []jmapComparator) {
+	if len(comparators) == 0 {
+		descending := false
+		comparators = []jmapComparator{{Property: "receivedAt", IsAscending: &descending}}
+	}
+	sort.SliceStable(emails, func(i, j int) bool {
+		a, b := emails[i], emails[j]
+		for _, c := range comparators {
+			var cmp int
+			switch c.Property {
+			case "receivedAt":
+				cmp = compareTimes(a.msg.Date(), b.msg.Date())
+			case "size":
+				cmp = compareInts(a.msg.Size(), b.msg.Size())
+			case "from":
+				cmp = strings.Compare(strings.ToLower(a.msg.From()), strings.ToLower(b.msg.From()))
+			case "subject":
+				cmp = strings.Compare(strings.ToLower(a.msg.Subject()),
+					strings.ToLower(b.msg.Subject()))
+			}
+			if c.IsAscending != nil && !*c.IsAscending {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// jmapEmailGet returns the messages asked for, all of the account if there
+// are few enough
+func jmapEmailGet(s *jmapSession, args jmapArgs) (interface{}, error) {
+	var a struct {
+		AccountId           string    `json:"accountId"`
+		Ids                 *[]string `json:"ids"`
+		Properties          []string  `json:"properties"`
+		BodyProperties      []string  `json:"bodyProperties"`
+		FetchTextBodyValues bool      `json:"fetchTextBodyValues"`
+		FetchHTMLBodyValues bool      `json:"fetchHTMLBodyValues"`
+		FetchAllBodyValues  bool      `json:"fetchAllBodyValues"`
+		MaxBodyValueBytes   int       `json:"maxBodyValueBytes"`
+	}
+	if err := args.decode(&a); err != nil {
+		return nil, err
+	}
+	acct, err := s.account(a.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	properties := a.Properties
+	if properties == nil {
+		properties = jmapEmailProperties
+	}
+	if err = checkProperties(properties, jmapEmailProperties); err != nil {
+		return nil, err
+	}
+
+	folders, err := s.folders(acct)
+	if err != nil {
+		return nil, err
+	}
+	emails, err := s.emails(folders)
+	if err != nil {
+		return nil, err
+	}
+	_, emailState, err := s.accountStates(acct)
+	if err != nil {
+		return nil, err
+	}
+	var wanted []*jmapEmail
+	notFound := []string{}
+	if a.Ids == nil {
+		wanted = emails
+	} else {
+		byId := make(map[string]*jmapEmail)
+		for _, e := range emails {
+			byId[e.msg.Id()] = e
+		}
+		for _, id := range *a.Ids {
+			if e := byId[s.resolveId(id)]; e != nil {
+				wanted = append(wanted, e)
+			} else {
+				notFound = append(notFound, id)
+			}
+		}
+	}
+	if len(wanted) > JMAP_MAX_OBJECTS {
+		return nil, &jmapError{Type: "requestTooLarge"}
+	}
+
+	list := make([]map[string]interface{}, 0, len(wanted))
+	for _, e := range wanted {
+		obj, err := e.jmapObject(properties, a.BodyProperties,
+			a.FetchTextBodyValues || a.FetchAllBodyValues,
+			a.FetchHTMLBodyValues || a.FetchAllBodyValues, a.MaxBodyValueBytes)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+	return map[string]interface{}{
+		"accountId": acct.Id,
+		"state":     emailState,
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// jmapObject returns the properties of e, the text and HTML bodies are the
+// single parts enmime finds
+func (e *jmapEmail) jmapObject(properties []string, bodyProperties []string,
+	fetchText bool, fetchHTML bool, maxBytes int) (map[string]interface{}, error) {
+	id := e.msg.Id()
+	obj := map[string]interface{}{
+		"id":         id,
+		"blobId":     id,
+		"threadId":   id,
+		"mailboxIds": map[string]bool{e.folder.Id: true},
+		"keywords":   e.keywords(),
+		"size":       e.msg.Size(),
+		"receivedAt": e.msg.Date().UTC().Format(JMAP_DATE_FMT),
+	}
+
+	needHeader, needBody := false, false
+	for _, p := range properties {
+		switch p {
+		case "messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+			"replyTo", "subject", "sentAt":
+			needHeader = true
+		case "hasAttachment", "preview", "bodyValues", "textBody", "htmlBody", "attachments":
+			needBody = true
+		}
+	}
+	if needHeader {
+		header, err := e.Header()
+		if err != nil {
+			return nil, err
+		}
+		obj["messageId"] = jmapMsgIds(header, "Message-Id")
+		obj["inReplyTo"] = jmapMsgIds(header, "In-Reply-To")
+		obj["references"] = jmapMsgIds(header, "References")
+		obj["sender"] = jmapAddresses(header, "Sender")
+		obj["from"] = jmapAddresses(header, "From")
+		obj["to"] = jmapAddresses(header, "To")
+		obj["cc"] = jmapAddresses(header, "Cc")
+		obj["bcc"] = jmapAddresses(header, "Bcc")
+		obj["replyTo"] = jmapAddresses(header, "Reply-To")
+		obj["subject"] = nil
+		if _, ok := header["Subject"]; ok {
+			obj["subject"] = decodeHeader(header, "Subject")
+		}
+		obj["sentAt"] = nil
+		if date, err := header.Date(); err == nil {
+			obj["sentAt"] = date.Format(time.RFC3339)
+		}
+	}
+	if needBody {
+		body, err := e.Body()
+		if err != nil {
+			return nil, err
+		}
+		utf8 := "utf-8"
+		var textParts, htmlParts []map[string]interface{}
+		values := make(map[string]jmapBodyValue)
+		value := func(s string) jmapBodyValue {
+			v := jmapBodyValue{Value: s}
+			if maxBytes > 0 && len(s) > maxBytes {
+				// Don't cut a character in two
+				for maxBytes > 0 && maxBytes < len(s) && s[maxBytes]&0xc0 == 0x80 {
+					maxBytes--
+				}
+				v.Value, v.IsTruncated = s[:maxBytes], true
+			}
+			return v
+		}
+		text := &jmapBodyPart{PartId: "1", Size: len(body.Text), Type: "text/plain",
+			Charset: &utf8}
+		html := &jmapBodyPart{PartId: "2", Size: len(body.Html), Type: "text/html",
+			Charset: &utf8}
+		if body.Text != "" || body.Html == "" {
+			textParts = append(textParts, bodyPartObject(text, bodyProperties))
+			if fetchText {
+				values["1"] = value(body.Text)
+			}
+		}
+		if body.Html != "" {
+			htmlParts = append(htmlParts, bodyPartObject(html, bodyProperties))
+			if fetchHTML {
+				values["2"] = value(body.Html)
+			}
+			if textParts == nil {
+				textParts = htmlParts
+				if fetchText {
+					values["2"] = value(body.Html)
+				}
+			}
+		} else {
+			htmlParts = textParts
+			if fetchHTML && body.Text != "" {
+				values["1"] = value(body.Text)
+			}
+		}
+		attachments := make([]map[string]interface{}, 0, len(body.Attachments))
+		for i, part := range body.Attachments {
+			blobId := fmt.Sprintf("%v_%v", id, i)
+			name := part.FileName()
+			disposition := "attachment"
+			attachments = append(attachments, bodyPartObject(&jmapBodyPart{
+				PartId: "a" + strconv.Itoa(i), BlobId: &blobId, Size: len(part.Content()),
+				Name: &name, Type: part.ContentType(), Disposition: &disposition},
+				bodyProperties))
+		}
+		obj["hasAttachment"] = len(body.Attachments) > 0
+		obj["preview"] = jmapPreview(body.Text)
+		obj["bodyValues"] = values
+		obj["textBody"] = textParts
+		obj["htmlBody"] = htmlParts
+		obj["attachments"] = attachments
+	}
+	return jmapProperties(obj, properties), nil
+}
+
+// bodyPartObject keeps the properties of part asked for
+func bodyPartObject(part *jmapBodyPart, properties []string) map[string]interface{} {
+	obj := map[string]interface{}{
+		"partId":      part.PartId,
+		"blobId":      part.BlobId,
+		"size":        part.Size,
+		"name":        part.Name,
+		"type":        part.Type,
+		"charset":     part.Charset,
+		"disposition": part.Disposition,
+		"cid":         nil,
+		"language":    nil,
+		"location":    nil,
+	}
+	if properties == nil {
+		return obj
+	}
+	kept := make(map[string]interface{})
+	for _, p := range properties {
+		if v, ok := obj[p]; ok {
+			kept[p] = v
+		}
+	}
+	return kept
+}
+
+// blob returns a message, or its attachment n for blob ID id_n
+func (s *jmapSession) blob(acct *jmapAccount, blobId string) ([]byte, error) {
+	id, num := blobId, -1
+	if i := strings.LastIndex(blobId, "_"); i >= 0 {
+		n, err := strconv.Atoi(blobId[i+1:])
+		if err != nil {
+			return nil, smtpd.ErrNotExist
+		}
+		id, num = blobId[:i], n
+	}
+	e, err := s.findEmail(acct, id)
+	if err != nil {
+		return nil, err
+	}
+	if num < 0 {
+		raw, err := e.msg.ReadRaw()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(*raw), nil
+	}
+	body, err := e.Body()
+	if err != nil {
+		return nil, err
+	}
+	if num >= len(body.Attachments) {
+		return nil, smtpd.ErrNotExist
+	}
+	return body.Attachments[num].Content(), nil
+}
+
+// findEmail looks for the message id in the folders of acct
+func (s *jmapSession) findEmail(acct *jmapAccount, id string) (*jmapEmail, error) {
+	folders, err := s.folders(acct)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range folders {
+		msg, err := f.Mailbox.GetMessage(id)
+		if err == nil {
+			return &jmapEmail{folder: f, msg: msg}, nil
+		}
+		if err != smtpd.ErrNotExist {
+			return nil, err
+		}
+	}
+	return nil, smtpd.ErrNotExist
+}
+
+type jmapEmailCreate struct {
+	MailboxIds map[string]bool          `json:"mailboxIds"`
+	Keywords   map[string]bool          `json:"keywords"`
+	From       []jmapAddress            `json:"from"`
+	Sender     []jmapAddress            `json:"sender"`
+	To         []jmapAddress            `json:"to"`
+	Cc         []jmapAddress            `json:"cc"`
+	Bcc        []jmapAddress            `json:"bcc"`
+	ReplyTo    []jmapAddress            `json:"replyTo"`
+	Subject    *string                  `json:"subject"`
+	SentAt     *time.Time               `json:"sentAt"`
+	ReceivedAt *time.Time               `json:"receivedAt"`
+	MessageId  []string                 `json:"messageId"`
+	InReplyTo  []string                 `json:"inReplyTo"`
+	References []string                 `json:"references"`
+	TextBody   []jmapBodyPart           `json:"textBody"`
+	HtmlBody   []jmapBodyPart           `json:"htmlBody"`
+	BodyValues map[string]jmapBodyValue `json:"bodyValues"`
+	// Only accepted empty, there is no blob upload
+	Attachments []json.RawMessage `json:"attachments"`
+}
+
+// jmapEmailSet creates, changes and destroys messages.  A message is in one
+// mailbox, changing its mailboxIds moves it.
+func jmapEmailSet(s *jmapSession, args jmapArgs) (interface{}, error) {
+	var a struct {
+		AccountId string                                `json:"accountId"`
+		IfInState *string                               `json:"ifInState"`
+		Create    map[string]json.RawMessage            `json:"create"`
+		Update    map[string]map[string]json.RawMessage `json:"update"`
+		Destroy   []string                              `json:"destroy"`
+	}
+	if err := args.decode(&a); err != nil {
+		return nil, err
+	}
+	acct, err := s.account(a.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.Create)+len(a.Update)+len(a.Destroy) > JMAP_MAX_OBJECTS {
+		return nil, &jmapError{Type: "requestTooLarge"}
+	}
+	if !acct.Rights.Delete && len(a.Create)+len(a.Update)+len(a.Destroy) > 0 {
+		return nil, &jmapError{Type: "accountReadOnly"}
+	}
+	_, oldState, err := s.accountStates(acct)
+	if err != nil {
+		return nil, err
+	}
+	if a.IfInState != nil && *a.IfInState != oldState {
+		return nil, &jmapError{Type: "stateMismatch"}
+	}
+	folders, err := s.folders(acct)
+	if err != nil {
+		return nil, err
+	}
+
+	var created map[string]interface{}
+	var updated map[string]interface{}
+	var destroyed []string
+	notCreated := make(map[string]*jmapSetError)
+	notUpdated := make(map[string]*jmapSetError)
+	notDestroyed := make(map[string]*jmapSetError)
+
+	// Sorted so creation IDs get used in a predictable order
+	cids := make([]string, 0, len(a.Create))
+	for cid := range a.Create {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	for _, cid := range cids {
+		obj, serr, err := s.createEmail(acct, folders, a.Create[cid])
+		if err != nil {
+			return nil, err
+		}
+		if serr != nil {
+			notCreated[cid] = serr
+			continue
+		}
+		if created == nil {
+			created = make(map[string]interface{})
+		}
+		created[cid] = obj
+		s.createdIds[cid] = obj["id"].(string)
+	}
+
+	for id, patch := range a.Update {
+		serr, err := s.updateEmail(acct, folders, s.resolveId(id), patch)
+		if err != nil {
+			return nil, err
+		}
+		if serr != nil {
+			notUpdated[id] = serr
+			continue
+		}
+		if updated == nil {
+			updated = make(map[string]interface{})
+		}
+		updated[id] = nil
+	}
+
+	for _, id := range a.Destroy {
+		serr, err := s.destroyEmail(acct, s.resolveId(id))
+		if err != nil {
+			return nil, err
+		}
+		if serr != nil {
+			notDestroyed[id] = serr
+			continue
+		}
+		destroyed = append(destroyed, id)
+	}
+
+	_, newState, err := s.accountStates(acct)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{
+		"accountId":    acct.Id,
+		"oldState":     oldState,
+		"newState":     newState,
+		"created":      created,
+		"updated":      updated,
+		"destroyed":    destroyed,
+		"notCreated":   nil,
+		"notUpdated":   nil,
+		"notDestroyed": nil,
+	}
+	if len(notCreated) > 0 {
+		result["notCreated"] = notCreated
+	}
+	if len(notUpdated) > 0 {
+		result["notUpdated"] = notUpdated
+	}
+	if len(notDestroyed) > 0 {
+		result["notDestroyed"] = notDestroyed
+	}
+	return result, nil
+}
+
+// jmapFolderById finds the one mailbox of mailboxIds
+func jmapFolderById(folders []*jmapFolder, mailboxIds map[string]bool) *jmapFolder {
+	if len(mailboxIds) != 1 {
+		return nil
+	}
+	for id, set := range mailboxIds {
+		for _, f := range folders {
+			if f.Id == id && set {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// createEmail stores a message built from the properties in data
+func (s *jmapSession) createEmail(acct *jmapAccount, folders []*jmapFolder,
+	data json.RawMessage) (map[string]interface{}, *jmapSetError, error) {
+	var c jmapEmailCreate
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, &jmapSetError{Type: "invalidProperties", Description: err.Error()}, nil
+	}
+	for id := range c.MailboxIds {
+		if resolved := s.resolveId(id); resolved != id {
+			c.MailboxIds[resolved] = c.MailboxIds[id]
+			delete(c.MailboxIds, id)
+		}
+	}
+	folder := jmapFolderById(folders, c.MailboxIds)
+	if folder == nil {
+		return nil, &jmapSetError{Type: "invalidProperties", Properties: []string{"mailboxIds"},
+			Description: "An email must be in exactly one existing mailbox"}, nil
+	}
+	flags, err := jmapFlags(c.Keywords)
+	if err != nil {
+		return nil, &jmapSetError{Type: "invalidProperties", Properties: []string{"keywords"}}, nil
+	}
+	if len(c.Attachments) > 0 {
+		return nil, &jmapSetError{Type: "invalidProperties", Properties: []string{"attachments"},
+			Description: "Attachments are not supported"}, nil
+	}
+	raw, serr := buildJmapEmail(&c, acct)
+	if serr != nil {
+		return nil, serr, nil
+	}
+
+	msg, err := folder.Mailbox.NewMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = msg.SetFlags(flags); err != nil {
+		return nil, nil, err
+	}
+	if err = msg.Append(raw); err != nil {
+		return nil, nil, err
+	}
+	if err = msg.Close(); err != nil {
+		return nil, nil, err
+	}
+	id := msg.Id()
+	return map[string]interface{}{"id": id, "blobId": id, "threadId": id,
+		"size": len(raw)}, nil, nil
+}
+
+// buildJmapEmail writes the message c describes, plain text, HTML or both as
+// alternatives
+func buildJmapEmail(c *jmapEmailCreate, acct *jmapAccount) ([]byte, *jmapSetError) {
+	bodyValue := func(parts []jmapBodyPart, property string, mediaType string) (*string,
+		*jmapSetError) {
+		if len(parts) == 0 {
+			return nil, nil
+		}
+		bad := &jmapSetError{Type: "invalidProperties", Properties: []string{property}}
+		if len(parts) > 1 || (parts[0].Type != "" && parts[0].Type != mediaType) {
+			return nil, bad
+		}
+		v, ok := c.BodyValues[parts[0].PartId]
+		if !ok {
+			return nil, bad
+		}
+		return &v.Value, nil
+	}
+	text, serr := bodyValue(c.TextBody, "textBody", "text/plain")
+	if serr != nil {
+		return nil, serr
+	}
+	html, serr := bodyValue(c.HtmlBody, "htmlBody", "text/html")
+	if serr != nil {
+		return nil, serr
+	}
+
+	var buf bytes.Buffer
+	addresses := func(key string, list []jmapAddress) {
+		if len(list) == 0 {
+			return
+		}
+		formatted := make([]string, len(list))
+		for i, a := range list {
+			addr := mail.Address{Address: a.Email}
+			if a.Name != nil {
+				addr.Name = *a.Name
+			}
+			formatted[i] = addr.String()
+		}
+		fmt.Fprintf(&buf, "%v: %v\r\n", key, strings.Join(formatted, ", "))
+	}
+	msgIds := func(key string, ids []string) {
+		if len(ids) == 0 {
+			return
+		}
+		fmt.Fprintf(&buf, "%v: <%v>\r\n", key, strings.Join(ids, "> <"))
+	}
+	addresses("From", c.From)
+	addresses("Sender", c.Sender)
+	addresses("To", c.To)
+	addresses("Cc", c.Cc)
+	addresses("Bcc", c.Bcc)
+	addresses("Reply-To", c.ReplyTo)
+	if c.Subject != nil {
+		fmt.Fprintf(&buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", *c.Subject))
+	}
+	sentAt := time.Now()
+	if c.SentAt != nil {
+		sentAt = *c.SentAt
+	}
+	fmt.Fprintf(&buf, "Date: %v\r\n", sentAt.Format(time.RFC1123Z))
+	if len(c.MessageId) == 0 {
+		domain := acct.Address[strings.LastIndex(acct.Address, "@")+1:]
+		c.MessageId = []string{fmt.Sprintf("%v.%v@%v", sentAt.UnixNano(), acct.Id, domain)}
+	}
+	msgIds("Message-ID", c.MessageId)
+	msgIds("In-Reply-To", c.InReplyTo)
+	msgIds("References", c.References)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	writeText := func(w *bytes.Buffer, s string) {
+		qp := quotedprintable.NewWriter(w)
+		qp.Write([]byte(s))
+		qp.Close()
+	}
+	if text != nil && html != nil {
+		mw := multipart.NewWriter(&buf)
+		fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n",
+			mw.Boundary())
+		for _, p := range []struct{ mediaType, value string }{
+			{"text/plain", *text}, {"text/html", *html}} {
+			pw, _ := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {p.mediaType + "; charset=utf-8"},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			})
+			qp := quotedprintable.NewWriter(pw)
+			qp.Write([]byte(p.value))
+			qp.Close()
+		}
+		mw.Close()
+		return buf.Bytes(), nil
+	}
+	mediaType, value := "text/plain", ""
+	if text != nil {
+		value = *text
+	} else if html != nil {
+		mediaType, value = "text/html", *html
+	}
+	fmt.Fprintf(&buf, "Content-Type: %v; charset=utf-8\r\n", mediaType)
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	writeText(&buf, value)
+	return buf.Bytes(), nil
+}
+
+// updateEmail applies a patch of keywords and mailboxIds to the message id
+func (s *jmapSession) updateEmail(acct *jmapAccount, folders []*jmapFolder, id string,
+	patch map[string]json.RawMessage) (*jmapSetError, error) {
+	e, err := s.findEmail(acct, id)
+	if err == smtpd.ErrNotExist {
+		return &jmapSetError{Type: "notFound"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keywords := e.keywords()
+	mailboxIds := map[string]bool{e.folder.Id: true}
+	for key, value := range patch {
+		bad := &jmapSetError{Type: "invalidProperties", Properties: []string{key}}
+		set := string(value) != "null"
+		switch {
+		case key == "keywords":
+			keywords = nil
+			if err := json.Unmarshal(value, &keywords); err != nil {
+				return bad, nil
+			}
+		case strings.HasPrefix(key, "keywords/"):
+			if set && string(value) != "true" {
+				return bad, nil
+			}
+			if set {
+				keywords[strings.ToLower(key[9:])] = true
+			} else {
+				delete(keywords, strings.ToLower(key[9:]))
+			}
+		case key == "mailboxIds":
+			mailboxIds = nil
+			if err := json.Unmarshal(value, &mailboxIds); err != nil {
+				return bad, nil
+			}
+		case strings.HasPrefix(key, "mailboxIds/"):
+			if set && string(value) != "true" {
+				return bad, nil
+			}
+			if set {
+				mailboxIds[s.resolveId(key[11:])] = true
+			} else {
+				delete(mailboxIds, s.resolveId(key[11:]))
+			}
+		default:
+			return bad, nil
+		}
+	}
+	flags, err := jmapFlags(keywords)
+	if err != nil {
+		return &jmapSetError{Type: "invalidProperties", Properties: []string{"keywords"}}, nil
+	}
+	if smtpd.HasFlag(e.msg, `\Deleted`) {
+		flags = append(flags, `\Deleted`)
+	}
+	dest := jmapFolderById(folders, mailboxIds)
+	if dest == nil {
+		return &jmapSetError{Type: "invalidProperties", Properties: []string{"mailboxIds"},
+			Description: "An email must be in exactly one existing mailbox"}, nil
+	}
+
+	if dest.Id != e.folder.Id {
+		if err = e.folder.Mailbox.Lock("JMAP"); err == smtpd.ErrMailboxLocked {
+			return &jmapSetError{Type: "forbidden", Description: "Mailbox is in use"}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		moved, err := e.folder.Mailbox.MoveMessage(id, dest.Mailbox)
+		e.folder.Mailbox.Unlock()
+		if err == smtpd.ErrNotExist {
+			return &jmapSetError{Type: "notFound"}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		e = &jmapEmail{folder: dest, msg: moved}
+	}
+	err = e.msg.SetFlags(flags)
+	if err == smtpd.ErrNotExist {
+		return &jmapSetError{Type: "notFound"}, nil
+	}
+	return nil, err
+}
+
+// destroyEmail deletes the message id
+func (s *jmapSession) destroyEmail(acct *jmapAccount, id string) (*jmapSetError, error) {
+	e, err := s.findEmail(acct, id)
+	if err == smtpd.ErrNotExist {
+		return &jmapSetError{Type: "notFound"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = e.folder.Mailbox.Lock("JMAP"); err == smtpd.ErrMailboxLocked {
+		return &jmapSetError{Type: "forbidden", Description: "Mailbox is in use"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer e.folder.Mailbox.Unlock()
+	err = e.msg.Delete()
+	if err == smtpd.ErrNotExist {
+		return &jmapSetError{Type: "notFound"}, nil
+	}
+	return nil, err
+}
+
+var jmapIdentityProperties = []string{"id", "name", "email", "replyTo", "bcc",
+	"textSignature", "htmlSignature", "mayDelete"}
+
+// jmapIdentityGet gives the address of the account as its one identity, if
+// the user may send as it
+func jmapIdentityGet(s *jmapSession, args jmapArgs) (interface{}, error) {
+	var a jmapGetArgs
+	if err := args.decode(&a); err != nil {
+		return nil, err
+	}
+	acct, err := s.account(a.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkProperties(a.Properties, jmapIdentityProperties); err != nil {
+		return nil, err
+	}
+	list := make([]map[string]interface{}, 0, 1)
+	notFound := []string{}
+	if acct.Rights.SendAs {
+		list = append(list, jmapProperties(map[string]interface{}{
+			"id":            acct.Id,
+			"name":          "",
+			"email":         acct.Address,
+			"replyTo":       nil,
+			"bcc":           nil,
+			"textSignature": "",
+			"htmlSignature": "",
+			"mayDelete":     false,
+		}, a.Properties))
+	}
+	if a.Ids != nil {
+		wanted := make([]map[string]interface{}, 0, 1)
+		for _, id := range *a.Ids {
+			if len(list) == 1 && id == acct.Id {
+				wanted = append(wanted, list[0])
+			} else {
+				notFound = append(notFound, id)
+			}
+		}
+		list = wanted
+	}
+	return map[string]interface{}{
+		"accountId": acct.Id,
+		"state":     jmapHash(acct.Address, fmt.Sprint(acct.Rights.SendAs)),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
@@ -0,0 +1,369 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/egggo/inbucket/config"
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+	"github.com/egggo/inbucket/smtpd"
+)
+
+type jmapEnvelopeAddress struct {
+	Email      string             `json:"email"`
+	Parameters map[string]*string `json:"parameters"`
+}
+
+type jmapEnvelope struct {
+	MailFrom jmapEnvelopeAddress   `json:"mailFrom"`
+	RcptTo   []jmapEnvelopeAddress `json:"rcptTo"`
+}
+
+type jmapSubmissionCreate struct {
+	IdentityId string        `json:"identityId"`
+	EmailId    string        `json:"emailId"`
+	Envelope   *jmapEnvelope `json:"envelope"`
+}
+
+// jmapEmailSubmissionSet sends messages.  Nothing is sent from the web
+// server: each recipient's copy is queued in the database like a message held
+// with FUTURERELEASE, and the SMTP server's release scanner delivers it within
+// a minute, or when the HOLDFOR or HOLDUNTIL parameter of mailFrom says.  It
+// is delivered as mail sent with SMTP AUTH is, so aliases, groups and Sieve
+// scripts apply and remote mail is DKIM signed.
+// Submissions are not kept, so they cannot be looked up or cancelled.
+func jmapEmailSubmissionSet(s *jmapSession, args jmapArgs) (interface{}, error) {
+	var a struct {
+		AccountId             string                                `json:"accountId"`
+		IfInState             *string                               `json:"ifInState"`
+		Create                map[string]json.RawMessage            `json:"create"`
+		Update                map[string]json.RawMessage            `json:"update"`
+		Destroy               []string                              `json:"destroy"`
+		OnSuccessUpdateEmail  map[string]map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+		OnSuccessDestroyEmail []string                              `json:"onSuccessDestroyEmail"`
+	}
+	if err := args.decode(&a); err != nil {
+		return nil, err
+	}
+	acct, err := s.account(a.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	if a.IfInState != nil && *a.IfInState != "0" {
+		return nil, &jmapError{Type: "stateMismatch"}
+	}
+	if len(a.Create)+len(a.Update)+len(a.Destroy) > JMAP_MAX_OBJECTS {
+		return nil, &jmapError{Type: "requestTooLarge"}
+	}
+
+	var created map[string]interface{}
+	notCreated := make(map[string]*jmapSetError)
+	notUpdated := make(map[string]*jmapSetError)
+	notDestroyed := make(map[string]*jmapSetError)
+	emailIds := make(map[string]string)
+	for cid, data := range a.Create {
+		var c jmapSubmissionCreate
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			notCreated[cid] = &jmapSetError{Type: "invalidProperties", Description: err.Error()}
+			continue
+		}
+		c.EmailId = s.resolveId(c.EmailId)
+		obj, serr, err := s.submit(acct, &c)
+		if err != nil {
+			return nil, err
+		}
+		if serr != nil {
+			notCreated[cid] = serr
+			continue
+		}
+		if created == nil {
+			created = make(map[string]interface{})
+		}
+		created[cid] = obj
+		s.createdIds[cid] = obj["id"].(string)
+		emailIds["#"+cid] = c.EmailId
+	}
+	for id := range a.Update {
+		notUpdated[id] = &jmapSetError{Type: "notFound"}
+	}
+	for _, id := range a.Destroy {
+		notDestroyed[id] = &jmapSetError{Type: "notFound"}
+	}
+
+	result := map[string]interface{}{
+		"accountId":    acct.Id,
+		"oldState":     "0",
+		"newState":     "0",
+		"created":      created,
+		"updated":      nil,
+		"destroyed":    nil,
+		"notCreated":   nil,
+		"notUpdated":   nil,
+		"notDestroyed": nil,
+	}
+	if len(notCreated) > 0 {
+		result["notCreated"] = notCreated
+	}
+	if len(notUpdated) > 0 {
+		result["notUpdated"] = notUpdated
+	}
+	if len(notDestroyed) > 0 {
+		result["notDestroyed"] = notDestroyed
+	}
+
+	// Change the messages sent, typically moving them to Sent, as an implicit
+	// Email/set call
+	update := make(map[string]map[string]json.RawMessage)
+	for ref, patch := range a.OnSuccessUpdateEmail {
+		if id, ok := emailIds[ref]; ok {
+			update[id] = patch
+		} else if !strings.HasPrefix(ref, "#") {
+			update[ref] = patch
+		}
+	}
+	var destroy []string
+	for _, ref := range a.OnSuccessDestroyEmail {
+		if id, ok := emailIds[ref]; ok {
+			destroy = append(destroy, id)
+		} else if !strings.HasPrefix(ref, "#") {
+			destroy = append(destroy, ref)
+		}
+	}
+	if len(update) > 0 || len(destroy) > 0 {
+		emailArgs := jmapArgs{}
+		emailArgs["accountId"], _ = json.Marshal(acct.Id)
+		if len(update) > 0 {
+			emailArgs["update"], _ = json.Marshal(update)
+		}
+		if len(destroy) > 0 {
+			emailArgs["destroy"], _ = json.Marshal(destroy)
+		}
+		response, err := jmapEmailSet(s, emailArgs)
+		if err != nil {
+			jerr, ok := err.(*jmapError)
+			if !ok {
+				return nil, err
+			}
+			s.implicit = append(s.implicit, jmapInvocation{Name: "error", Args: jerr})
+		} else {
+			s.implicit = append(s.implicit, jmapInvocation{Name: "Email/set", Args: response})
+		}
+	}
+	return result, nil
+}
+
+// submit queues the message c names for its recipients
+func (s *jmapSession) submit(acct *jmapAccount, c *jmapSubmissionCreate) (map[string]interface{},
+	*jmapSetError, error) {
+	if !acct.Rights.SendAs || c.IdentityId != acct.Id {
+		return nil, &jmapSetError{Type: "invalidProperties", Properties: []string{"identityId"},
+			Description: "No such identity"}, nil
+	}
+	e, err := s.findEmail(acct, c.EmailId)
+	if err == smtpd.ErrNotExist {
+		return nil, &jmapSetError{Type: "emailNotFound"}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := e.Header()
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := e.msg.ReadRaw()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	envelope := c.Envelope
+	if envelope == nil {
+		// Take the envelope from the message, RFC 8621 section 7
+		envelope = new(jmapEnvelope)
+		senders := jmapAddresses(header, "Sender")
+		if senders == nil {
+			senders = jmapAddresses(header, "From")
+		}
+		if len(senders) != 1 {
+			return nil, &jmapSetError{Type: "invalidEmail", Properties: []string{"from"},
+				Description: "The message needs one sender"}, nil
+		}
+		envelope.MailFrom.Email = senders[0].Email
+		seen := make(map[string]bool)
+		for _, key := range []string{"To", "Cc", "Bcc"} {
+			for _, a := range jmapAddresses(header, key) {
+				if !seen[strings.ToLower(a.Email)] {
+					seen[strings.ToLower(a.Email)] = true
+					envelope.RcptTo = append(envelope.RcptTo, jmapEnvelopeAddress{Email: a.Email})
+				}
+			}
+		}
+	}
+	smtpConfig := config.GetSmtpConfig()
+	if serr := checkEnvelope(envelope, acct.Address, smtpConfig.MaxRecipients); serr != nil {
+		return nil, serr, nil
+	}
+
+	now := time.Now()
+	sendAt, serr := jmapSendAt(envelope.MailFrom.Parameters, now)
+	if serr != nil {
+		return nil, serr, nil
+	}
+	data := smtpd.RemoveHeaders([]byte(*raw), "Bcc")
+	if smtpConfig.MaxMessageBytes > 0 && len(data) > smtpConfig.MaxMessageBytes {
+		return nil, &jmapSetError{Type: "tooLarge", MaxSize: smtpConfig.MaxMessageBytes}, nil
+	}
+	subject := decodeHeader(header, "Subject")
+	if len(subject) > 255 {
+		subject = subject[:255]
+	}
+
+	// The copies are held together so that a failure queues none of them
+	releases := make([]*db.FutureRelease, 0, len(envelope.RcptTo))
+	stamp := now.Format(smtpd.STAMP_FMT)
+	for _, rcpt := range envelope.RcptTo {
+		// Local recipients are expanded by the SMTP server on release
+		release := &db.FutureRelease{Sender: envelope.MailFrom.Email, Recipient: rcpt.Email,
+			Remote: !smtpd.IsLocal(s.ctx.Database, smtpConfig.Domain, rcpt.Email),
+			UserId: s.user.Id, Subject: subject, ReleaseAt: sendAt}
+		received := fmt.Sprintf("Received: from %s by %s with JMAP\r\n  for <%s>; %s\r\n",
+			s.user.Username, smtpConfig.Domain, rcpt.Email, stamp)
+		release.Data = append([]byte(received), data...)
+		releases = append(releases, release)
+	}
+	if err = s.ctx.Database.FutureReleaseAddAll(releases); err != nil {
+		return nil, nil, err
+	}
+	log.LogInfo("JMAP user %v submitted %v from <%v> to %v recipients", s.user.Username,
+		c.EmailId, envelope.MailFrom.Email, len(envelope.RcptTo))
+
+	// Until it is sent the message waits like any other held for release
+	undoStatus := "final"
+	if sendAt.After(now) {
+		undoStatus = "pending"
+	}
+	return map[string]interface{}{
+		"id":         strconv.FormatUint(releases[0].Id, 10),
+		"sendAt":     sendAt.UTC().Format(JMAP_DATE_FMT),
+		"undoStatus": undoStatus,
+	}, nil, nil
+}
+
+// checkEnvelope refuses an envelope not sent from the account's address
+// from, or whose recipients are missing, too many or not valid addresses.
+// Like SMTP, no more than maxRecipients may be given.
+func checkEnvelope(envelope *jmapEnvelope, from string, maxRecipients int) *jmapSetError {
+	if !strings.EqualFold(envelope.MailFrom.Email, from) {
+		return &jmapSetError{Type: "forbiddenFrom",
+			Description: fmt.Sprintf("Not allowed to send as <%v>", envelope.MailFrom.Email)}
+	}
+	if len(envelope.RcptTo) == 0 {
+		return &jmapSetError{Type: "noRecipients"}
+	}
+	if maxRecipients > 0 && len(envelope.RcptTo) > maxRecipients {
+		return &jmapSetError{Type: "tooManyRecipients", MaxRecipients: maxRecipients}
+	}
+	var invalid []string
+	for _, rcpt := range envelope.RcptTo {
+		if _, _, err := smtpd.ParseEmailAddress(rcpt.Email); err != nil || rcpt.Parameters != nil {
+			invalid = append(invalid, rcpt.Email)
+		}
+	}
+	if invalid != nil {
+		return &jmapSetError{Type: "invalidRecipients", InvalidRecipients: invalid}
+	}
+	return nil
+}
+
+// jmapSendAt works out when to send from the FUTURERELEASE parameters of
+// mailFrom, RFC 4865
+func jmapSendAt(params map[string]*string, now time.Time) (time.Time, *jmapSetError) {
+	bad := &jmapSetError{Type: "invalidProperties", Properties: []string{"envelope"}}
+	maxHold := time.Duration(config.GetSmtpConfig().MaxHoldSeconds) * time.Second
+	sendAt := now
+	for key, value := range params {
+		if value == nil || maxHold == 0 {
+			return now, bad
+		}
+		switch strings.ToUpper(key) {
+		case "HOLDFOR":
+			seconds, err := strconv.ParseUint(*value, 10, 32)
+			if err != nil {
+				return now, bad
+			}
+			sendAt = now.Add(time.Duration(seconds) * time.Second)
+		case "HOLDUNTIL":
+			t, err := time.Parse(time.RFC3339, *value)
+			if err != nil {
+				return now, bad
+			}
+			sendAt = t
+		default:
+			return now, bad
+		}
+	}
+	if len(params) > 1 || sendAt.Sub(now) > maxHold {
+		return now, bad
+	}
+	if sendAt.Before(now) {
+		sendAt = now
+	}
+	return sendAt, nil
+}
+
+// jmapEmailSubmissionGet finds nothing, submissions are not kept
+func jmapEmailSubmissionGet(s *jmapSession, args jmapArgs) (interface{}, error) {
+	var a jmapGetArgs
+	if err := args.decode(&a); err != nil {
+		return nil, err
+	}
+	acct, err := s.account(a.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	notFound := []string{}
+	if a.Ids != nil {
+		notFound = append(notFound, *a.Ids...)
+	}
+	return map[string]interface{}{
+		"accountId": acct.Id,
+		"state":     "0",
+		"list":      []interface{}{},
+		"notFound":  notFound,
+	}, nil
+}
+
+// jmapEmailSubmissionQuery finds nothing, submissions are not kept
+func jmapEmailSubmissionQuery(s *jmapSession, args jmapArgs) (interface{}, error) {
+	var a struct {
+		AccountId      string          `json:"accountId"`
+		Filter         json.RawMessage `json:"filter"`
+		Sort           json.RawMessage `json:"sort"`
+		Position       int             `json:"position"`
+		Anchor         *string         `json:"anchor"`
+		AnchorOffset   int             `json:"anchorOffset"`
+		Limit          *int            `json:"limit"`
+		CalculateTotal bool            `json:"calculateTotal"`
+	}
+	if err := args.decode(&a); err != nil {
+		return nil, err
+	}
+	acct, err := s.account(a.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"accountId":           acct.Id,
+		"queryState":          "0",
+		"canCalculateChanges": false,
+		"position":            0,
+		"ids":                 []string{},
+		"total":               0,
+	}, nil
+}
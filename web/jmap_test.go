@@ -0,0 +1,162 @@
+package web
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/smtpd"
+)
+
+func TestJmapPointer(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"ids":["a","b"],"list":[{"id":"x","to":["1","2"]},
+		{"id":"y","to":["3"]}],"a/b":{"~":1}}`), &doc)
+
+	testCases := []struct {
+		path string
+		want interface{}
+		ok   bool
+	}{
+		{"/ids", []interface{}{"a", "b"}, true},
+		{"/ids/1", "b", true},
+		{"/list/*/id", []interface{}{"x", "y"}, true},
+		{"/list/*/to", []interface{}{"1", "2", "3"}, true},
+		{"/a~1b/~0", float64(1), true},
+		{"/missing", nil, false},
+		{"/ids/2", nil, false},
+		{"ids", nil, false},
+	}
+	for _, tc := range testCases {
+		got, ok := jmapPointer(doc, tc.path)
+		if ok != tc.ok || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("jmapPointer(%q) got %v, %v, want %v, %v", tc.path, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestJmapFlags(t *testing.T) {
+	flags, err := jmapFlags(map[string]bool{"$seen": true, "$Flagged": true, "todo": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`\Flagged`, `\Seen`, "todo"}
+	if !reflect.DeepEqual(flags, want) {
+		t.Errorf("Got flags %v, want %v", flags, want)
+	}
+	if _, err = jmapFlags(map[string]bool{`\deleted`: true}); err != smtpd.ErrBadFlag {
+		t.Errorf("Expected ErrBadFlag for a system flag, got %v", err)
+	}
+
+	msg := &MockMessage{}
+	msg.On("Flags").Return([]string{`\Seen`, `\Deleted`, "ToDo"})
+	e := &jmapEmail{msg: msg}
+	keywords := e.keywords()
+	if !reflect.DeepEqual(keywords, map[string]bool{"$seen": true, "todo": true}) {
+		t.Errorf("Got keywords %v", keywords)
+	}
+}
+
+func TestJmapApi(t *testing.T) {
+	ds := &MockDataStore{}
+	inbox := &MockMailbox{}
+	junk := &MockMailbox{}
+	ds.On("MailboxFor", "fred").Return(inbox, nil)
+	inbox.On("Folders").Return([]string{"Junk"}, nil)
+	inbox.On("Folder", "Junk").Return(junk, nil)
+
+	older := (&InputMessageData{Id: "20140101T000000-0000", Subject: "older",
+		Date: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC), Size: 100}).MockMessage()
+	newer := (&InputMessageData{Id: "20140102T000000-0000", Subject: "newer",
+		Date: time.Date(2014, 1, 2, 0, 0, 0, 0, time.UTC), Size: 200}).MockMessage()
+	spam := (&InputMessageData{Id: "20140103T000000-0000", Subject: "spam",
+		Date: time.Date(2014, 1, 3, 0, 0, 0, 0, time.UTC), Size: 300}).MockMessage()
+	inbox.On("GetMessages").Return([]smtpd.Message{older, newer}, nil)
+	junk.On("GetMessages").Return([]smtpd.Message{spam}, nil)
+
+	s := &jmapSession{
+		ctx:  &Context{DataStore: ds},
+		user: &db.User{Id: 1, Username: "fred"},
+		accounts: map[string]*jmapAccount{"u1": {Id: "u1", Name: "fred",
+			Address: "fred@example.com", Personal: true,
+			Rights: &db.MailboxAcl{Read: true, Delete: true, SendAs: true}}},
+		using:      map[string]bool{JMAP_CORE: true, JMAP_MAIL: true},
+		createdIds: make(map[string]string),
+	}
+	var request jmapRequest
+	err := json.Unmarshal([]byte(`{"using":[],"methodCalls":[
+		["Email/query",{"accountId":"u1","filter":{"inMailbox":"inbox"},"calculateTotal":true},"0"],
+		["Email/get",{"accountId":"u1","#ids":{"resultOf":"0","name":"Email/query","path":"/ids"},
+			"properties":["mailboxIds","receivedAt"]},"1"],
+		["Email/query",{"accountId":"u1","filter":{"operator":"NOT","conditions":[
+			{"inMailbox":"inbox"}]}},"2"],
+		["Email/get",{"accountId":"nobody"},"3"],
+		["Identity/get",{"accountId":"u1"},"4"]]}`), &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range request.MethodCalls {
+		s.run(call)
+	}
+	data, _ := json.Marshal(s.responses)
+	var responses []interface{}
+	json.Unmarshal(data, &responses)
+
+	expect := func(path string, want interface{}) {
+		got, ok := jmapPointer(responses, path)
+		if !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("%v got %v, want %v", path, got, want)
+		}
+	}
+	expect("/0/1/ids", []interface{}{"20140102T000000-0000", "20140101T000000-0000"})
+	expect("/0/1/total", float64(2))
+	expect("/1/1/list/*/id", []interface{}{"20140102T000000-0000", "20140101T000000-0000"})
+	expect("/1/1/list/0/receivedAt", "2014-01-02T00:00:00Z")
+	expect("/1/1/list/0/mailboxIds", map[string]interface{}{"inbox": true})
+	expect("/2/1/ids", []interface{}{"20140103T000000-0000"})
+	expect("/3/0", "error")
+	expect("/3/1/type", "accountNotFound")
+	// Identity/get needs the submission capability
+	expect("/4/1/type", "unknownMethod")
+}
+
+func TestCheckEnvelope(t *testing.T) {
+	envelope := func(from string, rcpts ...string) *jmapEnvelope {
+		e := &jmapEnvelope{MailFrom: jmapEnvelopeAddress{Email: from}}
+		for _, rcpt := range rcpts {
+			e.RcptTo = append(e.RcptTo, jmapEnvelopeAddress{Email: rcpt})
+		}
+		return e
+	}
+
+	testCases := []struct {
+		envelope *jmapEnvelope
+		want     string
+	}{
+		{envelope("fred@inbucket.local", "bob@example.com", "sue@inbucket.local"), ""},
+		{envelope("Fred@Inbucket.local", "bob@example.com"), ""},
+		{envelope("james@inbucket.local", "bob@example.com"), "forbiddenFrom"},
+		{envelope("fred@inbucket.local"), "noRecipients"},
+		{envelope("fred@inbucket.local", "a@example.com", "b@example.com", "c@example.com"),
+			"tooManyRecipients"},
+		{envelope("fred@inbucket.local", "bob@example.com", "not an address"),
+			"invalidRecipients"},
+	}
+	for _, tc := range testCases {
+		got := ""
+		if serr := checkEnvelope(tc.envelope, "fred@inbucket.local", 2); serr != nil {
+			got = serr.Type
+		}
+		if got != tc.want {
+			t.Errorf("checkEnvelope(%+v) got %q, want %q", tc.envelope, got, tc.want)
+		}
+	}
+
+	serr := checkEnvelope(envelope("fred@inbucket.local", "a@example.com", "b@example.com",
+		"c@example.com"), "fred@inbucket.local", 2)
+	if serr == nil || serr.MaxRecipients != 2 {
+		t.Errorf("Expected maxRecipients 2, got %+v", serr)
+	}
+}
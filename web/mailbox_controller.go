@@ -1,14 +1,17 @@
 package web
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
+	"net"
 	"net/http"
 	"net/mail"
 	"strconv"
 	"time"
 
+	"github.com/egggo/inbucket/database"
 	"github.com/egggo/inbucket/log"
 	"github.com/egggo/inbucket/smtpd"
 )
@@ -17,6 +20,8 @@ type JsonMessageHeader struct {
 	Mailbox, Id, From, Subject string
 	Date                       time.Time
 	Size                       int64
+	Spam                       *smtpd.SpamResult
+	Flags                      []string
 }
 
 type JsonMessage struct {
@@ -25,6 +30,9 @@ type JsonMessage struct {
 	Size                       int64
 	Body                       *JsonMessageBody
 	Header                     mail.Header
+	AuthResults                *smtpd.AuthResults
+	Spam                       *smtpd.SpamResult
+	Flags                      []string
 }
 
 type JsonMessageBody struct {
@@ -77,10 +85,16 @@ func MailboxList(w http.ResponseWriter, req *http.Request, ctx *Context) (err er
 	if err != nil {
 		return err
 	}
-	mb, err := ctx.DataStore.MailboxFor(name)
+	if !mailboxAccess(w, req, ctx, name, false) {
+		return nil
+	}
+	mb, err := mailboxFolder(w, req, ctx, name)
 	if err != nil {
 		return fmt.Errorf("Failed to get mailbox for %v: %v", name, err)
 	}
+	if mb == nil {
+		return nil
+	}
 	messages, err := mb.GetMessages()
 	if err != nil {
 		return fmt.Errorf("Failed to get messages for %v: %v", name, err)
@@ -97,6 +111,8 @@ func MailboxList(w http.ResponseWriter, req *http.Request, ctx *Context) (err er
 				Subject: msg.Subject(),
 				Date:    msg.Date(),
 				Size:    msg.Size(),
+				Spam:    msg.SpamResult(),
+				Flags:   msg.Flags(),
 			}
 		}
 		return RenderJson(w, jmessages)
@@ -116,10 +132,16 @@ func MailboxShow(w http.ResponseWriter, req *http.Request, ctx *Context) (err er
 	if err != nil {
 		return err
 	}
-	mb, err := ctx.DataStore.MailboxFor(name)
+	if !mailboxAccess(w, req, ctx, name, false) {
+		return nil
+	}
+	mb, err := mailboxFolder(w, req, ctx, name)
 	if err != nil {
 		return fmt.Errorf("MailboxFor('%v'): %v", name, err)
 	}
+	if mb == nil {
+		return nil
+	}
 	msg, err := mb.GetMessage(id)
 	if err == smtpd.ErrNotExist {
 		http.NotFound(w, req)
@@ -151,6 +173,9 @@ func MailboxShow(w http.ResponseWriter, req *http.Request, ctx *Context) (err er
 					Text: mime.Text,
 					Html: mime.Html,
 				},
+				AuthResults: msg.AuthResults(),
+				Spam:        msg.SpamResult(),
+				Flags:       msg.Flags(),
 			})
 	}
 
@@ -173,10 +198,20 @@ func MailboxPurge(w http.ResponseWriter, req *http.Request, ctx *Context) (err e
 	if err != nil {
 		return err
 	}
-	mb, err := ctx.DataStore.MailboxFor(name)
+	if !mailboxAccess(w, req, ctx, name, true) {
+		return nil
+	}
+	mb, err := mailboxFolder(w, req, ctx, name)
 	if err != nil {
 		return fmt.Errorf("MailboxFor('%v'): %v", name, err)
 	}
+	if mb == nil {
+		return nil
+	}
+	if !lockMailbox(w, mb, name) {
+		return nil
+	}
+	defer mb.Unlock()
 	if err := mb.Purge(); err != nil {
 		return fmt.Errorf("Mailbox(%q) Purge: %v", name, err)
 	}
@@ -198,10 +233,16 @@ func MailboxHtml(w http.ResponseWriter, req *http.Request, ctx *Context) (err er
 	if err != nil {
 		return err
 	}
-	mb, err := ctx.DataStore.MailboxFor(name)
+	if !mailboxAccess(w, req, ctx, name, false) {
+		return nil
+	}
+	mb, err := mailboxFolder(w, req, ctx, name)
 	if err != nil {
 		return err
 	}
+	if mb == nil {
+		return nil
+	}
 	message, err := mb.GetMessage(id)
 	if err != nil {
 		return err
@@ -228,10 +269,16 @@ func MailboxSource(w http.ResponseWriter, req *http.Request, ctx *Context) (err
 	if err != nil {
 		return err
 	}
-	mb, err := ctx.DataStore.MailboxFor(name)
+	if !mailboxAccess(w, req, ctx, name, false) {
+		return nil
+	}
+	mb, err := mailboxFolder(w, req, ctx, name)
 	if err != nil {
 		return err
 	}
+	if mb == nil {
+		return nil
+	}
 	message, err := mb.GetMessage(id)
 	if err != nil {
 		return err
@@ -263,10 +310,16 @@ func MailboxDownloadAttach(w http.ResponseWriter, req *http.Request, ctx *Contex
 		return nil
 	}
 
-	mb, err := ctx.DataStore.MailboxFor(name)
+	if !mailboxAccess(w, req, ctx, name, false) {
+		return nil
+	}
+	mb, err := mailboxFolder(w, req, ctx, name)
 	if err != nil {
 		return err
 	}
+	if mb == nil {
+		return nil
+	}
 	message, err := mb.GetMessage(id)
 	if err != nil {
 		return err
@@ -305,10 +358,16 @@ func MailboxViewAttach(w http.ResponseWriter, req *http.Request, ctx *Context) (
 		return nil
 	}
 
-	mb, err := ctx.DataStore.MailboxFor(name)
+	if !mailboxAccess(w, req, ctx, name, false) {
+		return nil
+	}
+	mb, err := mailboxFolder(w, req, ctx, name)
 	if err != nil {
 		return err
 	}
+	if mb == nil {
+		return nil
+	}
 	message, err := mb.GetMessage(id)
 	if err != nil {
 		return err
@@ -336,10 +395,20 @@ func MailboxDelete(w http.ResponseWriter, req *http.Request, ctx *Context) (err
 	if err != nil {
 		return err
 	}
-	mb, err := ctx.DataStore.MailboxFor(name)
+	if !mailboxAccess(w, req, ctx, name, true) {
+		return nil
+	}
+	mb, err := mailboxFolder(w, req, ctx, name)
 	if err != nil {
 		return err
 	}
+	if mb == nil {
+		return nil
+	}
+	if !lockMailbox(w, mb, name) {
+		return nil
+	}
+	defer mb.Unlock()
 	message, err := mb.GetMessage(id)
 	if err != nil {
 		return err
@@ -357,3 +426,166 @@ func MailboxDelete(w http.ResponseWriter, req *http.Request, ctx *Context) (err
 	io.WriteString(w, "OK")
 	return nil
 }
+
+// MailboxFlags replaces the flags of a message with the JSON list of system
+// flags and keywords in the request body, and answers with the flags as set
+func MailboxFlags(w http.ResponseWriter, req *http.Request, ctx *Context) (err error) {
+	// Don't have to validate these aren't empty, Gorilla returns 404
+	id := ctx.Vars["id"]
+	name, err := smtpd.ParseMailboxName(ctx.Vars["name"])
+	if err != nil {
+		return err
+	}
+	if !mailboxAccess(w, req, ctx, name, true) {
+		return nil
+	}
+	var flags []string
+	if err = json.NewDecoder(req.Body).Decode(&flags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	mb, err := mailboxFolder(w, req, ctx, name)
+	if err != nil {
+		return err
+	}
+	if mb == nil {
+		return nil
+	}
+	message, err := mb.GetMessage(id)
+	if err == smtpd.ErrNotExist {
+		http.NotFound(w, req)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = message.SetFlags(flags)
+	if err == smtpd.ErrBadFlag {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.LogTrace("Set flags of %v in %q to %v", id, name, message.Flags())
+
+	return RenderJson(w, message.Flags())
+}
+
+// mailboxAccess enforces the ACLs of shared mailboxes, whose users sign in
+// with HTTP basic authentication; other mailboxes stay open to everyone.
+// Reading needs the read right, deleting the delete right.  It returns false
+// after refusing the request.
+func mailboxAccess(w http.ResponseWriter, req *http.Request, ctx *Context, name string,
+	delete bool) bool {
+	if ctx.Database == nil {
+		return true
+	}
+	shared, err := ctx.Database.SharedMailboxGetByName(name)
+	if err != nil {
+		log.LogError("get shared mailbox %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if shared == nil {
+		return true
+	}
+
+	logIn := func(ip string, login string, pass string) (*db.User, error) {
+		return smtpd.LogIn(ctx.Database, smtpd.DefaultAuthThrottle(), "HTTP", ip, login,
+			smtpd.PasswordCheck(ctx.Database, pass))
+	}
+	aclGet := func(user *db.User) (*db.MailboxAcl, error) {
+		return ctx.Database.MailboxAclGet(shared.Id, user.Id)
+	}
+	return sharedMailboxAccess(w, req, name, delete, logIn, aclGet)
+}
+
+// sharedMailboxAccess signs the basic authentication user in to the shared
+// mailbox name with logIn, which counts failures against the login throttle
+// by the client's address, and checks the ACL aclGet finds for them
+func sharedMailboxAccess(w http.ResponseWriter, req *http.Request, name string, delete bool,
+	logIn func(ip string, login string, pass string) (*db.User, error),
+	aclGet func(user *db.User) (*db.MailboxAcl, error)) bool {
+	login, pass, ok := req.BasicAuth()
+	if ok {
+		ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+		user, err := logIn(ip, login, pass)
+		if err == smtpd.ErrThrottled {
+			log.LogWarn("Refusing web login for %v on shared mailbox %v - %v", login, name, err)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return false
+		}
+		if err != nil {
+			log.LogWarn("Failed web auth for %v on shared mailbox %v - %v", login, name, err)
+		} else {
+			acl, err := aclGet(user)
+			if err != nil {
+				log.LogError("get mailbox acl %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return false
+			}
+			if aclAllows(acl, delete) {
+				return true
+			}
+			log.LogWarn("User %v denied access to shared mailbox %v", login, name)
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return false
+		}
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", "Inbucket "+name))
+	http.Error(w, "Sign in to open this mailbox", http.StatusUnauthorized)
+	return false
+}
+
+// aclAllows reports whether acl grants reading a shared mailbox, and deleting
+// from it too if delete is set
+func aclAllows(acl *db.MailboxAcl, delete bool) bool {
+	return acl != nil && acl.Read && (acl.Delete || !delete)
+}
+
+// mailboxFolder opens the mailbox name, or the folder of it named by the folder
+// form value.  It returns nil after answering the request if there is no such
+// folder.
+func mailboxFolder(w http.ResponseWriter, req *http.Request, ctx *Context,
+	name string) (smtpd.Mailbox, error) {
+	mb, err := ctx.DataStore.MailboxFor(name)
+	if err != nil {
+		return nil, err
+	}
+	folder := req.FormValue("folder")
+	if folder == "" {
+		return mb, nil
+	}
+	if mb, err = mb.Folder(folder); err != nil {
+		return nil, folderError(w, req, err)
+	}
+	return mb, nil
+}
+
+// folderError answers a request whose folder operation failed because of the
+// client, other errors are returned
+func folderError(w http.ResponseWriter, req *http.Request, err error) error {
+	switch err {
+	case smtpd.ErrFolderNotExist, smtpd.ErrNotExist:
+		http.NotFound(w, req)
+	case smtpd.ErrFolderExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case smtpd.ErrBadFolderName:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		return err
+	}
+	return nil
+}
+
+// lockMailbox takes the mailbox away from POP3 sessions while we delete from
+// it.  It returns false after refusing the request when a session has it.
+func lockMailbox(w http.ResponseWriter, mb smtpd.Mailbox, name string) bool {
+	if err := mb.Lock("web"); err != nil {
+		log.LogWarn("Mailbox %v is locked - %v", name, err)
+		http.Error(w, "Mailbox is in use", http.StatusConflict)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,327 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+)
+
+// checkGroupPolicy makes sure the posting policy of a group is one we know
+func checkGroupPolicy(group *db.Group) error {
+	switch group.Policy {
+	case "", db.GROUP_POLICY_ANYONE, db.GROUP_POLICY_MEMBERS, db.GROUP_POLICY_SENDERS,
+		db.GROUP_POLICY_MODERATED:
+		return nil
+	}
+	return fmt.Errorf("unknown policy %q, expected one of %v, %v, %v or %v", group.Policy,
+		db.GROUP_POLICY_ANYONE, db.GROUP_POLICY_MEMBERS, db.GROUP_POLICY_SENDERS,
+		db.GROUP_POLICY_MODERATED)
+}
+
+// routeGroup returns the group named by the id in the route, or nil after
+// rendering the failure
+func routeGroup(w http.ResponseWriter, reply Reply, ctx *Context) *db.Group {
+	groupId, err := strconv.ParseUint(ctx.Vars["id"], 10, 0)
+	if err != nil {
+		log.LogError("Bad group id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	group, err := ctx.Database.GroupGet(groupId)
+	if err != nil {
+		log.LogError("get group %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	if group == nil {
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = "group not found"
+		RenderJson(w, reply)
+		return nil
+	}
+	return group
+}
+
+// routeHeld returns the held message of the group named in the route, or nil
+// after rendering the failure
+func routeHeld(w http.ResponseWriter, reply Reply, ctx *Context) *db.GroupHeld {
+	group := routeGroup(w, reply, ctx)
+	if group == nil {
+		return nil
+	}
+	heldId, err := strconv.ParseUint(ctx.Vars["heldId"], 10, 0)
+	if err != nil {
+		log.LogError("Bad held id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	held, err := ctx.Database.GroupHeldGet(heldId)
+	if err != nil {
+		log.LogError("get held %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	if held == nil || held.GroupId != group.Id {
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = "held message not found"
+		RenderJson(w, reply)
+		return nil
+	}
+	return held
+}
+
+func GroupSenderList(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	group := routeGroup(w, reply, ctx)
+	if group == nil {
+		return nil
+	}
+
+	senders, err := ctx.Database.GroupSenderList(group.Id)
+	if err != nil {
+		log.LogError("get group senders %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("get group senders suc %d", group.Id)
+
+	reply["senders"] = senders
+	RenderJson(w, reply)
+	return nil
+}
+
+// GroupSenderPut allows the address in the route to post to a group with the
+// senders policy
+func GroupSenderPut(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	group := routeGroup(w, reply, ctx)
+	if group == nil {
+		return nil
+	}
+
+	address := ctx.Vars["address"]
+	addr, err := mail.ParseAddress(address)
+	if err == nil && addr.Address != strings.TrimSpace(address) {
+		err = fmt.Errorf("address must not have a display name")
+	}
+	if err != nil {
+		log.LogError("bad sender %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	listed, err := ctx.Database.GroupSenderHas(group.Id, addr.Address)
+	if err == nil && !listed {
+		err = ctx.Database.GroupSenderAdd(&db.GroupSender{GroupId: group.Id,
+			Address: addr.Address})
+	}
+	if err != nil {
+		log.LogError("add group sender %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("add group sender suc %d %v", group.Id, addr.Address)
+
+	RenderJson(w, reply)
+	return nil
+}
+
+func GroupSenderDel(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	group := routeGroup(w, reply, ctx)
+	if group == nil {
+		return nil
+	}
+	address := ctx.Vars["address"]
+
+	listed, err := ctx.Database.GroupSenderHas(group.Id, address)
+	if err != nil {
+		log.LogError("get group sender %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	if !listed {
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = "no such group sender"
+		RenderJson(w, reply)
+		return nil
+	}
+
+	err = ctx.Database.GroupSenderDel(group.Id, address)
+	if err != nil {
+		log.LogError("del group sender %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del group sender suc %d %v", group.Id, address)
+
+	RenderJson(w, reply)
+	return nil
+}
+
+// GroupHeldList pages through the messages waiting for a moderator
+func GroupHeldList(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	group := routeGroup(w, reply, ctx)
+	if group == nil {
+		return nil
+	}
+
+	pagenoNum, err := strconv.Atoi(ctx.Vars["pageno"])
+	if err != nil {
+		log.LogError("Bad pageno %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	countNum, err := strconv.Atoi(ctx.Vars["count"])
+	if err != nil {
+		log.LogError("Bad count %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	total, helds, err := ctx.Database.GroupHeldList(group.Id, pagenoNum, countNum)
+	if err != nil {
+		log.LogError("get held list %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("get held list suc %d %d %d", group.Id, pagenoNum, countNum)
+
+	reply["total"] = total
+	reply["held"] = helds
+	RenderJson(w, reply)
+	return nil
+}
+
+// GroupHeldGet returns a held message along with its source
+func GroupHeldGet(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	held := routeHeld(w, reply, ctx)
+	if held == nil {
+		return nil
+	}
+
+	log.LogTrace("get held suc %d", held.Id)
+
+	reply["held"] = held
+	reply["source"] = string(held.Data)
+	RenderJson(w, reply)
+	return nil
+}
+
+// GroupHeldApprove releases a held message to the group
+func GroupHeldApprove(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	return groupHeldDecide(w, req, ctx, db.HELD_APPROVED)
+}
+
+// GroupHeldReject discards a held message, the sender is told why if the
+// body gives a reason
+func GroupHeldReject(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	return groupHeldDecide(w, req, ctx, db.HELD_REJECTED)
+}
+
+// groupHeldDecide records the moderator's decision, SMTP then delivers or
+// discards the message
+func groupHeldDecide(w http.ResponseWriter, req *http.Request, ctx *Context, state string) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	held := routeHeld(w, reply, ctx)
+	if held == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	decision := struct {
+		Reason string `json:"reason"`
+	}{}
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &decision); err != nil {
+			log.LogError("unmarshal decision %v", err)
+			reply["code"] = REPLY_CODE_FAIL
+			reply["msg"] = err.Error()
+			RenderJson(w, reply)
+			return nil
+		}
+	}
+
+	waiting, err := ctx.Database.GroupHeldDecide(held.Id, state, decision.Reason)
+	if err != nil {
+		log.LogError("decide held %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	if !waiting {
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = "message was already " + held.State
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("%v held suc %d", state, held.Id)
+
+	RenderJson(w, reply)
+	return nil
+}
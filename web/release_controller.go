@@ -0,0 +1,132 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+)
+
+// routeFutureRelease returns the held message named by the id in the route,
+// or nil after rendering the failure
+func routeFutureRelease(w http.ResponseWriter, reply Reply, ctx *Context) *db.FutureRelease {
+	id, err := strconv.ParseUint(ctx.Vars["id"], 10, 0)
+	if err != nil {
+		log.LogError("Bad future release id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	release, err := ctx.Database.FutureReleaseGet(id)
+	if err != nil {
+		log.LogError("get future release %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	if release == nil {
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = "held message not found"
+		RenderJson(w, reply)
+		return nil
+	}
+	return release
+}
+
+// FutureReleaseList pages through the messages SMTP holds for later
+// delivery, soonest due first
+func FutureReleaseList(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	pagenoNum, err := strconv.Atoi(ctx.Vars["pageno"])
+	if err != nil {
+		log.LogError("Bad pageno %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	countNum, err := strconv.Atoi(ctx.Vars["count"])
+	if err != nil {
+		log.LogError("Bad count %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	total, releases, err := ctx.Database.FutureReleaseList(pagenoNum, countNum)
+	if err != nil {
+		log.LogError("get future release list %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("get future release list suc %d %d", pagenoNum, countNum)
+
+	reply["total"] = total
+	reply["releases"] = releases
+	RenderJson(w, reply)
+	return nil
+}
+
+// FutureReleaseGet returns a held message along with its source
+func FutureReleaseGet(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	release := routeFutureRelease(w, reply, ctx)
+	if release == nil {
+		return nil
+	}
+
+	log.LogTrace("get future release suc %d", release.Id)
+
+	reply["release"] = release
+	reply["source"] = string(release.Data)
+	RenderJson(w, reply)
+	return nil
+}
+
+// FutureReleaseCancel discards a held message before it is delivered, the
+// sender is not told
+func FutureReleaseCancel(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	release := routeFutureRelease(w, reply, ctx)
+	if release == nil {
+		return nil
+	}
+
+	taken, err := ctx.Database.FutureReleaseDel(release.Id)
+	if err != nil {
+		log.LogError("del future release %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	if !taken {
+		// Released in the meantime
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = "held message not found"
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del future release suc %d", release.Id)
+
+	RenderJson(w, reply)
+	return nil
+}
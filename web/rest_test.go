@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/egggo/inbucket/config"
+	"github.com/egggo/inbucket/database"
 	"github.com/egggo/inbucket/smtpd"
 	"github.com/jhillyerd/go.enmime"
 	"github.com/stretchr/testify/mock"
@@ -57,6 +58,9 @@ func (d *InputMessageData) MockMessage() *MockMessage {
 		Html: d.Html,
 	}
 	msg.On("ReadBody").Return(body, nil)
+	msg.On("AuthResults").Return((*smtpd.AuthResults)(nil))
+	msg.On("SpamResult").Return((*smtpd.SpamResult)(nil))
+	msg.On("Flags").Return([]string(nil))
 	return msg
 }
 
@@ -376,6 +380,148 @@ func TestRestMessage(t *testing.T) {
 	}
 }
 
+func TestRestFolders(t *testing.T) {
+	// Setup
+	ds := &MockDataStore{}
+	logbuf := setupWebServer(ds)
+
+	inbox := &MockMailbox{}
+	junk := &MockMailbox{}
+	ds.On("MailboxFor", "good").Return(inbox, nil)
+	inbox.On("Folders").Return([]string{"Junk", "Lists/Go"}, nil)
+	inbox.On("Folder", "Junk").Return(junk, nil)
+	inbox.On("Folder", "Trash").Return(nil, smtpd.ErrFolderNotExist)
+	junk.On("GetMessages").Return([]smtpd.Message{}, nil)
+
+	// Test folder list
+	w, err := testRestGet("http://localhost/folders/good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Errorf("Expected code %v, got %v", 200, w.Code)
+	}
+	var folders []string
+	if err := json.NewDecoder(w.Body).Decode(&folders); err != nil {
+		t.Errorf("Failed to decode JSON: %v", err)
+	}
+	if len(folders) != 2 || folders[0] != "Junk" || folders[1] != "Lists/Go" {
+		t.Errorf("Expected folders Junk and Lists/Go, got %v", folders)
+	}
+
+	// Test messages of a folder
+	w, err = testRestGet("http://localhost/mailbox/good?folder=Junk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 {
+		t.Errorf("Expected code %v, got %v", 200, w.Code)
+	}
+	junk.AssertExpectations(t)
+
+	// Test missing folder
+	w, err = testRestGet("http://localhost/mailbox/good?folder=Trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 404 {
+		t.Errorf("Expected code %v, got %v", 404, w.Code)
+	}
+
+	if t.Failed() {
+		// Wait for handler to finish logging
+		time.Sleep(2 * time.Second)
+		// Dump buffered log data if there was a failure
+		io.Copy(os.Stderr, logbuf)
+	}
+}
+
+func TestMailboxAccess(t *testing.T) {
+	// Without a database every mailbox is open
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "http://localhost/mailbox/shared", nil)
+	if !mailboxAccess(w, req, &Context{}, "shared", true) {
+		t.Errorf("Expected access without a database, got %v", w.Code)
+	}
+
+	testCases := []struct {
+		acl    *db.MailboxAcl
+		delete bool
+		want   bool
+	}{
+		{nil, false, false},
+		{&db.MailboxAcl{}, false, false},
+		{&db.MailboxAcl{Read: true}, false, true},
+		{&db.MailboxAcl{Read: true}, true, false},
+		{&db.MailboxAcl{Read: true, Delete: true}, true, true},
+		{&db.MailboxAcl{Delete: true, SendAs: true}, true, false},
+	}
+	for _, tc := range testCases {
+		if got := aclAllows(tc.acl, tc.delete); got != tc.want {
+			t.Errorf("aclAllows(%+v, %v) got %v, want %v", tc.acl, tc.delete, got, tc.want)
+		}
+	}
+}
+
+// Test signing in to a shared mailbox: the login is keyed by the client's
+// address and refused while the throttle has it locked out
+func TestSharedMailboxAccess(t *testing.T) {
+	fred := &db.User{Id: 7, Username: "fred"}
+	var ips []string
+	logIn := func(ip string, login string, pass string) (*db.User, error) {
+		ips = append(ips, ip)
+		if login == "fred" && pass == "secret" {
+			return fred, nil
+		}
+		return nil, smtpd.ErrAuthFailed
+	}
+	aclGet := func(user *db.User) (*db.MailboxAcl, error) {
+		return &db.MailboxAcl{UserId: user.Id, Read: true}, nil
+	}
+	access := func(login string, pass string,
+		logIn func(string, string, string) (*db.User, error)) (bool, int) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/mailbox/shared", nil)
+		req.RemoteAddr = "192.0.2.1:5000"
+		req.SetBasicAuth(login, pass)
+		ok := sharedMailboxAccess(w, req, "shared", false, logIn, aclGet)
+		return ok, w.Code
+	}
+
+	if ok, code := access("fred", "secret", logIn); !ok {
+		t.Errorf("Expected access with the right password, got %v", code)
+	}
+	if ok, code := access("fred", "guess", logIn); ok || code != http.StatusUnauthorized {
+		t.Errorf("Expected %v with the wrong password, got %v", http.StatusUnauthorized, code)
+	}
+	if len(ips) != 2 || ips[0] != "192.0.2.1" || ips[1] != "192.0.2.1" {
+		t.Errorf("Expected logins from 192.0.2.1, got %v", ips)
+	}
+
+	// A locked out client is refused before its password is looked at
+	throttle := smtpd.NewAuthThrottle(config.ThrottleConfig{MaxFailures: 1, LockoutMinutes: 5})
+	throttle.Failure("HTTP", "192.0.2.1", "fred")
+	throttled := func(ip string, login string, pass string) (*db.User, error) {
+		return smtpd.LogIn(nil, throttle, "HTTP", ip, login, nil)
+	}
+	if ok, code := access("fred", "secret", throttled); ok || code != http.StatusTooManyRequests {
+		t.Errorf("Expected %v while throttled, got %v", http.StatusTooManyRequests, code)
+	}
+}
+
+func TestMailboxRights(t *testing.T) {
+	// Users have every right on the mailbox named after them
+	user := &db.User{Id: 7, Username: "Fred"}
+	rights, err := (&db.Database{}).MailboxRights("fred", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := db.MailboxAcl{UserId: 7, Read: true, Delete: true, SendAs: true}
+	if rights == nil || *rights != want {
+		t.Errorf("Got rights %+v, want %+v", rights, want)
+	}
+}
+
 func testRestGet(url string) (*httptest.ResponseRecorder, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	req.Header.Add("Accept", "application/json")
@@ -444,6 +590,56 @@ func (m *MockMailbox) NewMessage() (smtpd.Message, error) {
 	return args.Get(0).(smtpd.Message), args.Error(1)
 }
 
+func (m *MockMailbox) UidValidity() (uint32, error) {
+	args := m.Called()
+	return uint32(args.Int(0)), args.Error(1)
+}
+
+func (m *MockMailbox) UidNext() (uint32, error) {
+	args := m.Called()
+	return uint32(args.Int(0)), args.Error(1)
+}
+
+func (m *MockMailbox) Lock(owner string) error {
+	return nil
+}
+
+func (m *MockMailbox) Unlock() {
+}
+
+func (m *MockMailbox) Folders() ([]string, error) {
+	args := m.Called()
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockMailbox) Folder(name string) (smtpd.Mailbox, error) {
+	args := m.Called(name)
+	mb, _ := args.Get(0).(smtpd.Mailbox)
+	return mb, args.Error(1)
+}
+
+func (m *MockMailbox) CreateFolder(name string) (smtpd.Mailbox, error) {
+	args := m.Called(name)
+	mb, _ := args.Get(0).(smtpd.Mailbox)
+	return mb, args.Error(1)
+}
+
+func (m *MockMailbox) RenameFolder(name string, newName string) error {
+	args := m.Called(name, newName)
+	return args.Error(0)
+}
+
+func (m *MockMailbox) DeleteFolder(name string) error {
+	args := m.Called(name)
+	return args.Error(0)
+}
+
+func (m *MockMailbox) MoveMessage(id string, dest smtpd.Mailbox) (smtpd.Message, error) {
+	args := m.Called(id, dest)
+	msg, _ := args.Get(0).(smtpd.Message)
+	return msg, args.Error(1)
+}
+
 func (m *MockMailbox) String() string {
 	args := m.Called()
 	return args.String(0)
@@ -459,6 +655,11 @@ func (m *MockMessage) Id() string {
 	return args.String(0)
 }
 
+func (m *MockMessage) Uid() uint32 {
+	args := m.Called()
+	return uint32(args.Int(0))
+}
+
 func (m *MockMessage) From() string {
 	args := m.Called()
 	return args.String(0)
@@ -518,3 +719,31 @@ func (m *MockMessage) String() string {
 	args := m.Called()
 	return args.String(0)
 }
+
+func (m *MockMessage) AuthResults() *smtpd.AuthResults {
+	args := m.Called()
+	return args.Get(0).(*smtpd.AuthResults)
+}
+
+func (m *MockMessage) SetAuthResults(results *smtpd.AuthResults) {
+	m.Called(results)
+}
+
+func (m *MockMessage) SetSpamResult(result *smtpd.SpamResult) {
+	m.Called(result)
+}
+
+func (m *MockMessage) SpamResult() *smtpd.SpamResult {
+	args := m.Called()
+	return args.Get(0).(*smtpd.SpamResult)
+}
+
+func (m *MockMessage) Flags() []string {
+	args := m.Called()
+	return args.Get(0).([]string)
+}
+
+func (m *MockMessage) SetFlags(flags []string) error {
+	args := m.Called(flags)
+	return args.Error(0)
+}
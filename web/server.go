@@ -62,12 +62,37 @@ func setupRoutes(cfg config.WebConfig) {
 	r.Path("/mailbox/{name}/{id}").Handler(handler(MailboxDelete)).Name("MailboxDelete").Methods("DELETE")
 	r.Path("/mailbox/dattach/{name}/{id}/{num}/{file}").Handler(handler(MailboxDownloadAttach)).Name("MailboxDownloadAttach").Methods("GET")
 	r.Path("/mailbox/vattach/{name}/{id}/{num}/{file}").Handler(handler(MailboxViewAttach)).Name("MailboxViewAttach").Methods("GET")
+	r.Path("/mailbox/{name}/{id}/move").Handler(handler(MailboxMove)).Name("MailboxMove").Methods("POST")
+	r.Path("/mailbox/{name}/{id}/flags").Handler(handler(MailboxFlags)).Name("MailboxFlags").Methods("PUT")
+	r.Path("/folders/{name}").Handler(handler(FolderList)).Name("FolderList").Methods("GET")
+	r.Path("/folders/{name}").Handler(handler(FolderCreate)).Name("FolderCreate").Methods("POST")
+	r.Path("/folders/{name}").Handler(handler(FolderRename)).Name("FolderRename").Methods("PUT")
+	r.Path("/folders/{name}").Handler(handler(FolderDelete)).Name("FolderDelete").Methods("DELETE")
+
+	r.Path("/.well-known/jmap").Handler(handler(JmapWellKnown)).Name("JmapWellKnown").Methods("GET")
+	r.Path("/jmap/session").Handler(handler(JmapSession)).Name("JmapSession").Methods("GET")
+	r.Path("/jmap/api").Handler(handler(JmapApi)).Name("JmapApi").Methods("POST")
+	r.Path("/jmap/download/{accountId}/{blobId}/{name}").Handler(handler(JmapDownload)).Name("JmapDownload").Methods("GET")
+	r.Path("/jmap/upload/{accountId}").Handler(handler(JmapUpload)).Name("JmapUpload").Methods("POST")
+	r.Path("/jmap/eventsource").HandlerFunc(JmapEventSource).Name("JmapEventSource").Methods("GET")
 
 	r.Path("/user").Handler(handler(UserAdd)).Name("UserAdd").Methods("POST")
 	r.Path("/user/{id}").Handler(handler(UserUpdate)).Name("UserUpdate").Methods("PUT")
 	r.Path("/user/{id}").Handler(handler(UserDel)).Name("UserDel").Methods("DELETE")
 	r.Path("/user/{id}").Handler(handler(UserGet)).Name("UserGet").Methods("GET")
 	r.Path("/user/{id}/passwd").Handler(handler(UserChangePasswd)).Name("UserChangePasswd").Methods("PUT")
+	r.Path("/user/{id}/apop").Handler(handler(UserApopPut)).Name("UserApopPut").Methods("PUT")
+	r.Path("/user/{id}/apop").Handler(handler(UserApopDel)).Name("UserApopDel").Methods("DELETE")
+	r.Path("/user/{id}/sieve").Handler(handler(SieveList)).Name("SieveList").Methods("GET")
+	r.Path("/user/{id}/sieve/{name}").Handler(handler(SieveGet)).Name("SieveGet").Methods("GET")
+	r.Path("/user/{id}/sieve/{name}").Handler(handler(SievePut)).Name("SievePut").Methods("PUT")
+	r.Path("/user/{id}/sieve/{name}").Handler(handler(SieveDel)).Name("SieveDel").Methods("DELETE")
+	r.Path("/user/{id}/sieve/{name}/active").Handler(handler(SieveActivate)).Name("SieveActivate").Methods("PUT")
+	r.Path("/user/{id}/vacation").Handler(handler(VacationGet)).Name("VacationGet").Methods("GET")
+	r.Path("/user/{id}/vacation").Handler(handler(VacationPut)).Name("VacationPut").Methods("PUT")
+	r.Path("/user/{id}/forward").Handler(handler(ForwardGet)).Name("ForwardGet").Methods("GET")
+	r.Path("/user/{id}/forward").Handler(handler(ForwardPut)).Name("ForwardPut").Methods("PUT")
+	r.Path("/user/{id}/forward").Handler(handler(ForwardDel)).Name("ForwardDel").Methods("DELETE")
 
 	r.Path("/users/{pageno}/{count}").Handler(handler(UserList)).Name("UserList").Methods("POST")
 
@@ -80,7 +105,44 @@ func setupRoutes(cfg config.WebConfig) {
 	r.Path("/groupMember").Handler(handler(GroupMemberAdd)).Name("GroupMemberAdd").Methods("POST")
 	r.Path("/groupMember/{id}").Handler(handler(GroupMemberDel)).Name("GroupMemberDel").Methods("DELETE")
 	r.Path("/groupMember/{id}").Handler(handler(GroupMemberGet)).Name("GroupMemberGet").Methods("GET")
+	r.Path("/groupMember/{id}").Handler(handler(GroupMemberUpdate)).Name("GroupMemberUpdate").Methods("PUT")
 	r.Path("/groupMembers/{groupId}/{pageno}/{count}").Handler(handler(GroupMemberList)).Name("GroupMemberList").Methods("GET")
+	r.Path("/group/{id}/member/{address}").Handler(handler(GroupMemberPutAddress)).Name("GroupMemberPutAddress").Methods("PUT")
+	r.Path("/group/{id}/member/{address}").Handler(handler(GroupMemberDelAddress)).Name("GroupMemberDelAddress").Methods("DELETE")
+	r.Path("/group/{id}/senders").Handler(handler(GroupSenderList)).Name("GroupSenderList").Methods("GET")
+	r.Path("/group/{id}/sender/{address}").Handler(handler(GroupSenderPut)).Name("GroupSenderPut").Methods("PUT")
+	r.Path("/group/{id}/sender/{address}").Handler(handler(GroupSenderDel)).Name("GroupSenderDel").Methods("DELETE")
+	r.Path("/group/{id}/held/{pageno}/{count}").Handler(handler(GroupHeldList)).Name("GroupHeldList").Methods("GET")
+	r.Path("/group/{id}/held/{heldId}").Handler(handler(GroupHeldGet)).Name("GroupHeldGet").Methods("GET")
+	r.Path("/group/{id}/held/{heldId}/approve").Handler(handler(GroupHeldApprove)).Name("GroupHeldApprove").Methods("POST")
+	r.Path("/group/{id}/held/{heldId}/reject").Handler(handler(GroupHeldReject)).Name("GroupHeldReject").Methods("POST")
+
+	r.Path("/alias").Handler(handler(AliasAdd)).Name("AliasAdd").Methods("POST")
+	r.Path("/alias/{id}").Handler(handler(AliasUpdate)).Name("AliasUpdate").Methods("PUT")
+	r.Path("/alias/{id}").Handler(handler(AliasDel)).Name("AliasDel").Methods("DELETE")
+	r.Path("/alias/{id}").Handler(handler(AliasGet)).Name("AliasGet").Methods("GET")
+	r.Path("/aliases/{pageno}/{count}").Handler(handler(AliasList)).Name("AliasList").Methods("GET")
+
+	r.Path("/sharedMailbox").Handler(handler(SharedMailboxAdd)).Name("SharedMailboxAdd").Methods("POST")
+	r.Path("/sharedMailbox/{id}").Handler(handler(SharedMailboxDel)).Name("SharedMailboxDel").Methods("DELETE")
+	r.Path("/sharedMailbox/{id}").Handler(handler(SharedMailboxGet)).Name("SharedMailboxGet").Methods("GET")
+	r.Path("/sharedMailbox/{id}/acl/{userId}").Handler(handler(MailboxAclPut)).Name("MailboxAclPut").Methods("PUT")
+	r.Path("/sharedMailbox/{id}/acl/{userId}").Handler(handler(MailboxAclDel)).Name("MailboxAclDel").Methods("DELETE")
+	r.Path("/sharedMailboxes/{pageno}/{count}").Handler(handler(SharedMailboxList)).Name("SharedMailboxList").Methods("GET")
+
+	r.Path("/futureReleases/{pageno}/{count}").Handler(handler(FutureReleaseList)).Name("FutureReleaseList").Methods("GET")
+	r.Path("/futureRelease/{id}").Handler(handler(FutureReleaseGet)).Name("FutureReleaseGet").Methods("GET")
+	r.Path("/futureRelease/{id}").Handler(handler(FutureReleaseCancel)).Name("FutureReleaseCancel").Methods("DELETE")
+
+	r.Path("/authBans").Handler(handler(AuthBanList)).Name("AuthBanList").Methods("GET")
+	r.Path("/authBans").Handler(handler(AuthBanClear)).Name("AuthBanClear").Methods("DELETE")
+	r.Path("/authBan/{key}").Handler(handler(AuthBanDel)).Name("AuthBanDel").Methods("DELETE")
+
+	r.Path("/dkim/{domain}").Handler(handler(DkimGet)).Name("DkimGet").Methods("GET")
+	r.Path("/dkim/{domain}").Handler(handler(DkimRotate)).Name("DkimRotate").Methods("POST")
+	r.Path("/dkim/{domain}").Handler(handler(DkimDel)).Name("DkimDel").Methods("DELETE")
+	r.Path("/dkim/{domain}/record").Handler(handler(DkimRecord)).Name("DkimRecord").Methods("GET")
+	r.Path("/dkims/{pageno}/{count}").Handler(handler(DkimList)).Name("DkimList").Methods("GET")
 
 	// Register w/ HTTP
 	Router = r
@@ -0,0 +1,317 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+	"github.com/egggo/inbucket/smtpd"
+)
+
+func SharedMailboxAdd(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	mailbox := new(db.SharedMailbox)
+	err = json.Unmarshal(body, mailbox)
+	if err == nil {
+		mailbox.Name, err = smtpd.ParseMailboxName(mailbox.Name)
+	}
+	if err != nil {
+		log.LogError("bad shared mailbox %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	// A user's own mailbox cannot be shared
+	user, err := ctx.Database.UserGetByName(mailbox.Name)
+	if err == nil && user == nil {
+		var existing *db.SharedMailbox
+		existing, err = ctx.Database.SharedMailboxGetByName(mailbox.Name)
+		if existing != nil {
+			log.LogError("already exist %v", existing.Name)
+			reply["code"] = REPLY_CODE_ALREADY_EXIST
+			reply["msg"] = "already exist shared mailbox"
+			RenderJson(w, reply)
+			return nil
+		}
+	}
+	if err != nil {
+		log.LogError("check shared mailbox %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	if user != nil {
+		log.LogError("already exist %v", user.Username)
+		reply["code"] = REPLY_CODE_ALREADY_EXIST
+		reply["msg"] = "already exist user"
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("add shared mailbox %v", mailbox)
+
+	err = ctx.Database.SharedMailboxAdd(mailbox)
+	if err != nil {
+		log.LogError("add shared mailbox %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("add shared mailbox suc %v", mailbox)
+
+	reply["id"] = mailbox.Id
+	RenderJson(w, reply)
+	return nil
+}
+
+func SharedMailboxDel(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	mailbox := routeSharedMailbox(reply, ctx)
+	if mailbox == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	err := ctx.Database.SharedMailboxDel(mailbox.Id)
+	if err != nil {
+		log.LogError("del shared mailbox %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del shared mailbox suc %d", mailbox.Id)
+
+	RenderJson(w, reply)
+	return nil
+}
+
+func SharedMailboxGet(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	mailbox := routeSharedMailbox(reply, ctx)
+	if mailbox == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	acls, err := ctx.Database.MailboxAclList(mailbox.Id)
+	if err != nil {
+		log.LogError("get mailbox acl %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("get shared mailbox suc %d", mailbox.Id)
+
+	reply["mailbox"] = mailbox
+	reply["acl"] = acls
+	RenderJson(w, reply)
+	return nil
+}
+
+func SharedMailboxList(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	pagenoNum, err := strconv.Atoi(ctx.Vars["pageno"])
+	if err != nil {
+		log.LogError("Bad pageno %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	countNum, err := strconv.Atoi(ctx.Vars["count"])
+	if err != nil {
+		log.LogError("Bad count %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	total, mailboxes, err := ctx.Database.SharedMailboxList(pagenoNum, countNum)
+	if err != nil {
+		log.LogError("get shared mailbox list %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("get shared mailbox list suc %d %d", pagenoNum, countNum)
+
+	reply["total"] = total
+	reply["mailboxes"] = mailboxes
+	RenderJson(w, reply)
+	return nil
+}
+
+// MailboxAclPut sets the rights of the user in the route on a shared
+// mailbox, from a body such as {"read": true, "delete": false, "sendAs": true}
+func MailboxAclPut(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	mailbox := routeSharedMailbox(reply, ctx)
+	if mailbox == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+	user := routeAclUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	acl := new(db.MailboxAcl)
+	err = json.Unmarshal(body, acl)
+	if err != nil {
+		log.LogError("unmarshal mailbox acl %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	acl.MailboxId = mailbox.Id
+	acl.UserId = user.Id
+
+	err = ctx.Database.MailboxAclSave(acl)
+	if err != nil {
+		log.LogError("put mailbox acl %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("put mailbox acl suc %v", acl)
+
+	RenderJson(w, reply)
+	return nil
+}
+
+func MailboxAclDel(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	mailbox := routeSharedMailbox(reply, ctx)
+	if mailbox == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+	user := routeAclUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	err := ctx.Database.MailboxAclDel(mailbox.Id, user.Id)
+	if err != nil {
+		log.LogError("del mailbox acl %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del mailbox acl suc %d %d", mailbox.Id, user.Id)
+
+	RenderJson(w, reply)
+	return nil
+}
+
+// routeSharedMailbox returns the shared mailbox named by the id in the route,
+// or nil with the failure set in reply
+func routeSharedMailbox(reply Reply, ctx *Context) *db.SharedMailbox {
+	mailboxId, err := strconv.ParseUint(ctx.Vars["id"], 10, 0)
+	if err != nil {
+		log.LogError("Bad shared mailbox id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		return nil
+	}
+
+	mailbox, err := ctx.Database.SharedMailboxGet(mailboxId)
+	if err != nil {
+		log.LogError("get shared mailbox %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		return nil
+	}
+	if mailbox == nil {
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = fmt.Errorf("no such shared mailbox").Error()
+		return nil
+	}
+	return mailbox
+}
+
+// routeAclUser returns the user named by the userId in the route, or nil
+// with the failure set in reply
+func routeAclUser(reply Reply, ctx *Context) *db.User {
+	userId, err := strconv.ParseUint(ctx.Vars["userId"], 10, 0)
+	if err != nil {
+		log.LogError("Bad user id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		return nil
+	}
+
+	user, err := ctx.Database.UserGet(userId)
+	if err != nil {
+		log.LogError("get user %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		return nil
+	}
+	if user == nil {
+		reply["code"] = REPLY_CODE_NO_SUCH_USER
+		reply["msg"] = fmt.Errorf("no such user").Error()
+		return nil
+	}
+	return user
+}
@@ -0,0 +1,255 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+	"github.com/egggo/inbucket/sieve"
+)
+
+type SieveScriptBody struct {
+	Script string `json:"script"`
+}
+
+type SieveActivation struct {
+	Active bool `json:"active"`
+}
+
+func SieveList(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("get sieve script list %d", user.Id)
+
+	scripts, err := ctx.Database.SieveScriptList(user.Id)
+	if err != nil {
+		log.LogError("get sieve script list %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	reply["scripts"] = scripts
+	RenderJson(w, reply)
+
+	return nil
+}
+
+func SieveGet(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+	name := ctx.Vars["name"]
+
+	log.LogTrace("get sieve script %d %v", user.Id, name)
+
+	script, err := ctx.Database.SieveScriptGet(user.Id, name)
+	if err != nil {
+		log.LogError("get sieve script %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	if script == nil {
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = fmt.Errorf("no such sieve script").Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	reply["script"] = script
+	RenderJson(w, reply)
+
+	return nil
+}
+
+// SievePut stores a script after checking that it compiles, syntax errors
+// are reported along with their line number
+func SievePut(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+	name := ctx.Vars["name"]
+	if !sieve.ValidName(name) {
+		log.LogError("Bad sieve script name %q", name)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = fmt.Errorf("invalid script name %q", name).Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	scriptBody := new(SieveScriptBody)
+	err = json.Unmarshal(body, scriptBody)
+	if err != nil {
+		log.LogError("unmarshal sieve script %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	if _, err = sieve.Compile(scriptBody.Script); err != nil {
+		log.LogTrace("bad sieve script %d %v: %v", user.Id, name, err)
+		reply["code"] = REPLY_CODE_BAD_SCRIPT
+		reply["msg"] = err.Error()
+		if serr, ok := err.(*sieve.Error); ok {
+			reply["line"] = serr.Line
+		}
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("put sieve script %d %v", user.Id, name)
+
+	script := &db.SieveScript{UserId: user.Id, Name: name, Script: scriptBody.Script}
+	err = ctx.Database.SieveScriptSave(script)
+	if err != nil {
+		log.LogError("save sieve script %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("put sieve script suc %d %v", user.Id, name)
+
+	reply["script"] = script
+	RenderJson(w, reply)
+
+	return nil
+}
+
+func SieveDel(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+	name := ctx.Vars["name"]
+
+	log.LogTrace("del sieve script %d %v", user.Id, name)
+
+	err := ctx.Database.SieveScriptDel(user.Id, name)
+	if err != nil {
+		log.LogError("del sieve script %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del sieve script suc %d %v", user.Id, name)
+
+	RenderJson(w, reply)
+
+	return nil
+}
+
+// SieveActivate makes the named script the one run on delivery, or turns
+// filtering off for the user when active is false
+func SieveActivate(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+	name := ctx.Vars["name"]
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	activation := &SieveActivation{Active: true}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, activation)
+		if err != nil {
+			log.LogError("unmarshal sieve activation %v", err)
+			reply["code"] = REPLY_CODE_FAIL
+			reply["msg"] = err.Error()
+			RenderJson(w, reply)
+			return nil
+		}
+	}
+
+	if activation.Active {
+		script, err := ctx.Database.SieveScriptGet(user.Id, name)
+		if err != nil {
+			log.LogError("get sieve script %v", err)
+			reply["code"] = REPLY_CODE_FAIL
+			reply["msg"] = err.Error()
+			RenderJson(w, reply)
+			return nil
+		}
+		if script == nil {
+			reply["code"] = REPLY_CODE_NOT_FOUND
+			reply["msg"] = fmt.Errorf("no such sieve script").Error()
+			RenderJson(w, reply)
+			return nil
+		}
+	} else {
+		name = ""
+	}
+
+	log.LogTrace("activate sieve script %d %q", user.Id, name)
+
+	err = ctx.Database.SieveScriptSetActive(user.Id, name)
+	if err != nil {
+		log.LogError("activate sieve script %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	RenderJson(w, reply)
+
+	return nil
+}
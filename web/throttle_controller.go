@@ -0,0 +1,57 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/egggo/inbucket/log"
+	"github.com/egggo/inbucket/smtpd"
+)
+
+// AuthBanList lists the client addresses and usernames locked out after too
+// many failed POP3 or SMTP logins
+func AuthBanList(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	bans := smtpd.DefaultAuthThrottle().Bans()
+
+	log.LogTrace("get auth bans suc %d", len(bans))
+
+	reply["bans"] = bans
+	RenderJson(w, reply)
+	return nil
+}
+
+// AuthBanDel lifts the ban on a key such as ip:192.0.2.1 or user:bob
+func AuthBanDel(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	key := ctx.Vars["key"]
+	if !smtpd.DefaultAuthThrottle().Clear(key) {
+		reply["code"] = REPLY_CODE_NOT_FOUND
+		reply["msg"] = "no such auth ban"
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del auth ban suc %v", key)
+
+	RenderJson(w, reply)
+	return nil
+}
+
+func AuthBanClear(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	smtpd.DefaultAuthThrottle().ClearAll()
+
+	log.LogTrace("clear auth bans suc")
+
+	RenderJson(w, reply)
+	return nil
+}
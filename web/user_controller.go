@@ -20,6 +20,8 @@ const (
 	REPLY_CODE_NO_SUCH_USER  = "10"
 	REPLY_CODE_BAD_PASSWD    = "11"
 	REPLY_CODE_ALREADY_EXIST = "12"
+	REPLY_CODE_NOT_FOUND     = "13"
+	REPLY_CODE_BAD_SCRIPT    = "14"
 )
 
 const (
@@ -386,3 +388,108 @@ func UserList(w http.ResponseWriter, req *http.Request, ctx *Context) error {
 
 	return nil
 }
+
+// UserApopPut sets the secret the user logs in to POP3 with via APOP, from a
+// body such as {"secret": "..."}
+func UserApopPut(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	apop := struct {
+		Secret string `json:"secret"`
+	}{}
+	err = json.Unmarshal(body, &apop)
+	if err == nil && apop.Secret == "" {
+		err = fmt.Errorf("secret is required")
+	}
+	if err != nil {
+		log.LogError("bad apop secret %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	err = ctx.Database.UserSetApopSecret(user.Id, apop.Secret)
+	if err != nil {
+		log.LogError("put apop secret %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("put apop secret suc %v", user.Id)
+
+	RenderJson(w, reply)
+	return nil
+}
+
+// UserApopDel turns off APOP for the user
+func UserApopDel(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	err := ctx.Database.UserSetApopSecret(user.Id, "")
+	if err != nil {
+		log.LogError("del apop secret %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("del apop secret suc %v", user.Id)
+
+	RenderJson(w, reply)
+	return nil
+}
+
+// routeUser looks up the user named by the id route variable, filling in
+// reply when it could not be found
+func routeUser(reply Reply, ctx *Context) *db.User {
+	userId, err := strconv.ParseUint(ctx.Vars["id"], 10, 0)
+	if err != nil {
+		log.LogError("Bad user id %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		return nil
+	}
+
+	user, err := ctx.Database.UserGet(userId)
+	if err != nil {
+		log.LogError("get user %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		return nil
+	}
+	if user == nil {
+		reply["code"] = REPLY_CODE_NO_SUCH_USER
+		reply["msg"] = fmt.Errorf("no such user").Error()
+		return nil
+	}
+	return user
+}
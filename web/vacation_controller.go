@@ -0,0 +1,119 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/egggo/inbucket/log"
+)
+
+// VacationGet returns the user's out of office settings, an inactive
+// default when they have never set any
+func VacationGet(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("get vacation %d", user.Id)
+
+	vacation, err := ctx.Database.VacationGet(user.Id)
+	if err != nil {
+		log.LogError("get vacation %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	if vacation == nil {
+		vacation = &db.Vacation{UserId: user.Id}
+	}
+
+	reply["vacation"] = vacation
+	RenderJson(w, reply)
+
+	return nil
+}
+
+func VacationPut(w http.ResponseWriter, req *http.Request, ctx *Context) error {
+	reply := make(Reply)
+	reply["code"] = REPLY_CODE_OK
+	reply["msg"] = "OK"
+
+	user := routeUser(reply, ctx)
+	if user == nil {
+		RenderJson(w, reply)
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.LogError("read req %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	vacation := new(db.Vacation)
+	err = json.Unmarshal(body, vacation)
+	if err != nil {
+		log.LogError("unmarshal vacation %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+	vacation.UserId = user.Id
+
+	if err = checkVacation(vacation); err != nil {
+		log.LogError("bad vacation %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("put vacation %d", user.Id)
+
+	err = ctx.Database.VacationSave(vacation)
+	if err != nil {
+		log.LogError("save vacation %v", err)
+		reply["code"] = REPLY_CODE_FAIL
+		reply["msg"] = err.Error()
+		RenderJson(w, reply)
+		return nil
+	}
+
+	log.LogTrace("put vacation suc %d", user.Id)
+
+	reply["vacation"] = vacation
+	RenderJson(w, reply)
+
+	return nil
+}
+
+// checkVacation validates settings supplied by a client
+func checkVacation(v *db.Vacation) error {
+	if v.Active && v.Body == "" {
+		return fmt.Errorf("a reply body is required")
+	}
+	if len(v.Subject) > 255 {
+		return fmt.Errorf("subject is too long")
+	}
+	if v.IntervalDays < 0 {
+		return fmt.Errorf("intervalDays must not be negative")
+	}
+	if !v.StartTime.IsZero() && !v.EndTime.IsZero() && !v.EndTime.After(v.StartTime) {
+		return fmt.Errorf("endTime must be after startTime")
+	}
+	return nil
+}
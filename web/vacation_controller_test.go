@@ -0,0 +1,25 @@
+package web
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/egggo/inbucket/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckVacation(t *testing.T) {
+	start := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, checkVacation(&db.Vacation{}), "inactive settings need no body")
+	assert.Nil(t, checkVacation(&db.Vacation{Active: true, Body: "Away", IntervalDays: 3,
+		StartTime: start, EndTime: start.Add(24 * time.Hour)}))
+
+	assert.NotNil(t, checkVacation(&db.Vacation{Active: true}), "missing body")
+	assert.NotNil(t, checkVacation(&db.Vacation{Body: "Away", Subject: strings.Repeat("x", 256)}),
+		"subject too long")
+	assert.NotNil(t, checkVacation(&db.Vacation{Body: "Away", IntervalDays: -1}),
+		"negative interval")
+	assert.NotNil(t, checkVacation(&db.Vacation{Body: "Away", StartTime: start,
+		EndTime: start}), "empty period")
+}